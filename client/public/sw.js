@@ -85,7 +85,7 @@ self.addEventListener('push', (event) => {
         let imageUrl = null;
         let iconUrl = null;
         if (
-            data.snapshotId &&
+            data.snapshotUrl &&
             data.snapshotKey &&
             data.snapshotKeyIv &&
             data.snapshotIv &&
@@ -139,7 +139,7 @@ self.addEventListener('push', (event) => {
                         ['decrypt']
                     );
 
-                    const res = await fetch(`/api/push/snapshot/${data.snapshotId}`);
+                    const res = await fetch(data.snapshotUrl);
                     if (res.ok) {
                         const encrypted = await res.arrayBuffer();
                         const decrypted = await crypto.subtle.decrypt(
@@ -183,9 +183,20 @@ self.addEventListener('push', (event) => {
             badge: '/serenada.png',
             data: { url: data.url }
         };
+        if (data.tag) {
+            // Notifications for the same call or chat replace each other,
+            // e.g. a missed call replaces the ring.
+            options.tag = data.tag;
+            options.renotify = data.type === 'call_incoming' || data.type === 'message';
+        }
         if (imageUrl) {
             options.image = imageUrl;
         }
+        // Delivered during quiet hours: show without sound or vibration
+        if (data.silent === '1') {
+            options.silent = true;
+            options.renotify = false;
+        }
 
         await self.registration.showNotification(title, options);
     })());
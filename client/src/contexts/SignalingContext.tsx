@@ -12,7 +12,8 @@ interface SignalingContextValue {
     clientId: string | null;
     roomState: RoomState | null;
     turnToken: string | null;
-    joinRoom: (roomId: string, opts?: { snapshotId?: string }) => void;
+    roomToken: string | null;
+    joinRoom: (roomId: string, opts?: JoinOptions) => void;
     leaveRoom: () => void;
     endRoom: () => void;
     sendMessage: (type: string, payload?: any, to?: string) => void;
@@ -24,8 +25,36 @@ interface SignalingContextValue {
     roomStatuses: Record<string, number>;
 }
 
+interface JoinOptions {
+    snapshotId?: string;
+    // Hold the ring until a push_snapshot message follows the join.
+    snapshotPending?: boolean;
+}
+
 const SignalingContext = createContext<SignalingContextValue | null>(null);
 
+const CALLER_TOKEN_TIMEOUT_MS = 1000;
+
+// fetchCallerToken returns a short-lived token identifying the signed-in user
+// as the caller of this room, or null. The session token itself never goes
+// into signaling messages.
+async function fetchCallerToken(roomId: string): Promise<string | null> {
+    const authToken = localStorage.getItem('auth_token');
+    if (!authToken) return null;
+    const request = fetch(`/api/auth/caller-token?roomId=${encodeURIComponent(roomId)}`, {
+        method: 'POST',
+        headers: { Authorization: `Bearer ${authToken}` }
+    })
+        .then(async (res) => {
+            if (!res.ok) return null;
+            const data = await res.json();
+            return typeof data?.callerToken === 'string' ? data.callerToken : null;
+        })
+        .catch(() => null);
+    const timeout = new Promise<null>((resolve) => window.setTimeout(() => resolve(null), CALLER_TOKEN_TIMEOUT_MS));
+    return Promise.race([request, timeout]);
+}
+
 export const useSignaling = () => {
     const context = useContext(SignalingContext);
     if (!context) {
@@ -43,6 +72,7 @@ export const SignalingProvider: React.FC<{ children: React.ReactNode }> = ({ chi
     const [error, setError] = useState<string | null>(null);
     const [roomStatuses, setRoomStatuses] = useState<Record<string, number>>({});
     const [turnToken, setTurnToken] = useState<string | null>(null);
+    const [roomToken, setRoomToken] = useState<{ token: string; expiresAt: number } | null>(null);
     const { showToast } = useToast();
     const { t } = useTranslation();
 
@@ -56,7 +86,7 @@ export const SignalingProvider: React.FC<{ children: React.ReactNode }> = ({ chi
     const transportIdRef = useRef(0);
     const currentRoomIdRef = useRef<string | null>(null);
     const pendingJoinRef = useRef<string | null>(null);
-    const pendingJoinPayloadRef = useRef<{ snapshotId?: string } | null>(null);
+    const pendingJoinPayloadRef = useRef<JoinOptions | null>(null);
     const clientIdRef = useRef<string | null>(null);
     const lastClientIdRef = useRef<string | null>(null);
     const needsRejoinRef = useRef(false);
@@ -111,6 +141,15 @@ export const SignalingProvider: React.FC<{ children: React.ReactNode }> = ({ chi
                     if (msg.payload.turnToken) {
                         setTurnToken(msg.payload.turnToken as string);
                     }
+                    // Room token authorizes the push endpoints for this room
+                    if (msg.payload.roomToken) {
+                        setRoomToken({ token: msg.payload.roomToken, expiresAt: msg.payload.roomTokenExpiresAt });
+                    }
+                }
+                break;
+            case 'room_token':
+                if (msg.payload?.roomToken) {
+                    setRoomToken({ token: msg.payload.roomToken, expiresAt: msg.payload.roomTokenExpiresAt });
                 }
                 break;
             case 'room_state':
@@ -120,6 +159,7 @@ export const SignalingProvider: React.FC<{ children: React.ReactNode }> = ({ chi
                 break;
             case 'room_ended':
                 setRoomState(null);
+                setRoomToken(null);
                 currentRoomIdRef.current = null;
                 needsRejoinRef.current = false;
                 clearReconnectStorage();
@@ -180,7 +220,15 @@ export const SignalingProvider: React.FC<{ children: React.ReactNode }> = ({ chi
         };
     }, [isConnected, sendMessage]);
 
-    const joinRoom = useCallback((roomId: string, opts?: { snapshotId?: string }) => {
+    // Renew the room token a minute before it expires while in the room
+    useEffect(() => {
+        if (!roomToken || !isConnected) return;
+        const delay = Math.max(roomToken.expiresAt * 1000 - Date.now() - 60000, 0);
+        const timer = window.setTimeout(() => sendMessage('room_token'), delay);
+        return () => window.clearTimeout(timer);
+    }, [roomToken, isConnected, sendMessage]);
+
+    const joinRoom = useCallback((roomId: string, opts?: JoinOptions) => {
         console.log(`[Signaling] joinRoom call for ${roomId}`);
         setError(null);
         needsRejoinRef.current = false;
@@ -189,7 +237,11 @@ export const SignalingProvider: React.FC<{ children: React.ReactNode }> = ({ chi
             const payload: any = { capabilities: { trickleIce: true } };
             if (opts?.snapshotId) {
                 payload.snapshotId = opts.snapshotId;
+            } else if (opts?.snapshotPending) {
+                payload.snapshotPending = true;
             }
+            // Identify a signed-in caller so their priority contacts are rung through quiet hours
+            const callerTokenPromise = fetchCallerToken(roomId);
             // If we have a previous client ID, send it to help server evict ghosts
             const reconnectCid = clientIdRef.current || lastClientIdRef.current;
             if (reconnectCid) {
@@ -198,11 +250,17 @@ export const SignalingProvider: React.FC<{ children: React.ReactNode }> = ({ chi
             let sent = false;
             const sendJoin = (endpoint?: string) => {
                 if (sent) return;
+                sent = true;
                 if (endpoint) {
                     payload.pushEndpoint = endpoint;
                 }
-                sendMessage('join', payload);
-                sent = true;
+                callerTokenPromise.then((callerToken) => {
+                    if (currentRoomIdRef.current !== roomId) return;
+                    if (callerToken) {
+                        payload.callerToken = callerToken;
+                    }
+                    sendMessage('join', payload);
+                });
             };
 
             const hasPushSupport =
@@ -375,6 +433,7 @@ export const SignalingProvider: React.FC<{ children: React.ReactNode }> = ({ chi
         needsRejoinRef.current = false;
         clearReconnectStorage();
         setRoomState(null);
+        setRoomToken(null);
     }, [clearReconnectStorage, sendMessage]);
 
     const endRoom = useCallback(() => {
@@ -400,6 +459,7 @@ export const SignalingProvider: React.FC<{ children: React.ReactNode }> = ({ chi
             clientId,
             roomState,
             turnToken,
+            roomToken: roomToken?.token ?? null,
             joinRoom,
             leaveRoom,
             endRoom,
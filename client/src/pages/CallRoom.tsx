@@ -32,18 +32,31 @@ function base64FromBytes(bytes: Uint8Array): string {
     return window.btoa(binary);
 }
 
-async function fetchRecipients(roomId: string): Promise<{ id: number; publicKey: JsonWebKey }[]> {
-    const res = await fetch(`/api/push/recipients?roomId=${encodeURIComponent(roomId)}`);
+// Subscriptions made while signed in are linked to the account, so its
+// quiet hours apply to them.
+function pushHeaders(roomToken: string): Record<string, string> {
+    const headers: Record<string, string> = { 'Content-Type': 'application/json', 'X-Room-Token': roomToken };
+    const authToken = localStorage.getItem('auth_token');
+    if (authToken) {
+        headers['Authorization'] = `Bearer ${authToken}`;
+    }
+    return headers;
+}
+
+async function fetchRecipients(roomId: string, roomToken: string): Promise<{ id: number; publicKey: JsonWebKey }[]> {
+    const res = await fetch(`/api/push/recipients?roomId=${encodeURIComponent(roomId)}`, {
+        headers: { 'X-Room-Token': roomToken }
+    });
     if (!res.ok) return [];
     const data = await res.json();
     if (!Array.isArray(data)) return [];
     return data.filter((item: any) => typeof item?.id === 'number' && item?.publicKey);
 }
 
-async function buildEncryptedSnapshot(stream: MediaStream, roomId: string): Promise<string | null> {
+async function buildEncryptedSnapshot(stream: MediaStream, roomId: string, roomToken: string): Promise<string | null> {
     if (!('crypto' in window) || !window.crypto.subtle) return null;
 
-    const recipients = await fetchRecipients(roomId);
+    const recipients = await fetchRecipients(roomId, roomToken);
     if (recipients.length === 0) return null;
 
     const snapshot = await captureSnapshotBytes(stream);
@@ -118,9 +131,9 @@ async function buildEncryptedSnapshot(stream: MediaStream, roomId: string): Prom
 
     if (recipientsPayload.length === 0) return null;
 
-    const res = await fetch('/api/push/snapshot', {
+    const res = await fetch(`/api/push/snapshot?roomId=${encodeURIComponent(roomId)}`, {
         method: 'POST',
-        headers: { 'Content-Type': 'application/json' },
+        headers: { 'Content-Type': 'application/json', 'X-Room-Token': roomToken },
         body: JSON.stringify({
             ciphertext: base64FromBytes(new Uint8Array(ciphertext)),
             snapshotIv: base64FromBytes(snapshotIv),
@@ -194,7 +207,8 @@ const CallRoom: React.FC = () => {
     const {
         joinRoom,
         leaveRoom,
-
+        sendMessage,
+        roomToken,
         roomState,
         clientId,
         isConnected,
@@ -244,24 +258,36 @@ const CallRoom: React.FC = () => {
                 reg.pushManager.getSubscription().then(sub => {
                     if (sub) {
                         setIsSubscribed(true);
-                        getOrCreatePushKeyPair()
-                            .then(({ publicJwk }) => fetch('/api/push/subscribe?roomId=' + roomId, {
-                                method: 'POST',
-                                headers: { 'Content-Type': 'application/json' },
-                                body: JSON.stringify({ ...sub.toJSON(), locale: navigator.language, encPublicKey: publicJwk })
-                            }))
-                            .catch(() => { });
                     }
                 });
             });
         }
     }, []);
 
+    // Refresh an existing subscription for this room once we hold a room token
+    const resubscribedRef = useRef(false);
+    useEffect(() => {
+        if (!roomToken || !isSubscribed || resubscribedRef.current) return;
+        resubscribedRef.current = true;
+        navigator.serviceWorker.ready
+            .then(reg => reg.pushManager.getSubscription())
+            .then(async sub => {
+                if (!sub) return;
+                const { publicJwk } = await getOrCreatePushKeyPair();
+                await fetch('/api/push/subscribe?roomId=' + roomId, {
+                    method: 'POST',
+                    headers: pushHeaders(roomToken),
+                    body: JSON.stringify({ ...sub.toJSON(), locale: navigator.language, encPublicKey: publicJwk })
+                });
+            })
+            .catch(() => { });
+    }, [roomToken, isSubscribed, roomId]);
+
     const handlePushToggle = async (e: React.MouseEvent | React.PointerEvent) => {
         e.stopPropagation();
         handleControlsInteraction(); // Keep controls visible
 
-        if (!vapidKey) return;
+        if (!vapidKey || !roomToken) return;
         try {
             const reg = await navigator.serviceWorker.ready;
             if (isSubscribed) {
@@ -270,7 +296,7 @@ const CallRoom: React.FC = () => {
                     await sub.unsubscribe();
                     await fetch('/api/push/subscribe?roomId=' + roomId, {
                         method: 'DELETE',
-                        headers: { 'Content-Type': 'application/json' },
+                        headers: pushHeaders(roomToken),
                         body: JSON.stringify({ endpoint: sub.endpoint })
                     });
                     setIsSubscribed(false);
@@ -289,9 +315,10 @@ const CallRoom: React.FC = () => {
                 });
                 await fetch('/api/push/subscribe?roomId=' + roomId, {
                     method: 'POST',
-                    headers: { 'Content-Type': 'application/json' },
+                    headers: pushHeaders(roomToken),
                     body: JSON.stringify({ ...sub.toJSON(), locale: navigator.language, encPublicKey: publicJwk })
                 });
+                resubscribedRef.current = true;
                 setIsSubscribed(true);
                 showToast('success', 'You will be notified!');
             }
@@ -473,6 +500,24 @@ const CallRoom: React.FC = () => {
     // eslint-disable-line react-hooks/exhaustive-deps
 
     const callStartTimeRef = useRef<number | null>(null);
+    const snapshotStreamRef = useRef<MediaStream | null>(null);
+
+    // Upload the encrypted snapshot once joined and release the held ring
+    useEffect(() => {
+        const stream = snapshotStreamRef.current;
+        if (!roomToken || !stream || !roomId) return;
+        snapshotStreamRef.current = null;
+        const snapshotPromise = buildEncryptedSnapshot(stream, roomId, roomToken).catch((err) => {
+            console.warn('[Push] Failed to build encrypted snapshot', err);
+            return null;
+        });
+        Promise.race([
+            snapshotPromise,
+            new Promise<null>((resolve) => setTimeout(() => resolve(null), 2000))
+        ]).then((snapshotId) => {
+            sendMessage('push_snapshot', snapshotId ? { snapshotId } : {});
+        });
+    }, [roomToken, roomId, sendMessage]);
 
     const handleJoin = async () => {
         if (!roomId) return;
@@ -492,20 +537,12 @@ const CallRoom: React.FC = () => {
                 }
             }
             const stream = await startLocalMedia();
-            let snapshotId: string | null = null;
-            if (stream) {
-                const snapshotPromise = buildEncryptedSnapshot(stream, roomId).catch((err) => {
-                    console.warn('[Push] Failed to build encrypted snapshot', err);
-                    return null;
-                });
-                snapshotId = await Promise.race([
-                    snapshotPromise,
-                    new Promise<null>((resolve) => setTimeout(() => resolve(null), 1200))
-                ]);
-            }
+            // The snapshot needs the room token from `joined`, so the server
+            // holds the ring until we send it (or give up).
+            snapshotStreamRef.current = stream ?? null;
             // Tiny delay to ensure state propagates
             setTimeout(() => {
-                joinRoom(roomId, snapshotId ? { snapshotId } : undefined);
+                joinRoom(roomId, stream ? { snapshotPending: true } : undefined);
                 setHasJoined(true);
                 callStartTimeRef.current = Date.now();
             }, 50);
@@ -21,8 +21,8 @@ export const Register: React.FC = () => {
       return;
     }
 
-    if (password.length < 6) {
-      setError('Password must be at least 6 characters');
+    if (password.length < 10) {
+      setError('Password must be at least 10 characters');
       return;
     }
 
@@ -89,7 +89,7 @@ export const Register: React.FC = () => {
                 placeholder="Create a password"
                 required
                 disabled={isLoading}
-                minLength={6}
+                minLength={10}
               />
             </div>
 
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Deleted accounts are replaced by a placeholder in chat history.
+const deletedUserUsername = "Deleted user"
+
+// deletedUserID is the tombstone ID that replaces userID in chat history. It
+// is distinct per user, so a chat whose members have all deleted their
+// accounts still has one participant entry per member.
+func deletedUserID(userID string) string {
+	sum := sha256.Sum256([]byte(userID))
+	return "U-deleted-" + hex.EncodeToString(sum[:6])
+}
+
+// deleteUser removes the account and every reference other users hold to
+// it, and revokes all of its sessions. It returns the removed user.
+func (s *AuthStore) deleteUser(userID string) (*User, error) {
+	s.mu.Lock()
+	user, ok := s.usersByID[userID]
+	if !ok {
+		s.mu.Unlock()
+		return nil, errors.New("user not found")
+	}
+	delete(s.usersByID, userID)
+	delete(s.users, user.Username)
+	s.searchIndex.remove(user)
+	s.revokeTokensLocked(userID, "")
+	for key, challenge := range s.challenges {
+		if challenge.userID == userID {
+			delete(s.challenges, key)
+		}
+	}
+	for _, other := range s.usersByID {
+		delete(other.Contacts, userID)
+		delete(other.Blocked, userID)
+		delete(other.PriorityContacts, userID)
+	}
+	avatar := user.AvatarFile
+	s.mu.Unlock()
+
+	if avatar != "" {
+		os.Remove(filepath.Join(avatarDir(s.cfg), avatar))
+	}
+	return user, nil
+}
+
+// anonymizeUser replaces the user's identity in every chat they took part
+// in. Message content is kept so that the other participants' history stays
+// intact.
+func (s *MessagingStore) anonymizeUser(userID string) {
+	s.mu.Lock()
+	chatIDs := s.userChats[userID]
+	delete(s.userChats, userID)
+	conn := s.wsClients[userID]
+	delete(s.wsClients, userID)
+	chats := make([]*ChatRoom, 0, len(chatIDs))
+	for _, id := range chatIDs {
+		if chat := s.chats[id]; chat != nil {
+			chats = append(chats, chat)
+		}
+	}
+	s.mu.Unlock()
+
+	if conn != nil {
+		conn.conn.Close()
+	}
+
+	tombstone := deletedUserID(userID)
+	for _, chat := range chats {
+		chat.mu.Lock()
+		participants := make([]string, len(chat.Participants))
+		for i, id := range chat.Participants {
+			if id == userID {
+				id = tombstone
+			}
+			participants[i] = id
+		}
+		chat.Participants = participants
+		usernames := make(map[string]string, len(chat.ParticipantUsernames))
+		for id, name := range chat.ParticipantUsernames {
+			if id == userID {
+				id, name = tombstone, deletedUserUsername
+			}
+			usernames[id] = name
+		}
+		chat.ParticipantUsernames = usernames
+		delete(chat.UnreadCount, userID)
+		delete(chat.MutedUntil, userID)
+		// Messages are shared with getMessages callers, so replace rather
+		// than mutate them.
+		for i, msg := range chat.Messages {
+			if msg.SenderID != userID {
+				continue
+			}
+			anon := *msg
+			anon.SenderID = tombstone
+			anon.SenderUsername = deletedUserUsername
+			chat.Messages[i] = &anon
+			if chat.LastMessage == msg {
+				chat.LastMessage = &anon
+			}
+		}
+		chat.mu.Unlock()
+	}
+}
+
+type exportChat struct {
+	ID           string            `json:"id"`
+	Participants map[string]string `json:"participants"` // userID -> username
+	Messages     []*Message        `json:"messages"`
+}
+
+type accountExport struct {
+	ExportedAt int64           `json:"exportedAt"`
+	Profile    Profile         `json:"profile"`
+	CreatedAt  time.Time       `json:"createdAt"`
+	Privacy    PrivacySettings `json:"privacy"`
+	Contacts   []Profile       `json:"contacts"`
+	Blocked    []string        `json:"blocked"`
+	TwoFactor  bool            `json:"twoFactorEnabled"`
+	Passkeys   []string        `json:"passkeys"`
+	Chats      []exportChat    `json:"chats"`
+}
+
+func buildAccountExport(authStore *AuthStore, msgStore *MessagingStore, user *User) accountExport {
+	authStore.mu.RLock()
+	export := accountExport{
+		ExportedAt: time.Now().UnixMilli(),
+		Profile:    authStore.profileLocked(user),
+		CreatedAt:  user.CreatedAt,
+		Privacy:    user.Privacy,
+		Blocked:    make([]string, 0, len(user.Blocked)),
+		TwoFactor:  user.TOTPSecret != "",
+		Passkeys:   make([]string, 0, len(user.Passkeys)),
+		Chats:      []exportChat{},
+	}
+	contactIDs := make([]string, 0, len(user.Contacts))
+	for id := range user.Contacts {
+		contactIDs = append(contactIDs, id)
+	}
+	for id := range user.Blocked {
+		export.Blocked = append(export.Blocked, id)
+	}
+	for _, passkey := range user.Passkeys {
+		export.Passkeys = append(export.Passkeys, passkey.Name)
+	}
+	authStore.mu.RUnlock()
+	export.Contacts = authStore.contactProfiles(contactIDs)
+
+	for _, chat := range msgStore.getUserChats(user.UserID) {
+		export.Chats = append(export.Chats, exportChat{
+			ID:           chat.ID,
+			Participants: chat.ParticipantUsernames,
+			Messages:     msgStore.getMessages(chat.ID),
+		})
+	}
+	return export
+}
+
+// handleAccountExport returns the caller's data as JSON, or as a zip archive
+// including the avatar with ?format=zip.
+func handleAccountExport(authStore *AuthStore, msgStore *MessagingStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, err := authStore.getUserByToken(extractToken(r))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		export := buildAccountExport(authStore, msgStore, user)
+		// The user ID keeps the name free of quotes and other header syntax.
+		filename := "serenada-export-" + user.UserID
+
+		if r.URL.Query().Get("format") != "zip" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename + ".json"}))
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			enc.Encode(export)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename + ".zip"}))
+		zw := zip.NewWriter(w)
+		defer zw.Close()
+
+		writeJSON := func(name string, v interface{}) error {
+			f, err := zw.Create(name)
+			if err != nil {
+				return err
+			}
+			enc := json.NewEncoder(f)
+			enc.SetIndent("", "  ")
+			return enc.Encode(v)
+		}
+		chats := export.Chats
+		export.Chats = nil
+		if err := writeJSON("account.json", export); err != nil {
+			slog.Warn("account export failed", "user_id", user.UserID, "err", err)
+			return
+		}
+		for _, chat := range chats {
+			if err := writeJSON("chats/"+chat.ID+".json", chat); err != nil {
+				slog.Warn("account export failed", "user_id", user.UserID, "err", err)
+				return
+			}
+		}
+
+		authStore.mu.RLock()
+		avatar := user.AvatarFile
+		authStore.mu.RUnlock()
+		if avatar != "" {
+			if src, err := os.Open(filepath.Join(avatarDir(authStore.cfg), avatar)); err == nil {
+				if dst, err := zw.Create("avatar" + filepath.Ext(avatar)); err == nil {
+					io.Copy(dst, src)
+				}
+				src.Close()
+			}
+		}
+	}
+}
+
+// handleDeleteAccount permanently deletes the caller's account. It requires
+// the password, and a second factor when 2FA is enabled. Push subscriptions
+// registered while signed in are purged, as are any extra endpoints the
+// client lists for this device.
+func handleDeleteAccount(cfg *Config, authStore *AuthStore, msgStore *MessagingStore, push *PushService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, err := authStore.getUserByToken(extractToken(r))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			Password string `json:"password"`
+			Code     string `json:"code"`
+			// The caller's devices, so that subscriptions made while signed
+			// out are removed too.
+			PushSubscriptions []endpointProof `json:"pushSubscriptions"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		ip := getClientIP(cfg, r)
+		if wait := authStore.guard.check(user.Username, ip); wait > 0 {
+			writeTooManyAttempts(w, r, wait)
+			return
+		}
+		authStore.mu.RLock()
+		hash := user.PasswordHash
+		authStore.mu.RUnlock()
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) != nil {
+			authStore.guard.recordFailure(user.Username, ip)
+			writeJSONMessage(w, http.StatusForbidden, localizeError(requestLocale(r), errWrongPassword))
+			return
+		}
+		if authStore.hasTOTP(user) {
+			if err := authStore.verifySecondFactor(user, req.Code); err != nil {
+				authStore.guard.recordFailure(user.Username, ip)
+				writeJSONMessage(w, http.StatusForbidden, localizeError(requestLocale(r), err))
+				return
+			}
+		}
+
+		if _, err := authStore.deleteUser(user.UserID); err != nil {
+			http.Error(w, "Account not found", http.StatusNotFound)
+			return
+		}
+		msgStore.anonymizeUser(user.UserID)
+		removed, err := push.DeleteUserSubscriptions(user.UserID, req.PushSubscriptions)
+		if err != nil {
+			slog.Error("failed to purge push subscriptions", "user_id", user.UserID, "err", err)
+		}
+
+		audit("account_deleted", "user_id", user.UserID, "ip", redactIP(ip), "push_subscriptions", removed)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestAnonymizeBothParticipants(t *testing.T) {
+	msgStore := newMessagingStore(nil)
+	chat := msgStore.getOrCreateChat("U-alice", "U-bob", "alice", "bob")
+	if _, err := msgStore.addMessage(chat.ID, "U-alice", "alice", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := msgStore.addMessage(chat.ID, "U-bob", "bob", "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	msgStore.anonymizeUser("U-alice")
+	msgStore.anonymizeUser("U-bob")
+
+	participants := msgStore.chatParticipants(chat.ID)
+	if len(participants) != 2 || participants[0] == participants[1] {
+		t.Fatalf("participants = %v, want two distinct tombstones", participants)
+	}
+	if len(chat.ParticipantUsernames) != 2 {
+		t.Fatalf("participant usernames = %v, want two entries", chat.ParticipantUsernames)
+	}
+	messages := msgStore.getMessages(chat.ID)
+	if messages[0].SenderID != participants[0] || messages[1].SenderID != participants[1] {
+		t.Errorf("message senders = %s, %s, want %v", messages[0].SenderID, messages[1].SenderID, participants)
+	}
+	if deletedUserID("U-alice") != participants[0] {
+		t.Error("tombstone ID is not stable")
+	}
+}
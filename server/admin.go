@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type adminParticipant struct {
+	SID         string `json:"sid"`
+	CID         string `json:"cid"`
+	Transport   string `json:"transport"`
+	IP          string `json:"ip"`
+	ConnectedAt int64  `json:"connectedAt"`
+	JoinedAt    int64  `json:"joinedAt,omitempty"`
+}
+
+type adminRoom struct {
+	ID           string             `json:"id"`
+	HostCID      string             `json:"hostCid"`
+	CreatedAt    int64              `json:"createdAt"`
+	AgeSeconds   int64              `json:"ageSeconds"`
+	Watchers     int                `json:"watchers"`
+	Participants []adminParticipant `json:"participants"`
+}
+
+// adminRooms returns a snapshot of all active rooms. Rooms are identified by
+// roomHash so that the admin API never exposes room IDs.
+func (h *Hub) adminRooms() []adminRoom {
+	now := time.Now()
+	h.mu.RLock()
+	rooms := make([]adminRoom, 0, len(h.rooms))
+	for rid, room := range h.rooms {
+		room.mu.Lock()
+		info := adminRoom{
+			ID:           roomHash(rid),
+			HostCID:      room.HostCID,
+			CreatedAt:    room.CreatedAt.UnixMilli(),
+			AgeSeconds:   int64(now.Sub(room.CreatedAt).Seconds()),
+			Watchers:     len(h.watchers[rid]),
+			Participants: make([]adminParticipant, 0, len(room.Participants)),
+		}
+		for client, cid := range room.Participants {
+			p := adminParticipant{
+				SID:         client.sid,
+				CID:         cid,
+				Transport:   string(client.transport),
+				IP:          client.ip,
+				ConnectedAt: client.connectedAt.UnixMilli(),
+			}
+			if !client.joinedAt.IsZero() {
+				p.JoinedAt = client.joinedAt.UnixMilli()
+			}
+			info.Participants = append(info.Participants, p)
+		}
+		room.mu.Unlock()
+		rooms = append(rooms, info)
+	}
+	h.mu.RUnlock()
+
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].CreatedAt < rooms[j].CreatedAt })
+	return rooms
+}
+
+func (h *Hub) roomByHash(id string) *Room {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for rid, room := range h.rooms {
+		if roomHash(rid) == id {
+			return room
+		}
+	}
+	return nil
+}
+
+// disconnectSession closes the client's transport and removes it from the hub.
+func (h *Hub) disconnectSession(sid string) bool {
+	client := h.getClientBySID(sid)
+	if client == nil {
+		return false
+	}
+	client.close()
+	h.disconnectClient(client)
+	return true
+}
+
+func (h *Hub) watcherStats() map[string]interface{} {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	byRoom := make(map[string]int, len(h.watchers))
+	clients := make(map[*Client]bool)
+	for rid, set := range h.watchers {
+		byRoom[roomHash(rid)] = len(set)
+		for client := range set {
+			clients[client] = true
+		}
+	}
+	return map[string]interface{}{
+		"watchedRooms": len(h.watchers),
+		"clients":      len(clients),
+		"byRoom":       byRoom,
+	}
+}
+
+// requireAdmin guards admin endpoints with the ADMIN_TOKEN bearer credential.
+// The admin API is not exposed at all when no token is configured.
+func requireAdmin(cfg *Config, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.AdminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token := extractToken(r)
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+			slog.Warn("admin auth failed", "ip", redactIP(getClientIP(cfg, r)), "path", r.URL.Path)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func handleAdmin(hub *Hub, authStore *AuthStore) http.HandlerFunc {
+	return requireAdmin(hub.cfg, func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin"), "/"), "/")
+		ip := redactIP(getClientIP(hub.cfg, r))
+
+		switch {
+		case len(parts) == 1 && parts[0] == "rooms":
+			if r.Method != http.MethodGet {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"rooms": hub.adminRooms()})
+
+		case len(parts) == 3 && parts[0] == "rooms" && parts[2] == "end":
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			room := hub.roomByHash(parts[1])
+			if room == nil {
+				http.Error(w, "Room not found", http.StatusNotFound)
+				return
+			}
+			notified := hub.endRoom(room, "admin", "admin_ended")
+			slog.Info("admin ended room", "room", parts[1], "notified", notified, "admin_ip", ip)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]int{"notified": notified})
+
+		case len(parts) == 2 && parts[0] == "sessions":
+			if r.Method != http.MethodDelete {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if !hub.disconnectSession(parts[1]) {
+				http.Error(w, "Session not found", http.StatusNotFound)
+				return
+			}
+			slog.Info("admin disconnected session", "sid", parts[1], "admin_ip", ip)
+			w.WriteHeader(http.StatusNoContent)
+
+		case len(parts) == 1 && parts[0] == "watchers":
+			if r.Method != http.MethodGet {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(hub.watcherStats())
+
+		case len(parts) == 2 && parts[0] == "push" && parts[1] == "deliveries":
+			// Recent delivery outcomes, optionally for one ?endpoint=.
+			if r.Method != http.MethodGet {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			limit := 100
+			if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 && n <= 1000 {
+				limit = n
+			}
+			records, err := hub.push.queue.deliveries(r.URL.Query().Get("endpoint"), limit)
+			if err != nil {
+				http.Error(w, "Failed to load deliveries", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"queue":      hub.push.queue.stats(),
+				"deliveries": records,
+			})
+
+		case len(parts) == 3 && parts[0] == "users" && parts[2] == "password-reset":
+			// Issues a reset token for the operator to hand over out of band.
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			user := authStore.getUserByUsername(parts[1])
+			if user == nil {
+				http.Error(w, "User not found", http.StatusNotFound)
+				return
+			}
+			token, expiresAt, err := authStore.issueResetToken(user)
+			if err != nil {
+				http.Error(w, "Failed to create token", http.StatusInternalServerError)
+				return
+			}
+			audit("password_reset_issued", "user_id", user.UserID, "by", "admin", "admin_ip", ip)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"token":     token,
+				"expiresAt": expiresAt.UnixMilli(),
+			})
+
+		default:
+			http.Error(w, "Not found", http.StatusNotFound)
+		}
+	})
+}
@@ -5,8 +5,12 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -17,24 +21,105 @@ type User struct {
 	Username     string    `json:"username"`
 	PasswordHash string    `json:"-"`
 	CreatedAt    time.Time `json:"createdAt"`
+
+	// Profile (see profile.go). Guarded by AuthStore.mu.
+	DisplayName     string `json:"displayName,omitempty"`
+	Bio             string `json:"bio,omitempty"`
+	Status          string `json:"status,omitempty"`
+	AvatarFile      string `json:"-"`
+	AvatarUpdatedAt int64  `json:"-"`
+
+	// Contacts, blocks and privacy (see contacts.go). Guarded by AuthStore.mu.
+	Contacts map[string]time.Time `json:"-"` // userID -> added at
+	Blocked  map[string]bool      `json:"-"` // userID -> blocked
+	// PriorityContacts ring through quiet hours that allow it.
+	PriorityContacts map[string]bool `json:"-"`
+	Privacy          PrivacySettings `json:"-"`
+
+	// Two-factor authentication (see totp.go). Guarded by AuthStore.mu.
+	TOTPSecret         string   `json:"-"`
+	RecoveryCodeHashes []string `json:"-"`
+	pendingTOTPSecret  string
+	totpLastStep       int64
+
+	// Passkeys (see passkey.go). WebAuthnHandle is the random user handle
+	// given to authenticators. Guarded by AuthStore.mu.
+	WebAuthnHandle []byte    `json:"-"`
+	Passkeys       []Passkey `json:"-"`
 }
 
 type AuthStore struct {
-	users        map[string]*User // username -> User
-	usersByID    map[string]*User // userID -> User
-	tokens       map[string]string // token -> userID
-	mu           sync.RWMutex
+	cfg               *Config
+	resetSecret       []byte
+	users             map[string]*User            // username -> User
+	usersByID         map[string]*User            // userID -> User
+	tokens            map[string]string           // token -> userID
+	challenges        map[string]*loginChallenge  // 2FA login challenge -> pending login
+	passkeyCeremonies map[string]*passkeyCeremony // WebAuthn session ID -> challenge
+	searchIndex       *userIndex
+	guard             *loginGuard
+	// resetGuard throttles password reset requests per username and IP. It
+	// is kept apart from guard so that requesting resets for an account
+	// cannot lock it out of logging in.
+	resetGuard *loginGuard
+	dummyHash  atomic.Pointer[dummyPasswordHash]
+	mu         sync.RWMutex
+}
+
+func newAuthStore(cfg *Config) *AuthStore {
+	s := &AuthStore{
+		cfg:               cfg,
+		resetSecret:       newResetSecret(cfg),
+		users:             make(map[string]*User),
+		usersByID:         make(map[string]*User),
+		tokens:            make(map[string]string),
+		challenges:        make(map[string]*loginChallenge),
+		passkeyCeremonies: make(map[string]*passkeyCeremony),
+		searchIndex:       newUserIndex(),
+		guard:             newLoginGuard(),
+		resetGuard:        newLoginGuard(),
+	}
+	s.refreshDummyHash()
+	cfg.onReload(s.refreshDummyHash)
+	return s
+}
+
+// dummyPasswordHash is compared against for unknown usernames.
+type dummyPasswordHash struct {
+	cost int
+	hash []byte
+}
+
+// refreshDummyHash hashes the dummy password at the configured cost, unless
+// the current dummy hash already has it. It runs at startup and after each
+// reload, so that logins never wait for it.
+func (s *AuthStore) refreshDummyHash() {
+	cost := s.cfg.passwordCost()
+	if d := s.dummyHash.Load(); d != nil && d.cost == cost {
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("serenada-dummy-password"), cost)
+	if err != nil {
+		slog.Error("failed to hash dummy password", "err", err)
+		return
+	}
+	s.dummyHash.Store(&dummyPasswordHash{cost: cost, hash: hash})
 }
 
-func newAuthStore() *AuthStore {
-	return &AuthStore{
-		users:     make(map[string]*User),
-		usersByID: make(map[string]*User),
-		tokens:    make(map[string]string),
+// compareDummyPassword spends as long as a real bcrypt comparison, so that
+// unknown usernames cannot be told apart from wrong passwords by timing.
+func (s *AuthStore) compareDummyPassword(password string) {
+	if d := s.dummyHash.Load(); d != nil {
+		_ = bcrypt.CompareHashAndPassword(d.hash, []byte(password))
 	}
 }
 
 func (s *AuthStore) createUser(username, password string) (*User, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), s.cfg.passwordCost())
+	if err != nil {
+		return nil, err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -42,20 +127,17 @@ func (s *AuthStore) createUser(username, password string) (*User, error) {
 		return nil, errors.New("username already exists")
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return nil, err
-	}
-
 	user := &User{
 		UserID:       generateID("U-"),
 		Username:     username,
 		PasswordHash: string(hash),
 		CreatedAt:    time.Now(),
+		Privacy:      defaultPrivacySettings(),
 	}
 
 	s.users[username] = user
 	s.usersByID[user.UserID] = user
+	s.searchIndex.add(user)
 
 	return user, nil
 }
@@ -66,16 +148,38 @@ func (s *AuthStore) verifyUser(username, password string) (*User, error) {
 	s.mu.RUnlock()
 
 	if !exists {
+		s.compareDummyPassword(password)
 		return nil, errors.New("invalid credentials")
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+	s.mu.RLock()
+	current := user.PasswordHash
+	s.mu.RUnlock()
+
+	if err := bcrypt.CompareHashAndPassword([]byte(current), []byte(password)); err != nil {
 		return nil, errors.New("invalid credentials")
 	}
 
+	// Rehash with the configured cost if the stored hash is weaker.
+	if cost, err := bcrypt.Cost([]byte(current)); err == nil && cost < s.cfg.passwordCost() {
+		if hash, err := bcrypt.GenerateFromPassword([]byte(password), s.cfg.passwordCost()); err == nil {
+			s.mu.Lock()
+			if user.PasswordHash == current {
+				user.PasswordHash = string(hash)
+			}
+			s.mu.Unlock()
+		}
+	}
+
 	return user, nil
 }
 
+func (s *AuthStore) getUserByUsername(username string) *User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.users[username]
+}
+
 func (s *AuthStore) createToken(userID string) (string, error) {
 	tokenBytes := make([]byte, 32)
 	if _, err := rand.Read(tokenBytes); err != nil {
@@ -111,21 +215,33 @@ func (s *AuthStore) getUserByToken(token string) (*User, error) {
 	return user, nil
 }
 
-func (s *AuthStore) searchUsers(query string) []*User {
+// searchUsers returns up to limit users visible to requester whose username
+// or display name starts with query, skipping the first offset matches.
+// hasMore reports whether further matches exist.
+func (s *AuthStore) searchUsers(requester *User, query string, limit, offset int) (results []*User, hasMore bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	var results []*User
-	for _, user := range s.users {
-		if len(user.Username) >= len(query) && user.Username[:len(query)] == query {
-			results = append(results, user)
+	skipped := 0
+	s.searchIndex.search(query, func(user *User) bool {
+		if !s.visibleInSearchLocked(requester, user) {
+			return true
 		}
-	}
-
-	return results
+		if skipped < offset {
+			skipped++
+			return true
+		}
+		if len(results) == limit {
+			hasMore = true
+			return false
+		}
+		results = append(results, user)
+		return true
+	})
+	return results, hasMore
 }
 
-func handleRegister(authStore *AuthStore) http.HandlerFunc {
+func handleRegister(cfg *Config, authStore *AuthStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -142,8 +258,14 @@ func handleRegister(authStore *AuthStore) http.HandlerFunc {
 			return
 		}
 
-		if len(req.Username) < 3 || len(req.Password) < 6 {
-			http.Error(w, "Username must be at least 3 characters and password at least 6 characters", http.StatusBadRequest)
+		if len(req.Username) < 3 {
+			http.Error(w, "Username must be at least 3 characters", http.StatusBadRequest)
+			return
+		}
+		if err := validatePassword(cfg, req.Username, req.Password); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": localizeError(requestLocale(r), err)})
 			return
 		}
 
@@ -170,7 +292,7 @@ func handleRegister(authStore *AuthStore) http.HandlerFunc {
 	}
 }
 
-func handleLogin(authStore *AuthStore) http.HandlerFunc {
+func handleLogin(cfg *Config, authStore *AuthStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -187,27 +309,62 @@ func handleLogin(authStore *AuthStore) http.HandlerFunc {
 			return
 		}
 
+		ip := getClientIP(cfg, r)
+		if wait := authStore.guard.check(req.Username, ip); wait > 0 {
+			writeTooManyAttempts(w, r, wait)
+			return
+		}
+
 		user, err := authStore.verifyUser(req.Username, req.Password)
 		if err != nil {
+			accountLocked, ipLocked := authStore.guard.recordFailure(req.Username, ip)
+			if accountLocked {
+				audit("login_account_locked", "username", req.Username, "ip", redactIP(ip), "duration", loginLockoutDuration)
+			}
+			if ipLocked {
+				audit("login_ip_locked", "ip", redactIP(ip), "duration", loginLockoutDuration)
+			}
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusUnauthorized)
 			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
 			return
 		}
 
-		token, err := authStore.createToken(user.UserID)
-		if err != nil {
-			http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		if authStore.hasTOTP(user) {
+			// The password was right; failures from here on are counted by
+			// the second step.
+			challenge, err := authStore.createLoginChallenge(user.UserID)
+			if err != nil {
+				http.Error(w, "Failed to create challenge", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"twoFactorRequired": true,
+				"challenge":         challenge,
+			})
 			return
 		}
+		authStore.guard.recordSuccess(req.Username)
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{
-			"token":    token,
-			"username": user.Username,
-			"userId":   user.UserID,
-		})
+		writeLoginSession(w, authStore, user)
+	}
+}
+
+// writeLoginSession creates a session token and writes the login response.
+func writeLoginSession(w http.ResponseWriter, authStore *AuthStore, user *User) {
+	token, err := authStore.createToken(user.UserID)
+	if err != nil {
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"token":    token,
+		"username": user.Username,
+		"userId":   user.UserID,
+	})
 }
 
 func handleSearchUsers(authStore *AuthStore) http.HandlerFunc {
@@ -223,34 +380,54 @@ func handleSearchUsers(authStore *AuthStore) http.HandlerFunc {
 			return
 		}
 
-		_, err := authStore.getUserByToken(token)
+		requester, err := authStore.getUserByToken(token)
 		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		query := r.URL.Query().Get("q")
-		if query == "" {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{"users": []interface{}{}})
-			return
+		q := r.URL.Query()
+		limit := searchDefaultLimit
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = min(n, searchMaxLimit)
+		}
+		offset := 0
+		if v := q.Get("offset"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "Invalid offset", http.StatusBadRequest)
+				return
+			}
+			offset = n
 		}
 
-		users := authStore.searchUsers(query)
-		
-		results := make([]map[string]string, 0, len(users))
+		users, hasMore := authStore.searchUsers(requester, q.Get("q"), limit, offset)
+
+		results := make([]Profile, 0, len(users))
 		for _, user := range users {
-			results = append(results, map[string]string{
-				"userId":   user.UserID,
-				"username": user.Username,
-			})
+			results = append(results, authStore.profile(user))
 		}
 
+		resp := map[string]interface{}{"users": results}
+		if hasMore {
+			resp["nextOffset"] = offset + len(users)
+		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{"users": results})
+		json.NewEncoder(w).Encode(resp)
 	}
 }
 
+func writeTooManyAttempts(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	minutes := int(math.Ceil(wait.Minutes()))
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(wait)))
+	writeJSONMessage(w, http.StatusTooManyRequests, localizePlural(requestLocale(r), "error.too_many_attempts", minutes, minutes))
+}
+
 func extractToken(r *http.Request) string {
 	authHeader := r.Header.Get("Authorization")
 	if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
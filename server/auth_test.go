@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDummyHashFollowsReloadedCost(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	writeConfig := func(cost string) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte("room_id_secret: test-room-id-secret\nbcrypt_cost: "+cost+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("10")
+	cfg := defaultConfig()
+	cfg.configFile = file
+	cfg.envFile = filepath.Join(dir, "missing.env")
+	if err := cfg.load(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.applyReloadable(cfg)
+
+	// The dummy hash exists before the first unknown username is tried.
+	authStore := newAuthStore(cfg)
+	if d := authStore.dummyHash.Load(); d == nil || d.cost != 10 {
+		t.Fatalf("dummy hash at startup = %+v, want cost 10", d)
+	}
+
+	writeConfig("11")
+	if err := cfg.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.passwordCost(); got != 11 {
+		t.Fatalf("passwordCost = %d after reload, want 11", got)
+	}
+	if d := authStore.dummyHash.Load(); d == nil || d.cost != 11 {
+		t.Fatalf("dummy hash after reload = %+v, want cost 11", d)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Caller tokens identify a signed-in caller to the signaling server, so that
+// their priority contacts are rung through quiet hours. They are issued by
+// /api/auth/caller-token for one room, live briefly and are sent in the join
+// payload instead of the session token.
+
+const (
+	callerTokenVersion = 1
+	callerTokenTTL     = 2 * time.Minute
+	// Separates caller token MACs from room tokens and room ID tags, which
+	// share the secret.
+	callerTokenDomain = "serenada-caller-token:"
+)
+
+type callerTokenClaims struct {
+	V   int    `json:"v"`
+	UID string `json:"uid"`
+	RID string `json:"rid"`
+	Exp int64  `json:"exp"`
+}
+
+func callerTokenMAC(cfg *Config, payload string) ([]byte, error) {
+	if cfg.RoomIDSecret == "" {
+		return nil, ErrRoomIDSecretMissing
+	}
+	mac := hmac.New(sha256.New, []byte(cfg.RoomIDSecret))
+	mac.Write([]byte(callerTokenDomain + payload))
+	return mac.Sum(nil), nil
+}
+
+func issueCallerToken(cfg *Config, userID, rid string) (string, time.Time, error) {
+	expiresAt := time.Now().Add(callerTokenTTL)
+	payloadBytes, err := json.Marshal(callerTokenClaims{V: callerTokenVersion, UID: userID, RID: rid, Exp: expiresAt.Unix()})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(payloadBytes)
+	sig, err := callerTokenMAC(cfg, payload)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sig), expiresAt, nil
+}
+
+// validateCallerToken returns the user ID the token was issued to, if it is
+// valid for the room.
+func validateCallerToken(cfg *Config, token, rid string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", errors.New("malformed caller token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.New("malformed caller token")
+	}
+	expected, err := callerTokenMAC(cfg, parts[0])
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal(sig, expected) {
+		return "", errors.New("invalid caller token signature")
+	}
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errors.New("malformed caller token")
+	}
+	var claims callerTokenClaims
+	if err := json.Unmarshal(payloadBytes, &claims); err != nil {
+		return "", errors.New("malformed caller token")
+	}
+	if claims.V != callerTokenVersion || claims.RID != rid {
+		return "", errors.New("caller token is for another room")
+	}
+	if time.Now().Unix() > claims.Exp {
+		return "", errors.New("caller token expired")
+	}
+	return claims.UID, nil
+}
+
+// handleCallerToken issues a caller token for ?roomId= to the signed-in user.
+func handleCallerToken(cfg *Config, authStore *AuthStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, err := authStore.getUserByToken(extractToken(r))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		roomID := r.URL.Query().Get("roomId")
+		if err := validateRoomID(cfg, roomID); err != nil {
+			if errors.Is(err, ErrRoomIDSecretMissing) {
+				http.Error(w, "Room ID service is not configured", http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, "Invalid roomId", http.StatusBadRequest)
+			return
+		}
+		token, expiresAt, err := issueCallerToken(cfg, user.UserID, roomID)
+		if err != nil {
+			http.Error(w, "Failed to issue caller token", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"callerToken": token,
+			"expiresAt":   expiresAt.Unix(),
+		})
+	}
+}
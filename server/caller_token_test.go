@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCallerToken(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.RoomIDSecret = "test-room-id-secret"
+	rid, err := generateRoomID(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := generateRoomID(cfg)
+
+	token, _, err := issueCallerToken(cfg, "U-alice", rid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID, err := validateCallerToken(cfg, token, rid); err != nil || userID != "U-alice" {
+		t.Fatalf("validateCallerToken = %q, %v", userID, err)
+	}
+	if _, err := validateCallerToken(cfg, token, other); err == nil {
+		t.Error("token accepted for another room")
+	}
+	payload, sig, _ := strings.Cut(token, ".")
+	if _, err := validateCallerToken(cfg, payload+"x."+sig, rid); err == nil {
+		t.Error("tampered token accepted")
+	}
+	roomToken, _, _ := issueRoomToken(cfg, rid)
+	if _, err := validateCallerToken(cfg, roomToken, rid); err == nil {
+		t.Error("room token accepted as a caller token")
+	}
+}
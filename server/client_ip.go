@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// defaultTrustedProxies is used when TRUST_PROXY=1 is set without an explicit
+// TRUSTED_PROXIES list: loopback and private networks, which covers nginx on
+// the same host or on a Docker network.
+var defaultTrustedProxies = []string{
+	"127.0.0.0/8",
+	"::1/128",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+}
+
+// getClientIP resolves the real client IP. Forwarding headers are only
+// honoured when the direct peer is a trusted proxy; the hop list is then
+// walked right to left and the first untrusted address is the client, so a
+// client cannot spoof its address by sending its own headers. Forwarded is
+// ignored unless TRUST_FORWARDED_HEADER is set, since proxies that only
+// append to X-Forwarded-For pass a client's Forwarded header through as-is.
+func getClientIP(cfg *Config, r *http.Request) string {
+	peer := remoteIP(r.RemoteAddr)
+	if !cfg.isTrustedProxy(peer) {
+		return peer
+	}
+
+	if cfg.TrustForwardedHeader {
+		if hops := parseForwardedHeader(r.Header.Values("Forwarded")); len(hops) > 0 {
+			return cfg.walkForwardedHops(hops, peer)
+		}
+	}
+	if hops := parseXForwardedFor(r.Header.Values("X-Forwarded-For")); len(hops) > 0 {
+		return cfg.walkForwardedHops(hops, peer)
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return peer
+}
+
+func remoteIP(remoteAddr string) string {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return ip
+}
+
+func (c *Config) isTrustedProxy(ip string) bool {
+	if len(c.trustedProxies) == 0 {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	return parsed != nil && ipInNets(parsed, c.trustedProxies)
+}
+
+// walkForwardedHops returns the right-most hop that is not a trusted proxy.
+// If an unparsable hop is reached, the last address vouched for by a trusted
+// proxy is used instead.
+func (c *Config) walkForwardedHops(hops []string, peer string) string {
+	candidate := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := hops[i]
+		if net.ParseIP(hop) == nil {
+			return candidate
+		}
+		candidate = hop
+		if !c.isTrustedProxy(hop) {
+			return hop
+		}
+	}
+	return candidate
+}
+
+func parseXForwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			hops = append(hops, stripPort(strings.TrimSpace(part)))
+		}
+	}
+	return hops
+}
+
+// parseForwardedHeader extracts the for= addresses from RFC 7239 Forwarded
+// headers, in order. Obfuscated identifiers ("unknown", "_hidden") are kept
+// as-is so that they stop the walk.
+func parseForwardedHeader(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+				val = strings.Trim(strings.TrimSpace(val), `"`)
+				hops = append(hops, stripPort(val))
+			}
+		}
+	}
+	return hops
+}
+
+// stripPort removes an optional port and IPv6 brackets from an address.
+func stripPort(addr string) string {
+	if strings.HasPrefix(addr, "[") {
+		if end := strings.Index(addr, "]"); end > 0 {
+			return addr[1:end]
+		}
+		return addr
+	}
+	if strings.Count(addr, ":") == 1 {
+		host, _, err := net.SplitHostPort(addr)
+		if err == nil {
+			return host
+		}
+	}
+	return addr
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetClientIP(t *testing.T) {
+	cfg := newTestConfig()
+	nets, err := parseCIDRs([]string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.trustedProxies = nets
+
+	tests := []struct {
+		name           string
+		remote         string
+		trustForwarded bool
+		forwarded      []string
+		xff            []string
+		realIP         string
+		want           string
+	}{
+		{name: "direct client", remote: "203.0.113.5:1234", want: "203.0.113.5"},
+		{name: "untrusted peer ignores headers", remote: "203.0.113.5:1234", xff: []string{"198.51.100.1"}, forwarded: []string{"for=198.51.100.2"}, realIP: "198.51.100.3", want: "203.0.113.5"},
+		{name: "xff one hop", remote: "10.0.0.2:1234", xff: []string{"203.0.113.5"}, want: "203.0.113.5"},
+		{name: "xff through trusted hops", remote: "10.0.0.2:1234", xff: []string{"203.0.113.5, 10.0.0.9, 10.0.0.3"}, want: "203.0.113.5"},
+		// A client-supplied hop left of the real client is ignored.
+		{name: "xff spoofed hop", remote: "10.0.0.2:1234", xff: []string{"1.2.3.4, 203.0.113.5"}, want: "203.0.113.5"},
+		{name: "xff untrusted hop stops the walk", remote: "10.0.0.2:1234", xff: []string{"203.0.113.5, 198.51.100.7, 10.0.0.3"}, want: "198.51.100.7"},
+		{name: "xff all hops trusted", remote: "10.0.0.2:1234", xff: []string{"10.0.0.4, 10.0.0.3"}, want: "10.0.0.4"},
+		{name: "xff unparsable hop", remote: "10.0.0.2:1234", xff: []string{"garbage, 10.0.0.3"}, want: "10.0.0.3"},
+		{name: "xff split across headers", remote: "10.0.0.2:1234", xff: []string{"1.2.3.4", "203.0.113.5, 10.0.0.3"}, want: "203.0.113.5"},
+		{name: "xff with port", remote: "10.0.0.2:1234", xff: []string{"203.0.113.5:4711"}, want: "203.0.113.5"},
+		{name: "forwarded", remote: "10.0.0.2:1234", trustForwarded: true, forwarded: []string{`for=198.51.100.17;proto=https, for=10.0.0.3`}, want: "198.51.100.17"},
+		{name: "forwarded ipv6", remote: "[fd00::2]:443", trustForwarded: true, forwarded: []string{`for="[2001:db8::1]:4711"`}, want: "2001:db8::1"},
+		{name: "forwarded spoofed hop", remote: "10.0.0.2:1234", trustForwarded: true, forwarded: []string{"for=1.2.3.4", "for=198.51.100.17"}, want: "198.51.100.17"},
+		{name: "forwarded obfuscated hop", remote: "10.0.0.2:1234", trustForwarded: true, forwarded: []string{"for=unknown, for=10.0.0.3"}, want: "10.0.0.3"},
+		{name: "trusted forwarded wins over xff", remote: "10.0.0.2:1234", trustForwarded: true, forwarded: []string{"for=198.51.100.17"}, xff: []string{"203.0.113.5"}, want: "198.51.100.17"},
+		// nginx appends to X-Forwarded-For but passes a client's Forwarded
+		// header through, so it is ignored unless explicitly trusted.
+		{name: "forwarded ignored by default", remote: "10.0.0.2:1234", forwarded: []string{"for=198.51.100.17"}, xff: []string{"203.0.113.5"}, want: "203.0.113.5"},
+		{name: "forwarded alone ignored by default", remote: "10.0.0.2:1234", forwarded: []string{"for=198.51.100.17"}, want: "10.0.0.2"},
+		{name: "x-real-ip", remote: "10.0.0.2:1234", realIP: "203.0.113.5", want: "203.0.113.5"},
+		{name: "invalid x-real-ip", remote: "10.0.0.2:1234", realIP: "not-an-ip", want: "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			cfg.TrustForwardedHeader = tt.trustForwarded
+			for _, v := range tt.forwarded {
+				r.Header.Add("Forwarded", v)
+			}
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := getClientIP(cfg, r); got != tt.want {
+				t.Errorf("getClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetClientIPWithoutTrustedProxies(t *testing.T) {
+	cfg := newTestConfig()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.2:1234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.5")
+	if got := getClientIP(cfg, r); got != "10.0.0.2" {
+		t.Errorf("getClientIP = %q, want the peer address", got)
+	}
+}
@@ -0,0 +1,615 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/joho/godotenv"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds all server configuration. It is loaded once at startup from
+// (lowest to highest precedence) built-in defaults, an optional YAML file
+// (CONFIG_FILE), a .env file (ENV_FILE, default ".env") and the process
+// environment.
+//
+// Fields are read-only after load, except those applied by reload, which are
+// exposed through accessor methods.
+type Config struct {
+	Port    string `yaml:"port"`
+	DataDir string `yaml:"data_dir"`
+
+	RoomIDSecret string `yaml:"room_id_secret"`
+	RoomIDEnv    string `yaml:"room_id_env"`
+
+	TurnSecret      string `yaml:"turn_secret"`
+	TurnTokenSecret string `yaml:"turn_token_secret"`
+	TurnHost        string `yaml:"turn_host"`
+	StunHost        string `yaml:"stun_host"`
+
+	AllowedOrigins []string `yaml:"allowed_origins"`
+
+	// TrustedProxies lists the CIDRs whose forwarding headers
+	// (X-Forwarded-For, X-Real-IP) and PROXY protocol headers are honoured.
+	// TrustProxy without TrustedProxies trusts loopback and private networks.
+	TrustProxy     bool     `yaml:"trust_proxy"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// TrustForwardedHeader also honours RFC 7239 Forwarded headers, ahead of
+	// X-Forwarded-For. Only enable it when every trusted proxy sets or clears
+	// Forwarded; the shipped nginx configs clear it.
+	TrustForwardedHeader bool `yaml:"trust_forwarded_header"`
+	// ProxyProtocol is off, optional or required (PROXY protocol v2).
+	ProxyProtocol string `yaml:"proxy_protocol"`
+
+	PushSubscriberEmail string `yaml:"push_subscriber_email"`
+
+	// Native push. FCM is enabled by a service account JSON file, APNs by a
+	// token signing key (.p8). The endpoints are overridable for testing.
+	FCMCredentialsFile string `yaml:"fcm_credentials_file"`
+	FCMEndpoint        string `yaml:"fcm_endpoint"`
+	APNsKeyFile        string `yaml:"apns_key_file"`
+	APNsKeyID          string `yaml:"apns_key_id"`
+	APNsTeamID         string `yaml:"apns_team_id"`
+	APNsTopic          string `yaml:"apns_topic"` // app bundle ID
+	APNsEndpoint       string `yaml:"apns_endpoint"`
+
+	// Push delivery queue: worker pool size, concurrent deliveries per
+	// subscription endpoint and attempts before giving up.
+	PushWorkers             int `yaml:"push_workers"`
+	PushEndpointConcurrency int `yaml:"push_endpoint_concurrency"`
+	PushMaxAttempts         int `yaml:"push_max_attempts"`
+	// PushSubscriptionTTLDays expires subscriptions that clients have not
+	// renewed for this many days; 0 keeps them until unsubscribed.
+	PushSubscriptionTTLDays int `yaml:"push_subscription_ttl_days"`
+
+	// Encrypted call snapshots: storage backend (fs or s3), lifetime, how many
+	// a room may hold and the total size cap. The S3 settings address any
+	// S3-compatible service with path-style requests.
+	SnapshotBackend     string `yaml:"snapshot_backend"`
+	SnapshotTTLMinutes  int    `yaml:"snapshot_ttl_minutes"`
+	SnapshotRoomQuota   int    `yaml:"snapshot_room_quota"`
+	SnapshotQuotaMB     int    `yaml:"snapshot_quota_mb"`
+	SnapshotS3Endpoint  string `yaml:"snapshot_s3_endpoint"`
+	SnapshotS3Bucket    string `yaml:"snapshot_s3_bucket"`
+	SnapshotS3Region    string `yaml:"snapshot_s3_region"`
+	SnapshotS3Prefix    string `yaml:"snapshot_s3_prefix"`
+	SnapshotS3AccessKey string `yaml:"snapshot_s3_access_key"`
+	SnapshotS3SecretKey string `yaml:"snapshot_s3_secret_key"`
+
+	// Signaling abuse limits.
+	MaxSessionsPerIP      int `yaml:"max_sessions_per_ip"`
+	MaxWatchRoomsPerMsg   int `yaml:"max_watch_rooms_per_msg"`
+	MaxWatchedRoomsPerSID int `yaml:"max_watched_rooms_per_session"`
+
+	// RateLimitAllowlist lists CIDRs (or IPs) exempt from per-IP rate limits.
+	RateLimitAllowlist  []string `yaml:"rate_limit_allowlist"`
+	RateLimitMaxEntries int      `yaml:"rate_limit_max_entries"`
+	// RateLimitAlgorithm selects the per-IP limiter: token_bucket or
+	// sliding_window.
+	RateLimitAlgorithm string `yaml:"rate_limit_algorithm"`
+
+	// Password policy and reset. PasswordResetSecret signs reset tokens; when
+	// unset a random key is used and outstanding tokens die on restart.
+	// BcryptCost is reloadable and read through passwordCost.
+	PasswordMinLength       int    `yaml:"password_min_length"`
+	PasswordMinClasses      int    `yaml:"password_min_classes"`
+	BcryptCost              int    `yaml:"bcrypt_cost"`
+	PasswordResetSecret     string `yaml:"password_reset_secret"`
+	PasswordResetTTLMinutes int    `yaml:"password_reset_ttl_minutes"`
+
+	// WebAuthn relying party. The RP ID defaults to the host of the first
+	// ALLOWED_ORIGINS entry at startup and is not changed by a reload;
+	// passkeys are disabled without allowed origins.
+	WebAuthnRPID   string `yaml:"webauthn_rp_id"`
+	WebAuthnRPName string `yaml:"webauthn_rp_name"`
+
+	// AdminToken enables the admin API when set. It must be distinct from
+	// every other secret.
+	AdminToken string `yaml:"admin_token"`
+
+	LogLevel  string `yaml:"log_level"`
+	LogFormat string `yaml:"log_format"`
+	LogRedact bool   `yaml:"log_redact"`
+
+	configFile string
+	envFile    string
+
+	rateLimitAllowlist []*net.IPNet
+	trustedProxies     []*net.IPNet
+
+	// Hot-reloadable state.
+	origins    atomic.Pointer[map[string]bool]
+	logLevel   slog.LevelVar
+	bcryptCost atomic.Int64
+
+	reloadMu    sync.Mutex
+	reloadHooks []func()
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Port:      "8080",
+		DataDir:   ".",
+		RoomIDEnv: "dev",
+
+		ProxyProtocol: proxyProtoOff,
+
+		FCMEndpoint:  defaultFCMEndpoint,
+		APNsEndpoint: defaultAPNsEndpoint,
+
+		PushWorkers:             8,
+		PushEndpointConcurrency: 4,
+		PushMaxAttempts:         8,
+		PushSubscriptionTTLDays: 90,
+
+		SnapshotBackend:    "fs",
+		SnapshotTTLMinutes: 10,
+		SnapshotRoomQuota:  3,
+		SnapshotQuotaMB:    256,
+		SnapshotS3Region:   "us-east-1",
+		SnapshotS3Prefix:   "snapshots/",
+
+		MaxSessionsPerIP:      20,
+		MaxWatchRoomsPerMsg:   50,
+		MaxWatchedRoomsPerSID: 200,
+		RateLimitMaxEntries:   defaultLimiterMaxEntries,
+		RateLimitAlgorithm:    rateLimitTokenBucket,
+
+		PasswordMinLength:       10,
+		PasswordMinClasses:      2,
+		BcryptCost:              12,
+		PasswordResetTTLMinutes: 30,
+
+		WebAuthnRPName: "Serenada",
+
+		LogLevel:  "info",
+		LogFormat: "text",
+		LogRedact: true,
+	}
+}
+
+// loadConfig reads and validates the configuration.
+func loadConfig() (*Config, error) {
+	cfg := defaultConfig()
+	cfg.configFile = os.Getenv("CONFIG_FILE")
+	cfg.envFile = os.Getenv("ENV_FILE")
+	if cfg.envFile == "" {
+		cfg.envFile = ".env"
+	}
+
+	if err := cfg.load(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	cfg.applyReloadable(cfg)
+	return cfg, nil
+}
+
+func (c *Config) load() error {
+	if c.configFile != "" {
+		data, err := os.ReadFile(c.configFile)
+		if err != nil {
+			return fmt.Errorf("config: reading %s: %w", c.configFile, err)
+		}
+		if err := yaml.Unmarshal(data, c); err != nil {
+			return fmt.Errorf("config: parsing %s: %w", c.configFile, err)
+		}
+	}
+
+	dotenv, err := godotenv.Read(c.envFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("config: reading %s: %w", c.envFile, err)
+	}
+
+	lookup := func(key string) (string, bool) {
+		if v, ok := os.LookupEnv(key); ok && v != "" {
+			return v, true
+		}
+		v, ok := dotenv[key]
+		return v, ok && v != ""
+	}
+
+	var errs []error
+	setString := func(key string, dst *string) {
+		if v, ok := lookup(key); ok {
+			*dst = strings.TrimSpace(v)
+		}
+	}
+	setInt := func(key string, dst *int) {
+		if v, ok := lookup(key); ok {
+			n, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid integer %q", key, v))
+				return
+			}
+			*dst = n
+		}
+	}
+	setBool := func(key string, dst *bool) {
+		if v, ok := lookup(key); ok {
+			switch strings.ToLower(strings.TrimSpace(v)) {
+			case "1", "true", "yes", "on":
+				*dst = true
+			case "0", "false", "no", "off":
+				*dst = false
+			default:
+				errs = append(errs, fmt.Errorf("%s: invalid boolean %q", key, v))
+			}
+		}
+	}
+
+	setString("PORT", &c.Port)
+	setString("DATA_DIR", &c.DataDir)
+	setString("ROOM_ID_SECRET", &c.RoomIDSecret)
+	setString("ROOM_ID_ENV", &c.RoomIDEnv)
+	setString("TURN_SECRET", &c.TurnSecret)
+	setString("TURN_TOKEN_SECRET", &c.TurnTokenSecret)
+	setString("TURN_HOST", &c.TurnHost)
+	setString("STUN_HOST", &c.StunHost)
+	if v, ok := lookup("ALLOWED_ORIGINS"); ok {
+		c.AllowedOrigins = splitList(v)
+	}
+	setBool("TRUST_PROXY", &c.TrustProxy)
+	if v, ok := lookup("TRUSTED_PROXIES"); ok {
+		c.TrustedProxies = splitList(v)
+	}
+	setBool("TRUST_FORWARDED_HEADER", &c.TrustForwardedHeader)
+	setString("PROXY_PROTOCOL", &c.ProxyProtocol)
+	c.ProxyProtocol = strings.ToLower(c.ProxyProtocol)
+	setString("PUSH_SUBSCRIBER_EMAIL", &c.PushSubscriberEmail)
+	setString("FCM_CREDENTIALS_FILE", &c.FCMCredentialsFile)
+	setString("FCM_ENDPOINT", &c.FCMEndpoint)
+	setString("APNS_KEY_FILE", &c.APNsKeyFile)
+	setString("APNS_KEY_ID", &c.APNsKeyID)
+	setString("APNS_TEAM_ID", &c.APNsTeamID)
+	setString("APNS_TOPIC", &c.APNsTopic)
+	setString("APNS_ENDPOINT", &c.APNsEndpoint)
+	setInt("PUSH_WORKERS", &c.PushWorkers)
+	setInt("PUSH_ENDPOINT_CONCURRENCY", &c.PushEndpointConcurrency)
+	setInt("PUSH_MAX_ATTEMPTS", &c.PushMaxAttempts)
+	setInt("PUSH_SUBSCRIPTION_TTL_DAYS", &c.PushSubscriptionTTLDays)
+	setString("SNAPSHOT_BACKEND", &c.SnapshotBackend)
+	c.SnapshotBackend = strings.ToLower(c.SnapshotBackend)
+	setInt("SNAPSHOT_TTL_MINUTES", &c.SnapshotTTLMinutes)
+	setInt("SNAPSHOT_ROOM_QUOTA", &c.SnapshotRoomQuota)
+	setInt("SNAPSHOT_QUOTA_MB", &c.SnapshotQuotaMB)
+	setString("SNAPSHOT_S3_ENDPOINT", &c.SnapshotS3Endpoint)
+	setString("SNAPSHOT_S3_BUCKET", &c.SnapshotS3Bucket)
+	setString("SNAPSHOT_S3_REGION", &c.SnapshotS3Region)
+	setString("SNAPSHOT_S3_PREFIX", &c.SnapshotS3Prefix)
+	setString("SNAPSHOT_S3_ACCESS_KEY", &c.SnapshotS3AccessKey)
+	setString("SNAPSHOT_S3_SECRET_KEY", &c.SnapshotS3SecretKey)
+	setInt("MAX_SESSIONS_PER_IP", &c.MaxSessionsPerIP)
+	setInt("MAX_WATCH_ROOMS_PER_MSG", &c.MaxWatchRoomsPerMsg)
+	setInt("MAX_WATCHED_ROOMS_PER_SESSION", &c.MaxWatchedRoomsPerSID)
+	if v, ok := lookup("RATE_LIMIT_ALLOWLIST"); ok {
+		c.RateLimitAllowlist = splitList(v)
+	}
+	setInt("RATE_LIMIT_MAX_ENTRIES", &c.RateLimitMaxEntries)
+	setString("RATE_LIMIT_ALGORITHM", &c.RateLimitAlgorithm)
+	setInt("PASSWORD_MIN_LENGTH", &c.PasswordMinLength)
+	setInt("PASSWORD_MIN_CLASSES", &c.PasswordMinClasses)
+	setInt("BCRYPT_COST", &c.BcryptCost)
+	setString("PASSWORD_RESET_SECRET", &c.PasswordResetSecret)
+	setInt("PASSWORD_RESET_TTL_MINUTES", &c.PasswordResetTTLMinutes)
+	setString("WEBAUTHN_RP_ID", &c.WebAuthnRPID)
+	setString("WEBAUTHN_RP_NAME", &c.WebAuthnRPName)
+	setString("ADMIN_TOKEN", &c.AdminToken)
+	setString("LOG_LEVEL", &c.LogLevel)
+	setString("LOG_FORMAT", &c.LogFormat)
+	setBool("LOG_REDACT", &c.LogRedact)
+	c.LogFormat = strings.ToLower(c.LogFormat)
+
+	return errors.Join(errs...)
+}
+
+func (c *Config) validate() error {
+	var errs []error
+
+	if port, err := strconv.Atoi(c.Port); err != nil || port <= 0 || port > 65535 {
+		errs = append(errs, fmt.Errorf("PORT: %q is not a valid port", c.Port))
+	}
+	if c.DataDir == "" {
+		errs = append(errs, errors.New("DATA_DIR: must not be empty"))
+	}
+	if c.RoomIDSecret == "" {
+		errs = append(errs, errors.New("ROOM_ID_SECRET: required (generate with `openssl rand -hex 32`)"))
+	}
+	if c.TurnSecret != "" && c.StunHost == "" {
+		errs = append(errs, errors.New("STUN_HOST: required when TURN_SECRET is set"))
+	}
+	for _, origin := range c.AllowedOrigins {
+		if err := validateOrigin(origin); err != nil {
+			errs = append(errs, fmt.Errorf("ALLOWED_ORIGINS: %w", err))
+		}
+	}
+	if c.PushSubscriberEmail != "" {
+		addr := strings.TrimPrefix(c.PushSubscriberEmail, "mailto:")
+		if _, err := mail.ParseAddress(addr); err != nil && !strings.HasPrefix(c.PushSubscriberEmail, "https://") {
+			errs = append(errs, fmt.Errorf("PUSH_SUBSCRIBER_EMAIL: %q is not an email address or https URL", c.PushSubscriberEmail))
+		}
+	}
+	for key, endpoint := range map[string]string{"FCM_ENDPOINT": c.FCMEndpoint, "APNS_ENDPOINT": c.APNsEndpoint} {
+		if err := validateOrigin(endpoint); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+	if c.APNsKeyFile != "" && (c.APNsKeyID == "" || c.APNsTeamID == "" || c.APNsTopic == "") {
+		errs = append(errs, errors.New("APNS_KEY_FILE: requires APNS_KEY_ID, APNS_TEAM_ID and APNS_TOPIC"))
+	}
+	if c.PushWorkers <= 0 {
+		errs = append(errs, errors.New("PUSH_WORKERS: must be positive"))
+	}
+	if c.PushEndpointConcurrency <= 0 {
+		errs = append(errs, errors.New("PUSH_ENDPOINT_CONCURRENCY: must be positive"))
+	}
+	if c.PushMaxAttempts <= 0 {
+		errs = append(errs, errors.New("PUSH_MAX_ATTEMPTS: must be positive"))
+	}
+	if c.PushSubscriptionTTLDays < 0 {
+		errs = append(errs, errors.New("PUSH_SUBSCRIPTION_TTL_DAYS: must not be negative"))
+	}
+	switch c.SnapshotBackend {
+	case "fs":
+	case "s3":
+		if err := validateOrigin(c.SnapshotS3Endpoint); err != nil {
+			errs = append(errs, fmt.Errorf("SNAPSHOT_S3_ENDPOINT: %w", err))
+		}
+		if c.SnapshotS3Bucket == "" || strings.Contains(c.SnapshotS3Bucket, "/") {
+			errs = append(errs, errors.New("SNAPSHOT_S3_BUCKET: required bucket name"))
+		}
+		if c.SnapshotS3Region == "" {
+			errs = append(errs, errors.New("SNAPSHOT_S3_REGION: must not be empty"))
+		}
+		if c.SnapshotS3AccessKey == "" || c.SnapshotS3SecretKey == "" {
+			errs = append(errs, errors.New("SNAPSHOT_S3_ACCESS_KEY: requires SNAPSHOT_S3_SECRET_KEY"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("SNAPSHOT_BACKEND: %q must be fs or s3", c.SnapshotBackend))
+	}
+	if c.SnapshotTTLMinutes <= 0 {
+		errs = append(errs, errors.New("SNAPSHOT_TTL_MINUTES: must be positive"))
+	}
+	if c.SnapshotRoomQuota < 0 {
+		errs = append(errs, errors.New("SNAPSHOT_ROOM_QUOTA: must not be negative"))
+	}
+	if c.SnapshotQuotaMB < 0 {
+		errs = append(errs, errors.New("SNAPSHOT_QUOTA_MB: must not be negative"))
+	}
+	if c.MaxSessionsPerIP <= 0 {
+		errs = append(errs, errors.New("MAX_SESSIONS_PER_IP: must be positive"))
+	}
+	if c.MaxWatchRoomsPerMsg <= 0 {
+		errs = append(errs, errors.New("MAX_WATCH_ROOMS_PER_MSG: must be positive"))
+	}
+	if c.MaxWatchedRoomsPerSID < c.MaxWatchRoomsPerMsg {
+		errs = append(errs, errors.New("MAX_WATCHED_ROOMS_PER_SESSION: must be at least MAX_WATCH_ROOMS_PER_MSG"))
+	}
+	proxies := c.TrustedProxies
+	if len(proxies) == 0 && c.TrustProxy {
+		proxies = defaultTrustedProxies
+	}
+	if nets, err := parseCIDRs(proxies); err != nil {
+		errs = append(errs, fmt.Errorf("TRUSTED_PROXIES: %w", err))
+	} else {
+		c.trustedProxies = nets
+	}
+	switch c.ProxyProtocol {
+	case proxyProtoOff, proxyProtoOptional, proxyProtoRequired:
+		if c.ProxyProtocol != proxyProtoOff && len(c.trustedProxies) == 0 {
+			errs = append(errs, errors.New("PROXY_PROTOCOL: requires TRUSTED_PROXIES"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("PROXY_PROTOCOL: %q must be off, optional or required", c.ProxyProtocol))
+	}
+	if nets, err := parseCIDRs(c.RateLimitAllowlist); err != nil {
+		errs = append(errs, fmt.Errorf("RATE_LIMIT_ALLOWLIST: %w", err))
+	} else {
+		c.rateLimitAllowlist = nets
+	}
+	if c.RateLimitMaxEntries <= 0 {
+		errs = append(errs, errors.New("RATE_LIMIT_MAX_ENTRIES: must be positive"))
+	}
+	switch c.RateLimitAlgorithm {
+	case rateLimitTokenBucket, rateLimitSlidingWindow:
+	default:
+		errs = append(errs, fmt.Errorf("RATE_LIMIT_ALGORITHM: %q must be token_bucket or sliding_window", c.RateLimitAlgorithm))
+	}
+	if c.PasswordMinLength < 8 || c.PasswordMinLength > passwordMaxBytes {
+		errs = append(errs, fmt.Errorf("PASSWORD_MIN_LENGTH: must be between 8 and %d", passwordMaxBytes))
+	}
+	if c.PasswordMinClasses < 0 || c.PasswordMinClasses > 4 {
+		errs = append(errs, errors.New("PASSWORD_MIN_CLASSES: must be between 0 and 4"))
+	}
+	if c.BcryptCost < bcrypt.DefaultCost || c.BcryptCost > bcrypt.MaxCost {
+		errs = append(errs, fmt.Errorf("BCRYPT_COST: must be between %d and %d", bcrypt.DefaultCost, bcrypt.MaxCost))
+	}
+	if c.PasswordResetSecret != "" && len(c.PasswordResetSecret) < 16 {
+		errs = append(errs, errors.New("PASSWORD_RESET_SECRET: must be at least 16 characters"))
+	}
+	if c.PasswordResetTTLMinutes <= 0 {
+		errs = append(errs, errors.New("PASSWORD_RESET_TTL_MINUTES: must be positive"))
+	}
+	if c.WebAuthnRPID != "" {
+		// The RP ID must be the host of, or a parent domain of, every origin
+		// that performs ceremonies.
+		for _, origin := range c.AllowedOrigins {
+			u, err := url.Parse(origin)
+			if err != nil {
+				continue
+			}
+			host := u.Hostname()
+			if host != c.WebAuthnRPID && !strings.HasSuffix(host, "."+c.WebAuthnRPID) {
+				errs = append(errs, fmt.Errorf("WEBAUTHN_RP_ID: %q is not a registrable suffix of origin %q", c.WebAuthnRPID, origin))
+			}
+		}
+	}
+	if c.WebAuthnRPName == "" {
+		errs = append(errs, errors.New("WEBAUTHN_RP_NAME: must not be empty"))
+	}
+	if c.AdminToken != "" {
+		if len(c.AdminToken) < 16 {
+			errs = append(errs, errors.New("ADMIN_TOKEN: must be at least 16 characters"))
+		}
+		for _, secret := range []string{c.RoomIDSecret, c.TurnSecret, c.TurnTokenSecret, c.PasswordResetSecret} {
+			if secret != "" && secret == c.AdminToken {
+				errs = append(errs, errors.New("ADMIN_TOKEN: must not reuse another secret"))
+				break
+			}
+		}
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("LOG_LEVEL: %w", err))
+	}
+	switch c.LogFormat {
+	case "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("LOG_FORMAT: %q must be text or json", c.LogFormat))
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateOrigin(origin string) error {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return fmt.Errorf("%q must be of the form scheme://host[:port]", origin)
+	}
+	return nil
+}
+
+func splitList(raw string) []string {
+	var items []string
+	for _, item := range strings.Split(raw, ",") {
+		if trimmed := strings.TrimSpace(item); trimmed != "" {
+			items = append(items, trimmed)
+		}
+	}
+	return items
+}
+
+// applyReloadable copies the fields that are safe to change at runtime.
+func (c *Config) applyReloadable(next *Config) {
+	origins := make(map[string]bool, len(next.AllowedOrigins))
+	for _, origin := range next.AllowedOrigins {
+		origins[origin] = true
+	}
+	c.origins.Store(&origins)
+
+	level, _ := parseLogLevel(next.LogLevel)
+	c.logLevel.Set(level)
+
+	c.bcryptCost.Store(int64(next.BcryptCost))
+}
+
+// reloadableKeys are the settings applyReloadable picks up at runtime.
+var reloadableKeys = map[string]bool{"allowed_origins": true, "log_level": true, "bcrypt_cost": true}
+
+// onReload registers f to run after each successful reload.
+func (c *Config) onReload(f func()) {
+	c.reloadMu.Lock()
+	c.reloadHooks = append(c.reloadHooks, f)
+	c.reloadMu.Unlock()
+}
+
+// restartRequiredChanges names, as environment variables, the settings that
+// differ in next but only take effect after a restart. Values are not
+// reported since several of them are secrets.
+func (c *Config) restartRequiredChanges(next *Config) []string {
+	var changed []string
+	cur, nv := reflect.ValueOf(c).Elem(), reflect.ValueOf(next).Elem()
+	for _, field := range reflect.VisibleFields(cur.Type()) {
+		key := field.Tag.Get("yaml")
+		if key == "" || reloadableKeys[key] {
+			continue
+		}
+		if !reflect.DeepEqual(cur.FieldByIndex(field.Index).Interface(), nv.FieldByIndex(field.Index).Interface()) {
+			changed = append(changed, strings.ToUpper(key))
+		}
+	}
+	return changed
+}
+
+// reload re-reads the config sources and applies the hot-reloadable fields.
+// Changes to other fields are reported and ignored until restart.
+func (c *Config) reload() error {
+	next := defaultConfig()
+	next.configFile = c.configFile
+	next.envFile = c.envFile
+	if err := next.load(); err != nil {
+		return err
+	}
+	if err := next.validate(); err != nil {
+		return err
+	}
+
+	if changed := c.restartRequiredChanges(next); len(changed) > 0 {
+		slog.Warn("config reload: changed settings require a restart and were not applied", "keys", strings.Join(changed, ","))
+	}
+	if rpID := next.passkeyRPID(); rpID != c.passkeyRPID() {
+		slog.Warn("config reload: passkey RP ID is fixed until restart", "current", c.passkeyRPID(), "reloaded", rpID)
+	}
+
+	c.applyReloadable(next)
+	c.reloadMu.Lock()
+	hooks := c.reloadHooks
+	c.reloadMu.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+	return nil
+}
+
+// watchReload reloads the configuration on SIGHUP.
+func (c *Config) watchReload() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			if err := c.reload(); err != nil {
+				slog.Error("config reload failed", "err", err)
+				continue
+			}
+			slog.Info("config reloaded")
+		}
+	}()
+}
+
+// passwordCost is the bcrypt cost for new password hashes.
+func (c *Config) passwordCost() int {
+	return int(c.bcryptCost.Load())
+}
+
+func (c *Config) allowedOrigins() map[string]bool {
+	if origins := c.origins.Load(); origins != nil {
+		return *origins
+	}
+	return nil
+}
+
+// turnTokenSecret returns the secret used to sign TURN tokens, falling back
+// to the TURN shared secret.
+func (c *Config) turnTokenSecret() (string, error) {
+	if c.TurnTokenSecret != "" {
+		return c.TurnTokenSecret, nil
+	}
+	if c.TurnSecret != "" {
+		return c.TurnSecret, nil
+	}
+	return "", errors.New("TURN token secret not configured")
+}
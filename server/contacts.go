@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Privacy audiences.
+const (
+	audienceEveryone = "everyone"
+	audienceContacts = "contacts"
+	audienceNobody   = "nobody"
+)
+
+// PrivacySettings control who can find and message a user.
+type PrivacySettings struct {
+	// Searchable is everyone, contacts or nobody.
+	Searchable string `json:"searchable"`
+	// MessagesFrom is everyone or contacts.
+	MessagesFrom string `json:"messagesFrom"`
+}
+
+func defaultPrivacySettings() PrivacySettings {
+	return PrivacySettings{Searchable: audienceEveryone, MessagesFrom: audienceEveryone}
+}
+
+// isBlockedLocked reports whether either user has blocked the other.
+// Caller must hold s.mu.
+func (s *AuthStore) isBlockedLocked(a, b *User) bool {
+	return a.Blocked[b.UserID] || b.Blocked[a.UserID]
+}
+
+// canMessage reports whether sender may start a chat with, send messages to
+// or ring recipient.
+func (s *AuthStore) canMessage(sender, recipient *User) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.isBlockedLocked(sender, recipient) {
+		return false
+	}
+	if recipient.Privacy.MessagesFrom == audienceContacts {
+		_, ok := recipient.Contacts[sender.UserID]
+		return ok
+	}
+	return true
+}
+
+// visibleInSearchLocked reports whether target may appear in searcher's
+// results. Caller must hold s.mu.
+func (s *AuthStore) visibleInSearchLocked(searcher, target *User) bool {
+	if searcher.UserID == target.UserID || s.isBlockedLocked(searcher, target) {
+		return false
+	}
+	switch target.Privacy.Searchable {
+	case audienceNobody:
+		return false
+	case audienceContacts:
+		_, ok := target.Contacts[searcher.UserID]
+		return ok
+	}
+	return true
+}
+
+// canSeeProfile reports whether viewer may look a user up outside search,
+// by username or avatar. That is the case when target is visible to them in
+// search or the two already know each other through a contact entry or a
+// shared chat. Without a viewer only profiles searchable by everyone are
+// visible.
+func canSeeProfile(authStore *AuthStore, msgStore *MessagingStore, viewer, target *User) bool {
+	authStore.mu.RLock()
+	if viewer == nil {
+		public := target.Privacy.Searchable == audienceEveryone
+		authStore.mu.RUnlock()
+		return public
+	}
+	if viewer.UserID == target.UserID || authStore.visibleInSearchLocked(viewer, target) {
+		authStore.mu.RUnlock()
+		return true
+	}
+	if authStore.isBlockedLocked(viewer, target) {
+		authStore.mu.RUnlock()
+		return false
+	}
+	_, contact := viewer.Contacts[target.UserID]
+	_, contactOf := target.Contacts[viewer.UserID]
+	authStore.mu.RUnlock()
+	return contact || contactOf || msgStore.sharesChat(viewer.UserID, target.UserID)
+}
+
+func (s *AuthStore) addContact(user, contact *User) {
+	s.mu.Lock()
+	if user.Contacts == nil {
+		user.Contacts = make(map[string]time.Time)
+	}
+	if _, ok := user.Contacts[contact.UserID]; !ok {
+		user.Contacts[contact.UserID] = time.Now()
+	}
+	s.mu.Unlock()
+}
+
+func (s *AuthStore) removeContact(user *User, contactID string) {
+	s.mu.Lock()
+	delete(user.Contacts, contactID)
+	delete(user.PriorityContacts, contactID)
+	s.mu.Unlock()
+}
+
+// addPriorityContact marks a contact as priority, adding them as a contact
+// first if needed.
+func (s *AuthStore) addPriorityContact(user, contact *User) {
+	s.addContact(user, contact)
+	s.mu.Lock()
+	if user.PriorityContacts == nil {
+		user.PriorityContacts = make(map[string]bool)
+	}
+	user.PriorityContacts[contact.UserID] = true
+	s.mu.Unlock()
+}
+
+func (s *AuthStore) removePriorityContact(user *User, contactID string) {
+	s.mu.Lock()
+	delete(user.PriorityContacts, contactID)
+	s.mu.Unlock()
+}
+
+// isPriorityContact reports whether callerID is one of the user's priority
+// contacts and neither has blocked the other.
+func (s *AuthStore) isPriorityContact(userID, callerID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, caller := s.usersByID[userID], s.usersByID[callerID]
+	if user == nil || caller == nil {
+		return false
+	}
+	return user.PriorityContacts[callerID] && !s.isBlockedLocked(user, caller)
+}
+
+// block also drops the blocked user from the contact list.
+func (s *AuthStore) block(user, target *User) {
+	s.mu.Lock()
+	if user.Blocked == nil {
+		user.Blocked = make(map[string]bool)
+	}
+	user.Blocked[target.UserID] = true
+	delete(user.Contacts, target.UserID)
+	delete(user.PriorityContacts, target.UserID)
+	s.mu.Unlock()
+}
+
+func (s *AuthStore) unblock(user *User, targetID string) {
+	s.mu.Lock()
+	delete(user.Blocked, targetID)
+	s.mu.Unlock()
+}
+
+// contactProfiles returns the profiles of the listed user IDs, sorted by
+// username.
+func (s *AuthStore) contactProfiles(ids []string) []Profile {
+	profiles := make([]Profile, 0, len(ids))
+	for _, p := range s.profiles(ids) {
+		profiles = append(profiles, p)
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Username < profiles[j].Username })
+	return profiles
+}
+
+// chatParticipants returns the participants of a chat, or nil if it does not
+// exist.
+func (s *MessagingStore) chatParticipants(chatID string) []string {
+	s.mu.RLock()
+	chat := s.chats[chatID]
+	s.mu.RUnlock()
+	if chat == nil {
+		return nil
+	}
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	return chat.Participants
+}
+
+// userListHandler serves a per-user list of accounts: GET lists it, POST
+// {"username"} adds to it and DELETE /{userId} removes from it. Users the
+// caller may not see are reported as not found, like missing ones.
+func userListHandler(authStore *AuthStore, msgStore *MessagingStore, prefix string, list func(*User) []string, add func(user, target *User), remove func(user *User, targetID string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := authStore.getUserByToken(extractToken(r))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		targetID := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+
+		switch {
+		case r.Method == http.MethodGet && targetID == "":
+			authStore.mu.RLock()
+			ids := list(user)
+			authStore.mu.RUnlock()
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"users": authStore.contactProfiles(ids)})
+
+		case r.Method == http.MethodPost && targetID == "":
+			var req struct {
+				Username string `json:"username"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			target := authStore.getUserByUsername(req.Username)
+			if target == nil || target.UserID == user.UserID || !canSeeProfile(authStore, msgStore, user, target) {
+				writeJSONMessage(w, http.StatusNotFound, localize(requestLocale(r), "error.user_not_found"))
+				return
+			}
+			add(user, target)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(authStore.profile(target))
+
+		case r.Method == http.MethodDelete && targetID != "":
+			remove(user, targetID)
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func handleContacts(authStore *AuthStore, msgStore *MessagingStore) http.HandlerFunc {
+	return userListHandler(authStore, msgStore, "/api/contacts",
+		func(user *User) []string {
+			ids := make([]string, 0, len(user.Contacts))
+			for id := range user.Contacts {
+				ids = append(ids, id)
+			}
+			return ids
+		},
+		authStore.addContact,
+		authStore.removeContact,
+	)
+}
+
+func handlePriorityContacts(authStore *AuthStore, msgStore *MessagingStore) http.HandlerFunc {
+	return userListHandler(authStore, msgStore, "/api/priority-contacts",
+		func(user *User) []string {
+			ids := make([]string, 0, len(user.PriorityContacts))
+			for id := range user.PriorityContacts {
+				ids = append(ids, id)
+			}
+			return ids
+		},
+		authStore.addPriorityContact,
+		authStore.removePriorityContact,
+	)
+}
+
+func handleBlocks(authStore *AuthStore, msgStore *MessagingStore) http.HandlerFunc {
+	return userListHandler(authStore, msgStore, "/api/blocks",
+		func(user *User) []string {
+			ids := make([]string, 0, len(user.Blocked))
+			for id := range user.Blocked {
+				ids = append(ids, id)
+			}
+			return ids
+		},
+		func(user, target *User) {
+			authStore.block(user, target)
+			audit("user_blocked", "user_id", user.UserID, "target_id", target.UserID)
+		},
+		authStore.unblock,
+	)
+}
+
+func handlePrivacy(authStore *AuthStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := authStore.getUserByToken(extractToken(r))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPatch:
+			var req struct {
+				Searchable   *string `json:"searchable"`
+				MessagesFrom *string `json:"messagesFrom"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if req.Searchable != nil {
+				switch *req.Searchable {
+				case audienceEveryone, audienceContacts, audienceNobody:
+				default:
+					writeJSONMessage(w, http.StatusBadRequest, "searchable must be everyone, contacts or nobody")
+					return
+				}
+			}
+			if req.MessagesFrom != nil {
+				switch *req.MessagesFrom {
+				case audienceEveryone, audienceContacts:
+				default:
+					writeJSONMessage(w, http.StatusBadRequest, "messagesFrom must be everyone or contacts")
+					return
+				}
+			}
+			authStore.mu.Lock()
+			if req.Searchable != nil {
+				user.Privacy.Searchable = *req.Searchable
+			}
+			if req.MessagesFrom != nil {
+				user.Privacy.MessagesFrom = *req.MessagesFrom
+			}
+			authStore.mu.Unlock()
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		authStore.mu.RLock()
+		settings := user.Privacy
+		authStore.mu.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(settings)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func callUserHandler(h http.HandlerFunc, method, url, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
+
+func TestHiddenUsersLookLikeMissingOnes(t *testing.T) {
+	cfg := newTestConfig()
+	authStore := newAuthStore(cfg)
+	msgStore := newMessagingStore(nil)
+	_, token := newTestUser(t, authStore, "alice", "correct horse battery")
+	hidden, _ := newTestUser(t, authStore, "bob", "correct horse battery")
+	hidden.Privacy.Searchable = audienceNobody
+
+	missing := callUserHandler(handleContacts(authStore, msgStore), http.MethodPost, "/api/contacts", token, `{"username":"nobody-here"}`)
+	for _, tt := range []struct {
+		name string
+		h    http.HandlerFunc
+		url  string
+	}{
+		{"contacts", handleContacts(authStore, msgStore), "/api/contacts"},
+		{"priority contacts", handlePriorityContacts(authStore, msgStore), "/api/priority-contacts"},
+		{"blocks", handleBlocks(authStore, msgStore), "/api/blocks"},
+		{"create chat", handleCreateChat(authStore, msgStore), "/api/chats"},
+	} {
+		rec := callUserHandler(tt.h, http.MethodPost, tt.url, token, `{"username":"bob"}`)
+		if rec.Code != missing.Code || rec.Body.String() != missing.Body.String() {
+			t.Errorf("%s: hidden user got %d %q, missing user %d %q", tt.name, rec.Code, rec.Body, missing.Code, missing.Body)
+		}
+	}
+}
+
+func TestHiddenUserVisibleToAcquaintances(t *testing.T) {
+	cfg := newTestConfig()
+	authStore := newAuthStore(cfg)
+	msgStore := newMessagingStore(nil)
+	alice, token := newTestUser(t, authStore, "alice", "correct horse battery")
+	hidden, _ := newTestUser(t, authStore, "bob", "correct horse battery")
+	hidden.Privacy.Searchable = audienceNobody
+
+	// Someone who already has a chat with the user may still block them.
+	msgStore.getOrCreateChat(hidden.UserID, alice.UserID, "bob", "alice")
+	rec := callUserHandler(handleBlocks(authStore, msgStore), http.MethodPost, "/api/blocks", token, `{"username":"bob"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("block chat partner: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestAvatarVisibility(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.DataDir = t.TempDir()
+	authStore := newAuthStore(cfg)
+	msgStore := newMessagingStore(nil)
+	alice, aliceToken := newTestUser(t, authStore, "alice", "correct horse battery")
+	_, carolToken := newTestUser(t, authStore, "carol", "correct horse battery")
+	bob, bobToken := newTestUser(t, authStore, "bob", "correct horse battery")
+
+	if err := os.MkdirAll(avatarDir(cfg), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(avatarDir(cfg), bob.UserID+".png"), []byte("png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bob.AvatarFile = bob.UserID + ".png"
+	msgStore.getOrCreateChat(alice.UserID, bob.UserID, "alice", "bob")
+
+	h := handleAvatar(authStore, msgStore)
+	url := "/api/avatars/" + bob.UserID
+	tests := []struct {
+		searchable string
+		token      string
+		want       int
+	}{
+		{audienceEveryone, "", http.StatusOK},
+		{audienceContacts, "", http.StatusNotFound},
+		{audienceNobody, "", http.StatusNotFound},
+		{audienceNobody, "not-a-session", http.StatusNotFound},
+		{audienceNobody, carolToken, http.StatusNotFound},
+		{audienceNobody, aliceToken, http.StatusOK}, // shares a chat
+		{audienceNobody, bobToken, http.StatusOK},
+	}
+	for _, tt := range tests {
+		bob.Privacy.Searchable = tt.searchable
+		if rec := callUserHandler(h, http.MethodGet, url, tt.token, ""); rec.Code != tt.want {
+			t.Errorf("searchable %s, token %q: %d, want %d", tt.searchable, tt.token, rec.Code, tt.want)
+		}
+	}
+}
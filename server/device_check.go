@@ -7,11 +7,11 @@ import (
 
 const deviceCheckHTML = `
 <!DOCTYPE html>
-<html lang="en">
+<html lang="{{.Lang}}">
 <head>
     <meta charset="UTF-8">
     <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>Serenada - Device Diagnostics</title>
+    <title>{{t "devicecheck.title"}}</title>
     <style>
         :root {
             --bg-color: #0f172a;
@@ -123,18 +123,18 @@ const deviceCheckHTML = `
 <body>
     <div class="container">
         <header>
-            <h1>Device Diagnostics</h1>
-            <p class="subtitle">Troubleshooting tool for Serenada</p>
+            <h1>{{t "devicecheck.heading"}}</h1>
+            <p class="subtitle">{{t "devicecheck.subtitle"}}</p>
         </header>
 
         <div class="actions">
-            <a href="/" class="btn btn-secondary" style="text-decoration: none; display: flex; align-items: center; justify-content: center;">Back to Home</a>
-            <button class="btn" id="copy-btn" onclick="copyDiagnostics()">Copy Diagnostic Data</button>
-            <button class="btn btn-secondary" onclick="window.location.reload()">Refresh</button>
+            <a href="/" class="btn btn-secondary" style="text-decoration: none; display: flex; align-items: center; justify-content: center;">{{t "devicecheck.back"}}</a>
+            <button class="btn" id="copy-btn" onclick="copyDiagnostics()">{{t "devicecheck.copy"}}</button>
+            <button class="btn btn-secondary" onclick="window.location.reload()">{{t "devicecheck.refresh"}}</button>
         </div>
 
         <div class="card">
-            <div class="card-title">Browser Information</div>
+            <div class="card-title">{{t "devicecheck.browser"}}</div>
             <div class="item">
                 <span class="label">Date/Time</span>
                 <span class="value" id="datetime">-</span>
@@ -162,7 +162,7 @@ const deviceCheckHTML = `
         </div>
 
         <div class="card">
-            <div class="card-title">WebRTC Capabilities</div>
+            <div class="card-title">{{t "devicecheck.webrtc"}}</div>
             <div class="item">
                 <span class="label">RTCPeerConnection</span>
                 <span id="webrtc-support">-</span>
@@ -178,7 +178,7 @@ const deviceCheckHTML = `
         </div>
 
         <div class="card">
-            <div class="card-title">Audio Processing Capabilities</div>
+            <div class="card-title">{{t "devicecheck.audio"}}</div>
             <div id="audio-constraints"></div>
             <div class="item">
                 <span class="label">Track Capabilities</span>
@@ -189,8 +189,8 @@ const deviceCheckHTML = `
 
         <div class="card">
             <div class="card-title">
-                Media Devices
-                <button class="btn" onclick="requestMediaPermissions()" style="margin: 0; padding: 0.25rem 0.5rem; font-size: 0.75rem;">Test Permissions</button>
+                {{t "devicecheck.media"}}
+                <button class="btn" onclick="requestMediaPermissions()" style="margin: 0; padding: 0.25rem 0.5rem; font-size: 0.75rem;">{{t "devicecheck.test_permissions"}}</button>
             </div>
             <div id="media-status-container" class="item">
                 <span class="label">Permission Status</span>
@@ -200,7 +200,7 @@ const deviceCheckHTML = `
         </div>
 
         <div class="card">
-            <div class="card-title">Network Connectivity</div>
+            <div class="card-title">{{t "devicecheck.network"}}</div>
             <div class="item">
                 <span class="label">Server Connection (REST)</span>
                 <span id="api-status">-</span>
@@ -224,10 +224,10 @@ const deviceCheckHTML = `
         </div>
 
             <div class="card-title">
-                ICE Connectivity (STUN/TURN)
+                {{t "devicecheck.ice"}}
                 <div style="display: flex; gap: 0.5rem;">
-                    <button class="btn" id="ice-test-btn" onclick="runIceTest()" style="margin: 0; padding: 0.25rem 0.5rem; font-size: 0.75rem;">Run Full Test</button>
-                    <button class="btn btn-secondary" id="ice-test-turns-btn" onclick="runIceTest(true)" style="margin: 0; padding: 0.25rem 0.5rem; font-size: 0.75rem; background-color: #6366f1;">Run TURNS Only</button>
+                    <button class="btn" id="ice-test-btn" onclick="runIceTest()" style="margin: 0; padding: 0.25rem 0.5rem; font-size: 0.75rem;">{{t "devicecheck.ice_full"}}</button>
+                    <button class="btn btn-secondary" id="ice-test-turns-btn" onclick="runIceTest(true)" style="margin: 0; padding: 0.25rem 0.5rem; font-size: 0.75rem; background-color: #6366f1;">{{t "devicecheck.ice_turns"}}</button>
                 </div>
             </div>
             <div class="item">
@@ -891,20 +891,27 @@ const deviceCheckHTML = `
 </html>
 `
 
-func handleDeviceCheck(w http.ResponseWriter, r *http.Request) {
-	tmpl, err := template.New("deviceCheck").Parse(deviceCheckHTML)
-	if err != nil {
-		http.Error(w, "Error loading template", http.StatusInternalServerError)
-		return
+func handleDeviceCheck(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		locale := requestLocale(r)
+		tmpl, err := template.New("deviceCheck").Funcs(template.FuncMap{
+			"t": func(key string) string { return localize(locale, key) },
+		}).Parse(deviceCheckHTML)
+		if err != nil {
+			http.Error(w, "Error loading template", http.StatusInternalServerError)
+			return
+		}
+		clientIP := getClientIP(cfg, r)
+		if clientIP == "" {
+			clientIP = "Unknown"
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		tmpl.Execute(w, struct {
+			Lang     string
+			ClientIP string
+		}{
+			Lang:     locales.match(locale).String(),
+			ClientIP: clientIP,
+		})
 	}
-	clientIP := getClientIP(r)
-	if clientIP == "" {
-		clientIP = "Unknown"
-	}
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	tmpl.Execute(w, struct {
-		ClientIP string
-	}{
-		ClientIP: clientIP,
-	})
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// Build metadata, overridable at link time:
+//
+//	go build -ldflags "-X main.buildVersion=1.2.3 -X main.buildCommit=abc123 -X main.buildTime=2024-01-01T00:00:00Z"
+var (
+	buildVersion = "dev"
+	buildCommit  = ""
+	buildTime    = ""
+)
+
+const (
+	healthCheckTimeout = 2 * time.Second
+	hubLivenessWindow  = 3 * sseReaperInterval
+)
+
+var serverStartedAt = time.Now()
+
+type healthCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+func (h *Hub) markAlive() {
+	atomic.StoreInt64(&h.lastTick, time.Now().UnixNano())
+}
+
+func (h *Hub) checkAlive() error {
+	last := atomic.LoadInt64(&h.lastTick)
+	if last == 0 {
+		return errors.New("hub loop not started")
+	}
+	if time.Since(time.Unix(0, last)) > hubLivenessWindow {
+		return errors.New("hub loop stalled")
+	}
+	return nil
+}
+
+// probe sends a probe through the run loop and waits for the answer.
+func (h *Hub) probe(ctx context.Context) error {
+	reply := make(chan struct{})
+	select {
+	case h.probes <- reply:
+	case <-ctx.Done():
+		return errors.New("hub loop not responding")
+	}
+	select {
+	case <-reply:
+		return nil
+	case <-ctx.Done():
+		return errors.New("hub lock not acquired")
+	}
+}
+
+func checkTurnConfig(cfg *Config) error {
+	if _, err := cfg.turnTokenSecret(); err != nil {
+		return err
+	}
+	if cfg.TurnSecret == "" {
+		return errors.New("TURN_SECRET not configured")
+	}
+	if cfg.StunHost == "" && cfg.TurnHost == "" {
+		return errors.New("STUN_HOST/TURN_HOST not configured")
+	}
+	return nil
+}
+
+func checkPushDatabase(ctx context.Context, push *PushService) error {
+	if push == nil || push.db == nil {
+		return errors.New("push service not initialized")
+	}
+	return push.db.PingContext(ctx)
+}
+
+func checkSnapshotStore(ctx context.Context, push *PushService) error {
+	if push == nil || push.snapshots == nil {
+		return errors.New("snapshot store not initialized")
+	}
+	return push.snapshots.backend.Check(ctx)
+}
+
+func runHealthChecks(checks map[string]func() error) (healthReport, bool) {
+	report := healthReport{Status: "ok", Checks: make(map[string]healthCheck, len(checks))}
+	healthy := true
+	for name, check := range checks {
+		if err := check(); err != nil {
+			report.Checks[name] = healthCheck{OK: false, Error: err.Error()}
+			healthy = false
+			continue
+		}
+		report.Checks[name] = healthCheck{OK: true}
+	}
+	if !healthy {
+		report.Status = "fail"
+	}
+	return report, healthy
+}
+
+func writeHealthReport(w http.ResponseWriter, report healthReport, healthy bool) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleHealthz reports liveness: the process is serving and the hub loop is running.
+func handleHealthz(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		report, healthy := runHealthChecks(map[string]func() error{
+			"hub": hub.checkAlive,
+		})
+		writeHealthReport(w, report, healthy)
+	}
+}
+
+// handleReadyz reports readiness: configuration and dependencies are usable.
+// ROOM_ID_SECRET is not probed, since the server refuses to start without it.
+func handleReadyz(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+		defer cancel()
+
+		report, healthy := runHealthChecks(map[string]func() error{
+			"hub":       func() error { return hub.probe(ctx) },
+			"turn":      func() error { return checkTurnConfig(hub.cfg) },
+			"push_db":   func() error { return checkPushDatabase(ctx, hub.push) },
+			"snapshots": func() error { return checkSnapshotStore(ctx, hub.push) },
+		})
+		writeHealthReport(w, report, healthy)
+	}
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	commit := buildCommit
+	builtAt := buildTime
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if commit == "" {
+					commit = setting.Value
+				}
+			case "vcs.time":
+				if builtAt == "" {
+					builtAt = setting.Value
+				}
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"version":   buildVersion,
+		"commit":    commit,
+		"buildTime": builtAt,
+		"goVersion": runtime.Version(),
+		"uptime":    int64(time.Since(serverStartedAt).Seconds()),
+	})
+}
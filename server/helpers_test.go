@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testOrigin = "https://serenada.test"
+
+func newTestConfig() *Config {
+	cfg := defaultConfig()
+	cfg.AllowedOrigins = []string{testOrigin}
+	cfg.BcryptCost = bcrypt.MinCost
+	cfg.applyReloadable(cfg)
+	return cfg
+}
+
+func newTestUser(t *testing.T, authStore *AuthStore, username, password string) (*User, string) {
+	t.Helper()
+	user, err := authStore.createUser(username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := authStore.createToken(user.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, token
+}
+
+// newTestPushService returns a push service backed by a fresh database in a
+// temporary data directory. Its queue and janitor are not started.
+func newTestPushService(t *testing.T, cfg *Config, authStore *AuthStore) *PushService {
+	t.Helper()
+	cfg.DataDir = t.TempDir()
+	s, err := newPushService(cfg, authStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.db.Close() })
+	return s
+}
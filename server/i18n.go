@@ -0,0 +1,211 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+
+	"golang.org/x/text/feature/plural"
+	"golang.org/x/text/language"
+)
+
+// Server-sent strings live in locales/<BCP 47 tag>.json. A value is either a
+// string or an object of CLDR plural forms ("zero", "one", "two", "few",
+// "many", "other"). Keys missing from a locale fall back to its parent
+// (de-AT -> de) and finally to English.
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+var defaultLocale = language.English
+
+type catalogEntry map[plural.Form]string
+
+func (e *catalogEntry) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*e = catalogEntry{plural.Other: s}
+		return nil
+	}
+	var forms map[string]string
+	if err := json.Unmarshal(data, &forms); err != nil {
+		return err
+	}
+	entry := catalogEntry{}
+	for name, text := range forms {
+		form, ok := pluralForms[name]
+		if !ok {
+			return fmt.Errorf("unknown plural form %q", name)
+		}
+		entry[form] = text
+	}
+	if _, ok := entry[plural.Other]; !ok {
+		return fmt.Errorf("plural entry without \"other\"")
+	}
+	*e = entry
+	return nil
+}
+
+var pluralForms = map[string]plural.Form{
+	"zero":  plural.Zero,
+	"one":   plural.One,
+	"two":   plural.Two,
+	"few":   plural.Few,
+	"many":  plural.Many,
+	"other": plural.Other,
+}
+
+type catalog struct {
+	tags     []language.Tag
+	matcher  language.Matcher
+	messages map[language.Tag]map[string]catalogEntry
+}
+
+var locales = mustLoadCatalog()
+
+func mustLoadCatalog() *catalog {
+	c, err := loadCatalog()
+	if err != nil {
+		panic("locales: " + err.Error())
+	}
+	return c
+}
+
+func loadCatalog() (*catalog, error) {
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		return nil, err
+	}
+	c := &catalog{
+		// The default goes first so it wins when nothing matches.
+		tags:     []language.Tag{defaultLocale},
+		messages: make(map[language.Tag]map[string]catalogEntry),
+	}
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name(), ".json")
+		tag, err := language.Parse(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+		raw, err := localeFiles.ReadFile(path.Join("locales", f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var messages map[string]catalogEntry
+		if err := json.Unmarshal(raw, &messages); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+		c.messages[tag] = messages
+		if tag != defaultLocale {
+			c.tags = append(c.tags, tag)
+		}
+	}
+	if _, ok := c.messages[defaultLocale]; !ok {
+		return nil, fmt.Errorf("missing %s catalogue", defaultLocale)
+	}
+	c.matcher = language.NewMatcher(c.tags)
+	return c, nil
+}
+
+// match picks the best supported locale for a BCP 47 tag or an
+// Accept-Language header value.
+func (c *catalog) match(locale string) language.Tag {
+	desired, _, err := language.ParseAcceptLanguage(locale)
+	if err != nil || len(desired) == 0 {
+		return defaultLocale
+	}
+	_, index, confidence := c.matcher.Match(desired...)
+	if confidence == language.No {
+		return defaultLocale
+	}
+	return c.tags[index]
+}
+
+func (c *catalog) lookup(tag language.Tag, key string) (catalogEntry, language.Tag) {
+	for t := tag; ; t = t.Parent() {
+		if entry, ok := c.messages[t][key]; ok {
+			return entry, t
+		}
+		if t == language.Und {
+			break
+		}
+	}
+	if entry, ok := c.messages[defaultLocale][key]; ok {
+		return entry, defaultLocale
+	}
+	slog.Warn("missing locale key", "key", key)
+	return catalogEntry{plural.Other: key}, defaultLocale
+}
+
+// localize returns the message for key in the best match for locale,
+// formatted with args.
+func localize(locale, key string, args ...interface{}) string {
+	entry, _ := locales.lookup(locales.match(locale), key)
+	return format(entry[plural.Other], args)
+}
+
+// localizePlural selects the plural form for n using the rules of the
+// locale the message was found in.
+func localizePlural(locale, key string, n int, args ...interface{}) string {
+	entry, tag := locales.lookup(locales.match(locale), key)
+	text, ok := entry[plural.Cardinal.MatchPlural(tag, n, 0, 0, 0, 0)]
+	if !ok {
+		text = entry[plural.Other]
+	}
+	return format(text, args)
+}
+
+// localizedError is an error whose message comes from the catalogue. Error
+// returns the English text; handlers answer with localizeError instead.
+type localizedError struct {
+	key    string
+	n      int
+	plural bool
+	args   []interface{}
+}
+
+func newLocalizedError(key string, args ...interface{}) error {
+	return &localizedError{key: key, args: args}
+}
+
+func newLocalizedPluralError(key string, n int, args ...interface{}) error {
+	return &localizedError{key: key, n: n, plural: true, args: args}
+}
+
+func (e *localizedError) Error() string {
+	return e.localize(defaultLocale.String())
+}
+
+func (e *localizedError) localize(locale string) string {
+	if e.plural {
+		return localizePlural(locale, e.key, e.n, e.args...)
+	}
+	return localize(locale, e.key, e.args...)
+}
+
+// localizeError returns the message of err in locale, falling back to
+// err.Error() for errors that are not in the catalogue.
+func localizeError(locale string, err error) string {
+	var le *localizedError
+	if errors.As(err, &le) {
+		return le.localize(locale)
+	}
+	return err.Error()
+}
+
+func format(text string, args []interface{}) string {
+	if len(args) == 0 {
+		return text
+	}
+	return fmt.Sprintf(text, args...)
+}
+
+// requestLocale is the locale for responses to r.
+func requestLocale(r *http.Request) string {
+	return r.Header.Get("Accept-Language")
+}
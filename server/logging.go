@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// redactLogs controls whether secrets and personal data are masked in logs.
+var redactLogs = true
+
+func parseLogLevel(raw string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown level %q", raw)
+}
+
+// initLogger configures the default slog logger. The level follows
+// cfg.logLevel, so it can be changed by a config reload.
+func initLogger(cfg *Config) {
+	redactLogs = cfg.LogRedact
+
+	opts := &slog.HandlerOptions{Level: &cfg.logLevel}
+	var handler slog.Handler
+	if cfg.LogFormat == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+	// Route anything still using the standard logger (e.g. net/http) through slog.
+	log.SetOutput(slog.NewLogLogger(handler, slog.LevelInfo).Writer())
+	log.SetFlags(0)
+}
+
+// redactRoomID returns a stable short hash of a room ID. Room IDs are bearer
+// secrets, so they must never appear verbatim in logs.
+func redactRoomID(rid string) string {
+	if rid == "" {
+		return ""
+	}
+	if !redactLogs {
+		return rid
+	}
+	return roomHash(rid)
+}
+
+// roomHash is a stable, non-reversible identifier for a room, used wherever a
+// room must be referenced without revealing its ID (logs, admin API).
+func roomHash(rid string) string {
+	sum := sha256.Sum256([]byte(rid))
+	return "r:" + hex.EncodeToString(sum[:6])
+}
+
+// redactSnapshotID replaces a snapshot ID with a stable hash, since the ID
+// alone is enough to download the snapshot.
+func redactSnapshotID(id string) string {
+	if id == "" || !redactLogs {
+		return id
+	}
+	sum := sha256.Sum256([]byte(id))
+	return "s:" + hex.EncodeToString(sum[:6])
+}
+
+// redactEndpoint truncates a push endpoint to its host plus a short path prefix.
+func redactEndpoint(endpoint string) string {
+	if endpoint == "" || !redactLogs {
+		return endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return truncate(endpoint, 12)
+	}
+	return u.Host + truncate(u.Path, 12)
+}
+
+// redactIP masks the host part of an IP address (/24 for IPv4, /48 for IPv6).
+func redactIP(ip string) string {
+	if ip == "" || !redactLogs {
+		return ip
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "invalid"
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "…"
+}
+
+// audit records a security-relevant event. Audit events are always logged at
+// info level with audit=true so they can be filtered and retained separately.
+func audit(event string, args ...any) {
+	slog.Info("audit", append([]any{"audit", true, "event", event}, args...)...)
+}
+
+// logger returns a logger carrying the client's correlation IDs.
+func (c *Client) logger() *slog.Logger {
+	return slog.With(
+		"sid", c.sid,
+		"cid", c.cid,
+		"rid", redactRoomID(c.rid),
+		"transport", string(c.transport),
+	)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	loginFreeAttempts     = 3                // failures before backoff starts
+	loginBackoffBase      = 1 * time.Second  // first backoff delay, doubled per failure
+	loginBackoffMax       = 5 * time.Minute  // backoff cap
+	loginAccountLockAfter = 10               // failures per account before lockout
+	loginIPLockAfter      = 50               // failures per IP before lockout
+	loginLockoutDuration  = 15 * time.Minute // lockout length
+	loginFailureWindow    = time.Hour        // failures older than this are forgotten
+	loginGuardSweepEvery  = time.Minute
+	loginGuardMaxRecords  = 100000
+)
+
+type loginFailures struct {
+	count        int
+	lastFailure  time.Time
+	blockedUntil time.Time // backoff or lockout end
+	locked       bool      // blockedUntil is a lockout rather than a backoff
+}
+
+// loginGuard tracks failed logins per account and per IP. Accounts are keyed
+// by the submitted username whether or not it exists, so the guard behaves
+// identically for unknown users.
+type loginGuard struct {
+	mu        sync.Mutex
+	accounts  map[string]*loginFailures
+	ips       map[string]*loginFailures
+	lastSweep time.Time
+}
+
+func newLoginGuard() *loginGuard {
+	return &loginGuard{
+		accounts:  make(map[string]*loginFailures),
+		ips:       make(map[string]*loginFailures),
+		lastSweep: time.Now(),
+	}
+}
+
+func loginGuardIPKey(ip string) string {
+	return limiterKey(ip, net.ParseIP(ip))
+}
+
+// check returns how long the caller must wait before another attempt is
+// accepted for this username and IP, or 0 if an attempt is allowed now.
+func (g *loginGuard) check(username, ip string) time.Duration {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var wait time.Duration
+	for _, rec := range []*loginFailures{g.accounts[username], g.ips[loginGuardIPKey(ip)]} {
+		if rec != nil && rec.blockedUntil.After(now) {
+			if d := rec.blockedUntil.Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait
+}
+
+// recordFailure registers a failed attempt and returns which of the account
+// and IP became locked out as a result.
+func (g *loginGuard) recordFailure(username, ip string) (accountLocked, ipLocked bool) {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if now.Sub(g.lastSweep) >= loginGuardSweepEvery || len(g.accounts)+len(g.ips) > loginGuardMaxRecords {
+		g.sweep(now)
+	}
+
+	accountLocked = g.fail(g.accounts, username, loginAccountLockAfter, now)
+	ipLocked = g.fail(g.ips, loginGuardIPKey(ip), loginIPLockAfter, now)
+	return accountLocked, ipLocked
+}
+
+func (g *loginGuard) fail(records map[string]*loginFailures, key string, lockAfter int, now time.Time) bool {
+	rec := records[key]
+	if rec == nil || now.Sub(rec.lastFailure) > loginFailureWindow {
+		rec = &loginFailures{}
+		records[key] = rec
+	}
+	rec.count++
+	rec.lastFailure = now
+
+	if rec.count >= lockAfter {
+		wasLocked := rec.locked && rec.blockedUntil.After(now)
+		rec.locked = true
+		rec.blockedUntil = now.Add(loginLockoutDuration)
+		return !wasLocked
+	}
+	if rec.count > loginFreeAttempts {
+		delay := loginBackoffBase << (rec.count - loginFreeAttempts - 1)
+		if delay > loginBackoffMax || delay <= 0 {
+			delay = loginBackoffMax
+		}
+		rec.blockedUntil = now.Add(delay)
+	}
+	return false
+}
+
+// recordSuccess clears the account's failures. IP failures are kept so that
+// an attacker cannot reset them by logging into their own account.
+func (g *loginGuard) recordSuccess(username string) {
+	g.mu.Lock()
+	delete(g.accounts, username)
+	g.mu.Unlock()
+}
+
+// sweep forgets records that are neither blocked nor recent. Caller must hold g.mu.
+func (g *loginGuard) sweep(now time.Time) {
+	g.lastSweep = now
+	for _, records := range []map[string]*loginFailures{g.accounts, g.ips} {
+		for key, rec := range records {
+			if rec.blockedUntil.Before(now) && now.Sub(rec.lastFailure) > loginFailureWindow {
+				delete(records, key)
+			}
+		}
+	}
+}
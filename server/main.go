@@ -1,28 +1,51 @@
 package main
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
 func main() {
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+	initLogger(cfg)
+	cfg.watchReload()
+
 	// Initialize stores
-	authStore := newAuthStore()
-	msgStore := newMessagingStore()
+	authStore := newAuthStore(cfg)
+
+	pushService, err := newPushService(cfg, authStore)
+	if err != nil {
+		slog.Error("failed to initialize push service", "err", err)
+		os.Exit(1)
+	}
+	go pushService.RunQueue()
+	go pushService.RunSnapshotJanitor()
+
+	msgStore := newMessagingStore(pushService)
+	hub := newHub(cfg, pushService)
+	go hub.run()
 
 	// Simple CORS middleware
 	enableCors := func(h http.HandlerFunc) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
-			origin := r.Header.Get("Origin")
-			if origin != "" {
-				w.Header().Set("Access-Control-Allow-Origin", origin)
+			if origin := r.Header.Get("Origin"); origin != "" {
 				w.Header().Set("Vary", "Origin")
+				if isOriginAllowed(cfg, r) {
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+				}
 			}
 			if r.Method == "OPTIONS" {
-				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Push-Auth, X-Room-Token")
 				w.WriteHeader(http.StatusNoContent)
 				return
 			}
@@ -30,11 +53,56 @@ func main() {
 		}
 	}
 
+	// Signaling
+	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	})
+	http.HandleFunc("/sse", handleSSE(hub))
+	http.HandleFunc("/api/turn-credentials", enableCors(handleTurnCredentials(cfg)))
+	http.HandleFunc("/api/diagnostic-token", enableCors(handleDiagnosticToken(cfg)))
+	http.HandleFunc("/device-check", handleDeviceCheck(cfg))
+
+	// Health and build info
+	http.HandleFunc("/healthz", handleHealthz(hub))
+	http.HandleFunc("/readyz", handleReadyz(hub))
+	http.HandleFunc("/version", handleVersion)
+
+	// Admin API (disabled unless ADMIN_TOKEN is set)
+	http.HandleFunc("/api/admin/", handleAdmin(hub, authStore))
+
 	// Auth endpoints
-	http.HandleFunc("/api/auth/register", enableCors(handleRegister(authStore)))
-	http.HandleFunc("/api/auth/login", enableCors(handleLogin(authStore)))
+	http.HandleFunc("/api/auth/register", enableCors(handleRegister(cfg, authStore)))
+	http.HandleFunc("/api/auth/login", enableCors(handleLogin(cfg, authStore)))
+	http.HandleFunc("/api/auth/login/2fa", enableCors(handleLoginTOTP(cfg, authStore)))
+	http.HandleFunc("/api/auth/2fa/setup", enableCors(handleTOTPSetup(authStore)))
+	http.HandleFunc("/api/auth/2fa/confirm", enableCors(handleTOTPConfirm(cfg, authStore)))
+	http.HandleFunc("/api/auth/2fa/disable", enableCors(handleTOTPDisable(cfg, authStore)))
+	http.HandleFunc("/api/auth/passkeys/register/begin", enableCors(handlePasskeyRegisterBegin(cfg, authStore)))
+	http.HandleFunc("/api/auth/passkeys/register/finish", enableCors(handlePasskeyRegisterFinish(cfg, authStore)))
+	http.HandleFunc("/api/auth/passkeys/login/begin", enableCors(handlePasskeyLoginBegin(cfg, authStore)))
+	http.HandleFunc("/api/auth/passkeys/login/finish", enableCors(handlePasskeyLoginFinish(cfg, authStore)))
+	http.HandleFunc("/api/auth/account", enableCors(handleDeleteAccount(cfg, authStore, msgStore, pushService)))
+	http.HandleFunc("/api/auth/export", enableCors(handleAccountExport(authStore, msgStore)))
+	http.HandleFunc("/api/auth/password", enableCors(handleChangePassword(cfg, authStore)))
+	http.HandleFunc("/api/auth/password-reset/request", enableCors(handleRequestPasswordReset(cfg, authStore, logMailer{})))
+	http.HandleFunc("/api/auth/password-reset/confirm", enableCors(handleConfirmPasswordReset(cfg, authStore)))
+	http.HandleFunc("/api/auth/caller-token", enableCors(handleCallerToken(cfg, authStore)))
 	http.HandleFunc("/api/users/search", enableCors(handleSearchUsers(authStore)))
 
+	// Contacts, blocking and privacy
+	http.HandleFunc("/api/contacts", enableCors(handleContacts(authStore, msgStore)))
+	http.HandleFunc("/api/contacts/", enableCors(handleContacts(authStore, msgStore)))
+	http.HandleFunc("/api/priority-contacts", enableCors(handlePriorityContacts(authStore, msgStore)))
+	http.HandleFunc("/api/priority-contacts/", enableCors(handlePriorityContacts(authStore, msgStore)))
+	http.HandleFunc("/api/blocks", enableCors(handleBlocks(authStore, msgStore)))
+	http.HandleFunc("/api/blocks/", enableCors(handleBlocks(authStore, msgStore)))
+	http.HandleFunc("/api/privacy", enableCors(handlePrivacy(authStore)))
+
+	// Profiles
+	http.HandleFunc("/api/profile", enableCors(handleProfile(authStore, msgStore)))
+	http.HandleFunc("/api/profile/avatar", enableCors(handleProfileAvatar(authStore, msgStore)))
+	http.HandleFunc("/api/avatars/", enableCors(handleAvatar(authStore, msgStore)))
+
 	// Messaging endpoints
 	http.HandleFunc("/api/chats", enableCors(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
@@ -58,16 +126,18 @@ func main() {
 			}
 		} else if r.URL.Path[len(r.URL.Path)-5:] == "/read" {
 			handleMarkAsRead(authStore, msgStore)(w, r)
+		} else if strings.HasSuffix(r.URL.Path, "/mute") {
+			handleMuteChat(authStore, msgStore)(w, r)
 		} else {
 			http.Error(w, "Not found", http.StatusNotFound)
 		}
 	}))
 
 	// WebSocket for messaging
-	http.HandleFunc("/ws-msg", handleMessagingWebSocket(authStore, msgStore))
+	http.HandleFunc("/ws-msg", handleMessagingWebSocket(cfg, authStore, msgStore))
 
 	// Room ID endpoint for quick calls
-    http.HandleFunc("/api/room-id", enableCors(handleRoomID()))
+	http.HandleFunc("/api/room-id", enableCors(handleRoomID(cfg)))
 
 	http.HandleFunc("/.well-known/assetlinks.json", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -85,30 +155,36 @@ func main() {
 ]`))
 	})
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// Push endpoints, rate-limited per IP
+	pushLimiter := newConfiguredIPLimiter(cfg, pushRateLimit, pushRateBurst)
+	pushRoute := func(h http.HandlerFunc) http.HandlerFunc {
+		return enableCors(rateLimitMiddleware(cfg, pushLimiter, h))
 	}
+	http.HandleFunc("/api/push/vapid-public-key", pushRoute(handlePushVapidKey(pushService)))
+	http.HandleFunc("/api/push/subscribe", pushRoute(handlePushSubscribe(cfg, pushService, authStore)))
+	http.HandleFunc("/api/push/user-subscribe", pushRoute(handlePushUserSubscribe(pushService, authStore)))
+	http.HandleFunc("/api/push/subscriptions", pushRoute(handlePushSubscriptions(cfg, pushService)))
+	http.HandleFunc("/api/push/quiet-hours", pushRoute(handlePushQuietHours(pushService, authStore)))
+	http.HandleFunc("/api/push/mute", pushRoute(handlePushMute(cfg, pushService)))
+	http.HandleFunc("/api/push/recipients", pushRoute(handlePushRecipients(cfg, pushService)))
+	http.HandleFunc("/api/push/snapshot", pushRoute(handlePushSnapshot(cfg, pushService)))
+	http.Handle("/api/push/snapshot/", pushRoute(http.StripPrefix("/api/push/snapshot", handlePushSnapshot(cfg, pushService)).ServeHTTP))
 
-    log.Printf("Server starting on :%s", port)
-
-    if err := InitPushService(); err != nil {
-        log.Fatalf("Failed to initialize push service: %v", err)
-    }
-
-    // Push endpoints
-    http.HandleFunc("/api/push/vapid-public-key", enableCors(handlePushVapidKey))
-    http.HandleFunc("/api/push/subscribe", enableCors(handlePushSubscribe))
-    http.HandleFunc("/api/push/recipients", enableCors(handlePushRecipients))
-    http.Handle("/api/push/snapshot/", enableCors(http.StripPrefix("/api/push/snapshot", http.HandlerFunc(handlePushSnapshot))))
+	slog.Info("server starting", "port", cfg.Port)
 	server := &http.Server{
-		Addr:              ":" + port,
+		Addr:              ":" + cfg.Port,
 		ReadHeaderTimeout: 5 * time.Second,
 		ReadTimeout:       15 * time.Second,
 		WriteTimeout:      0,
 		IdleTimeout:       60 * time.Second,
 	}
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatal("ListenAndServe: ", err)
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		slog.Error("failed to listen", "addr", server.Addr, "err", err)
+		os.Exit(1)
+	}
+	if err := server.Serve(newProxyProtoListener(listener, cfg)); err != nil {
+		slog.Error("server stopped", "err", err)
+		os.Exit(1)
 	}
 }
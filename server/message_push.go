@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+const messagePreviewMaxRune = 120
+
+// User subscriptions follow the signed-in user across chats, unlike the
+// per-room subscriptions used for calls.
+func createUserSubscriptionsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS user_subscriptions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id TEXT NOT NULL,
+		endpoint TEXT NOT NULL,
+		auth TEXT NOT NULL,
+		p256dh TEXT NOT NULL,
+		locale TEXT DEFAULT 'en',
+		previews INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL,
+		UNIQUE(user_id, endpoint)
+	);`)
+	return err
+}
+
+// SubscribeUser stores a device subscription for chat message notifications.
+// With previews the sender and message text are included in the payload;
+// otherwise the notification only says that a new message arrived.
+func (s *PushService) SubscribeUser(userID string, sub PushSubscriptionRequest, previews bool) error {
+	locale := sub.Locale
+	if locale == "" {
+		locale = "en"
+	}
+	platform := sub.Platform
+	if platform == "" {
+		platform = platformWeb
+	}
+	now := time.Now().UnixMilli()
+	_, err := s.db.Exec("INSERT OR REPLACE INTO user_subscriptions(user_id, platform, endpoint, auth, p256dh, locale, previews, created_at, refreshed_at) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		userID, platform, sub.Endpoint, sub.Keys.Auth, sub.Keys.P256dh, locale, previews, now, now)
+	if err != nil {
+		slog.Error("failed to save user push subscription", "user_id", userID, "endpoint", redactEndpoint(sub.Endpoint), "err", err)
+		return err
+	}
+	slog.Info("user push subscribed", "user_id", userID, "platform", platform, "endpoint", redactEndpoint(sub.Endpoint), "previews", previews)
+	return nil
+}
+
+func (s *PushService) UnsubscribeUser(userID, endpoint string) error {
+	if _, err := s.db.Exec("DELETE FROM user_subscriptions WHERE user_id = ? AND endpoint = ?", userID, endpoint); err != nil {
+		return err
+	}
+	slog.Info("user push unsubscribed", "user_id", userID, "endpoint", redactEndpoint(endpoint))
+	return nil
+}
+
+// SendMessageNotification pushes msg to every device the user subscribed.
+// VoIP tokens are skipped: iOS only allows them for calls.
+func (s *PushService) SendMessageNotification(userID string, msg *Message) {
+	rows, err := s.db.Query("SELECT platform, endpoint, auth, p256dh, locale, previews FROM user_subscriptions WHERE user_id = ? AND platform != ?", userID, platformAPNsVoIP)
+	if err != nil {
+		slog.Error("failed to query user push subscriptions", "user_id", userID, "err", err)
+		return
+	}
+	type target struct {
+		platform, endpoint, auth, p256dh, locale string
+		previews                                 bool
+	}
+	var targets []target
+	for rows.Next() {
+		var t target
+		if err := rows.Scan(&t.platform, &t.endpoint, &t.auth, &t.p256dh, &t.locale, &t.previews); err != nil {
+			slog.Error("failed to scan user push subscription", "err", err)
+			continue
+		}
+		targets = append(targets, t)
+	}
+	rows.Close()
+
+	for _, t := range targets {
+		topic := chatTopic(msg.ChatID)
+		payload := messagePayload{
+			Type:      notifyMessage,
+			URL:       "/chat/" + msg.ChatID,
+			Tag:       topic,
+			SentAt:    sentAtNow(),
+			ChatID:    msg.ChatID,
+			MessageID: msg.ID,
+			SenderID:  msg.SenderID,
+		}
+		if t.previews {
+			payload.Title = msg.SenderUsername
+			payload.Body = messagePreview(msg.Content)
+		} else {
+			payload.Title, payload.Body = notificationText(notifyMessage, t.locale)
+		}
+		err := s.queue.enqueue(PushTarget{
+			Platform: t.platform,
+			Token:    t.endpoint,
+			Auth:     t.auth,
+			P256dh:   t.p256dh,
+		}, newNotification(notifyMessage, topic, payload), "", userID)
+		if err != nil {
+			slog.Error("failed to queue message notification", "user_id", userID, "err", err)
+		}
+	}
+}
+
+func messagePreview(content string) string {
+	if utf8.RuneCountInString(content) <= messagePreviewMaxRune {
+		return content
+	}
+	runes := []rune(content)
+	return string(runes[:messagePreviewMaxRune]) + "…"
+}
+
+// handlePushUserSubscribe registers (POST) or removes (DELETE) the caller's
+// device for chat message notifications.
+func handlePushUserSubscribe(pushService *PushService, authStore *AuthStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := authStore.getUserByToken(extractToken(r))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			var req struct {
+				PushSubscriptionRequest
+				Previews bool `json:"previews"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid body", http.StatusBadRequest)
+				return
+			}
+			if err := pushService.validatePlatform(&req.PushSubscriptionRequest); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := pushService.SubscribeUser(user.UserID, req.PushSubscriptionRequest, req.Previews); err != nil {
+				http.Error(w, "Failed to subscribe", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		case http.MethodDelete:
+			var req struct {
+				Endpoint string `json:"endpoint"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid body", http.StatusBadRequest)
+				return
+			}
+			if err := pushService.UnsubscribeUser(user.UserID, req.Endpoint); err != nil {
+				http.Error(w, "Failed to unsubscribe", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -2,7 +2,7 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 	"sync"
@@ -12,13 +12,13 @@ import (
 )
 
 type Message struct {
-	ID              string `json:"id"`
-	ChatID          string `json:"chatId"`
-	SenderID        string `json:"senderId"`
-	SenderUsername  string `json:"senderUsername"`
-	Content         string `json:"content"`
-	Timestamp       int64  `json:"timestamp"`
-	Read            bool   `json:"read"`
+	ID             string `json:"id"`
+	ChatID         string `json:"chatId"`
+	SenderID       string `json:"senderId"`
+	SenderUsername string `json:"senderUsername"`
+	Content        string `json:"content"`
+	Timestamp      int64  `json:"timestamp"`
+	Read           bool   `json:"read"`
 }
 
 type ChatRoom struct {
@@ -28,47 +28,85 @@ type ChatRoom struct {
 	Messages             []*Message        `json:"-"`
 	LastMessage          *Message          `json:"lastMessage,omitempty"`
 	UnreadCount          map[string]int    `json:"-"`
+	MutedUntil           map[string]int64  `json:"-"` // userID -> unix ms; muted chats don't push
 	mu                   sync.Mutex
 }
 
 // ChatRoomForClient is a simplified version of ChatRoom for client-side consumption
 type ChatRoomForClient struct {
-	ID                   string            `json:"id"`
-	Participants         []string          `json:"participants"`
-	ParticipantUsernames map[string]string `json:"participantUsernames"`
-	LastMessage          *Message          `json:"lastMessage,omitempty"`
-	UnreadCount          int               `json:"unreadCount"` // Specific for the requesting user
+	ID                   string             `json:"id"`
+	Participants         []string           `json:"participants"`
+	ParticipantUsernames map[string]string  `json:"participantUsernames"`
+	Profiles             map[string]Profile `json:"profiles"` // userID -> current profile
+	LastMessage          *Message           `json:"lastMessage,omitempty"`
+	UnreadCount          int                `json:"unreadCount"` // Specific for the requesting user
+	MutedUntil           int64              `json:"mutedUntil,omitempty"`
+}
+
+// msgConn is a messaging WebSocket. Chat messages and profile updates are
+// sent from different goroutines, and gorilla allows one writer at a time.
+type msgConn struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+}
+
+func (c *msgConn) send(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, data)
 }
 
 type MessagingStore struct {
-	chats       map[string]*ChatRoom   // chatID -> ChatRoom
-	userChats   map[string][]string    // userID -> []chatID
-	wsClients   map[string]*websocket.Conn // userID -> websocket
-	mu          sync.RWMutex
+	chats     map[string]*ChatRoom // chatID -> ChatRoom
+	userChats map[string][]string  // userID -> []chatID
+	wsClients map[string]*msgConn  // userID -> websocket
+	push      *PushService
+	mu        sync.RWMutex
 }
 
-func newMessagingStore() *MessagingStore {
+func newMessagingStore(push *PushService) *MessagingStore {
 	return &MessagingStore{
 		chats:     make(map[string]*ChatRoom),
 		userChats: make(map[string][]string),
-		wsClients: make(map[string]*websocket.Conn),
+		wsClients: make(map[string]*msgConn),
+		push:      push,
 	}
 }
 
+// findChatLocked returns the chat between the two users, or nil. Caller must
+// hold s.mu.
+func (s *MessagingStore) findChatLocked(userID1, userID2 string) *ChatRoom {
+	for _, chatID := range s.userChats[userID1] {
+		chat := s.chats[chatID]
+		if chat == nil {
+			continue
+		}
+		chat.mu.Lock()
+		participants := chat.Participants
+		chat.mu.Unlock()
+		for _, p := range participants {
+			if p == userID2 {
+				return chat
+			}
+		}
+	}
+	return nil
+}
+
+// sharesChat reports whether the two users have a chat with each other.
+func (s *MessagingStore) sharesChat(userID1, userID2 string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.findChatLocked(userID1, userID2) != nil
+}
+
 func (s *MessagingStore) getOrCreateChat(userID1, userID2, username1, username2 string) *ChatRoom {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	// Check if chat already exists
-	for _, chatID := range s.userChats[userID1] {
-		chat := s.chats[chatID]
-		if chat != nil {
-			for _, p := range chat.Participants {
-				if p == userID2 {
-					return chat
-				}
-			}
-		}
+	if chat := s.findChatLocked(userID1, userID2); chat != nil {
+		return chat
 	}
 
 	// Create new chat
@@ -81,6 +119,7 @@ func (s *MessagingStore) getOrCreateChat(userID1, userID2, username1, username2
 		},
 		Messages:    make([]*Message, 0),
 		UnreadCount: make(map[string]int),
+		MutedUntil:  make(map[string]int64),
 	}
 
 	s.chats[chat.ID] = chat
@@ -111,6 +150,9 @@ func (s *MessagingStore) getUserChats(userID string) []*ChatRoomForClient {
 				LastMessage:          chat.LastMessage,
 				UnreadCount:          currentUnreadCount,
 			}
+			if until := chat.MutedUntil[userID]; until > time.Now().UnixMilli() {
+				chatCopy.MutedUntil = until
+			}
 			chat.mu.Unlock()
 			chats = append(chats, chatCopy)
 		}
@@ -141,21 +183,67 @@ func (s *MessagingStore) addMessage(chatID, senderID, senderUsername, content st
 	chat.mu.Lock()
 	chat.Messages = append(chat.Messages, msg)
 	chat.LastMessage = msg
-	
+
 	// Increment unread for other participants
+	var notify []string
 	for _, participantID := range chat.Participants {
 		if participantID != senderID {
 			chat.UnreadCount[participantID]++
+			if chat.MutedUntil[participantID] <= msg.Timestamp {
+				notify = append(notify, participantID)
+			}
 		}
 	}
 	chat.mu.Unlock()
 
 	// Broadcast to WebSocket clients
 	s.broadcastMessage(msg)
+	s.pushMessage(msg, notify)
 
 	return msg, nil
 }
 
+// pushMessage sends a push notification to recipients without a live
+// messaging connection.
+func (s *MessagingStore) pushMessage(msg *Message, recipients []string) {
+	if s.push == nil {
+		return
+	}
+	for _, userID := range recipients {
+		s.mu.RLock()
+		_, online := s.wsClients[userID]
+		s.mu.RUnlock()
+		if !online {
+			go s.push.SendMessageNotification(userID, msg)
+		}
+	}
+}
+
+// setMute silences push notifications for the chat until the given unix ms
+// time; zero unmutes. It reports whether the user is in the chat.
+func (s *MessagingStore) setMute(chatID, userID string, until int64) bool {
+	s.mu.RLock()
+	chat := s.chats[chatID]
+	s.mu.RUnlock()
+	if chat == nil {
+		return false
+	}
+
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	for _, id := range chat.Participants {
+		if id == userID {
+			if until > 0 {
+				chat.MutedUntil[userID] = until
+			} else {
+				delete(chat.MutedUntil, userID)
+			}
+			return true
+		}
+	}
+	return false
+}
+
 func (s *MessagingStore) getMessages(chatID string) []*Message {
 	s.mu.RLock()
 	chat := s.chats[chatID]
@@ -187,10 +275,10 @@ func (s *MessagingStore) markAsRead(chatID, userID string) {
 
 func (s *MessagingStore) registerWSClient(userID string, conn *websocket.Conn) {
 	s.mu.Lock()
-	if oldConn, exists := s.wsClients[userID]; exists {
-		oldConn.Close()
+	if old, exists := s.wsClients[userID]; exists {
+		old.conn.Close()
 	}
-	s.wsClients[userID] = conn
+	s.wsClients[userID] = &msgConn{conn: conn}
 	s.mu.Unlock()
 }
 
@@ -216,14 +304,18 @@ func (s *MessagingStore) broadcastMessage(msg *Message) {
 
 	jsonData, _ := json.Marshal(data)
 
-	for _, participantID := range chat.Participants {
+	chat.mu.Lock()
+	participants := chat.Participants
+	chat.mu.Unlock()
+
+	for _, participantID := range participants {
 		s.mu.RLock()
 		conn := s.wsClients[participantID]
 		s.mu.RUnlock()
 
 		if conn != nil {
-			if err := conn.WriteMessage(websocket.TextMessage, jsonData); err != nil {
-				log.Printf("Failed to send message to %s: %v", participantID, err)
+			if err := conn.send(jsonData); err != nil {
+				slog.Warn("failed to deliver chat message", "user_id", participantID, "chat", msg.ChatID, "err", err)
 			}
 		}
 	}
@@ -258,10 +350,14 @@ func handleCreateChat(authStore *AuthStore, msgStore *MessagingStore) http.Handl
 		targetUser, exists := authStore.users[req.Username]
 		authStore.mu.RUnlock()
 
-		if !exists {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(map[string]string{"message": "User not found"})
+		// Hidden users are reported like missing ones.
+		if !exists || !canSeeProfile(authStore, msgStore, user, targetUser) {
+			writeJSONMessage(w, http.StatusNotFound, localize(requestLocale(r), "error.user_not_found"))
+			return
+		}
+
+		if !authStore.canMessage(user, targetUser) {
+			writeJSONMessage(w, http.StatusForbidden, localize(requestLocale(r), "error.cannot_message"))
 			return
 		}
 
@@ -287,6 +383,9 @@ func handleGetChats(authStore *AuthStore, msgStore *MessagingStore) http.Handler
 		}
 
 		chats := msgStore.getUserChats(user.UserID)
+		for _, chat := range chats {
+			chat.Profiles = authStore.profiles(chat.Participants)
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{"chats": chats})
@@ -351,6 +450,28 @@ func handleSendMessage(authStore *AuthStore, msgStore *MessagingStore) http.Hand
 			return
 		}
 
+		// Call invitations are sent as chat messages, so this also stops
+		// blocked users from ringing.
+		participants := msgStore.chatParticipants(chatID)
+		isParticipant := false
+		for _, id := range participants {
+			if id == user.UserID {
+				isParticipant = true
+				continue
+			}
+			authStore.mu.RLock()
+			recipient := authStore.usersByID[id]
+			authStore.mu.RUnlock()
+			if recipient != nil && !authStore.canMessage(user, recipient) {
+				writeJSONMessage(w, http.StatusForbidden, localize(requestLocale(r), "error.cannot_message"))
+				return
+			}
+		}
+		if !isParticipant {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+			return
+		}
+
 		msg, err := msgStore.addMessage(chatID, user.UserID, user.Username, req.Content)
 		if err != nil || msg == nil {
 			http.Error(w, "Failed to send message", http.StatusInternalServerError)
@@ -389,7 +510,47 @@ func handleMarkAsRead(authStore *AuthStore, msgStore *MessagingStore) http.Handl
 	}
 }
 
-func handleMessagingWebSocket(authStore *AuthStore, msgStore *MessagingStore) http.HandlerFunc {
+// handleMuteChat sets {"mutedUntil": unix ms} for the caller; 0 unmutes.
+func handleMuteChat(authStore *AuthStore, msgStore *MessagingStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		token := extractToken(r)
+		user, err := authStore.getUserByToken(token)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) < 4 {
+			http.Error(w, "Invalid chat ID", http.StatusBadRequest)
+			return
+		}
+		chatID := parts[3]
+
+		var req struct {
+			MutedUntil int64 `json:"mutedUntil"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MutedUntil < 0 {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if !msgStore.setMute(chatID, user.UserID, req.MutedUntil) {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleMessagingWebSocket(cfg *Config, authStore *AuthStore, msgStore *MessagingStore) http.HandlerFunc {
+	upgrader := newWSUpgrader(cfg)
 	return func(w http.ResponseWriter, r *http.Request) {
 		token := r.URL.Query().Get("token")
 		if token == "" {
@@ -403,9 +564,9 @@ func handleMessagingWebSocket(authStore *AuthStore, msgStore *MessagingStore) ht
 			return
 		}
 
-		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			log.Println("WebSocket upgrade error:", err)
+			slog.Warn("messaging websocket upgrade failed", "ip", redactIP(getClientIP(cfg, r)), "err", err)
 			return
 		}
 
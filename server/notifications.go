@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// Notification types. Call notifications for a room share a topic, so a
+// pending ring is replaced by the missed-call or call-ended notification
+// instead of stacking next to it.
+const (
+	notifyIncomingCall = "call_incoming"
+	notifyMissedCall   = "call_missed"
+	notifyCallEnded    = "call_ended"
+	notifyMessage      = "message"
+)
+
+type notificationPolicy struct {
+	urgent bool
+	ttl    time.Duration
+}
+
+var notificationPolicies = map[string]notificationPolicy{
+	// A ring is worthless once the caller has given up.
+	notifyIncomingCall: {urgent: true, ttl: time.Minute},
+	notifyMissedCall:   {ttl: 24 * time.Hour},
+	// Only needed to clear a ring that is still showing.
+	notifyCallEnded: {ttl: 5 * time.Minute},
+	notifyMessage:   {ttl: 24 * time.Hour},
+}
+
+// callPayload is the data of call notifications. The snapshot fields are
+// only set on rings that carry an encrypted preview for the recipient.
+type callPayload struct {
+	Type                 string `json:"type"`
+	Title                string `json:"title"`
+	Body                 string `json:"body"`
+	URL                  string `json:"url"`
+	Tag                  string `json:"tag"`
+	SentAt               string `json:"sentAt"`
+	Silent               string `json:"silent,omitempty"` // "1" during quiet hours
+	SnapshotID           string `json:"snapshotId,omitempty"`
+	SnapshotURL          string `json:"snapshotUrl,omitempty"`
+	SnapshotIV           string `json:"snapshotIv,omitempty"`
+	SnapshotSalt         string `json:"snapshotSalt,omitempty"`
+	SnapshotEphemeralKey string `json:"snapshotEphemeralPubKey,omitempty"`
+	SnapshotKey          string `json:"snapshotKey,omitempty"`
+	SnapshotKeyIV        string `json:"snapshotKeyIv,omitempty"`
+	SnapshotMime         string `json:"snapshotMime,omitempty"`
+}
+
+// messagePayload is the data of new message notifications.
+type messagePayload struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Body      string `json:"body"`
+	URL       string `json:"url"`
+	Tag       string `json:"tag"`
+	SentAt    string `json:"sentAt"`
+	ChatID    string `json:"chatId"`
+	MessageID string `json:"messageId"`
+	SenderID  string `json:"senderId"`
+}
+
+// Topics are at most 32 URL-safe characters (the Web Push limit) and don't
+// reveal the room or chat ID.
+func callTopic(roomID string) string {
+	sum := sha256.Sum256([]byte(roomID))
+	return "call-" + hex.EncodeToString(sum[:8])
+}
+
+func chatTopic(chatID string) string {
+	sum := sha256.Sum256([]byte(chatID))
+	return "chat-" + hex.EncodeToString(sum[:8])
+}
+
+func sentAtNow() string {
+	return strconv.FormatInt(time.Now().UnixMilli(), 10)
+}
+
+// newNotification applies the kind's urgency and TTL to a payload. Payloads
+// only have string fields, as FCM data requires.
+func newNotification(kind, topic string, payload interface{}) PushNotification {
+	data := make(map[string]string)
+	raw, _ := json.Marshal(payload)
+	json.Unmarshal(raw, &data)
+	policy := notificationPolicies[kind]
+	return PushNotification{Data: data, TTL: policy.ttl, Urgent: policy.urgent, Topic: topic}
+}
+
+// notificationText returns the title and body for a notification kind.
+func notificationText(kind, locale string) (string, string) {
+	return localize(locale, "notification.title"), localize(locale, "notification."+kind)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const passkeyCeremonyTimeout = 5 * time.Minute
+
+var (
+	errPasskeysDisabled    = newLocalizedError("error.passkeys_unavailable")
+	errInvalidPasskeyFlow  = newLocalizedError("error.passkey_session_invalid")
+	errPasskeyRegistration = newLocalizedError("error.passkey_registration_failed")
+	errPasskeyInvalidLogin = newLocalizedError("error.invalid_credentials")
+)
+
+// Passkey is a WebAuthn credential registered to a user.
+type Passkey struct {
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	Credential webauthn.Credential
+}
+
+type passkeyCeremony struct {
+	userID  string // empty for discoverable login
+	session webauthn.SessionData
+	expires time.Time
+}
+
+// passkeyUser adapts a snapshot of a User to webauthn.User, so the library
+// never reads user fields without the store lock.
+type passkeyUser struct {
+	handle      []byte
+	name        string
+	credentials []webauthn.Credential
+}
+
+func (u *passkeyUser) WebAuthnID() []byte                         { return u.handle }
+func (u *passkeyUser) WebAuthnName() string                       { return u.name }
+func (u *passkeyUser) WebAuthnDisplayName() string                { return u.name }
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+func (u *passkeyUser) WebAuthnIcon() string                       { return "" }
+
+// passkeyRPID returns the configured relying party ID, or the host of the
+// first allowed origin. It reads the startup config on purpose: passkeys are
+// bound to the RP ID, so a reload may change the accepted origins but never
+// the RP ID. Set WEBAUTHN_RP_ID to pin it explicitly.
+func (c *Config) passkeyRPID() string {
+	if c.WebAuthnRPID != "" {
+		return c.WebAuthnRPID
+	}
+	if len(c.AllowedOrigins) > 0 {
+		if u, err := url.Parse(c.AllowedOrigins[0]); err == nil {
+			return u.Hostname()
+		}
+	}
+	return ""
+}
+
+// newWebAuthn builds the relying party from the current config. Origins come
+// from ALLOWED_ORIGINS, so they follow config reloads.
+func newWebAuthn(cfg *Config) (*webauthn.WebAuthn, error) {
+	rpID := cfg.passkeyRPID()
+	origins := make([]string, 0, len(cfg.allowedOrigins()))
+	for origin := range cfg.allowedOrigins() {
+		origins = append(origins, origin)
+	}
+	if rpID == "" || len(origins) == 0 {
+		return nil, errPasskeysDisabled
+	}
+	sort.Strings(origins)
+
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: passkeyCeremonyTimeout, TimeoutUVD: passkeyCeremonyTimeout}
+	return webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: cfg.WebAuthnRPName,
+		RPOrigins:     origins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationRequired,
+		},
+		AttestationPreference: protocol.PreferNoAttestation,
+		Timeouts:              webauthn.TimeoutsConfig{Login: timeout, Registration: timeout},
+	})
+}
+
+// passkeyUserLocked snapshots the user for the webauthn library, assigning a
+// random user handle on first use. Caller must hold s.mu for writing.
+func (s *AuthStore) passkeyUserLocked(user *User) (*passkeyUser, error) {
+	if len(user.WebAuthnHandle) == 0 {
+		handle := make([]byte, 32)
+		if _, err := rand.Read(handle); err != nil {
+			return nil, err
+		}
+		user.WebAuthnHandle = handle
+	}
+	credentials := make([]webauthn.Credential, len(user.Passkeys))
+	for i, passkey := range user.Passkeys {
+		credentials[i] = passkey.Credential
+	}
+	return &passkeyUser{handle: user.WebAuthnHandle, name: user.Username, credentials: credentials}, nil
+}
+
+func (s *AuthStore) storeCeremony(ceremony *passkeyCeremony) (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(raw)
+	now := time.Now()
+
+	s.mu.Lock()
+	for key, c := range s.passkeyCeremonies {
+		if now.After(c.expires) {
+			delete(s.passkeyCeremonies, key)
+		}
+	}
+	ceremony.expires = now.Add(passkeyCeremonyTimeout)
+	s.passkeyCeremonies[id] = ceremony
+	s.mu.Unlock()
+	return id, nil
+}
+
+// takeCeremony removes and returns a ceremony; each challenge is single-use.
+func (s *AuthStore) takeCeremony(id string) (*passkeyCeremony, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ceremony, ok := s.passkeyCeremonies[id]
+	delete(s.passkeyCeremonies, id)
+	if !ok || time.Now().After(ceremony.expires) {
+		return nil, errInvalidPasskeyFlow
+	}
+	return ceremony, nil
+}
+
+// passkeyUserByHandle resolves a discoverable credential's user handle.
+func (s *AuthStore) passkeyUserByHandle(handle []byte) (*User, *passkeyUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, user := range s.usersByID {
+		if len(user.WebAuthnHandle) > 0 && bytes.Equal(user.WebAuthnHandle, handle) {
+			pu, err := s.passkeyUserLocked(user)
+			return user, pu, err
+		}
+	}
+	return nil, nil, errors.New("unknown user handle")
+}
+
+// recordPasskeyUse stores the credential's new sign count.
+func (s *AuthStore) recordPasskeyUse(user *User, credential *webauthn.Credential) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range user.Passkeys {
+		if bytes.Equal(user.Passkeys[i].Credential.ID, credential.ID) {
+			user.Passkeys[i].Credential.Authenticator = credential.Authenticator
+			user.Passkeys[i].Credential.Flags = credential.Flags
+			user.Passkeys[i].LastUsedAt = time.Now()
+			return
+		}
+	}
+}
+
+func handlePasskeyRegisterBegin(cfg *Config, authStore *AuthStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, err := authStore.getUserByToken(extractToken(r))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		wa, err := newWebAuthn(cfg)
+		if err != nil {
+			writeJSONMessage(w, http.StatusNotFound, localizeError(requestLocale(r), errPasskeysDisabled))
+			return
+		}
+
+		authStore.mu.Lock()
+		pu, err := authStore.passkeyUserLocked(user)
+		authStore.mu.Unlock()
+		if err != nil {
+			http.Error(w, "Failed to start registration", http.StatusInternalServerError)
+			return
+		}
+
+		exclusions := make([]protocol.CredentialDescriptor, len(pu.credentials))
+		for i, credential := range pu.credentials {
+			exclusions[i] = credential.Descriptor()
+		}
+		creation, session, err := wa.BeginRegistration(pu, webauthn.WithExclusions(exclusions))
+		if err != nil {
+			http.Error(w, "Failed to start registration", http.StatusInternalServerError)
+			return
+		}
+		id, err := authStore.storeCeremony(&passkeyCeremony{userID: user.UserID, session: *session})
+		if err != nil {
+			http.Error(w, "Failed to start registration", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"sessionId": id,
+			"options":   creation,
+		})
+	}
+}
+
+// handlePasskeyRegisterFinish verifies the attestation response (the request
+// body) for the ceremony given by ?session= and stores the new credential.
+func handlePasskeyRegisterFinish(cfg *Config, authStore *AuthStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, err := authStore.getUserByToken(extractToken(r))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		wa, err := newWebAuthn(cfg)
+		if err != nil {
+			writeJSONMessage(w, http.StatusNotFound, localizeError(requestLocale(r), errPasskeysDisabled))
+			return
+		}
+
+		ceremony, err := authStore.takeCeremony(r.URL.Query().Get("session"))
+		if err != nil || ceremony.userID != user.UserID {
+			writeJSONMessage(w, http.StatusBadRequest, localizeError(requestLocale(r), errInvalidPasskeyFlow))
+			return
+		}
+
+		authStore.mu.Lock()
+		pu, err := authStore.passkeyUserLocked(user)
+		authStore.mu.Unlock()
+		if err != nil {
+			http.Error(w, "Failed to register passkey", http.StatusInternalServerError)
+			return
+		}
+
+		credential, err := wa.FinishRegistration(pu, ceremony.session, r)
+		if err != nil {
+			slog.Debug("passkey registration rejected", "user_id", user.UserID, "err", err)
+			writeJSONMessage(w, http.StatusBadRequest, localizeError(requestLocale(r), errPasskeyRegistration))
+			return
+		}
+
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			name = "Passkey"
+		}
+		authStore.mu.Lock()
+		user.Passkeys = append(user.Passkeys, Passkey{Name: truncate(name, 64), CreatedAt: time.Now(), Credential: *credential})
+		authStore.mu.Unlock()
+
+		audit("passkey_registered", "user_id", user.UserID, "ip", redactIP(getClientIP(cfg, r)))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"id": base64.RawURLEncoding.EncodeToString(credential.ID),
+		})
+	}
+}
+
+// handlePasskeyLoginBegin starts a discoverable login: the authenticator
+// picks the account, so no username is needed.
+func handlePasskeyLoginBegin(cfg *Config, authStore *AuthStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		wa, err := newWebAuthn(cfg)
+		if err != nil {
+			writeJSONMessage(w, http.StatusNotFound, localizeError(requestLocale(r), errPasskeysDisabled))
+			return
+		}
+
+		assertion, session, err := wa.BeginDiscoverableLogin()
+		if err != nil {
+			http.Error(w, "Failed to start login", http.StatusInternalServerError)
+			return
+		}
+		id, err := authStore.storeCeremony(&passkeyCeremony{session: *session})
+		if err != nil {
+			http.Error(w, "Failed to start login", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"sessionId": id,
+			"options":   assertion,
+		})
+	}
+}
+
+// handlePasskeyLoginFinish verifies the assertion (the request body) for the
+// ceremony given by ?session= and returns a session token like handleLogin.
+func handlePasskeyLoginFinish(cfg *Config, authStore *AuthStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		wa, err := newWebAuthn(cfg)
+		if err != nil {
+			writeJSONMessage(w, http.StatusNotFound, localizeError(requestLocale(r), errPasskeysDisabled))
+			return
+		}
+
+		ceremony, err := authStore.takeCeremony(r.URL.Query().Get("session"))
+		if err != nil || ceremony.userID != "" {
+			writeJSONMessage(w, http.StatusBadRequest, localizeError(requestLocale(r), errInvalidPasskeyFlow))
+			return
+		}
+
+		ip := getClientIP(cfg, r)
+		var user *User
+		credential, err := wa.FinishDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			found, pu, err := authStore.passkeyUserByHandle(userHandle)
+			user = found
+			return pu, err
+		}, ceremony.session, r)
+		if err != nil {
+			slog.Debug("passkey login rejected", "ip", redactIP(ip), "err", err)
+			writeJSONMessage(w, http.StatusUnauthorized, localizeError(requestLocale(r), errPasskeyInvalidLogin))
+			return
+		}
+
+		// A sign count that did not increase suggests a cloned authenticator.
+		if credential.Authenticator.CloneWarning {
+			audit("passkey_clone_warning", "user_id", user.UserID, "ip", redactIP(ip),
+				"credential", base64.RawURLEncoding.EncodeToString(credential.ID))
+			writeJSONMessage(w, http.StatusUnauthorized, localizeError(requestLocale(r), errPasskeyInvalidLogin))
+			return
+		}
+		authStore.recordPasskeyUse(user, credential)
+		authStore.guard.recordSuccess(user.Username)
+
+		writeLoginSession(w, authStore, user)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+// softAuthenticator is a software ES256 platform authenticator holding one
+// discoverable credential.
+type softAuthenticator struct {
+	key        *ecdsa.PrivateKey
+	credID     []byte
+	userHandle []byte
+	signCount  uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credID := make([]byte, 16)
+	rand.Read(credID)
+	return &softAuthenticator{key: key, credID: credID}
+}
+
+type passkeyBeginResponse struct {
+	SessionID string `json:"sessionId"`
+	Options   struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			RP        struct {
+				ID string `json:"id"`
+			} `json:"rp"`
+			RPID string `json:"rpId"`
+			User struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	} `json:"options"`
+}
+
+func (a *softAuthenticator) clientData(t *testing.T, ceremony, challenge string) []byte {
+	t.Helper()
+	data, err := json.Marshal(map[string]interface{}{
+		"type":        ceremony,
+		"challenge":   challenge,
+		"origin":      testOrigin,
+		"crossOrigin": false,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// authData builds authenticator data with the user present and verified
+// flags, plus attested credential data when attest is set.
+func (a *softAuthenticator) authData(t *testing.T, rpID string, attest bool) []byte {
+	t.Helper()
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	flags := protocol.FlagUserPresent | protocol.FlagUserVerified
+	if attest {
+		flags |= protocol.FlagAttestedCredentialData
+	}
+	data := append(rpIDHash[:], byte(flags))
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if !attest {
+		return data
+	}
+
+	data = append(data, make([]byte, 16)...) // AAGUID
+	data = binary.BigEndian.AppendUint16(data, uint16(len(a.credID)))
+	data = append(data, a.credID...)
+	coseKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(data, coseKey...)
+}
+
+// register answers a registration begin response with a "none" attestation.
+func (a *softAuthenticator) register(t *testing.T, begin passkeyBeginResponse) []byte {
+	t.Helper()
+	options := begin.Options.PublicKey
+	handle, err := base64.RawURLEncoding.DecodeString(options.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.userHandle = handle
+
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authData(t, options.RP.ID, true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credID),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(a.clientData(t, "webauthn.create", options.Challenge)),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+		},
+	})
+	return body
+}
+
+// assert answers a login begin response, bumping the sign count first
+// unless replay is set.
+func (a *softAuthenticator) assert(t *testing.T, begin passkeyBeginResponse, replay bool) []byte {
+	t.Helper()
+	if !replay {
+		a.signCount++
+	}
+	authData := a.authData(t, begin.Options.PublicKey.RPID, false)
+	clientData := a.clientData(t, "webauthn.get", begin.Options.PublicKey.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credID),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(sig),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+		},
+	})
+	return body
+}
+
+func callPasskeyHandler(t *testing.T, h http.HandlerFunc, url, token string, body []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
+
+func beginPasskey(t *testing.T, h http.HandlerFunc, token string) passkeyBeginResponse {
+	t.Helper()
+	rec := callPasskeyHandler(t, h, "/begin", token, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("begin: %d %s", rec.Code, rec.Body)
+	}
+	var begin passkeyBeginResponse
+	if err := json.NewDecoder(rec.Body).Decode(&begin); err != nil {
+		t.Fatal(err)
+	}
+	return begin
+}
+
+// registerPasskey runs a registration ceremony for the user behind token.
+func registerPasskey(t *testing.T, cfg *Config, authStore *AuthStore, auth *softAuthenticator, token string) {
+	t.Helper()
+	begin := beginPasskey(t, handlePasskeyRegisterBegin(cfg, authStore), token)
+	rec := callPasskeyHandler(t, handlePasskeyRegisterFinish(cfg, authStore),
+		"/finish?session="+begin.SessionID+"&name=Laptop", token, auth.register(t, begin))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("register finish: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func loginWithPasskey(t *testing.T, cfg *Config, authStore *AuthStore, auth *softAuthenticator, replay bool) *httptest.ResponseRecorder {
+	t.Helper()
+	begin := beginPasskey(t, handlePasskeyLoginBegin(cfg, authStore), "")
+	return callPasskeyHandler(t, handlePasskeyLoginFinish(cfg, authStore),
+		"/finish?session="+begin.SessionID, "", auth.assert(t, begin, replay))
+}
+
+func TestPasskeyRegisterAndDiscoverableLogin(t *testing.T) {
+	cfg := newTestConfig()
+	authStore := newAuthStore(cfg)
+	user, token := newTestUser(t, authStore, "alice", "correct horse battery")
+	auth := newSoftAuthenticator(t)
+
+	registerPasskey(t, cfg, authStore, auth, token)
+	if len(user.Passkeys) != 1 || user.Passkeys[0].Name != "Laptop" {
+		t.Fatalf("passkeys = %+v", user.Passkeys)
+	}
+
+	rec := loginWithPasskey(t, cfg, authStore, auth, false)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login finish: %d %s", rec.Code, rec.Body)
+	}
+	var session struct {
+		Token  string `json:"token"`
+		UserID string `json:"userId"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&session); err != nil {
+		t.Fatal(err)
+	}
+	if session.UserID != user.UserID {
+		t.Fatalf("logged in as %q, want %q", session.UserID, user.UserID)
+	}
+	if got, err := authStore.getUserByToken(session.Token); err != nil || got != user {
+		t.Fatalf("session token does not resolve to the user: %v", err)
+	}
+	if sc := user.Passkeys[0].Credential.Authenticator.SignCount; sc != auth.signCount {
+		t.Errorf("stored sign count = %d, want %d", sc, auth.signCount)
+	}
+}
+
+func TestPasskeyCloneWarningRejected(t *testing.T) {
+	cfg := newTestConfig()
+	authStore := newAuthStore(cfg)
+	_, token := newTestUser(t, authStore, "alice", "correct horse battery")
+	auth := newSoftAuthenticator(t)
+	registerPasskey(t, cfg, authStore, auth, token)
+
+	if rec := loginWithPasskey(t, cfg, authStore, auth, false); rec.Code != http.StatusOK {
+		t.Fatalf("first login: %d %s", rec.Code, rec.Body)
+	}
+	// A copy of the credential presents a sign count that did not increase.
+	if rec := loginWithPasskey(t, cfg, authStore, auth, true); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("login with a stale sign count: %d, want 401", rec.Code)
+	}
+}
+
+func TestPasskeyCeremonyExpiry(t *testing.T) {
+	cfg := newTestConfig()
+	authStore := newAuthStore(cfg)
+	_, token := newTestUser(t, authStore, "alice", "correct horse battery")
+	auth := newSoftAuthenticator(t)
+	registerPasskey(t, cfg, authStore, auth, token)
+
+	begin := beginPasskey(t, handlePasskeyLoginBegin(cfg, authStore), "")
+	authStore.mu.Lock()
+	authStore.passkeyCeremonies[begin.SessionID].expires = time.Now().Add(-time.Second)
+	authStore.mu.Unlock()
+	rec := callPasskeyHandler(t, handlePasskeyLoginFinish(cfg, authStore),
+		"/finish?session="+begin.SessionID, "", auth.assert(t, begin, false))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expired ceremony: %d, want 400", rec.Code)
+	}
+
+	// Challenges are single-use.
+	begin = beginPasskey(t, handlePasskeyLoginBegin(cfg, authStore), "")
+	body := auth.assert(t, begin, false)
+	finish := handlePasskeyLoginFinish(cfg, authStore)
+	if rec := callPasskeyHandler(t, finish, "/finish?session="+begin.SessionID, "", body); rec.Code != http.StatusOK {
+		t.Fatalf("login: %d %s", rec.Code, rec.Body)
+	}
+	if rec := callPasskeyHandler(t, finish, "/finish?session="+begin.SessionID, "", body); rec.Code != http.StatusBadRequest {
+		t.Fatalf("replayed ceremony: %d, want 400", rec.Code)
+	}
+}
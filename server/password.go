@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcrypt ignores input beyond 72 bytes, so longer passwords are rejected
+// rather than silently truncated.
+const passwordMaxBytes = 72
+
+var (
+	errInvalidResetToken = newLocalizedError("error.invalid_reset_token")
+	errWrongPassword     = newLocalizedError("error.wrong_password")
+)
+
+// validatePassword checks a new password against the configured policy.
+func validatePassword(cfg *Config, username, password string) error {
+	if len([]rune(password)) < cfg.PasswordMinLength {
+		return newLocalizedPluralError("error.password_too_short", cfg.PasswordMinLength, cfg.PasswordMinLength)
+	}
+	if len(password) > passwordMaxBytes {
+		return newLocalizedPluralError("error.password_too_long", passwordMaxBytes, passwordMaxBytes)
+	}
+	if strings.EqualFold(password, username) {
+		return newLocalizedError("error.password_matches_username")
+	}
+
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			classes++
+		}
+	}
+	if classes < cfg.PasswordMinClasses {
+		return newLocalizedError("error.password_too_simple", cfg.PasswordMinClasses)
+	}
+	return nil
+}
+
+// Mailer delivers password reset tokens to users. Deployments plug in their
+// own implementation; the default only logs that a reset was requested.
+type Mailer interface {
+	SendPasswordReset(user *User, token string, expiresAt time.Time) error
+}
+
+type logMailer struct{}
+
+func (logMailer) SendPasswordReset(user *User, token string, expiresAt time.Time) error {
+	slog.Info("password reset requested but no mailer is configured", "user_id", user.UserID)
+	return nil
+}
+
+type passwordResetClaims struct {
+	UserID string `json:"uid"`
+	Exp    int64  `json:"exp"`
+	// Hash binds the token to the password it resets, so it stops working
+	// once used (or once the password is changed by other means).
+	Hash string `json:"ph"`
+}
+
+func passwordHashFingerprint(passwordHash string) string {
+	sum := sha256.Sum256([]byte(passwordHash))
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+// issueResetToken creates a signed, single-use password reset token.
+func (s *AuthStore) issueResetToken(user *User) (string, time.Time, error) {
+	s.mu.RLock()
+	hash := user.PasswordHash
+	s.mu.RUnlock()
+
+	expiresAt := time.Now().Add(time.Duration(s.cfg.PasswordResetTTLMinutes) * time.Minute)
+	payloadBytes, err := json.Marshal(passwordResetClaims{
+		UserID: user.UserID,
+		Exp:    expiresAt.Unix(),
+		Hash:   passwordHashFingerprint(hash),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(payloadBytes)
+
+	mac := hmac.New(sha256.New, s.resetSecret)
+	mac.Write([]byte(payload))
+	sig := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	return payload + "." + sig, expiresAt, nil
+}
+
+// resetPassword redeems a reset token, sets the new password and revokes all
+// of the user's sessions.
+func (s *AuthStore) resetPassword(token, newPassword string) (*User, error) {
+	payload, sigPart, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errInvalidResetToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(sigPart)
+	if err != nil {
+		return nil, errInvalidResetToken
+	}
+	mac := hmac.New(sha256.New, s.resetSecret)
+	mac.Write([]byte(payload))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errInvalidResetToken
+	}
+
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errInvalidResetToken
+	}
+	var claims passwordResetClaims
+	if err := json.Unmarshal(payloadBytes, &claims); err != nil {
+		return nil, errInvalidResetToken
+	}
+	if time.Now().Unix() > claims.Exp {
+		return nil, errInvalidResetToken
+	}
+
+	s.mu.RLock()
+	user, exists := s.usersByID[claims.UserID]
+	s.mu.RUnlock()
+	if !exists {
+		return nil, errInvalidResetToken
+	}
+	if err := validatePassword(s.cfg, user.Username, newPassword); err != nil {
+		return nil, err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(newPassword), s.cfg.passwordCost())
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !hmac.Equal([]byte(passwordHashFingerprint(user.PasswordHash)), []byte(claims.Hash)) {
+		return nil, errInvalidResetToken
+	}
+	user.PasswordHash = string(hash)
+	s.revokeTokensLocked(user.UserID, "")
+	return user, nil
+}
+
+// changePassword verifies the current password, sets the new one and revokes
+// every session except keepToken.
+func (s *AuthStore) changePassword(user *User, currentPassword, newPassword, keepToken string) error {
+	s.mu.RLock()
+	current := user.PasswordHash
+	s.mu.RUnlock()
+
+	if err := bcrypt.CompareHashAndPassword([]byte(current), []byte(currentPassword)); err != nil {
+		return errWrongPassword
+	}
+	if err := validatePassword(s.cfg, user.Username, newPassword); err != nil {
+		return err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(newPassword), s.cfg.passwordCost())
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The current password was checked against current; if a concurrent
+	// change or reset replaced it meanwhile, that check no longer holds.
+	if user.PasswordHash != current {
+		return errWrongPassword
+	}
+	user.PasswordHash = string(hash)
+	s.revokeTokensLocked(user.UserID, keepToken)
+	return nil
+}
+
+// revokeTokensLocked drops the user's session tokens other than keep.
+// Caller must hold s.mu.
+func (s *AuthStore) revokeTokensLocked(userID, keep string) int {
+	revoked := 0
+	for token, uid := range s.tokens {
+		if uid == userID && token != keep {
+			delete(s.tokens, token)
+			revoked++
+		}
+	}
+	return revoked
+}
+
+func newResetSecret(cfg *Config) []byte {
+	if cfg.PasswordResetSecret != "" {
+		return []byte(cfg.PasswordResetSecret)
+	}
+	// Without a configured secret, reset tokens only survive until restart.
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+func handleChangePassword(cfg *Config, authStore *AuthStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		token := extractToken(r)
+		user, err := authStore.getUserByToken(token)
+		if token == "" || err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			CurrentPassword string `json:"currentPassword"`
+			NewPassword     string `json:"newPassword"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		ip := getClientIP(cfg, r)
+		if wait := authStore.guard.check(user.Username, ip); wait > 0 {
+			writeTooManyAttempts(w, r, wait)
+			return
+		}
+
+		if err := authStore.changePassword(user, req.CurrentPassword, req.NewPassword, token); err != nil {
+			if errors.Is(err, errWrongPassword) {
+				authStore.guard.recordFailure(user.Username, ip)
+				writeJSONMessage(w, http.StatusForbidden, localizeError(requestLocale(r), err))
+				return
+			}
+			writeJSONMessage(w, http.StatusBadRequest, localizeError(requestLocale(r), err))
+			return
+		}
+
+		audit("password_changed", "user_id", user.UserID, "ip", redactIP(ip))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleRequestPasswordReset sends a reset token through the mailer. It
+// always answers 202 so that it cannot be used to probe for usernames. Every
+// request counts against the reset guard, which backs off and then locks out
+// repeated requests for the same username or from the same IP.
+func handleRequestPasswordReset(cfg *Config, authStore *AuthStore, mailer Mailer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Username string `json:"username"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		ip := getClientIP(cfg, r)
+		if wait := authStore.resetGuard.check(req.Username, ip); wait > 0 {
+			writeTooManyAttempts(w, r, wait)
+			return
+		}
+		authStore.resetGuard.recordFailure(req.Username, ip)
+
+		if user := authStore.getUserByUsername(req.Username); user != nil {
+			token, expiresAt, err := authStore.issueResetToken(user)
+			if err == nil {
+				err = mailer.SendPasswordReset(user, token, expiresAt)
+			}
+			if err != nil {
+				slog.Error("password reset delivery failed", "user_id", user.UserID, "err", err)
+			} else {
+				audit("password_reset_requested", "user_id", user.UserID, "ip", redactIP(ip))
+			}
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func handleConfirmPasswordReset(cfg *Config, authStore *AuthStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Token       string `json:"token"`
+			NewPassword string `json:"newPassword"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		user, err := authStore.resetPassword(req.Token, req.NewPassword)
+		if err != nil {
+			writeJSONMessage(w, http.StatusBadRequest, localizeError(requestLocale(r), err))
+			return
+		}
+		authStore.guard.recordSuccess(user.Username)
+		authStore.resetGuard.recordSuccess(user.Username)
+
+		audit("password_reset", "user_id", user.UserID, "ip", redactIP(getClientIP(cfg, r)))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestValidatePassword(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.PasswordMinLength = 10
+	cfg.PasswordMinClasses = 2
+
+	tests := []struct {
+		name     string
+		password string
+		key      string // catalogue key of the expected error
+	}{
+		{"valid", "correct horse battery", ""},
+		{"too short", "Short1!", "error.password_too_short"},
+		{"length counts characters", "ééééééééé1", ""},
+		{"too long", strings.Repeat("aB3", 25), "error.password_too_long"},
+		{"matches username", "ALICE-SMITH-1", "error.password_matches_username"},
+		{"one class", "lowercaseonly", "error.password_too_simple"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePassword(cfg, "alice-smith-1", tt.password)
+			if tt.key == "" {
+				if err != nil {
+					t.Fatalf("validatePassword = %v, want nil", err)
+				}
+				return
+			}
+			var le *localizedError
+			if !errors.As(err, &le) || le.key != tt.key {
+				t.Fatalf("validatePassword = %v, want %s", err, tt.key)
+			}
+		})
+	}
+
+	err := validatePassword(cfg, "alice", "short")
+	if got, want := localizeError("ru", err), "пароль должен содержать не менее 10 символов"; got != want {
+		t.Errorf("ru message = %q, want %q", got, want)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	cfg := newTestConfig()
+	authStore := newAuthStore(cfg)
+	user, session := newTestUser(t, authStore, "alice", "correct horse battery")
+
+	token, _, err := authStore.issueResetToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authStore.resetPassword(token+"x", "new horse battery"); !errors.Is(err, errInvalidResetToken) {
+		t.Fatalf("tampered token: %v", err)
+	}
+	if _, err := authStore.resetPassword(token, "new horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authStore.verifyUser("alice", "new horse battery"); err != nil {
+		t.Fatalf("new password rejected: %v", err)
+	}
+	if _, err := authStore.getUserByToken(session); err == nil {
+		t.Error("session survived a password reset")
+	}
+	// The token is bound to the old password hash, so it is single-use.
+	if _, err := authStore.resetPassword(token, "third horse battery"); !errors.Is(err, errInvalidResetToken) {
+		t.Fatalf("reused token: %v", err)
+	}
+}
+
+func TestResetTokenInvalidatedByPasswordChange(t *testing.T) {
+	cfg := newTestConfig()
+	authStore := newAuthStore(cfg)
+	user, session := newTestUser(t, authStore, "alice", "correct horse battery")
+
+	token, _, err := authStore.issueResetToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authStore.changePassword(user, "correct horse battery", "new horse battery", session); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authStore.resetPassword(token, "third horse battery"); !errors.Is(err, errInvalidResetToken) {
+		t.Fatalf("token issued before a password change: %v", err)
+	}
+}
+
+func TestResetTokenExpiry(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.PasswordResetTTLMinutes = -1
+	authStore := newAuthStore(cfg)
+	user, _ := newTestUser(t, authStore, "alice", "correct horse battery")
+
+	token, _, err := authStore.issueResetToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authStore.resetPassword(token, "new horse battery"); !errors.Is(err, errInvalidResetToken) {
+		t.Fatalf("expired token: %v", err)
+	}
+}
+
+func TestChangePasswordRevokesOtherSessions(t *testing.T) {
+	cfg := newTestConfig()
+	authStore := newAuthStore(cfg)
+	user, current := newTestUser(t, authStore, "alice", "correct horse battery")
+	other, err := authStore.createToken(user.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, bystander := newTestUser(t, authStore, "bob", "correct horse battery")
+
+	if err := authStore.changePassword(user, "wrong horse battery", "new horse battery", current); !errors.Is(err, errWrongPassword) {
+		t.Fatalf("wrong current password: %v", err)
+	}
+	if _, err := authStore.getUserByToken(other); err != nil {
+		t.Fatal("a failed change revoked sessions")
+	}
+
+	if err := authStore.changePassword(user, "correct horse battery", "new horse battery", current); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authStore.getUserByToken(current); err != nil {
+		t.Error("the session that changed the password was revoked")
+	}
+	if _, err := authStore.getUserByToken(other); err == nil {
+		t.Error("another session survived the password change")
+	}
+	if _, err := authStore.getUserByToken(bystander); err != nil {
+		t.Error("another user's session was revoked")
+	}
+}
+
+func TestVerifyUserUpgradesCost(t *testing.T) {
+	cfg := newTestConfig()
+	authStore := newAuthStore(cfg)
+	user, _ := newTestUser(t, authStore, "alice", "correct horse battery")
+
+	cfg.BcryptCost = bcrypt.MinCost + 1
+	cfg.applyReloadable(cfg)
+	if _, err := authStore.verifyUser("alice", "wrong horse battery"); err == nil {
+		t.Fatal("wrong password accepted")
+	}
+	if cost, _ := bcrypt.Cost([]byte(user.PasswordHash)); cost != bcrypt.MinCost {
+		t.Fatalf("failed login rehashed the password (cost %d)", cost)
+	}
+
+	if _, err := authStore.verifyUser("alice", "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	if cost, _ := bcrypt.Cost([]byte(user.PasswordHash)); cost != cfg.BcryptCost {
+		t.Fatalf("cost = %d, want %d", cost, cfg.BcryptCost)
+	}
+	if _, err := authStore.verifyUser("alice", "correct horse battery"); err != nil {
+		t.Fatalf("upgraded hash rejects the password: %v", err)
+	}
+}
+
+func TestConcurrentPasswordChanges(t *testing.T) {
+	cfg := newTestConfig()
+	authStore := newAuthStore(cfg)
+	user, session := newTestUser(t, authStore, "alice", "correct horse battery")
+
+	// Both requests know the current password; only one may replace it.
+	const n = 8
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = authStore.changePassword(user, "correct horse battery", "new horse battery "+string(rune('a'+i)), session)
+		}(i)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, errWrongPassword):
+			t.Fatalf("changePassword: %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("%d concurrent changes succeeded, want 1", succeeded)
+	}
+}
+
+func TestChangePasswordJSONErrors(t *testing.T) {
+	cfg := newTestConfig()
+	authStore := newAuthStore(cfg)
+	_, session := newTestUser(t, authStore, "alice", "correct horse battery")
+
+	for _, tt := range []struct {
+		body string
+		code int
+	}{
+		{`{"currentPassword":"wrong horse battery","newPassword":"new horse battery"}`, http.StatusForbidden},
+		{`{"currentPassword":"correct horse battery","newPassword":"short"}`, http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/auth/password", strings.NewReader(tt.body))
+		req.Header.Set("Authorization", "Bearer "+session)
+		rec := httptest.NewRecorder()
+		handleChangePassword(cfg, authStore)(rec, req)
+		var body struct {
+			Message string `json:"message"`
+		}
+		if rec.Code != tt.code || rec.Header().Get("Content-Type") != "application/json" || json.NewDecoder(rec.Body).Decode(&body) != nil || body.Message == "" {
+			t.Errorf("%s: %d %q, want a %d JSON message", tt.body, rec.Code, rec.Header().Get("Content-Type"), tt.code)
+		}
+	}
+}
+
+type countingMailer struct {
+	mu   sync.Mutex
+	sent int
+}
+
+func (m *countingMailer) SendPasswordReset(*User, string, time.Time) error {
+	m.mu.Lock()
+	m.sent++
+	m.mu.Unlock()
+	return nil
+}
+
+func TestPasswordResetRequestsThrottled(t *testing.T) {
+	cfg := newTestConfig()
+	authStore := newAuthStore(cfg)
+	newTestUser(t, authStore, "alice", "correct horse battery")
+	mailer := &countingMailer{}
+	h := handleRequestPasswordReset(cfg, authStore, mailer)
+
+	request := func(username, ip string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/auth/password-reset/request", strings.NewReader(`{"username":"`+username+`"}`))
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec.Code
+	}
+
+	for i := 0; i <= loginFreeAttempts; i++ {
+		if code := request("alice", "203.0.113.5"); code != http.StatusAccepted {
+			t.Fatalf("request %d: %d, want 202", i+1, code)
+		}
+	}
+	// Further requests for the account back off, from any IP, and unknown
+	// usernames are throttled the same way.
+	if code := request("alice", "198.51.100.9"); code != http.StatusTooManyRequests {
+		t.Fatalf("request after %d: %d, want 429", loginFreeAttempts+1, code)
+	}
+	if mailer.sent != loginFreeAttempts+1 {
+		t.Errorf("%d reset emails sent, want %d", mailer.sent, loginFreeAttempts+1)
+	}
+	for i := 0; i <= loginFreeAttempts; i++ {
+		request("nobody-here", "192.0.2.1")
+	}
+	if code := request("nobody-here", "192.0.2.2"); code != http.StatusTooManyRequests {
+		t.Fatalf("unknown username: %d, want 429", code)
+	}
+
+	// Reset requests do not lock the account out of logging in.
+	if wait := authStore.guard.check("alice", "203.0.113.5"); wait != 0 {
+		t.Errorf("login blocked for %v after reset requests", wait)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxDisplayNameLen = 64
+	maxBioLen         = 280
+	maxStatusLen      = 100
+	maxAvatarBytes    = 2 << 20
+	maxAvatarSide     = 4096
+)
+
+// avatarTypes maps accepted upload types to the stored file extension.
+var avatarTypes = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+}
+
+// Profile is the public view of a user returned by search, chat listings and
+// profile events.
+type Profile struct {
+	UserID      string `json:"userId"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+	Status      string `json:"status,omitempty"`
+	AvatarURL   string `json:"avatarUrl,omitempty"`
+}
+
+func avatarDir(cfg *Config) string {
+	return filepath.Join(cfg.DataDir, "avatars")
+}
+
+func (s *AuthStore) profileLocked(user *User) Profile {
+	p := Profile{
+		UserID:      user.UserID,
+		Username:    user.Username,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		Status:      user.Status,
+	}
+	if user.AvatarFile != "" {
+		// The version parameter lets clients cache avatars indefinitely.
+		p.AvatarURL = "/api/avatars/" + user.UserID + "?v=" + strconv.FormatInt(user.AvatarUpdatedAt, 10)
+	}
+	return p
+}
+
+func (s *AuthStore) profile(user *User) Profile {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.profileLocked(user)
+}
+
+// profiles returns the profiles of the given user IDs that still exist.
+func (s *AuthStore) profiles(userIDs []string) map[string]Profile {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	profiles := make(map[string]Profile, len(userIDs))
+	for _, id := range userIDs {
+		if user, ok := s.usersByID[id]; ok {
+			profiles[id] = s.profileLocked(user)
+		}
+	}
+	return profiles
+}
+
+// cleanProfileText trims the value and rejects control characters and
+// overlong input.
+func cleanProfileText(field, value string, maxLen int) (string, error) {
+	value = strings.TrimSpace(value)
+	if !utf8.ValidString(value) {
+		return "", fmt.Errorf("%s must be valid UTF-8", field)
+	}
+	if utf8.RuneCountInString(value) > maxLen {
+		return "", fmt.Errorf("%s must be at most %d characters", field, maxLen)
+	}
+	for _, r := range value {
+		if unicode.IsControl(r) && !(field == "bio" && r == '\n') {
+			return "", fmt.Errorf("%s must not contain control characters", field)
+		}
+	}
+	return value, nil
+}
+
+// validateAvatar checks the upload's type and dimensions and returns the
+// file extension to store it under.
+func validateAvatar(data []byte) (string, error) {
+	ext, ok := avatarTypes[http.DetectContentType(data)]
+	if !ok {
+		return "", errors.New("avatar must be a PNG or JPEG image")
+	}
+	imgCfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", errors.New("avatar image could not be decoded")
+	}
+	if imgCfg.Width > maxAvatarSide || imgCfg.Height > maxAvatarSide {
+		return "", fmt.Errorf("avatar must be at most %dx%d pixels", maxAvatarSide, maxAvatarSide)
+	}
+	return ext, nil
+}
+
+// saveAvatar stores a validated image under DATA_DIR, replacing any previous
+// avatar.
+func (s *AuthStore) saveAvatar(user *User, data []byte, ext string) error {
+	dir := avatarDir(s.cfg)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	name := user.UserID + ext
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	previous := user.AvatarFile
+	user.AvatarFile = name
+	user.AvatarUpdatedAt = time.Now().UnixMilli()
+	s.mu.Unlock()
+	if previous != "" && previous != name {
+		os.Remove(filepath.Join(dir, previous))
+	}
+	return nil
+}
+
+func (s *AuthStore) removeAvatar(user *User) {
+	s.mu.Lock()
+	previous := user.AvatarFile
+	user.AvatarFile = ""
+	user.AvatarUpdatedAt = 0
+	s.mu.Unlock()
+	if previous != "" {
+		os.Remove(filepath.Join(avatarDir(s.cfg), previous))
+	}
+}
+
+// notifyProfileUpdated sends a profile_updated event to everyone the user
+// shares a chat with.
+func (s *MessagingStore) notifyProfileUpdated(profile Profile) {
+	data, _ := json.Marshal(map[string]interface{}{
+		"type":    "profile_updated",
+		"profile": profile,
+	})
+
+	s.mu.RLock()
+	partners := make(map[string]bool)
+	for _, chatID := range s.userChats[profile.UserID] {
+		if chat := s.chats[chatID]; chat != nil {
+			// anonymizeUser replaces Participants under chat.mu.
+			chat.mu.Lock()
+			participants := chat.Participants
+			chat.mu.Unlock()
+			for _, id := range participants {
+				if id != profile.UserID {
+					partners[id] = true
+				}
+			}
+		}
+	}
+	conns := make(map[string]*msgConn, len(partners))
+	for id := range partners {
+		if conn := s.wsClients[id]; conn != nil {
+			conns[id] = conn
+		}
+	}
+	s.mu.RUnlock()
+
+	for id, conn := range conns {
+		if err := conn.send(data); err != nil {
+			slog.Warn("failed to deliver profile update", "user_id", id, "err", err)
+		}
+	}
+}
+
+// handleProfile serves GET and PATCH for the caller's own profile.
+func handleProfile(authStore *AuthStore, msgStore *MessagingStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := authStore.getUserByToken(extractToken(r))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPatch:
+			var req struct {
+				DisplayName *string `json:"displayName"`
+				Bio         *string `json:"bio"`
+				Status      *string `json:"status"`
+			}
+			if err := json.NewDecoder(io.LimitReader(r.Body, 16<<10)).Decode(&req); err != nil {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+
+			fields := []struct {
+				name   string
+				value  *string
+				maxLen int
+				dst    *string
+			}{
+				{"displayName", req.DisplayName, maxDisplayNameLen, &user.DisplayName},
+				{"bio", req.Bio, maxBioLen, &user.Bio},
+				{"status", req.Status, maxStatusLen, &user.Status},
+			}
+			cleaned := make([]string, len(fields))
+			for i, f := range fields {
+				if f.value == nil {
+					continue
+				}
+				if cleaned[i], err = cleanProfileText(f.name, *f.value, f.maxLen); err != nil {
+					writeJSONMessage(w, http.StatusBadRequest, err.Error())
+					return
+				}
+			}
+
+			authStore.mu.Lock()
+			for i, f := range fields {
+				if f.value != nil {
+					*f.dst = cleaned[i]
+				}
+			}
+			if req.DisplayName != nil {
+				authStore.searchIndex.reindex(user)
+			}
+			authStore.mu.Unlock()
+			msgStore.notifyProfileUpdated(authStore.profile(user))
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(authStore.profile(user))
+	}
+}
+
+// handleProfileAvatar accepts a raw image body (POST) or removes the avatar
+// (DELETE).
+func handleProfileAvatar(authStore *AuthStore, msgStore *MessagingStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := authStore.getUserByToken(extractToken(r))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			data, err := io.ReadAll(io.LimitReader(r.Body, maxAvatarBytes+1))
+			if err != nil {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if len(data) > maxAvatarBytes {
+				http.Error(w, "Avatar too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			ext, err := validateAvatar(data)
+			if err != nil {
+				writeJSONMessage(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if err := authStore.saveAvatar(user, data, ext); err != nil {
+				slog.Error("failed to store avatar", "user_id", user.UserID, "err", err)
+				http.Error(w, "Failed to store avatar", http.StatusInternalServerError)
+				return
+			}
+		case http.MethodDelete:
+			authStore.removeAvatar(user)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		profile := authStore.profile(user)
+		msgStore.notifyProfileUpdated(profile)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(profile)
+	}
+}
+
+// handleAvatar serves /api/avatars/{userId}. Avatars of users searchable by
+// everyone are public so that they can be used directly in <img> tags; other
+// avatars need a bearer token of a user who may see the profile. Hidden
+// avatars are reported as not found.
+func handleAvatar(authStore *AuthStore, msgStore *MessagingStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		userID := strings.TrimPrefix(r.URL.Path, "/api/avatars/")
+
+		var viewer *User
+		if token := extractToken(r); token != "" {
+			viewer, _ = authStore.getUserByToken(token)
+		}
+		authStore.mu.RLock()
+		target := authStore.usersByID[userID]
+		var file string
+		if target != nil {
+			file = target.AvatarFile
+		}
+		authStore.mu.RUnlock()
+		if file == "" || !canSeeProfile(authStore, msgStore, viewer, target) {
+			http.NotFound(w, r)
+			return
+		}
+
+		// The response depends on the viewer, so it must not be shared.
+		w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+		w.Header().Set("Vary", "Authorization")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		http.ServeFile(w, r, filepath.Join(avatarDir(authStore.cfg), file))
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// PROXY protocol v2 support for the HTTP listener, so that a TCP load
+// balancer in front of the server can pass the original client address.
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+
+const (
+	proxyProtoOff      = "off"
+	proxyProtoOptional = "optional"
+	proxyProtoRequired = "required"
+
+	proxyProtoHeaderTimeout = 5 * time.Second
+)
+
+var proxyProtoV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+var errProxyProtoMissing = errors.New("proxy protocol header required")
+
+// proxyProtoListener wraps accepted connections so that a PROXY v2 header
+// sent by a trusted proxy replaces the connection's remote address.
+type proxyProtoListener struct {
+	net.Listener
+	cfg      *Config
+	required bool
+}
+
+func newProxyProtoListener(inner net.Listener, cfg *Config) net.Listener {
+	if cfg.ProxyProtocol == proxyProtoOff {
+		return inner
+	}
+	return &proxyProtoListener{
+		Listener: inner,
+		cfg:      cfg,
+		required: cfg.ProxyProtocol == proxyProtoRequired,
+	}
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: conn, listener: l}, nil
+}
+
+// proxyProtoConn parses the header lazily, on the first Read or RemoteAddr
+// call, so that a slow client cannot stall the accept loop.
+type proxyProtoConn struct {
+	net.Conn
+	listener *proxyProtoListener
+	once     sync.Once
+	reader   io.Reader
+	remote   net.Addr
+	err      error
+}
+
+func (c *proxyProtoConn) init() {
+	c.remote = c.Conn.RemoteAddr()
+	br := bufio.NewReader(c.Conn)
+	c.reader = br
+
+	peer := remoteIP(c.remote.String())
+	if !c.listener.cfg.isTrustedProxy(peer) {
+		return
+	}
+
+	c.Conn.SetReadDeadline(time.Now().Add(proxyProtoHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	sig, err := br.Peek(len(proxyProtoV2Signature))
+	if err != nil || !bytes.Equal(sig, proxyProtoV2Signature) {
+		if c.listener.required {
+			c.err = errProxyProtoMissing
+		}
+		return
+	}
+
+	addr, err := readProxyProtoV2(br)
+	if err != nil {
+		c.err = err
+		return
+	}
+	if addr != nil {
+		c.remote = addr
+	}
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.once.Do(c.init)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.once.Do(c.init)
+	return c.remote
+}
+
+// readProxyProtoV2 consumes a v2 header and returns the source address, or
+// nil for LOCAL commands and unsupported address families.
+func readProxyProtoV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("proxy protocol: reading header: %w", err)
+	}
+	verCmd, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("proxy protocol: unsupported version %d", verCmd>>4)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("proxy protocol: reading addresses: %w", err)
+	}
+
+	switch verCmd & 0x0F {
+	case 0x0: // LOCAL: health check from the proxy itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("proxy protocol: unsupported command %d", verCmd&0x0F)
+	}
+
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		if len(body) < 12 {
+			return nil, errors.New("proxy protocol: short IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errors.New("proxy protocol: short IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
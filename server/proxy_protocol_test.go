@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// proxyV2Header builds a PROXY v2 header with the given command, address
+// family byte and address block.
+func proxyV2Header(cmd, family byte, addrs []byte) []byte {
+	h := append([]byte(nil), proxyProtoV2Signature...)
+	h = append(h, 0x20|cmd, family)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(addrs)))
+	return append(h, addrs...)
+}
+
+func proxyV2Addrs(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	var b []byte
+	b = append(b, src...)
+	b = append(b, dst...)
+	b = binary.BigEndian.AppendUint16(b, srcPort)
+	return binary.BigEndian.AppendUint16(b, dstPort)
+}
+
+func TestReadProxyProtoV2(t *testing.T) {
+	v4 := proxyV2Addrs(net.ParseIP("203.0.113.7").To4(), net.ParseIP("10.0.0.1").To4(), 51234, 443)
+	v6 := proxyV2Addrs(net.ParseIP("2001:db8::7"), net.ParseIP("fd00::1"), 51234, 443)
+	badVersion := proxyV2Header(0x1, 0x11, v4)
+	badVersion[12] = 0x11
+	tests := []struct {
+		name    string
+		header  []byte
+		addr    string // empty for no address
+		wantErr bool
+	}{
+		{name: "tcp4", header: proxyV2Header(0x1, 0x11, v4), addr: "203.0.113.7:51234"},
+		{name: "tcp6", header: proxyV2Header(0x1, 0x21, v6), addr: "[2001:db8::7]:51234"},
+		{name: "tlvs after addresses", header: proxyV2Header(0x1, 0x11, append(v4, 0x04, 0x00, 0x01, 0xFF)), addr: "203.0.113.7:51234"},
+		{name: "local", header: proxyV2Header(0x0, 0x00, nil)},
+		{name: "local with addresses", header: proxyV2Header(0x0, 0x11, v4)},
+		{name: "unix family", header: proxyV2Header(0x1, 0x31, make([]byte, 216))},
+		{name: "truncated header", header: proxyV2Header(0x1, 0x11, v4)[:14], wantErr: true},
+		{name: "truncated addresses", header: proxyV2Header(0x1, 0x11, v4)[:20], wantErr: true},
+		{name: "short ipv4 block", header: proxyV2Header(0x1, 0x11, v4[:8]), wantErr: true},
+		{name: "short ipv6 block", header: proxyV2Header(0x1, 0x21, v6[:32]), wantErr: true},
+		{name: "unsupported version", header: badVersion, wantErr: true},
+		{name: "unknown command", header: proxyV2Header(0x2, 0x11, v4), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := tt.header
+			if !tt.wantErr {
+				stream = append(stream, "GET / HTTP/1.1\r\n"...)
+			}
+			r := bufio.NewReader(bytes.NewReader(stream))
+			addr, err := readProxyProtoV2(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readProxyProtoV2 = %v, want an error", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.addr {
+				t.Fatalf("address = %q, want %q", got, tt.addr)
+			}
+			// The whole header, TLVs included, is consumed.
+			if rest, _ := io.ReadAll(r); string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Fatalf("left %q after the header", rest)
+			}
+		})
+	}
+}
+
+// peerConn is one end of a net.Pipe with a chosen remote address.
+type peerConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *peerConn) RemoteAddr() net.Addr { return c.remote }
+
+// dialProxyProto returns a proxyProtoConn accepted from peer, after the
+// peer has sent data and closed its side.
+func dialProxyProto(t *testing.T, mode, peer string, data []byte) net.Conn {
+	t.Helper()
+	cfg := newTestConfig()
+	cfg.ProxyProtocol = mode
+	nets, err := parseCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.trustedProxies = nets
+
+	server, client := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	remote, _ := net.ResolveTCPAddr("tcp", peer)
+	listener := newProxyProtoListener(nil, cfg).(*proxyProtoListener)
+	return &proxyProtoConn{Conn: &peerConn{Conn: server, remote: remote}, listener: listener}
+}
+
+func TestProxyProtoConn(t *testing.T) {
+	payload := []byte("GET / HTTP/1.1\r\n")
+	v4 := proxyV2Header(0x1, 0x11, proxyV2Addrs(net.ParseIP("203.0.113.7").To4(), net.ParseIP("10.0.0.1").To4(), 51234, 443))
+	local := proxyV2Header(0x0, 0x00, nil)
+	tests := []struct {
+		name    string
+		mode    string
+		peer    string
+		data    []byte
+		remote  string
+		read    []byte
+		readErr error
+	}{
+		{name: "trusted proxy", mode: proxyProtoOptional, peer: "10.1.2.3:40000", data: append(v4, payload...), remote: "203.0.113.7:51234", read: payload},
+		{name: "local health check", mode: proxyProtoRequired, peer: "10.1.2.3:40000", data: append(local, payload...), remote: "10.1.2.3:40000", read: payload},
+		{name: "optional without header", mode: proxyProtoOptional, peer: "10.1.2.3:40000", data: payload, remote: "10.1.2.3:40000", read: payload},
+		{name: "required without header", mode: proxyProtoRequired, peer: "10.1.2.3:40000", data: payload, remote: "10.1.2.3:40000", readErr: errProxyProtoMissing},
+		// An untrusted client cannot claim another address; its bytes are
+		// passed through untouched for the HTTP server to reject.
+		{name: "untrusted peer", mode: proxyProtoRequired, peer: "198.51.100.9:40000", data: append(v4, payload...), remote: "198.51.100.9:40000", read: append(v4, payload...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dialProxyProto(t, tt.mode, tt.peer, tt.data)
+			if got := conn.RemoteAddr().String(); got != tt.remote {
+				t.Errorf("RemoteAddr = %s, want %s", got, tt.remote)
+			}
+			got, err := io.ReadAll(conn)
+			if tt.readErr != nil {
+				if !errors.Is(err, tt.readErr) {
+					t.Fatalf("Read = %v, want %v", err, tt.readErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.read) {
+				t.Fatalf("read %q, want %q", got, tt.read)
+			}
+		})
+	}
+}
+
+func TestProxyProtoConnTruncatedHeader(t *testing.T) {
+	v4 := proxyV2Header(0x1, 0x11, proxyV2Addrs(net.ParseIP("203.0.113.7").To4(), net.ParseIP("10.0.0.1").To4(), 51234, 443))
+	conn := dialProxyProto(t, proxyProtoOptional, "10.1.2.3:40000", v4[:20])
+	if _, err := conn.Read(make([]byte, 64)); err == nil {
+		t.Fatal("Read after a truncated header succeeded")
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,9 +21,14 @@ import (
 )
 
 type PushService struct {
+	cfg        *Config
 	db         *sql.DB
 	privateKey string
 	publicKey  string
+	providers  map[string]PushProvider // platform -> provider
+	auth       *AuthStore              // priority contacts for quiet hours
+	queue      *pushQueue
+	snapshots  *SnapshotStore
 	mu         sync.RWMutex
 }
 
@@ -38,6 +45,9 @@ type PushSubscriptionRequest struct {
 	} `json:"keys"`
 	Locale       string          `json:"locale"`
 	EncPublicKey json.RawMessage `json:"encPublicKey"`
+	// Platform is web (default), fcm, apns or apns-voip. Native platforms
+	// send the device token as the endpoint.
+	Platform string `json:"platform"`
 }
 
 type SnapshotRecipient struct {
@@ -61,50 +71,29 @@ type SnapshotRecipientKey struct {
 }
 
 type SnapshotMeta struct {
+	RoomID       string                          `json:"roomId"`
 	IV           string                          `json:"iv"`
 	Salt         string                          `json:"salt"`
 	EphemeralKey string                          `json:"ephemeralPubKey"`
 	Mime         string                          `json:"mime"`
 	CreatedAt    int64                           `json:"createdAt"`
+	Size         int64                           `json:"size"`
 	Recipients   map[string]SnapshotRecipientKey `json:"recipients"`
 }
 
-var pushService *PushService
-
-func getDataDir() string {
-	dataDir := os.Getenv("DATA_DIR")
-	if dataDir == "" {
-		dataDir = "."
-	}
-	return dataDir
-}
-
-func getSnapshotDir() string {
-	return filepath.Join(getDataDir(), "snapshots")
-}
-
-func snapshotDataPath(id string) string {
-	return filepath.Join(getSnapshotDir(), id+".bin")
-}
-
-func snapshotMetaPath(id string) string {
-	return filepath.Join(getSnapshotDir(), id+".json")
-}
-
-func InitPushService() error {
-	dataDir := getDataDir()
+func newPushService(cfg *Config, auth *AuthStore) (*PushService, error) {
+	dataDir := cfg.DataDir
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
-		return fmt.Errorf("failed to create data dir: %v", err)
-	}
-	if err := os.MkdirAll(getSnapshotDir(), 0755); err != nil {
-		return fmt.Errorf("failed to create snapshot dir: %v", err)
+		return nil, fmt.Errorf("failed to create data dir: %v", err)
 	}
 
 	// 1. Setup SQLite
-	dbPath := fmt.Sprintf("%s/subscriptions.db", dataDir)
-	db, err := sql.Open("sqlite", dbPath)
+	dbPath := filepath.Join(dataDir, "subscriptions.db")
+	// The delivery queue writes from several workers; wait for locks rather
+	// than failing with SQLITE_BUSY.
+	db, err := sql.Open("sqlite", dbPath+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
 	if err != nil {
-		return fmt.Errorf("failed to open sqlite db: %v", err)
+		return nil, fmt.Errorf("failed to open sqlite db: %v", err)
 	}
 
 	createTableSQL := `
@@ -121,34 +110,76 @@ func InitPushService() error {
 	);`
 
 	if _, err := db.Exec(createTableSQL); err != nil {
-		return fmt.Errorf("failed to create table: %v", err)
+		return nil, fmt.Errorf("failed to create table: %v", err)
 	}
 
 	// Migration: Add locale column if not exists (simplistic check)
 	// Ignore error if column exists
 	_, _ = db.Exec("ALTER TABLE subscriptions ADD COLUMN locale TEXT DEFAULT 'en'")
 	_, _ = db.Exec("ALTER TABLE subscriptions ADD COLUMN enc_pubkey TEXT")
+	// user_id links subscriptions made while signed in, so they can be
+	// purged with the account.
+	_, _ = db.Exec("ALTER TABLE subscriptions ADD COLUMN user_id TEXT")
+
+	if err := createUserSubscriptionsTable(db); err != nil {
+		return nil, fmt.Errorf("failed to create table: %v", err)
+	}
+	_, _ = db.Exec("ALTER TABLE subscriptions ADD COLUMN platform TEXT NOT NULL DEFAULT 'web'")
+	_, _ = db.Exec("ALTER TABLE user_subscriptions ADD COLUMN platform TEXT NOT NULL DEFAULT 'web'")
+	// refreshed_at is bumped whenever a client subscribes again; stale
+	// subscriptions expire after PUSH_SUBSCRIPTION_TTL_DAYS.
+	for _, table := range []string{"subscriptions", "user_subscriptions"} {
+		_, _ = db.Exec("ALTER TABLE " + table + " ADD COLUMN refreshed_at INTEGER")
+		_, _ = db.Exec("UPDATE " + table + " SET refreshed_at = created_at WHERE refreshed_at IS NULL")
+	}
+	if err := createPushQueueTables(db); err != nil {
+		return nil, fmt.Errorf("failed to create table: %v", err)
+	}
+	if err := createQuietHoursTable(db); err != nil {
+		return nil, fmt.Errorf("failed to create table: %v", err)
+	}
+	_, _ = db.Exec("ALTER TABLE subscriptions ADD COLUMN muted_until INTEGER NOT NULL DEFAULT 0")
 
 	// 2. Setup VAPID Keys
-	keys, err := loadOrGenerateVAPIDKeys()
+	keys, err := loadOrGenerateVAPIDKeys(dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup VAPID keys: %v", err)
+	}
+
+	providers, err := newPushProviders(cfg, keys)
 	if err != nil {
-		return fmt.Errorf("failed to setup VAPID keys: %v", err)
+		return nil, fmt.Errorf("failed to setup push providers: %v", err)
 	}
 
-	pushService = &PushService{
+	snapshots, err := newSnapshotStore(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup snapshot store: %v", err)
+	}
+
+	s := &PushService{
+		cfg:        cfg,
 		db:         db,
 		privateKey: keys.PrivateKey,
 		publicKey:  keys.PublicKey,
+		providers:  providers,
+		auth:       auth,
+		snapshots:  snapshots,
 	}
+	s.queue = newPushQueue(s)
 
-	log.Printf("[PUSH] PushService initialized with SQLite persistence at %s", dbPath)
-	return nil
+	platforms := make([]string, 0, len(providers))
+	for platform := range providers {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+	slog.Info("push service initialized", "db", dbPath, "platforms", platforms)
+	return s, nil
 }
 
-func loadOrGenerateVAPIDKeys() (*VAPIDKeys, error) {
-	filename := fmt.Sprintf("%s/vapid.json", getDataDir())
+func loadOrGenerateVAPIDKeys(dataDir string) (*VAPIDKeys, error) {
+	filename := filepath.Join(dataDir, "vapid.json")
 	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		log.Println("[PUSH] Generating new VAPID keys...")
+		slog.Info("generating new VAPID keys")
 		privateKey, publicKey, err := webpush.GenerateVAPIDKeys()
 		if err != nil {
 			return nil, err
@@ -175,14 +206,41 @@ func loadOrGenerateVAPIDKeys() (*VAPIDKeys, error) {
 	return &keys, nil
 }
 
+// RunQueue delivers queued notifications; it blocks forever.
+func (s *PushService) RunQueue() {
+	s.queue.run()
+}
+
+// RunSnapshotJanitor deletes expired snapshots; it blocks forever.
+func (s *PushService) RunSnapshotJanitor() {
+	s.snapshots.RunJanitor()
+}
+
 func (s *PushService) GetVAPIDPublicKey() string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	return s.publicKey
 }
 
-func (s *PushService) Subscribe(roomID string, sub PushSubscriptionRequest) error {
-	stmt, err := s.db.Prepare("INSERT OR REPLACE INTO subscriptions(room_id, endpoint, auth, p256dh, locale, enc_pubkey, created_at) VALUES(?, ?, ?, ?, ?, ?, ?)")
+// validatePlatform defaults an empty platform to web and rejects platforms
+// without a configured provider.
+func (s *PushService) validatePlatform(sub *PushSubscriptionRequest) error {
+	if sub.Platform == "" {
+		sub.Platform = platformWeb
+	}
+	if _, ok := s.providers[sub.Platform]; !ok {
+		return fmt.Errorf("push platform %q is not supported", sub.Platform)
+	}
+	if sub.Endpoint == "" {
+		return errors.New("missing endpoint")
+	}
+	return nil
+}
+
+// Subscribe stores a subscription for the room. userID is empty for
+// anonymous subscribers.
+func (s *PushService) Subscribe(roomID string, sub PushSubscriptionRequest, userID string) error {
+	stmt, err := s.db.Prepare("INSERT OR REPLACE INTO subscriptions(room_id, endpoint, auth, p256dh, locale, enc_pubkey, user_id, platform, created_at, refreshed_at) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		return err
 	}
@@ -198,12 +256,23 @@ func (s *PushService) Subscribe(roomID string, sub PushSubscriptionRequest) erro
 		encKey = ""
 	}
 
-	_, err = stmt.Exec(roomID, sub.Endpoint, sub.Keys.Auth, sub.Keys.P256dh, locale, encKey, time.Now().UnixMilli())
+	var uid interface{}
+	if userID != "" {
+		uid = userID
+	}
+
+	platform := sub.Platform
+	if platform == "" {
+		platform = platformWeb
+	}
+
+	now := time.Now().UnixMilli()
+	_, err = stmt.Exec(roomID, sub.Endpoint, sub.Keys.Auth, sub.Keys.P256dh, locale, encKey, uid, platform, now, now)
 	if err != nil {
-		log.Printf("[PUSH] Failed to save subscription: %v", err)
+		slog.Error("failed to save push subscription", "rid", redactRoomID(roomID), "endpoint", redactEndpoint(sub.Endpoint), "err", err)
 		return err
 	}
-	log.Printf("[PUSH] Subscribed endpoint %s to room %s (locale: %s)", sub.Endpoint, roomID, locale)
+	slog.Info("push subscribed", "rid", redactRoomID(roomID), "platform", platform, "endpoint", redactEndpoint(sub.Endpoint), "locale", locale)
 	return nil
 }
 
@@ -218,142 +287,181 @@ func (s *PushService) Unsubscribe(roomID string, endpoint string) error {
 	if err != nil {
 		return err
 	}
-	log.Printf("[PUSH] Unsubscribed endpoint %s from room %s", endpoint, roomID)
+	slog.Info("push unsubscribed", "rid", redactRoomID(roomID), "endpoint", redactEndpoint(endpoint))
 	return nil
 }
 
-func (s *PushService) SendNotificationToRoom(roomID string, excludeEndpoint string, snapshotID string) {
-	rows, err := s.db.Query("SELECT id, endpoint, auth, p256dh, locale FROM subscriptions WHERE room_id = ?", roomID)
+// endpointProof names a device's push endpoint together with its current
+// auth secret, which proves the caller owns it.
+type endpointProof struct {
+	Endpoint string `json:"endpoint"`
+	Auth     string `json:"auth"`
+}
+
+// DeleteUserSubscriptions removes every subscription owned by the user, plus
+// the anonymous ones of the given devices, and returns how many were removed.
+// Devices whose auth secret does not match are skipped.
+func (s *PushService) DeleteUserSubscriptions(userID string, devices []endpointProof) (int64, error) {
+	var removed int64
+	res, err := s.db.Exec("DELETE FROM subscriptions WHERE user_id = ?", userID)
 	if err != nil {
-		log.Printf("[PUSH] Failed to query subscriptions for room %s: %v", roomID, err)
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	removed += n
+	res, err = s.db.Exec("DELETE FROM user_subscriptions WHERE user_id = ?", userID)
+	if err != nil {
+		return removed, err
+	}
+	n, _ = res.RowsAffected()
+	removed += n
+	if err := s.DeleteQuietHours(quietOwnerUser(userID)); err != nil {
+		return removed, err
+	}
+	for _, device := range devices {
+		owned, err := s.ownsEndpoint(device.Endpoint, device.Auth)
+		if err != nil {
+			return removed, err
+		}
+		if !owned {
+			slog.Warn("skipping push endpoint without ownership proof", "endpoint", redactEndpoint(device.Endpoint))
+			continue
+		}
+		res, err := s.db.Exec("DELETE FROM subscriptions WHERE endpoint = ?", device.Endpoint)
+		if err != nil {
+			return removed, err
+		}
+		n, _ := res.RowsAffected()
+		removed += n
+	}
+	return removed, nil
+}
+
+// SendNotificationToRoom notifies the room's subscribers, except the listed
+// endpoints (usually those of the participants), with a call notification of
+// the given kind. The snapshot preview is only attached to rings. callerID is
+// the signed-in user who started the call, if any; their priority contacts
+// ring through quiet hours.
+func (s *PushService) SendNotificationToRoom(roomID, kind string, exclude []string, snapshotID, callerID string) {
+	rows, err := s.db.Query("SELECT id, platform, endpoint, auth, p256dh, locale, user_id, muted_until FROM subscriptions WHERE room_id = ?", roomID)
+	if err != nil {
+		slog.Error("failed to query push subscriptions", "rid", redactRoomID(roomID), "err", err)
 		return
 	}
 	defer rows.Close()
 
-	type subData struct {
-		ID       int
-		Endpoint string
-		Auth     string
-		P256dh   string
-		Locale   string
+	excluded := make(map[string]bool, len(exclude))
+	for _, endpoint := range exclude {
+		excluded[endpoint] = true
 	}
-	var targets []subData
+	var targets []roomSubscriber
 
 	for rows.Next() {
-		var sd subData
-		if err := rows.Scan(&sd.ID, &sd.Endpoint, &sd.Auth, &sd.P256dh, &sd.Locale); err != nil {
-			log.Printf("[PUSH] Scan error: %v", err)
+		var sd roomSubscriber
+		var userID sql.NullString
+		if err := rows.Scan(&sd.ID, &sd.Platform, &sd.Endpoint, &sd.Auth, &sd.P256dh, &sd.Locale, &userID, &sd.MutedUntil); err != nil {
+			slog.Error("failed to scan push subscription", "err", err)
 			continue
 		}
-		if sd.Endpoint == excludeEndpoint {
+		sd.UserID = userID.String
+		if excluded[sd.Endpoint] {
 			continue
 		}
 		targets = append(targets, sd)
 	}
 
-	log.Printf("[PUSH] Found %d subscribers for room %s", len(targets), roomID)
+	slog.Info("sending push notifications", "rid", redactRoomID(roomID), "kind", kind, "subscribers", len(targets))
 
 	var snapshotMeta *SnapshotMeta
-	if snapshotID != "" && isSafeSnapshotID(snapshotID) {
-		if meta, err := loadSnapshotMeta(snapshotID); err == nil {
-			snapshotMeta = meta
+	if kind == notifyIncomingCall && snapshotID != "" && isSafeSnapshotID(snapshotID) {
+		if meta, err := s.snapshots.Meta(snapshotID); err != nil {
+			slog.Warn("failed to load snapshot", "snapshot", redactSnapshotID(snapshotID), "err", err)
+		} else if meta.RoomID != roomID {
+			slog.Warn("snapshot belongs to another room", "snapshot", redactSnapshotID(snapshotID), "rid", redactRoomID(roomID))
 		} else {
-			log.Printf("[PUSH] Failed to load snapshot %s: %v", snapshotID, err)
+			snapshotMeta = meta
 		}
 	}
 
-	// Send in parallel or just loop
+	now := time.Now()
+	var fetchers []string
 	for _, target := range targets {
-		go s.sendOne(roomID, target, snapshotID, snapshotMeta)
+		drop, silent := s.holdBack(target, kind, callerID, now)
+		if drop {
+			slog.Debug("push held back", "rid", redactRoomID(roomID), "kind", kind, "endpoint", redactEndpoint(target.Endpoint))
+			continue
+		}
+		if s.enqueueOne(roomID, kind, target, snapshotID, snapshotMeta, silent) {
+			fetchers = append(fetchers, strconv.Itoa(target.ID))
+		}
 	}
-}
-
-func getLocalizedMessage(locale string) (string, string) {
-	// Simple mapping, can be expanded
-	// Check prefix
-	lang := locale
-	if len(locale) > 2 {
-		lang = locale[:2]
-	}
-
-	switch lang {
-	case "ru":
-		return "Serenada", "Кто-то присоединился к вашему звонку!"
-	case "es":
-		return "Serenada", "¡Alguien se unió a tu llamada!"
-	case "de":
-		return "Serenada", "Jemand ist deinem Anruf beigetreten!"
-	case "fr":
-		return "Serenada", "Quelqu'un a rejoint votre appel !"
-	default:
-		return "Serenada", "Someone joined your call!"
+	if snapshotMeta != nil {
+		s.snapshots.Notified(snapshotID, fetchers)
 	}
 }
 
-func (s *PushService) sendOne(roomID string, target struct {
+type roomSubscriber struct {
 	ID       int
+	Platform string
 	Endpoint string
 	Auth     string
 	P256dh   string
 	Locale   string
-}, snapshotID string, snapshotMeta *SnapshotMeta) {
-	title, body := getLocalizedMessage(target.Locale)
+	UserID   string
+	// MutedUntil (unix ms) silences the room for this subscriber.
+	MutedUntil int64
+}
 
-	// Payload
-	payload := map[string]string{
-		"title": title,
-		"body":  body,
-		"url":   fmt.Sprintf("/call/%s", roomID),
+// enqueueOne queues the notification for one subscriber and reports whether
+// it carries the snapshot.
+func (s *PushService) enqueueOne(roomID, kind string, target roomSubscriber, snapshotID string, snapshotMeta *SnapshotMeta, silent bool) bool {
+	topic := callTopic(roomID)
+	payload := callPayload{
+		Type:   kind,
+		URL:    fmt.Sprintf("/call/%s", roomID),
+		Tag:    topic,
+		SentAt: sentAtNow(),
+	}
+	payload.Title, payload.Body = notificationText(kind, target.Locale)
+	if silent {
+		payload.Silent = "1"
 	}
 
 	if snapshotID != "" && snapshotMeta != nil {
-		if key, ok := snapshotMeta.Recipients[fmt.Sprintf("%d", target.ID)]; ok {
-			payload["snapshotId"] = snapshotID
-			payload["snapshotIv"] = snapshotMeta.IV
-			payload["snapshotSalt"] = snapshotMeta.Salt
-			payload["snapshotEphemeralPubKey"] = snapshotMeta.EphemeralKey
-			payload["snapshotKey"] = key.WrappedKey
-			payload["snapshotKeyIv"] = key.WrappedKeyIV
-			if snapshotMeta.Mime != "" {
-				payload["snapshotMime"] = snapshotMeta.Mime
+		recipient := strconv.Itoa(target.ID)
+		if key, ok := snapshotMeta.Recipients[recipient]; ok {
+			payload.SnapshotID = snapshotID
+			snapshotURL, err := signSnapshotURL(s.cfg, snapshotID, recipient, s.snapshots.expiresAt(snapshotMeta))
+			if err != nil {
+				slog.Error("failed to sign snapshot URL", "snapshot", redactSnapshotID(snapshotID), "err", err)
+				return false
 			}
+			payload.SnapshotURL = snapshotURL
+			payload.SnapshotIV = snapshotMeta.IV
+			payload.SnapshotSalt = snapshotMeta.Salt
+			payload.SnapshotEphemeralKey = snapshotMeta.EphemeralKey
+			payload.SnapshotKey = key.WrappedKey
+			payload.SnapshotKeyIV = key.WrappedKeyIV
+			payload.SnapshotMime = snapshotMeta.Mime
 		}
 	}
 
-	payloadBytes, _ := json.Marshal(payload)
-
-	sub := &webpush.Subscription{
-		Endpoint: target.Endpoint,
-		Keys: webpush.Keys{
-			Auth:   target.Auth,
-			P256dh: target.P256dh,
-		},
+	n := newNotification(kind, topic, payload)
+	if target.Platform == platformAPNsVoIP && !n.Urgent {
+		// iOS requires every VoIP push to report an incoming call.
+		return false
 	}
-
-	// Determine subscriber email for VAPID; configurable via environment variable.
-	subscriber := os.Getenv("PUSH_SUBSCRIBER_EMAIL")
-	// Send Notification
-	resp, err := webpush.SendNotification(payloadBytes, sub, &webpush.Options{
-		Subscriber:      subscriber,
-		VAPIDPublicKey:  s.publicKey,
-		VAPIDPrivateKey: s.privateKey,
-		TTL:             60, // 1 minute TTL
-	})
+	err := s.queue.enqueue(PushTarget{
+		Platform: target.Platform,
+		Token:    target.Endpoint,
+		Auth:     target.Auth,
+		P256dh:   target.P256dh,
+	}, n, roomID, "")
 	if err != nil {
-		log.Printf("[PUSH] Failed to send to %s: %v", target.Endpoint, err)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == 201 || resp.StatusCode == 200 {
-		log.Printf("[PUSH] Successfully sent notification to %s (Status %d)", target.Endpoint, resp.StatusCode)
-	} else if resp.StatusCode == 410 || resp.StatusCode == 404 {
-		// Subscription is gone, remove it
-		log.Printf("[PUSH] Subscription expired/gone (Status %d). Removing %s", resp.StatusCode, target.Endpoint)
-		s.Unsubscribe(roomID, target.Endpoint)
-	} else {
-		log.Printf("[PUSH] Unexpected response from push service: Status %d", resp.StatusCode)
+		slog.Error("failed to queue push notification", "rid", redactRoomID(roomID), "err", err)
+		return false
 	}
+	return payload.SnapshotID != ""
 }
 
 func isSafeSnapshotID(id string) bool {
@@ -369,262 +477,260 @@ func isSafeSnapshotID(id string) bool {
 	return true
 }
 
-func loadSnapshotMeta(id string) (*SnapshotMeta, error) {
-	path := snapshotMetaPath(id)
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-	var meta SnapshotMeta
-	if err := json.Unmarshal(data, &meta); err != nil {
-		return nil, err
-	}
-	return &meta, nil
-}
-
-func cleanupOldSnapshots(maxAge time.Duration) {
-	dir := getSnapshotDir()
-	entries, err := os.ReadDir(dir)
-	if err != nil {
-		return
-	}
-	cutoff := time.Now().Add(-maxAge)
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-		info, err := entry.Info()
-		if err != nil {
-			continue
-		}
-		if info.ModTime().Before(cutoff) {
-			_ = os.Remove(filepath.Join(dir, entry.Name()))
-		}
-	}
-}
-
 // HTTP Handlers
 
-func handlePushVapidKey(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+func handlePushVapidKey(pushService *PushService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"publicKey": pushService.GetVAPIDPublicKey(),
+		})
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"publicKey": pushService.GetVAPIDPublicKey(),
-	})
 }
 
-func handlePushSubscribe(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "OPTIONS" {
-		return
-	}
-
-	roomId := r.URL.Query().Get("roomId")
-	if roomId == "" {
-		http.Error(w, "Missing roomId", http.StatusBadRequest)
-		return
-	}
-
-	if r.Method == "POST" {
-		var sub PushSubscriptionRequest
-		if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
-			http.Error(w, "Invalid body", http.StatusBadRequest)
-			return
-		}
-		if len(sub.EncPublicKey) > 4096 {
-			http.Error(w, "Encryption key too large", http.StatusBadRequest)
-			return
-		}
-		if len(sub.EncPublicKey) > 0 && !json.Valid(sub.EncPublicKey) {
-			http.Error(w, "Invalid encryption key", http.StatusBadRequest)
+func handlePushSubscribe(cfg *Config, pushService *PushService, authStore *AuthStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
 			return
 		}
 
-		if err := pushService.Subscribe(roomId, sub); err != nil {
-			http.Error(w, "Failed to subscribe", http.StatusInternalServerError)
+		roomId := r.URL.Query().Get("roomId")
+		if !requireRoomToken(cfg, w, r, roomId) {
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-		return
-	}
 
-	if r.Method == "DELETE" {
-		var body struct {
-			Endpoint string `json:"endpoint"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-			http.Error(w, "Invalid body", http.StatusBadRequest)
+		if r.Method == "POST" {
+			var sub PushSubscriptionRequest
+			if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+				http.Error(w, "Invalid body", http.StatusBadRequest)
+				return
+			}
+			if len(sub.EncPublicKey) > 4096 {
+				http.Error(w, "Encryption key too large", http.StatusBadRequest)
+				return
+			}
+			if len(sub.EncPublicKey) > 0 && !json.Valid(sub.EncPublicKey) {
+				http.Error(w, "Invalid encryption key", http.StatusBadRequest)
+				return
+			}
+			if err := pushService.validatePlatform(&sub); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			var userID string
+			if user, err := authStore.getUserByToken(extractToken(r)); err == nil {
+				userID = user.UserID
+			}
+
+			if err := pushService.Subscribe(roomId, sub, userID); err != nil {
+				http.Error(w, "Failed to subscribe", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
 			return
 		}
 
-		if err := pushService.Unsubscribe(roomId, body.Endpoint); err != nil {
-			http.Error(w, "Failed to unsubscribe", http.StatusInternalServerError)
+		if r.Method == "DELETE" {
+			var body struct {
+				Endpoint string `json:"endpoint"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "Invalid body", http.StatusBadRequest)
+				return
+			}
+
+			if err := pushService.Unsubscribe(roomId, body.Endpoint); err != nil {
+				http.Error(w, "Failed to unsubscribe", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-		return
-	}
 
-	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-}
-
-func handlePushRecipients(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	roomId := r.URL.Query().Get("roomId")
-	if roomId == "" {
-		http.Error(w, "Missing roomId", http.StatusBadRequest)
-		return
-	}
-
-	rows, err := pushService.db.Query("SELECT id, enc_pubkey FROM subscriptions WHERE room_id = ? AND enc_pubkey IS NOT NULL AND enc_pubkey != ''", roomId)
-	if err != nil {
-		http.Error(w, "Failed to load recipients", http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	type recipient struct {
-		ID        int         `json:"id"`
-		PublicKey interface{} `json:"publicKey"`
-	}
-	var recipients []recipient
-	for rows.Next() {
-		var id int
-		var keyStr string
-		if err := rows.Scan(&id, &keyStr); err != nil {
-			continue
-		}
-		var key interface{}
-		if err := json.Unmarshal([]byte(keyStr), &key); err != nil {
-			continue
-		}
-		recipients = append(recipients, recipient{ID: id, PublicKey: key})
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(recipients)
 }
 
-func handlePushSnapshot(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "OPTIONS":
-		return
-	case "POST":
-		var req SnapshotUploadRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid body", http.StatusBadRequest)
+func handlePushRecipients(cfg *Config, pushService *PushService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		if req.Ciphertext == "" || req.SnapshotIV == "" || req.SnapshotSalt == "" || req.SnapshotEphemeralKey == "" {
-			http.Error(w, "Missing snapshot data", http.StatusBadRequest)
+		roomId := r.URL.Query().Get("roomId")
+		if !requireRoomToken(cfg, w, r, roomId) {
 			return
 		}
 
-		ciphertext, err := base64.StdEncoding.DecodeString(req.Ciphertext)
+		rows, err := pushService.db.Query("SELECT id, enc_pubkey FROM subscriptions WHERE room_id = ? AND enc_pubkey IS NOT NULL AND enc_pubkey != ''", roomId)
 		if err != nil {
-			http.Error(w, "Invalid snapshot data", http.StatusBadRequest)
-			return
-		}
-		if len(ciphertext) > 300*1024 {
-			http.Error(w, "Snapshot too large", http.StatusRequestEntityTooLarge)
+			http.Error(w, "Failed to load recipients", http.StatusInternalServerError)
 			return
 		}
+		defer rows.Close()
 
-		iv, err := base64.StdEncoding.DecodeString(req.SnapshotIV)
-		if err != nil || len(iv) != 12 {
-			http.Error(w, "Invalid snapshot IV", http.StatusBadRequest)
-			return
+		type recipient struct {
+			ID        int         `json:"id"`
+			PublicKey interface{} `json:"publicKey"`
 		}
-		salt, err := base64.StdEncoding.DecodeString(req.SnapshotSalt)
-		if err != nil || len(salt) < 8 || len(salt) > 64 {
-			http.Error(w, "Invalid snapshot salt", http.StatusBadRequest)
-			return
+		var recipients []recipient
+		for rows.Next() {
+			var id int
+			var keyStr string
+			if err := rows.Scan(&id, &keyStr); err != nil {
+				continue
+			}
+			var key interface{}
+			if err := json.Unmarshal([]byte(keyStr), &key); err != nil {
+				continue
+			}
+			recipients = append(recipients, recipient{ID: id, PublicKey: key})
 		}
-		ephemeralKey, err := base64.StdEncoding.DecodeString(req.SnapshotEphemeralKey)
-		if err != nil || len(ephemeralKey) < 32 {
-			http.Error(w, "Invalid snapshot key", http.StatusBadRequest)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(recipients)
+	}
+}
+
+func handlePushSnapshot(cfg *Config, pushService *PushService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "OPTIONS":
 			return
-		}
+		case "POST":
+			roomId := r.URL.Query().Get("roomId")
+			if !requireRoomToken(cfg, w, r, roomId) {
+				return
+			}
+			var req SnapshotUploadRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid body", http.StatusBadRequest)
+				return
+			}
 
-		recipients := make(map[string]SnapshotRecipientKey)
-		for _, r := range req.Recipients {
-			if r.ID <= 0 || r.WrappedKey == "" || r.WrappedKeyIV == "" {
-				continue
+			if req.Ciphertext == "" || req.SnapshotIV == "" || req.SnapshotSalt == "" || req.SnapshotEphemeralKey == "" {
+				http.Error(w, "Missing snapshot data", http.StatusBadRequest)
+				return
 			}
-			wrapped, err := base64.StdEncoding.DecodeString(r.WrappedKey)
-			if err != nil || len(wrapped) == 0 {
-				continue
+
+			ciphertext, err := base64.StdEncoding.DecodeString(req.Ciphertext)
+			if err != nil {
+				http.Error(w, "Invalid snapshot data", http.StatusBadRequest)
+				return
 			}
-			wrappedIV, err := base64.StdEncoding.DecodeString(r.WrappedKeyIV)
-			if err != nil || len(wrappedIV) != 12 {
-				continue
+			if len(ciphertext) > snapshotMaxBytes {
+				http.Error(w, "Snapshot too large", http.StatusRequestEntityTooLarge)
+				return
 			}
-			recipients[strconv.Itoa(r.ID)] = SnapshotRecipientKey{
-				WrappedKey:   r.WrappedKey,
-				WrappedKeyIV: r.WrappedKeyIV,
+
+			iv, err := base64.StdEncoding.DecodeString(req.SnapshotIV)
+			if err != nil || len(iv) != 12 {
+				http.Error(w, "Invalid snapshot IV", http.StatusBadRequest)
+				return
+			}
+			salt, err := base64.StdEncoding.DecodeString(req.SnapshotSalt)
+			if err != nil || len(salt) < 8 || len(salt) > 64 {
+				http.Error(w, "Invalid snapshot salt", http.StatusBadRequest)
+				return
+			}
+			ephemeralKey, err := base64.StdEncoding.DecodeString(req.SnapshotEphemeralKey)
+			if err != nil || len(ephemeralKey) < 32 {
+				http.Error(w, "Invalid snapshot key", http.StatusBadRequest)
+				return
 			}
-		}
-		if len(recipients) == 0 {
-			http.Error(w, "No valid recipients", http.StatusBadRequest)
-			return
-		}
 
-		id := generateID("SNAP-")
-		if err := os.WriteFile(snapshotDataPath(id), ciphertext, 0600); err != nil {
-			http.Error(w, "Failed to save snapshot", http.StatusInternalServerError)
-			return
-		}
+			recipients := make(map[string]SnapshotRecipientKey)
+			for _, r := range req.Recipients {
+				if r.ID <= 0 || r.WrappedKey == "" || r.WrappedKeyIV == "" {
+					continue
+				}
+				wrapped, err := base64.StdEncoding.DecodeString(r.WrappedKey)
+				if err != nil || len(wrapped) == 0 {
+					continue
+				}
+				wrappedIV, err := base64.StdEncoding.DecodeString(r.WrappedKeyIV)
+				if err != nil || len(wrappedIV) != 12 {
+					continue
+				}
+				recipients[strconv.Itoa(r.ID)] = SnapshotRecipientKey{
+					WrappedKey:   r.WrappedKey,
+					WrappedKeyIV: r.WrappedKeyIV,
+				}
+			}
+			if len(recipients) == 0 {
+				http.Error(w, "No valid recipients", http.StatusBadRequest)
+				return
+			}
 
-		mime := req.SnapshotMime
-		if mime == "" {
-			mime = "image/jpeg"
-		}
-		meta := SnapshotMeta{
-			IV:           req.SnapshotIV,
-			Salt:         req.SnapshotSalt,
-			EphemeralKey: req.SnapshotEphemeralKey,
-			Mime:         mime,
-			CreatedAt:    time.Now().UnixMilli(),
-			Recipients:   recipients,
-		}
-		metaBytes, _ := json.Marshal(meta)
-		if err := os.WriteFile(snapshotMetaPath(id), metaBytes, 0600); err != nil {
-			_ = os.Remove(snapshotDataPath(id))
-			http.Error(w, "Failed to save snapshot metadata", http.StatusInternalServerError)
-			return
-		}
-		cleanupOldSnapshots(10 * time.Minute)
+			mime := req.SnapshotMime
+			if mime == "" {
+				mime = "image/jpeg"
+			}
+			meta := &SnapshotMeta{
+				RoomID:       roomId,
+				IV:           req.SnapshotIV,
+				Salt:         req.SnapshotSalt,
+				EphemeralKey: req.SnapshotEphemeralKey,
+				Mime:         mime,
+				CreatedAt:    time.Now().UnixMilli(),
+				Recipients:   recipients,
+			}
+			id, err := pushService.snapshots.Save(meta, ciphertext)
+			if err != nil {
+				slog.Error("failed to save snapshot", "rid", redactRoomID(roomId), "err", err)
+				http.Error(w, "Failed to save snapshot", http.StatusInternalServerError)
+				return
+			}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{
-			"id":  id,
-			"url": fmt.Sprintf("/api/push/snapshot/%s", id),
-		})
-		return
-	case "GET":
-		id := strings.TrimPrefix(r.URL.Path, "/api/push/snapshot/")
-		if !isSafeSnapshotID(id) {
-			http.Error(w, "Not found", http.StatusNotFound)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":        id,
+				"expiresAt": pushService.snapshots.expiresAt(meta).UnixMilli(),
+			})
 			return
-		}
-		path := snapshotDataPath(id)
-		if _, err := os.Stat(path); err != nil {
-			http.Error(w, "Not found", http.StatusNotFound)
+		case "GET":
+			// Mounted under StripPrefix, so the path is /{id}.
+			id := strings.TrimPrefix(r.URL.Path, "/")
+			if !isSafeSnapshotID(id) {
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			recipient, err := verifySnapshotURL(cfg, id, r.URL.Query())
+			if errors.Is(err, errSnapshotURLExpired) {
+				http.Error(w, "Snapshot expired", http.StatusGone)
+				return
+			}
+			if err != nil {
+				slog.Warn("snapshot download denied", "ip", redactIP(getClientIP(cfg, r)), "snapshot", redactSnapshotID(id), "err", err)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			data, err := pushService.snapshots.Open(id, recipient)
+			if errors.Is(err, errSnapshotGone) {
+				http.Error(w, "Snapshot expired", http.StatusGone)
+				return
+			}
+			if err != nil {
+				slog.Error("failed to read snapshot", "snapshot", redactSnapshotID(id), "err", err)
+				http.Error(w, "Failed to load snapshot", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			if _, err := w.Write(data); err == nil {
+				pushService.snapshots.MarkFetched(id, recipient)
+			}
+			return
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		w.Header().Set("Cache-Control", "no-store")
-		w.Header().Set("Content-Type", "application/octet-stream")
-		http.ServeFile(w, r, path)
-		return
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
 	}
 }
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SherClockHolmes/webpush-go"
+)
+
+// Subscription platforms. For native platforms the subscription endpoint
+// holds the device token.
+const (
+	platformWeb      = "web"
+	platformFCM      = "fcm"
+	platformAPNs     = "apns"
+	platformAPNsVoIP = "apns-voip" // PushKit token; only used for calls
+)
+
+var errPushGone = errors.New("push subscription is no longer valid")
+
+// PushTarget is one device to notify.
+type PushTarget struct {
+	Platform string
+	Token    string // Web Push endpoint URL or native device token
+	Auth     string // Web Push only
+	P256dh   string // Web Push only
+}
+
+// PushNotification is a provider-independent notification. Data is
+// delivered as-is to the app; "title" and "body" are also used for the
+// visible alert where the platform renders one.
+type PushNotification struct {
+	Data map[string]string
+	TTL  time.Duration
+	// Urgent marks call notifications: high priority on every platform and
+	// delivered as VoIP pushes on apns-voip.
+	Urgent bool
+	// Topic collapses notifications: a newer one with the same topic
+	// replaces an undelivered older one.
+	Topic string
+}
+
+// PushProvider delivers notifications to one platform. Send returns
+// errPushGone when the device has unregistered.
+type PushProvider interface {
+	Send(ctx context.Context, target PushTarget, n PushNotification) error
+}
+
+// newPushProviders returns the providers for every configured platform.
+func newPushProviders(cfg *Config, vapid *VAPIDKeys) (map[string]PushProvider, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	providers := map[string]PushProvider{
+		platformWeb: &webPushProvider{
+			subscriber: cfg.PushSubscriberEmail,
+			publicKey:  vapid.PublicKey,
+			privateKey: vapid.PrivateKey,
+			client:     client,
+		},
+	}
+	if cfg.FCMCredentialsFile != "" {
+		p, err := newFCMProvider(cfg.FCMCredentialsFile, cfg.FCMEndpoint, client)
+		if err != nil {
+			return nil, fmt.Errorf("FCM: %w", err)
+		}
+		providers[platformFCM] = p
+	}
+	if cfg.APNsKeyFile != "" {
+		p, err := newAPNsProvider(cfg.APNsKeyFile, cfg.APNsKeyID, cfg.APNsTeamID, cfg.APNsTopic, cfg.APNsEndpoint, client)
+		if err != nil {
+			return nil, fmt.Errorf("APNs: %w", err)
+		}
+		providers[platformAPNs] = p
+		providers[platformAPNsVoIP] = p
+	}
+	return providers, nil
+}
+
+// pushHTTPError is an unexpected response from a push service.
+type pushHTTPError struct {
+	Service    string
+	StatusCode int
+	Detail     string
+	RetryAfter time.Duration // from the Retry-After header, if any
+	// TokenRefreshed is set when the provider dropped its own expired or
+	// rejected credentials, so the next attempt authenticates afresh.
+	TokenRefreshed bool
+}
+
+func (e *pushHTTPError) Error() string {
+	return fmt.Sprintf("%s responded %d: %s", e.Service, e.StatusCode, e.Detail)
+}
+
+func pushStatusError(service string, resp *http.Response) *pushHTTPError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return newPushHTTPError(service, resp, strings.TrimSpace(string(body)))
+}
+
+func newPushHTTPError(service string, resp *http.Response, detail string) *pushHTTPError {
+	e := &pushHTTPError{Service: service, StatusCode: resp.StatusCode, Detail: detail}
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+			e.RetryAfter = time.Duration(secs) * time.Second
+		} else if at, err := http.ParseTime(v); err == nil {
+			e.RetryAfter = time.Until(at)
+		}
+	}
+	return e
+}
+
+// Web Push
+
+type webPushProvider struct {
+	subscriber string
+	publicKey  string
+	privateKey string
+	client     *http.Client
+}
+
+func (p *webPushProvider) Send(ctx context.Context, target PushTarget, n PushNotification) error {
+	payload, _ := json.Marshal(n.Data)
+	urgency := webpush.UrgencyNormal
+	if n.Urgent {
+		urgency = webpush.UrgencyHigh
+	}
+	resp, err := webpush.SendNotificationWithContext(ctx, payload, &webpush.Subscription{
+		Endpoint: target.Token,
+		Keys: webpush.Keys{
+			Auth:   target.Auth,
+			P256dh: target.P256dh,
+		},
+	}, &webpush.Options{
+		HTTPClient:      p.client,
+		Subscriber:      p.subscriber,
+		VAPIDPublicKey:  p.publicKey,
+		VAPIDPrivateKey: p.privateKey,
+		TTL:             int(n.TTL.Seconds()),
+		Urgency:         urgency,
+		Topic:           n.Topic,
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated:
+		return nil
+	case resp.StatusCode == http.StatusGone || resp.StatusCode == http.StatusNotFound:
+		return errPushGone
+	default:
+		return pushStatusError("push service", resp)
+	}
+}
+
+// FCM HTTP v1
+
+const (
+	fcmScope           = "https://www.googleapis.com/auth/firebase.messaging"
+	defaultFCMEndpoint = "https://fcm.googleapis.com"
+)
+
+type fcmCredentials struct {
+	ProjectID   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// fcmProvider authenticates with a service account, exchanging a signed JWT
+// for an OAuth2 access token that is cached until shortly before expiry.
+type fcmProvider struct {
+	endpoint string
+	creds    fcmCredentials
+	key      *rsa.PrivateKey
+	client   *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+func newFCMProvider(credentialsFile, endpoint string, client *http.Client) (*fcmProvider, error) {
+	data, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	var creds fcmCredentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("parsing service account: %w", err)
+	}
+	if creds.ProjectID == "" || creds.ClientEmail == "" || creds.TokenURI == "" {
+		return nil, errors.New("service account is missing project_id, client_email or token_uri")
+	}
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return nil, errors.New("service account private_key is not PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing private_key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("service account private_key is not an RSA key")
+	}
+	if endpoint == "" {
+		endpoint = defaultFCMEndpoint
+	}
+	return &fcmProvider{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		creds:    creds,
+		key:      key,
+		client:   client,
+	}, nil
+}
+
+func (p *fcmProvider) token(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.accessToken != "" && time.Now().Before(p.expiresAt) {
+		return p.accessToken, nil
+	}
+
+	now := time.Now()
+	assertion, err := signJWT(map[string]string{"alg": "RS256", "typ": "JWT"}, map[string]interface{}{
+		"iss":   p.creds.ClientEmail,
+		"scope": fcmScope,
+		"aud":   p.creds.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}, func(digest []byte) ([]byte, error) {
+		return rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.creds.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", pushStatusError("FCM token endpoint", resp)
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil || tok.AccessToken == "" {
+		return "", errors.New("FCM token endpoint returned no access token")
+	}
+	p.accessToken = tok.AccessToken
+	p.expiresAt = now.Add(time.Duration(tok.ExpiresIn)*time.Second - time.Minute)
+	return p.accessToken, nil
+}
+
+func (p *fcmProvider) Send(ctx context.Context, target PushTarget, n PushNotification) error {
+	accessToken, err := p.token(ctx)
+	if err != nil {
+		return err
+	}
+
+	priority := "normal"
+	if n.Urgent {
+		priority = "high"
+	}
+	android := map[string]interface{}{
+		"priority": priority,
+		"ttl":      strconv.Itoa(int(n.TTL.Seconds())) + "s",
+	}
+	if n.Topic != "" {
+		android["collapse_key"] = n.Topic
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"token":   target.Token,
+			"data":    n.Data,
+			"android": android,
+		},
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint+"/v1/projects/"+url.PathEscape(p.creds.ProjectID)+"/messages:send", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound: // UNREGISTERED
+		return errPushGone
+	case http.StatusUnauthorized:
+		p.mu.Lock()
+		p.accessToken = ""
+		p.mu.Unlock()
+		e := pushStatusError("FCM", resp)
+		e.TokenRefreshed = true
+		return e
+	}
+	return pushStatusError("FCM", resp)
+}
+
+// APNs (token-based authentication)
+
+const (
+	defaultAPNsEndpoint = "https://api.push.apple.com"
+	// Apple rejects provider tokens older than an hour and throttles
+	// refreshes more frequent than every 20 minutes.
+	apnsTokenLifetime = 50 * time.Minute
+)
+
+type apnsProvider struct {
+	endpoint string
+	keyID    string
+	teamID   string
+	topic    string
+	key      *ecdsa.PrivateKey
+	client   *http.Client
+
+	mu       sync.Mutex
+	jwt      string
+	issuedAt time.Time
+}
+
+func newAPNsProvider(keyFile, keyID, teamID, topic, endpoint string, client *http.Client) (*apnsProvider, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("signing key is not PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing signing key: %w", err)
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key is not an ECDSA key")
+	}
+	if endpoint == "" {
+		endpoint = defaultAPNsEndpoint
+	}
+	return &apnsProvider{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		keyID:    keyID,
+		teamID:   teamID,
+		topic:    topic,
+		key:      key,
+		client:   client,
+	}, nil
+}
+
+func (p *apnsProvider) token() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.jwt != "" && time.Since(p.issuedAt) < apnsTokenLifetime {
+		return p.jwt, nil
+	}
+	now := time.Now()
+	jwt, err := signJWT(map[string]string{"alg": "ES256", "kid": p.keyID}, map[string]interface{}{
+		"iss": p.teamID,
+		"iat": now.Unix(),
+	}, func(digest []byte) ([]byte, error) {
+		r, s, err := ecdsa.Sign(rand.Reader, p.key, digest)
+		if err != nil {
+			return nil, err
+		}
+		// JWS wants the fixed-width r || s encoding, not ASN.1.
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	p.jwt, p.issuedAt = jwt, now
+	return jwt, nil
+}
+
+func (p *apnsProvider) Send(ctx context.Context, target PushTarget, n PushNotification) error {
+	jwt, err := p.token()
+	if err != nil {
+		return err
+	}
+
+	payload := make(map[string]interface{}, len(n.Data)+1)
+	for k, v := range n.Data {
+		payload[k] = v
+	}
+	topic, pushType := p.topic, "alert"
+	if target.Platform == platformAPNsVoIP {
+		// The app reports the call to CallKit itself.
+		topic, pushType = p.topic+".voip", "voip"
+		payload["aps"] = map[string]interface{}{}
+	} else {
+		payload["aps"] = map[string]interface{}{
+			"alert": map[string]string{"title": n.Data["title"], "body": n.Data["body"]},
+			"sound": "default",
+		}
+	}
+	priority := "5"
+	if n.Urgent {
+		priority = "10"
+	}
+	body, _ := json.Marshal(payload)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint+"/3/device/"+url.PathEscape(target.Token), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+jwt)
+	req.Header.Set("apns-topic", topic)
+	req.Header.Set("apns-push-type", pushType)
+	req.Header.Set("apns-priority", priority)
+	req.Header.Set("apns-expiration", strconv.FormatInt(time.Now().Add(n.TTL).Unix(), 10))
+	if n.Topic != "" {
+		req.Header.Set("apns-collapse-id", n.Topic)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var apnsErr struct {
+		Reason string `json:"reason"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	json.Unmarshal(data, &apnsErr)
+	switch {
+	case resp.StatusCode == http.StatusGone, apnsErr.Reason == "BadDeviceToken", apnsErr.Reason == "Unregistered":
+		return errPushGone
+	case apnsErr.Reason == "ExpiredProviderToken":
+		p.mu.Lock()
+		p.jwt = ""
+		p.mu.Unlock()
+		e := newPushHTTPError("APNs", resp, apnsErr.Reason)
+		e.TokenRefreshed = true
+		return e
+	}
+	return newPushHTTPError("APNs", resp, apnsErr.Reason)
+}
+
+// signJWT builds a compact JWS over the JSON header and claims.
+func signJWT(header map[string]string, claims map[string]interface{}, sign func(digest []byte) ([]byte, error)) (string, error) {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := sign(digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SherClockHolmes/webpush-go"
+)
+
+// pushResponse is what a fake push service answers with.
+type pushResponse struct {
+	status     int
+	body       string
+	retryAfter string
+}
+
+func (r pushResponse) write(w http.ResponseWriter) {
+	if r.retryAfter != "" {
+		w.Header().Set("Retry-After", r.retryAfter)
+	}
+	w.WriteHeader(r.status)
+	w.Write([]byte(r.body))
+}
+
+// outcomeCase describes how push_queue.go must treat a provider response.
+type outcomeCase struct {
+	name       string
+	resp       pushResponse
+	gone       bool
+	retryable  bool
+	retryAfter time.Duration
+	refreshed  bool
+}
+
+func checkOutcome(t *testing.T, tc outcomeCase, err error) {
+	t.Helper()
+	if tc.resp.status < 300 {
+		if err != nil {
+			t.Fatalf("Send = %v, want nil", err)
+		}
+		return
+	}
+	if got := errors.Is(err, errPushGone); got != tc.gone {
+		t.Fatalf("Send = %v, gone = %v, want %v", err, got, tc.gone)
+	}
+	if tc.gone {
+		return
+	}
+	var httpErr *pushHTTPError
+	if !errors.As(err, &httpErr) {
+		t.Fatalf("Send = %v, want a *pushHTTPError", err)
+	}
+	if httpErr.StatusCode != tc.resp.status {
+		t.Errorf("StatusCode = %d, want %d", httpErr.StatusCode, tc.resp.status)
+	}
+	if got := pushRetryable(err); got != tc.retryable {
+		t.Errorf("pushRetryable = %v, want %v", got, tc.retryable)
+	}
+	if httpErr.TokenRefreshed != tc.refreshed {
+		t.Errorf("TokenRefreshed = %v, want %v", httpErr.TokenRefreshed, tc.refreshed)
+	}
+	// HTTP-date values lose sub-second precision.
+	if d := httpErr.RetryAfter - tc.retryAfter; d < -2*time.Second || d > 0 {
+		t.Errorf("RetryAfter = %v, want %v", httpErr.RetryAfter, tc.retryAfter)
+	}
+}
+
+func writePKCS8(t *testing.T, key interface{}) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+// decodeJWT splits a compact JWS and returns its header, claims and the
+// SHA-256 digest of the signing input.
+func decodeJWT(t *testing.T, jwt string) (header, claims map[string]interface{}, digest []byte, sig []byte) {
+	t.Helper()
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed JWT %q", jwt)
+	}
+	for i, dst := range []*map[string]interface{}{&header, &claims} {
+		raw, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(raw, dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	return header, claims, sum[:], sig
+}
+
+// fakeFCM serves the OAuth token endpoint and the HTTP v1 send endpoint.
+type fakeFCM struct {
+	t   *testing.T
+	key *rsa.PublicKey
+
+	mu         sync.Mutex
+	tokenURI   string
+	issued     int
+	sendStatus pushResponse
+}
+
+func (f *fakeFCM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.Path {
+	case "/token":
+		if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			http.Error(w, "unsupported_grant_type", http.StatusBadRequest)
+			return
+		}
+		header, claims, digest, sig := decodeJWT(f.t, r.FormValue("assertion"))
+		if header["alg"] != "RS256" {
+			f.t.Errorf("assertion alg = %v", header["alg"])
+		}
+		if err := rsa.VerifyPKCS1v15(f.key, crypto.SHA256, digest, sig); err != nil {
+			f.t.Errorf("assertion signature: %v", err)
+		}
+		if claims["iss"] != "push@example.iam.gserviceaccount.com" || claims["scope"] != fcmScope || claims["aud"] != f.tokenURI {
+			f.t.Errorf("assertion claims = %v", claims)
+		}
+		f.issued++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access-" + strconv.Itoa(f.issued),
+			"expires_in":   3600,
+			"token_type":   "Bearer",
+		})
+	case "/v1/projects/test-project/messages:send":
+		if got, want := r.Header.Get("Authorization"), "Bearer access-"+strconv.Itoa(f.issued); got != want {
+			f.t.Errorf("Authorization = %q, want %q", got, want)
+		}
+		var body struct {
+			Message struct {
+				Token   string            `json:"token"`
+				Data    map[string]string `json:"data"`
+				Android map[string]string `json:"android"`
+			} `json:"message"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			f.t.Errorf("send body: %v", err)
+		}
+		if body.Message.Token != "device-token" || body.Message.Android["priority"] != "high" || body.Message.Android["collapse_key"] != "call-room" {
+			f.t.Errorf("send message = %+v", body.Message)
+		}
+		f.sendStatus.write(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeFCM) respond(resp pushResponse) {
+	f.mu.Lock()
+	f.sendStatus = resp
+	f.mu.Unlock()
+}
+
+func (f *fakeFCM) tokensIssued() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.issued
+}
+
+func newTestFCM(t *testing.T) (*fcmProvider, *fakeFCM) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeFCM{t: t, key: &key.PublicKey, sendStatus: pushResponse{status: http.StatusOK}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	fake.tokenURI = srv.URL + "/token"
+
+	creds, _ := json.Marshal(fcmCredentials{
+		ProjectID:   "test-project",
+		ClientEmail: "push@example.iam.gserviceaccount.com",
+		PrivateKey:  writePKCS8(t, key),
+		TokenURI:    fake.tokenURI,
+	})
+	file := filepath.Join(t.TempDir(), "service-account.json")
+	if err := os.WriteFile(file, creds, 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := newFCMProvider(file, srv.URL, srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, fake
+}
+
+var testCallNotification = PushNotification{
+	Data:   map[string]string{"title": "Serenada", "body": "Incoming call"},
+	TTL:    time.Minute,
+	Urgent: true,
+	Topic:  "call-room",
+}
+
+func TestFCMTokenCaching(t *testing.T) {
+	p, fake := newTestFCM(t)
+	target := PushTarget{Platform: platformFCM, Token: "device-token"}
+	for i := 0; i < 3; i++ {
+		if err := p.Send(context.Background(), target, testCallNotification); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := fake.tokensIssued(); n != 1 {
+		t.Fatalf("token endpoint called %d times, want 1", n)
+	}
+
+	// A rejected token is dropped, so the retry exchanges a new one.
+	rejected := pushResponse{status: http.StatusUnauthorized, body: `{"error":{"status":"UNAUTHENTICATED"}}`}
+	fake.respond(rejected)
+	err := p.Send(context.Background(), target, testCallNotification)
+	checkOutcome(t, outcomeCase{resp: rejected, retryable: true, refreshed: true}, err)
+	fake.respond(pushResponse{status: http.StatusOK})
+	if err := p.Send(context.Background(), target, testCallNotification); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.tokensIssued(); n != 2 {
+		t.Fatalf("token endpoint called %d times, want 2", n)
+	}
+
+	// An expired token is refreshed before sending.
+	p.mu.Lock()
+	p.expiresAt = time.Now().Add(-time.Second)
+	p.mu.Unlock()
+	if err := p.Send(context.Background(), target, testCallNotification); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.tokensIssued(); n != 3 {
+		t.Fatalf("token endpoint called %d times, want 3", n)
+	}
+}
+
+func TestFCMOutcomes(t *testing.T) {
+	retryAt := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	for _, tc := range []outcomeCase{
+		{name: "ok", resp: pushResponse{status: http.StatusOK}},
+		{name: "unregistered", resp: pushResponse{status: http.StatusNotFound, body: `{"error":{"status":"NOT_FOUND"}}`}, gone: true},
+		{name: "throttled", resp: pushResponse{status: http.StatusTooManyRequests, retryAfter: "30"}, retryable: true, retryAfter: 30 * time.Second},
+		{name: "throttled until date", resp: pushResponse{status: http.StatusTooManyRequests, retryAfter: retryAt}, retryable: true, retryAfter: time.Minute},
+		{name: "unavailable", resp: pushResponse{status: http.StatusServiceUnavailable}, retryable: true},
+		{name: "invalid argument", resp: pushResponse{status: http.StatusBadRequest, body: `{"error":{"status":"INVALID_ARGUMENT"}}`}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, fake := newTestFCM(t)
+			fake.respond(tc.resp)
+			err := p.Send(context.Background(), PushTarget{Platform: platformFCM, Token: "device-token"}, testCallNotification)
+			checkOutcome(t, tc, err)
+		})
+	}
+}
+
+// apnsRequest is what fakeAPNs saw of one request.
+type apnsRequest struct {
+	jwt      string
+	pushType string
+	topic    string
+	priority string
+	aps      map[string]interface{}
+}
+
+// fakeAPNs checks the provider token of every request and records its
+// headers.
+type fakeAPNs struct {
+	t   *testing.T
+	key *ecdsa.PublicKey
+
+	mu       sync.Mutex
+	requests []apnsRequest
+	resp     pushResponse
+}
+
+func (f *fakeAPNs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path != "/3/device/device-token" {
+		http.NotFound(w, r)
+		return
+	}
+	jwt, ok := strings.CutPrefix(r.Header.Get("Authorization"), "bearer ")
+	if !ok {
+		f.t.Errorf("Authorization = %q", r.Header.Get("Authorization"))
+	}
+	header, claims, digest, sig := decodeJWT(f.t, jwt)
+	if header["alg"] != "ES256" || header["kid"] != "KEYID12345" || claims["iss"] != "TEAMID1234" {
+		f.t.Errorf("provider token header %v, claims %v", header, claims)
+	}
+	if len(sig) != 64 {
+		f.t.Errorf("signature is %d bytes, want the 64-byte r || s form", len(sig))
+	} else if !ecdsa.Verify(f.key, digest, new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		f.t.Error("provider token signature does not verify")
+	}
+	var payload map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&payload)
+	aps, _ := payload["aps"].(map[string]interface{})
+	f.requests = append(f.requests, apnsRequest{
+		jwt:      jwt,
+		pushType: r.Header.Get("apns-push-type"),
+		topic:    r.Header.Get("apns-topic"),
+		priority: r.Header.Get("apns-priority"),
+		aps:      aps,
+	})
+	f.resp.write(w)
+}
+
+func (f *fakeAPNs) respond(resp pushResponse) {
+	f.mu.Lock()
+	f.resp = resp
+	f.mu.Unlock()
+}
+
+func (f *fakeAPNs) received() []apnsRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]apnsRequest(nil), f.requests...)
+}
+
+func newTestAPNs(t *testing.T) (*apnsProvider, *fakeAPNs) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeAPNs{t: t, key: &key.PublicKey, resp: pushResponse{status: http.StatusOK}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	file := filepath.Join(t.TempDir(), "AuthKey.p8")
+	if err := os.WriteFile(file, []byte(writePKCS8(t, key)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := newAPNsProvider(file, "KEYID12345", "TEAMID1234", "com.example.serenada", srv.URL, srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, fake
+}
+
+func TestAPNsPushTypes(t *testing.T) {
+	p, fake := newTestAPNs(t)
+	if err := p.Send(context.Background(), PushTarget{Platform: platformAPNsVoIP, Token: "device-token"}, testCallNotification); err != nil {
+		t.Fatal(err)
+	}
+	message := PushNotification{Data: map[string]string{"title": "Serenada", "body": "New message"}, TTL: time.Hour}
+	if err := p.Send(context.Background(), PushTarget{Platform: platformAPNs, Token: "device-token"}, message); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := fake.received()
+	if len(reqs) != 2 {
+		t.Fatalf("APNs received %d requests, want 2", len(reqs))
+	}
+	voip, alert := reqs[0], reqs[1]
+	if voip.pushType != "voip" || voip.topic != "com.example.serenada.voip" || voip.priority != "10" {
+		t.Errorf("VoIP push: type %q, topic %q, priority %q", voip.pushType, voip.topic, voip.priority)
+	}
+	if len(voip.aps) != 0 {
+		t.Errorf("VoIP push has an alert: %v", voip.aps)
+	}
+	if alert.pushType != "alert" || alert.topic != "com.example.serenada" || alert.priority != "5" {
+		t.Errorf("alert push: type %q, topic %q, priority %q", alert.pushType, alert.topic, alert.priority)
+	}
+	if _, ok := alert.aps["alert"]; !ok {
+		t.Errorf("alert push has no alert: %v", alert.aps)
+	}
+	if voip.jwt != alert.jwt {
+		t.Error("provider token was not reused between requests")
+	}
+}
+
+func TestAPNsExpiredProviderToken(t *testing.T) {
+	p, fake := newTestAPNs(t)
+	target := PushTarget{Platform: platformAPNs, Token: "device-token"}
+
+	expired := pushResponse{status: http.StatusForbidden, body: `{"reason":"ExpiredProviderToken"}`}
+	fake.respond(expired)
+	err := p.Send(context.Background(), target, testCallNotification)
+	checkOutcome(t, outcomeCase{resp: expired, retryable: true, refreshed: true}, err)
+
+	fake.respond(pushResponse{status: http.StatusOK})
+	if err := p.Send(context.Background(), target, testCallNotification); err != nil {
+		t.Fatal(err)
+	}
+	if reqs := fake.received(); len(reqs) != 2 || reqs[0].jwt == reqs[1].jwt {
+		t.Error("provider token was not reissued after ExpiredProviderToken")
+	}
+}
+
+func TestAPNsOutcomes(t *testing.T) {
+	for _, tc := range []outcomeCase{
+		{name: "ok", resp: pushResponse{status: http.StatusOK}},
+		{name: "unregistered", resp: pushResponse{status: http.StatusGone, body: `{"reason":"Unregistered"}`}, gone: true},
+		{name: "bad device token", resp: pushResponse{status: http.StatusBadRequest, body: `{"reason":"BadDeviceToken"}`}, gone: true},
+		{name: "throttled", resp: pushResponse{status: http.StatusTooManyRequests, body: `{"reason":"TooManyRequests"}`, retryAfter: "120"}, retryable: true, retryAfter: 2 * time.Minute},
+		{name: "invalid provider token", resp: pushResponse{status: http.StatusForbidden, body: `{"reason":"InvalidProviderToken"}`}},
+		{name: "bad topic", resp: pushResponse{status: http.StatusBadRequest, body: `{"reason":"BadTopic"}`}},
+		{name: "unavailable", resp: pushResponse{status: http.StatusServiceUnavailable, body: `{"reason":"ServiceUnavailable"}`}, retryable: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, fake := newTestAPNs(t)
+			fake.respond(tc.resp)
+			err := p.Send(context.Background(), PushTarget{Platform: platformAPNs, Token: "device-token"}, testCallNotification)
+			checkOutcome(t, tc, err)
+		})
+	}
+}
+
+func TestWebPushOutcomes(t *testing.T) {
+	vapidPrivate, vapidPublic, err := webpush.GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uaKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	rand.Read(auth)
+
+	for _, tc := range []outcomeCase{
+		{name: "created", resp: pushResponse{status: http.StatusCreated}},
+		{name: "gone", resp: pushResponse{status: http.StatusGone}, gone: true},
+		{name: "not found", resp: pushResponse{status: http.StatusNotFound}, gone: true},
+		{name: "vapid rejected", resp: pushResponse{status: http.StatusUnauthorized}},
+		{name: "throttled", resp: pushResponse{status: http.StatusTooManyRequests, retryAfter: "10"}, retryable: true, retryAfter: 10 * time.Second},
+		{name: "server error", resp: pushResponse{status: http.StatusInternalServerError}, retryable: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			headers := make(chan http.Header, 1)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				headers <- r.Header.Clone()
+				tc.resp.write(w)
+			}))
+			defer srv.Close()
+
+			p := &webPushProvider{subscriber: "admin@example.com", publicKey: vapidPublic, privateKey: vapidPrivate, client: srv.Client()}
+			err := p.Send(context.Background(), PushTarget{
+				Platform: platformWeb,
+				Token:    srv.URL + "/push/endpoint",
+				Auth:     base64.RawURLEncoding.EncodeToString(auth),
+				P256dh:   base64.RawURLEncoding.EncodeToString(uaKey.PublicKey().Bytes()),
+			}, testCallNotification)
+			checkOutcome(t, tc, err)
+			h := <-headers
+			if h.Get("Urgency") != "high" || h.Get("Topic") != "call-room" {
+				t.Errorf("Urgency %q, Topic %q", h.Get("Urgency"), h.Get("Topic"))
+			}
+		})
+	}
+}
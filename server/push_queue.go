@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	pushAttemptTimeout    = 20 * time.Second
+	pushBackoffBase       = 5 * time.Second
+	pushBackoffMax        = 15 * time.Minute
+	pushDispatchInterval  = time.Second
+	pushDispatchBatch     = 100
+	pushDeliveryRetention = 7 * 24 * time.Hour
+)
+
+// Delivery outcomes recorded in push_deliveries.
+const (
+	pushOutcomeSent    = "sent"
+	pushOutcomeRetry   = "retry"
+	pushOutcomeGone    = "gone"
+	pushOutcomeFailed  = "failed"
+	pushOutcomeExpired = "expired"
+)
+
+// pushQueue persists notifications in SQLite and delivers them from a
+// bounded worker pool, retrying transient failures with exponential backoff
+// until the notification's TTL runs out. Jobs survive restarts.
+type pushQueue struct {
+	s           *PushService
+	workers     int
+	perEndpoint int
+	maxAttempts int
+
+	jobs chan *pushJob
+	wake chan struct{}
+
+	mu     sync.Mutex
+	active map[string]int // endpoint key -> in-flight deliveries
+}
+
+type pushJob struct {
+	id        int64
+	target    PushTarget
+	data      map[string]string
+	urgent    bool
+	topic     string
+	roomID    string // set for room subscriptions
+	userID    string // set for user subscriptions
+	attempts  int
+	expiresAt time.Time
+}
+
+func createPushQueueTables(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS push_queue (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		platform TEXT NOT NULL,
+		endpoint TEXT NOT NULL,
+		auth TEXT NOT NULL DEFAULT '',
+		p256dh TEXT NOT NULL DEFAULT '',
+		room_id TEXT,
+		user_id TEXT,
+		payload TEXT NOT NULL,
+		urgent INTEGER NOT NULL DEFAULT 0,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		inflight INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS push_queue_due ON push_queue(inflight, next_attempt_at);
+	CREATE TABLE IF NOT EXISTS push_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		job_id INTEGER NOT NULL,
+		platform TEXT NOT NULL,
+		endpoint TEXT NOT NULL,
+		outcome TEXT NOT NULL,
+		status_code INTEGER,
+		error TEXT,
+		attempt INTEGER NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS push_deliveries_endpoint ON push_deliveries(endpoint, created_at);`)
+	if err != nil {
+		return err
+	}
+	// Ignore error if column exists
+	_, _ = db.Exec("ALTER TABLE push_queue ADD COLUMN topic TEXT NOT NULL DEFAULT ''")
+	return nil
+}
+
+func newPushQueue(s *PushService) *pushQueue {
+	return &pushQueue{
+		s:           s,
+		workers:     s.cfg.PushWorkers,
+		perEndpoint: s.cfg.PushEndpointConcurrency,
+		maxAttempts: s.cfg.PushMaxAttempts,
+		jobs:        make(chan *pushJob),
+		wake:        make(chan struct{}, 1),
+		active:      make(map[string]int),
+	}
+}
+
+// enqueue stores a notification for delivery. Its TTL bounds how long it is
+// retried for.
+func (q *pushQueue) enqueue(target PushTarget, n PushNotification, roomID, userID string) error {
+	payload, _ := json.Marshal(n.Data)
+	now := time.Now()
+	if n.Topic != "" {
+		// A queued notification for the same topic is superseded, just as
+		// the push service would collapse it.
+		if _, err := q.s.db.Exec("DELETE FROM push_queue WHERE endpoint = ? AND topic = ? AND inflight = 0", target.Token, n.Topic); err != nil {
+			return err
+		}
+	}
+	_, err := q.s.db.Exec(`INSERT INTO push_queue(platform, endpoint, auth, p256dh, room_id, user_id, payload, urgent, topic, next_attempt_at, expires_at, created_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		target.Platform, target.Token, target.Auth, target.P256dh, nullString(roomID), nullString(userID),
+		string(payload), n.Urgent, n.Topic, now.UnixMilli(), now.Add(n.TTL).UnixMilli(), now.UnixMilli())
+	if err != nil {
+		return err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// run starts the workers and dispatches due jobs until the process exits.
+func (q *pushQueue) run() {
+	// Jobs in flight when the process stopped are retried.
+	if _, err := q.s.db.Exec("UPDATE push_queue SET inflight = 0 WHERE inflight = 1"); err != nil {
+		slog.Error("failed to reset push queue", "err", err)
+	}
+	for i := 0; i < q.workers; i++ {
+		go func() {
+			for job := range q.jobs {
+				q.attempt(job)
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(pushDispatchInterval)
+	defer ticker.Stop()
+	lastPrune := time.Time{}
+	for {
+		q.dispatch()
+		if time.Since(lastPrune) > time.Hour {
+			q.prune()
+			q.s.expireSubscriptions()
+			lastPrune = time.Now()
+		}
+		select {
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *pushQueue) dispatch() {
+	now := time.Now()
+	rows, err := q.s.db.Query(`SELECT id, platform, endpoint, auth, p256dh, COALESCE(room_id, ''), COALESCE(user_id, ''), payload, urgent, topic, attempts, expires_at
+		FROM push_queue WHERE inflight = 0 AND next_attempt_at <= ? ORDER BY next_attempt_at LIMIT ?`, now.UnixMilli(), pushDispatchBatch)
+	if err != nil {
+		slog.Error("failed to query push queue", "err", err)
+		return
+	}
+	var due []*pushJob
+	for rows.Next() {
+		job := &pushJob{}
+		var payload string
+		var expiresAt int64
+		if err := rows.Scan(&job.id, &job.target.Platform, &job.target.Token, &job.target.Auth, &job.target.P256dh,
+			&job.roomID, &job.userID, &payload, &job.urgent, &job.topic, &job.attempts, &expiresAt); err != nil {
+			slog.Error("failed to scan push job", "err", err)
+			continue
+		}
+		json.Unmarshal([]byte(payload), &job.data)
+		job.expiresAt = time.UnixMilli(expiresAt)
+		due = append(due, job)
+	}
+	rows.Close()
+
+	for _, job := range due {
+		if !now.Before(job.expiresAt) {
+			q.finish(job, pushOutcomeExpired, nil)
+			continue
+		}
+		key := pushEndpointKey(job.target)
+		q.mu.Lock()
+		if q.active[key] >= q.perEndpoint {
+			q.mu.Unlock()
+			continue
+		}
+		q.active[key]++
+		q.mu.Unlock()
+
+		if _, err := q.s.db.Exec("UPDATE push_queue SET inflight = 1 WHERE id = ?", job.id); err != nil {
+			slog.Error("failed to claim push job", "err", err)
+			q.release(key)
+			continue
+		}
+		q.jobs <- job
+	}
+}
+
+// pushEndpointKey identifies the subscription whose concurrent deliveries
+// are limited. Sharing a push service must not make devices wait for each
+// other.
+func pushEndpointKey(target PushTarget) string {
+	return target.Platform + " " + target.Token
+}
+
+func (q *pushQueue) release(key string) {
+	q.mu.Lock()
+	if q.active[key]--; q.active[key] <= 0 {
+		delete(q.active, key)
+	}
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *pushQueue) attempt(job *pushJob) {
+	defer q.release(pushEndpointKey(job.target))
+	job.attempts++
+
+	provider, ok := q.s.providers[job.target.Platform]
+	if !ok {
+		q.finish(job, pushOutcomeFailed, errors.New("no provider for platform "+job.target.Platform))
+		return
+	}
+
+	// The remaining TTL is passed on so that push services drop the
+	// notification at the same time the queue would.
+	ttl := time.Until(job.expiresAt)
+	ctx, cancel := context.WithTimeout(context.Background(), pushAttemptTimeout)
+	err := provider.Send(ctx, job.target, PushNotification{Data: job.data, TTL: ttl, Urgent: job.urgent, Topic: job.topic})
+	cancel()
+
+	switch {
+	case err == nil:
+		q.finish(job, pushOutcomeSent, nil)
+	case errors.Is(err, errPushGone):
+		q.finish(job, pushOutcomeGone, err)
+		if job.roomID != "" {
+			q.s.Unsubscribe(job.roomID, job.target.Token)
+		}
+		if job.userID != "" {
+			q.s.UnsubscribeUser(job.userID, job.target.Token)
+		}
+	case pushRetryable(err) && job.attempts < q.maxAttempts:
+		delay := pushBackoff(job.attempts)
+		var httpErr *pushHTTPError
+		if errors.As(err, &httpErr) && httpErr.RetryAfter > delay {
+			delay = httpErr.RetryAfter
+		}
+		next := time.Now().Add(delay)
+		if !next.Before(job.expiresAt) {
+			q.finish(job, pushOutcomeExpired, err)
+			return
+		}
+		q.record(job, pushOutcomeRetry, err)
+		if _, dbErr := q.s.db.Exec("UPDATE push_queue SET inflight = 0, attempts = ?, next_attempt_at = ? WHERE id = ?",
+			job.attempts, next.UnixMilli(), job.id); dbErr != nil {
+			slog.Error("failed to reschedule push job", "err", dbErr)
+		}
+	default:
+		q.finish(job, pushOutcomeFailed, err)
+	}
+}
+
+// pushRetryable reports whether a failed delivery may succeed later:
+// network errors, throttling, server errors and provider tokens that were
+// just refreshed. Other rejections, such as a VAPID 401/403, are final.
+func pushRetryable(err error) bool {
+	var httpErr *pushHTTPError
+	if !errors.As(err, &httpErr) {
+		return true
+	}
+	return httpErr.StatusCode == http.StatusTooManyRequests || httpErr.StatusCode >= 500 || httpErr.TokenRefreshed
+}
+
+// pushBackoff returns the delay before the next attempt, doubling from
+// pushBackoffBase with ±20% jitter.
+func pushBackoff(attempts int) time.Duration {
+	delay := pushBackoffMax
+	if attempts < 20 {
+		delay = min(pushBackoffBase<<(attempts-1), pushBackoffMax)
+	}
+	return time.Duration(float64(delay) * (0.8 + 0.4*rand.Float64()))
+}
+
+// finish removes the job and records its final outcome.
+func (q *pushQueue) finish(job *pushJob, outcome string, err error) {
+	q.record(job, outcome, err)
+	if _, dbErr := q.s.db.Exec("DELETE FROM push_queue WHERE id = ?", job.id); dbErr != nil {
+		slog.Error("failed to remove push job", "err", dbErr)
+	}
+}
+
+func (q *pushQueue) record(job *pushJob, outcome string, err error) {
+	var status interface{}
+	var errText interface{}
+	if err != nil {
+		errText = err.Error()
+		var httpErr *pushHTTPError
+		if errors.As(err, &httpErr) {
+			status = httpErr.StatusCode
+		}
+	}
+	if _, dbErr := q.s.db.Exec(`INSERT INTO push_deliveries(job_id, platform, endpoint, outcome, status_code, error, attempt, created_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?)`,
+		job.id, job.target.Platform, job.target.Token, outcome, status, errText, job.attempts, time.Now().UnixMilli()); dbErr != nil {
+		slog.Error("failed to record push delivery", "err", dbErr)
+	}
+
+	log := slog.Debug
+	if outcome != pushOutcomeSent {
+		log = slog.Info
+	}
+	log("push delivery", "outcome", outcome, "platform", job.target.Platform, "endpoint", redactEndpoint(job.target.Token), "attempt", job.attempts, "err", err)
+}
+
+func (q *pushQueue) prune() {
+	cutoff := time.Now().Add(-pushDeliveryRetention).UnixMilli()
+	if _, err := q.s.db.Exec("DELETE FROM push_deliveries WHERE created_at < ?", cutoff); err != nil {
+		slog.Error("failed to prune push deliveries", "err", err)
+	}
+}
+
+type pushDelivery struct {
+	JobID      int64  `json:"jobId"`
+	Platform   string `json:"platform"`
+	Endpoint   string `json:"endpoint"`
+	Outcome    string `json:"outcome"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Attempt    int    `json:"attempt"`
+	CreatedAt  int64  `json:"createdAt"`
+}
+
+// deliveries returns the most recent delivery records, optionally for one
+// endpoint. Endpoints are redacted.
+func (q *pushQueue) deliveries(endpoint string, limit int) ([]pushDelivery, error) {
+	query := "SELECT job_id, platform, endpoint, outcome, COALESCE(status_code, 0), COALESCE(error, ''), attempt, created_at FROM push_deliveries"
+	args := []interface{}{}
+	if endpoint != "" {
+		query += " WHERE endpoint = ?"
+		args = append(args, endpoint)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := q.s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []pushDelivery{}
+	for rows.Next() {
+		var d pushDelivery
+		if err := rows.Scan(&d.JobID, &d.Platform, &d.Endpoint, &d.Outcome, &d.StatusCode, &d.Error, &d.Attempt, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		d.Endpoint = redactEndpoint(d.Endpoint)
+		records = append(records, d)
+	}
+	return records, rows.Err()
+}
+
+// stats reports the queue depth.
+func (q *pushQueue) stats() map[string]int {
+	var pending, inflight int
+	q.s.db.QueryRow("SELECT COUNT(*) - COALESCE(SUM(inflight), 0), COALESCE(SUM(inflight), 0) FROM push_queue").Scan(&pending, &inflight)
+	return map[string]int{"pending": pending, "inflight": inflight}
+}
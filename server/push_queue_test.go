@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePushProvider returns the queued results in order, then succeeds.
+type fakePushProvider struct {
+	mu      sync.Mutex
+	results []error
+	sent    []PushNotification
+}
+
+func (p *fakePushProvider) Send(ctx context.Context, target PushTarget, n PushNotification) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sent = append(p.sent, n)
+	if len(p.results) == 0 {
+		return nil
+	}
+	err := p.results[0]
+	p.results = p.results[1:]
+	return err
+}
+
+// newTestPushQueue returns a queue whose jobs are handed to the test instead
+// of to workers, delivering web pushes through the returned fake provider.
+func newTestPushQueue(t *testing.T) (*pushQueue, *fakePushProvider) {
+	t.Helper()
+	cfg := newTestConfig()
+	s := newTestPushService(t, cfg, newAuthStore(cfg))
+	provider := &fakePushProvider{}
+	s.providers = map[string]PushProvider{platformWeb: provider}
+	s.queue.jobs = make(chan *pushJob, pushDispatchBatch)
+	return s.queue, provider
+}
+
+func webTarget(endpoint string) PushTarget {
+	return PushTarget{Platform: platformWeb, Token: endpoint, Auth: "auth", P256dh: "key"}
+}
+
+func enqueueTest(t *testing.T, q *pushQueue, endpoint, topic string, ttl time.Duration) {
+	t.Helper()
+	n := PushNotification{Data: map[string]string{"title": "t"}, TTL: ttl, Topic: topic}
+	if err := q.enqueue(webTarget(endpoint), n, "", ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dispatched runs one dispatch pass and returns the jobs it handed out.
+func dispatched(q *pushQueue) []*pushJob {
+	q.dispatch()
+	var jobs []*pushJob
+	for {
+		select {
+		case job := <-q.jobs:
+			jobs = append(jobs, job)
+		default:
+			return jobs
+		}
+	}
+}
+
+func deliveryOutcomes(t *testing.T, q *pushQueue) []string {
+	t.Helper()
+	records, err := q.deliveries("", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outcomes := make([]string, len(records))
+	for i, d := range records {
+		outcomes[len(records)-1-i] = d.Outcome
+	}
+	return outcomes
+}
+
+func queuedJobs(t *testing.T, q *pushQueue) int {
+	t.Helper()
+	var n int
+	if err := q.s.db.QueryRow("SELECT COUNT(*) FROM push_queue").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// makeDue moves every queued job's next attempt to now.
+func makeDue(t *testing.T, q *pushQueue) {
+	t.Helper()
+	if _, err := q.s.db.Exec("UPDATE push_queue SET next_attempt_at = ?", time.Now().UnixMilli()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPushQueueRetriesWithBackoff(t *testing.T) {
+	q, provider := newTestPushQueue(t)
+	provider.results = []error{
+		&pushHTTPError{StatusCode: http.StatusServiceUnavailable},
+		&pushHTTPError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Hour},
+	}
+	enqueueTest(t, q, "https://push.example/a", "", 24*time.Hour)
+
+	jobs := dispatched(q)
+	if len(jobs) != 1 {
+		t.Fatalf("dispatched %d jobs, want 1", len(jobs))
+	}
+	before := time.Now()
+	q.attempt(jobs[0])
+
+	var attempts int
+	var next int64
+	if err := q.s.db.QueryRow("SELECT attempts, next_attempt_at FROM push_queue").Scan(&attempts, &next); err != nil {
+		t.Fatal(err)
+	}
+	delay := time.UnixMilli(next).Sub(before)
+	if attempts != 1 || delay < pushBackoffBase*8/10-time.Millisecond || delay > pushBackoffBase*12/10+time.Second {
+		t.Fatalf("after first failure: attempts %d, retry in %v, want 1 attempt and about %v", attempts, delay, pushBackoffBase)
+	}
+	if jobs := dispatched(q); len(jobs) != 0 {
+		t.Fatalf("job dispatched before its backoff ran out")
+	}
+
+	// Retry-After longer than the backoff wins.
+	makeDue(t, q)
+	before = time.Now()
+	q.attempt(dispatched(q)[0])
+	if err := q.s.db.QueryRow("SELECT attempts, next_attempt_at FROM push_queue").Scan(&attempts, &next); err != nil {
+		t.Fatal(err)
+	}
+	if delay := time.UnixMilli(next).Sub(before); attempts != 2 || delay < time.Hour-time.Second {
+		t.Fatalf("after 429: attempts %d, retry in %v, want 2 attempts and an hour", attempts, delay)
+	}
+
+	makeDue(t, q)
+	q.attempt(dispatched(q)[0])
+	if n := queuedJobs(t, q); n != 0 {
+		t.Errorf("%d jobs left after delivery", n)
+	}
+	if got := deliveryOutcomes(t, q); len(got) != 3 || got[0] != pushOutcomeRetry || got[1] != pushOutcomeRetry || got[2] != pushOutcomeSent {
+		t.Errorf("outcomes = %v, want retry, retry, sent", got)
+	}
+	// The remaining TTL is passed on to the push service.
+	if ttl := provider.sent[2].TTL; ttl <= 23*time.Hour || ttl > 24*time.Hour {
+		t.Errorf("last attempt TTL = %v, want just under 24h", ttl)
+	}
+}
+
+func TestPushQueueFinalOutcomes(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []error
+		ttl     time.Duration
+		want    []string
+	}{
+		{"rejected", []error{&pushHTTPError{StatusCode: http.StatusForbidden}}, time.Hour, []string{pushOutcomeFailed}},
+		{"gone", []error{errPushGone}, time.Hour, []string{pushOutcomeGone}},
+		{"retry after expiry", []error{&pushHTTPError{StatusCode: http.StatusServiceUnavailable, RetryAfter: 2 * time.Hour}}, time.Hour, []string{pushOutcomeExpired}},
+		{"attempts exhausted", []error{errors.New("timeout"), errors.New("timeout"), errors.New("timeout")}, time.Hour,
+			[]string{pushOutcomeRetry, pushOutcomeRetry, pushOutcomeFailed}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, provider := newTestPushQueue(t)
+			q.maxAttempts = 3
+			provider.results = tt.results
+			enqueueTest(t, q, "https://push.example/a", "", tt.ttl)
+			for i := 0; i < len(tt.results); i++ {
+				makeDue(t, q)
+				jobs := dispatched(q)
+				if len(jobs) != 1 {
+					t.Fatalf("attempt %d: dispatched %d jobs", i+1, len(jobs))
+				}
+				q.attempt(jobs[0])
+			}
+			if n := queuedJobs(t, q); n != 0 {
+				t.Errorf("%d jobs left", n)
+			}
+			if got := deliveryOutcomes(t, q); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("outcomes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPushQueueExpiresBeforeSending(t *testing.T) {
+	q, provider := newTestPushQueue(t)
+	enqueueTest(t, q, "https://push.example/a", "", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	if jobs := dispatched(q); len(jobs) != 0 {
+		t.Fatalf("expired job dispatched")
+	}
+	if len(provider.sent) != 0 || queuedJobs(t, q) != 0 {
+		t.Errorf("sent %d, queued %d, want neither", len(provider.sent), queuedJobs(t, q))
+	}
+	if got := deliveryOutcomes(t, q); len(got) != 1 || got[0] != pushOutcomeExpired {
+		t.Errorf("outcomes = %v, want expired", got)
+	}
+}
+
+func TestPushQueueGoneUnsubscribes(t *testing.T) {
+	q, provider := newTestPushQueue(t)
+	provider.results = []error{errPushGone}
+	sub := PushSubscriptionRequest{Endpoint: "https://push.example/a"}
+	if err := q.s.Subscribe("room", sub, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.enqueue(webTarget(sub.Endpoint), PushNotification{TTL: time.Hour}, "room", ""); err != nil {
+		t.Fatal(err)
+	}
+	q.attempt(dispatched(q)[0])
+
+	var n int
+	q.s.db.QueryRow("SELECT COUNT(*) FROM subscriptions").Scan(&n)
+	if n != 0 {
+		t.Errorf("%d subscriptions left after the endpoint was gone", n)
+	}
+}
+
+func TestPushQueueTopicSupersedes(t *testing.T) {
+	q, _ := newTestPushQueue(t)
+	enqueueTest(t, q, "https://push.example/a", "call", time.Hour)
+	enqueueTest(t, q, "https://push.example/a", "call", time.Hour)
+	enqueueTest(t, q, "https://push.example/a", "chat", time.Hour)
+	enqueueTest(t, q, "https://push.example/b", "call", time.Hour)
+	enqueueTest(t, q, "https://push.example/a", "", time.Hour)
+	enqueueTest(t, q, "https://push.example/a", "", time.Hour)
+	if n := queuedJobs(t, q); n != 5 {
+		t.Fatalf("queued %d jobs, want 5 (one per topic and endpoint, untopiced kept)", n)
+	}
+
+	// A delivery already in flight is not superseded.
+	if _, err := q.s.db.Exec("UPDATE push_queue SET inflight = 1 WHERE topic = 'call'"); err != nil {
+		t.Fatal(err)
+	}
+	enqueueTest(t, q, "https://push.example/a", "call", time.Hour)
+	if n := queuedJobs(t, q); n != 6 {
+		t.Errorf("queued %d jobs, want 6", n)
+	}
+}
+
+func TestPushQueueEndpointConcurrency(t *testing.T) {
+	q, _ := newTestPushQueue(t)
+	q.perEndpoint = 2
+	for i := 0; i < 3; i++ {
+		enqueueTest(t, q, "https://push.example/a", "", time.Hour)
+	}
+	enqueueTest(t, q, "https://push.example/b", "", time.Hour)
+
+	count := func(jobs []*pushJob) map[string]int {
+		counts := make(map[string]int)
+		for _, job := range jobs {
+			counts[job.target.Token]++
+		}
+		return counts
+	}
+	jobs := dispatched(q)
+	if got := count(jobs); got["https://push.example/a"] != 2 || got["https://push.example/b"] != 1 {
+		t.Fatalf("first pass dispatched %v, want 2 for a and 1 for b", got)
+	}
+	if jobs := dispatched(q); len(jobs) != 0 {
+		t.Fatalf("second pass dispatched %d jobs while a is at its limit", len(jobs))
+	}
+
+	for _, job := range jobs {
+		if job.target.Token == "https://push.example/a" {
+			q.attempt(job)
+			break
+		}
+	}
+	if got := count(dispatched(q)); got["https://push.example/a"] != 1 {
+		t.Errorf("after one delivery to a dispatched %v, want the last job for a", got)
+	}
+}
+
+func TestPushBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, pushBackoffBase},
+		{2, 2 * pushBackoffBase},
+		{5, 16 * pushBackoffBase},
+		{8, 128 * pushBackoffBase},
+		{9, pushBackoffMax},
+		{40, pushBackoffMax},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			if got := pushBackoff(tt.attempts); got < tt.want*8/10 || got > tt.want*12/10 {
+				t.Errorf("pushBackoff(%d) = %v, want %v ±20%%", tt.attempts, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestPushRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("connection reset"), true},
+		{&pushHTTPError{StatusCode: http.StatusTooManyRequests}, true},
+		{&pushHTTPError{StatusCode: http.StatusBadGateway}, true},
+		{&pushHTTPError{StatusCode: http.StatusForbidden}, false},
+		{&pushHTTPError{StatusCode: http.StatusUnauthorized, TokenRefreshed: true}, true},
+		{&pushHTTPError{StatusCode: http.StatusBadRequest}, false},
+	}
+	for _, tt := range tests {
+		if got := pushRetryable(tt.err); got != tt.want {
+			t.Errorf("pushRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Devices manage their subscriptions by endpoint. The endpoint alone is not
+// proof of ownership (it is shared with the push service), so requests also
+// carry the subscription's current auth secret, in X-Push-Auth for GET and
+// in the body otherwise. Native tokens have no auth secret.
+
+type endpointSubscription struct {
+	RoomID      string `json:"roomId"`
+	CreatedAt   int64  `json:"createdAt"`
+	RefreshedAt int64  `json:"refreshedAt"`
+	MutedUntil  int64  `json:"mutedUntil,omitempty"`
+}
+
+// ownsEndpoint reports whether auth matches the secret stored for endpoint
+// in any subscription.
+func (s *PushService) ownsEndpoint(endpoint, auth string) (bool, error) {
+	var stored string
+	err := s.db.QueryRow(`
+		SELECT auth FROM subscriptions WHERE endpoint = ?
+		UNION ALL SELECT auth FROM user_subscriptions WHERE endpoint = ?
+		LIMIT 1`, endpoint, endpoint).Scan(&stored)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(auth)) == 1, nil
+}
+
+// EndpointSubscriptions lists the rooms an endpoint is subscribed to and
+// whether it receives chat message notifications.
+func (s *PushService) EndpointSubscriptions(endpoint string) ([]endpointSubscription, bool, error) {
+	rows, err := s.db.Query("SELECT room_id, created_at, refreshed_at, muted_until FROM subscriptions WHERE endpoint = ? ORDER BY created_at", endpoint)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	subs := []endpointSubscription{}
+	for rows.Next() {
+		var sub endpointSubscription
+		var refreshed sql.NullInt64
+		if err := rows.Scan(&sub.RoomID, &sub.CreatedAt, &refreshed, &sub.MutedUntil); err != nil {
+			return nil, false, err
+		}
+		sub.RefreshedAt = refreshed.Int64
+		subs = append(subs, sub)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	var messages int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM user_subscriptions WHERE endpoint = ?", endpoint).Scan(&messages); err != nil {
+		return nil, false, err
+	}
+	return subs, messages > 0, nil
+}
+
+// UnsubscribeEndpoint removes the endpoint from the given rooms, or from
+// every room and user subscription when roomIDs is empty.
+func (s *PushService) UnsubscribeEndpoint(endpoint string, roomIDs []string) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var removed int64
+	exec := func(query string, args ...interface{}) error {
+		res, err := tx.Exec(query, args...)
+		if err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		removed += n
+		return nil
+	}
+	if len(roomIDs) == 0 {
+		if err := exec("DELETE FROM subscriptions WHERE endpoint = ?", endpoint); err != nil {
+			return 0, err
+		}
+		if err := exec("DELETE FROM user_subscriptions WHERE endpoint = ?", endpoint); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("DELETE FROM quiet_hours WHERE owner = ?", quietOwnerEndpoint(endpoint)); err != nil {
+			return 0, err
+		}
+		// Nothing left to deliver to.
+		if _, err := tx.Exec("DELETE FROM push_queue WHERE endpoint = ? AND inflight = 0", endpoint); err != nil {
+			return 0, err
+		}
+	} else {
+		for _, roomID := range roomIDs {
+			if err := exec("DELETE FROM subscriptions WHERE room_id = ? AND endpoint = ?", roomID, endpoint); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	slog.Info("push endpoint unsubscribed", "endpoint", redactEndpoint(endpoint), "rooms", len(roomIDs), "removed", removed)
+	return removed, nil
+}
+
+// RotateEndpointKeys replaces the encryption keys of every subscription of
+// the endpoint, including notifications still waiting in the queue.
+func (s *PushService) RotateEndpointKeys(endpoint, auth, p256dh string) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UnixMilli()
+	var updated int64
+	for _, query := range []string{
+		"UPDATE subscriptions SET auth = ?, p256dh = ?, refreshed_at = ? WHERE endpoint = ?",
+		"UPDATE user_subscriptions SET auth = ?, p256dh = ?, refreshed_at = ? WHERE endpoint = ?",
+	} {
+		res, err := tx.Exec(query, auth, p256dh, now, endpoint)
+		if err != nil {
+			return 0, err
+		}
+		n, _ := res.RowsAffected()
+		updated += n
+	}
+	if _, err := tx.Exec("UPDATE push_queue SET auth = ?, p256dh = ? WHERE endpoint = ?", auth, p256dh, endpoint); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	slog.Info("push endpoint keys rotated", "endpoint", redactEndpoint(endpoint), "subscriptions", updated)
+	return updated, nil
+}
+
+// expireSubscriptions removes subscriptions that have not been refreshed
+// within PUSH_SUBSCRIPTION_TTL_DAYS. Clients refresh by subscribing again.
+func (s *PushService) expireSubscriptions() {
+	if s.cfg.PushSubscriptionTTLDays > 0 {
+		s.expireStaleSubscriptions()
+	}
+	// Drop the schedules of devices that no longer have a subscription.
+	_, err := s.db.Exec(`DELETE FROM quiet_hours WHERE owner LIKE 'endpoint:%'
+		AND substr(owner, 10) NOT IN (SELECT endpoint FROM subscriptions UNION SELECT endpoint FROM user_subscriptions)`)
+	if err != nil {
+		slog.Error("failed to prune quiet hours", "err", err)
+	}
+}
+
+func (s *PushService) expireStaleSubscriptions() {
+	cutoff := time.Now().AddDate(0, 0, -s.cfg.PushSubscriptionTTLDays).UnixMilli()
+	var removed int64
+	for _, table := range []string{"subscriptions", "user_subscriptions"} {
+		res, err := s.db.Exec("DELETE FROM "+table+" WHERE refreshed_at < ?", cutoff)
+		if err != nil {
+			slog.Error("failed to expire push subscriptions", "table", table, "err", err)
+			continue
+		}
+		n, _ := res.RowsAffected()
+		removed += n
+	}
+	if removed > 0 {
+		slog.Info("expired stale push subscriptions", "removed", removed)
+	}
+}
+
+// handlePushSubscriptions lets a device list (GET), remove (DELETE) and
+// rotate the keys of (PATCH) its subscriptions.
+func handlePushSubscriptions(cfg *Config, pushService *PushService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			return
+		}
+
+		var req struct {
+			Endpoint string   `json:"endpoint"`
+			Auth     string   `json:"auth"`
+			RoomIDs  []string `json:"roomIds"`
+			Keys     struct {
+				Auth   string `json:"auth"`
+				P256dh string `json:"p256dh"`
+			} `json:"keys"`
+		}
+		switch r.Method {
+		case http.MethodGet:
+			req.Endpoint = r.URL.Query().Get("endpoint")
+			req.Auth = r.Header.Get("X-Push-Auth")
+		case http.MethodDelete, http.MethodPatch:
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid body", http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if strings.TrimSpace(req.Endpoint) == "" {
+			http.Error(w, "Missing endpoint", http.StatusBadRequest)
+			return
+		}
+		for _, roomID := range req.RoomIDs {
+			if err := validateRoomID(cfg, roomID); err != nil {
+				http.Error(w, "Invalid roomId", http.StatusBadRequest)
+				return
+			}
+		}
+
+		owned, err := pushService.ownsEndpoint(req.Endpoint, req.Auth)
+		if err != nil {
+			http.Error(w, "Failed to load subscriptions", http.StatusInternalServerError)
+			return
+		}
+		if !owned {
+			// Unknown endpoints and wrong secrets look the same.
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			rooms, messages, err := pushService.EndpointSubscriptions(req.Endpoint)
+			if err != nil {
+				http.Error(w, "Failed to load subscriptions", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"rooms":    rooms,
+				"messages": messages,
+			})
+		case http.MethodDelete:
+			removed, err := pushService.UnsubscribeEndpoint(req.Endpoint, req.RoomIDs)
+			if err != nil {
+				http.Error(w, "Failed to unsubscribe", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]int64{"removed": removed})
+		case http.MethodPatch:
+			if req.Keys.Auth == "" || req.Keys.P256dh == "" {
+				http.Error(w, "Missing keys", http.StatusBadRequest)
+				return
+			}
+			updated, err := pushService.RotateEndpointKeys(req.Endpoint, req.Keys.Auth, req.Keys.P256dh)
+			if err != nil {
+				http.Error(w, "Failed to update keys", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]int64{"updated": updated})
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testEndpointA = "https://push.example/a"
+	testEndpointB = "https://push.example/b"
+)
+
+func webSubscription(endpoint, auth string) PushSubscriptionRequest {
+	sub := PushSubscriptionRequest{Endpoint: endpoint}
+	sub.Keys.Auth = auth
+	sub.Keys.P256dh = "key-" + auth
+	return sub
+}
+
+// newTestSubscriptions subscribes endpoint A to two rooms and to chat
+// messages, and endpoint B to the first room.
+func newTestSubscriptions(t *testing.T) (*Config, *PushService, []string) {
+	t.Helper()
+	cfg := newTestConfig()
+	cfg.RoomIDSecret = "test-room-id-secret"
+	s := newTestPushService(t, cfg, newAuthStore(cfg))
+	rids := make([]string, 3)
+	for i := range rids {
+		rid, err := generateRoomID(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rids[i] = rid
+	}
+	for _, rid := range rids[:2] {
+		if err := s.Subscribe(rid, webSubscription(testEndpointA, "secret-a"), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SubscribeUser("U-alice", webSubscription(testEndpointA, "secret-a"), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Subscribe(rids[0], webSubscription(testEndpointB, "secret-b"), ""); err != nil {
+		t.Fatal(err)
+	}
+	return cfg, s, rids
+}
+
+func callSubscriptions(h http.HandlerFunc, method, endpoint, auth, body string) *httptest.ResponseRecorder {
+	target := "/api/push/subscriptions"
+	if method == http.MethodGet {
+		target += "?endpoint=" + url.QueryEscape(endpoint)
+	}
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if auth != "" {
+		req.Header.Set("X-Push-Auth", auth)
+	}
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
+
+func listRooms(t *testing.T, h http.HandlerFunc, endpoint, auth string) ([]string, bool) {
+	t.Helper()
+	rec := callSubscriptions(h, http.MethodGet, endpoint, auth, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list %s: %d %s", endpoint, rec.Code, rec.Body)
+	}
+	var resp struct {
+		Rooms    []endpointSubscription `json:"rooms"`
+		Messages bool                   `json:"messages"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	rooms := make([]string, len(resp.Rooms))
+	for i, sub := range resp.Rooms {
+		rooms[i] = sub.RoomID
+	}
+	return rooms, resp.Messages
+}
+
+func requestBody(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func TestPushSubscriptionsList(t *testing.T) {
+	cfg, s, rids := newTestSubscriptions(t)
+	h := handlePushSubscriptions(cfg, s)
+
+	rooms, messages := listRooms(t, h, testEndpointA, "secret-a")
+	if len(rooms) != 2 || rooms[0] != rids[0] || rooms[1] != rids[1] || !messages {
+		t.Errorf("endpoint A: rooms %v, messages %v", rooms, messages)
+	}
+	rooms, messages = listRooms(t, h, testEndpointB, "secret-b")
+	if len(rooms) != 1 || messages {
+		t.Errorf("endpoint B: rooms %v, messages %v", rooms, messages)
+	}
+
+	unknown := callSubscriptions(h, http.MethodGet, "https://push.example/unknown", "secret-a", "")
+	for _, tt := range []struct {
+		name, endpoint, auth string
+	}{
+		{"wrong secret", testEndpointA, "secret-b"},
+		{"no secret", testEndpointA, ""},
+	} {
+		rec := callSubscriptions(h, http.MethodGet, tt.endpoint, tt.auth, "")
+		if rec.Code != http.StatusNotFound || rec.Body.String() != unknown.Body.String() {
+			t.Errorf("%s: %d %q, want the unknown endpoint response", tt.name, rec.Code, rec.Body)
+		}
+	}
+	if rec := callSubscriptions(h, http.MethodGet, "", "secret-a", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("missing endpoint: %d, want 400", rec.Code)
+	}
+}
+
+func TestPushSubscriptionsUnsubscribe(t *testing.T) {
+	cfg, s, rids := newTestSubscriptions(t)
+	h := handlePushSubscriptions(cfg, s)
+	if err := s.SetQuietHours(quietOwnerEndpoint(testEndpointA), &quietHours{loc: time.UTC, days: 0x7f}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.queue.enqueue(webTarget(testEndpointA), PushNotification{TTL: time.Hour}, rids[1], ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := callSubscriptions(h, http.MethodDelete, "", "", requestBody(map[string]interface{}{
+		"endpoint": testEndpointA, "auth": "secret-a", "roomIds": []string{"not-a-room"},
+	})); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid room ID: %d, want 400", rec.Code)
+	}
+	if rec := callSubscriptions(h, http.MethodDelete, "", "", requestBody(map[string]interface{}{
+		"endpoint": testEndpointA, "auth": "secret-b", "roomIds": []string{rids[0]},
+	})); rec.Code != http.StatusNotFound {
+		t.Errorf("wrong secret: %d, want 404", rec.Code)
+	}
+
+	// Removing some rooms leaves the rest and other devices alone.
+	rec := callSubscriptions(h, http.MethodDelete, "", "", requestBody(map[string]interface{}{
+		"endpoint": testEndpointA, "auth": "secret-a", "roomIds": []string{rids[0], rids[2]},
+	}))
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"removed":1}` {
+		t.Fatalf("remove one room: %d %s", rec.Code, rec.Body)
+	}
+	if rooms, messages := listRooms(t, h, testEndpointA, "secret-a"); len(rooms) != 1 || rooms[0] != rids[1] || !messages {
+		t.Errorf("after removing one room: rooms %v, messages %v", rooms, messages)
+	}
+	if rooms, _ := listRooms(t, h, testEndpointB, "secret-b"); len(rooms) != 1 {
+		t.Errorf("endpoint B lost its subscription")
+	}
+
+	// Removing everything also drops the schedule and queued notifications.
+	rec = callSubscriptions(h, http.MethodDelete, "", "", requestBody(map[string]string{"endpoint": testEndpointA, "auth": "secret-a"}))
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"removed":2}` {
+		t.Fatalf("remove all: %d %s", rec.Code, rec.Body)
+	}
+	if rec := callSubscriptions(h, http.MethodGet, testEndpointA, "secret-a", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("list after removing all: %d, want 404", rec.Code)
+	}
+	if q, _ := s.QuietHours(quietOwnerEndpoint(testEndpointA)); q != nil {
+		t.Error("quiet hours kept after removing all subscriptions")
+	}
+	if n := queuedJobs(t, s.queue); n != 0 {
+		t.Errorf("%d notifications still queued", n)
+	}
+}
+
+func TestPushSubscriptionsRotateKeys(t *testing.T) {
+	cfg, s, rids := newTestSubscriptions(t)
+	h := handlePushSubscriptions(cfg, s)
+	if err := s.queue.enqueue(webTarget(testEndpointA), PushNotification{TTL: time.Hour}, rids[0], ""); err != nil {
+		t.Fatal(err)
+	}
+
+	rotate := func(auth string, keys map[string]string) *httptest.ResponseRecorder {
+		return callSubscriptions(h, http.MethodPatch, "", "", requestBody(map[string]interface{}{
+			"endpoint": testEndpointA, "auth": auth, "keys": keys,
+		}))
+	}
+	if rec := rotate("secret-a", map[string]string{"auth": "new-secret"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("missing p256dh: %d, want 400", rec.Code)
+	}
+	if rec := rotate("secret-b", map[string]string{"auth": "new-secret", "p256dh": "new-key"}); rec.Code != http.StatusNotFound {
+		t.Errorf("wrong secret: %d, want 404", rec.Code)
+	}
+	rec := rotate("secret-a", map[string]string{"auth": "new-secret", "p256dh": "new-key"})
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"updated":3}` {
+		t.Fatalf("rotate: %d %s", rec.Code, rec.Body)
+	}
+
+	if rec := callSubscriptions(h, http.MethodGet, testEndpointA, "secret-a", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("old secret still accepted: %d", rec.Code)
+	}
+	if rooms, _ := listRooms(t, h, testEndpointA, "new-secret"); len(rooms) != 2 {
+		t.Errorf("rooms after rotation = %v", rooms)
+	}
+	var auth, p256dh string
+	if err := s.db.QueryRow("SELECT auth, p256dh FROM push_queue WHERE endpoint = ?", testEndpointA).Scan(&auth, &p256dh); err != nil {
+		t.Fatal(err)
+	}
+	if auth != "new-secret" || p256dh != "new-key" {
+		t.Errorf("queued notification keys = %q, %q", auth, p256dh)
+	}
+	// Other devices keep their keys.
+	if rooms, _ := listRooms(t, h, testEndpointB, "secret-b"); len(rooms) != 1 {
+		t.Errorf("endpoint B rooms = %v", rooms)
+	}
+}
+
+func TestExpireSubscriptions(t *testing.T) {
+	cfg, s, _ := newTestSubscriptions(t)
+	h := handlePushSubscriptions(cfg, s)
+	if err := s.SetQuietHours(quietOwnerEndpoint(testEndpointA), &quietHours{loc: time.UTC, days: 0x7f}); err != nil {
+		t.Fatal(err)
+	}
+
+	stale := time.Now().AddDate(0, 0, -cfg.PushSubscriptionTTLDays-1).UnixMilli()
+	for _, table := range []string{"subscriptions", "user_subscriptions"} {
+		if _, err := s.db.Exec("UPDATE "+table+" SET refreshed_at = ? WHERE endpoint = ?", stale, testEndpointA); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A TTL of zero disables expiry.
+	cfg.PushSubscriptionTTLDays = 0
+	s.expireSubscriptions()
+	if rooms, _ := listRooms(t, h, testEndpointA, "secret-a"); len(rooms) != 2 {
+		t.Fatalf("expired with TTL disabled: rooms %v", rooms)
+	}
+
+	cfg.PushSubscriptionTTLDays = 90
+	s.expireSubscriptions()
+	if rec := callSubscriptions(h, http.MethodGet, testEndpointA, "secret-a", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("stale endpoint still listed: %d", rec.Code)
+	}
+	if q, _ := s.QuietHours(quietOwnerEndpoint(testEndpointA)); q != nil {
+		t.Error("quiet hours of an expired endpoint kept")
+	}
+	if rooms, _ := listRooms(t, h, testEndpointB, "secret-b"); len(rooms) != 1 {
+		t.Errorf("fresh endpoint expired: rooms %v", rooms)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+	_ "time/tzdata" // the runtime image has no zoneinfo
+)
+
+// Quiet hours hold back call notifications on a weekly schedule in the
+// subscriber's time zone, or until a do-not-disturb deadline. A schedule
+// belongs to a device (its push endpoint) or to a signed-in user; the
+// device's schedule wins. With allowPriority, calls from the user's priority
+// contacts ring through. Missed calls are still delivered, silently, so they
+// are there in the morning.
+
+type quietHours struct {
+	startMin      int // minutes after local midnight
+	endMin        int // before startMin when the window spans midnight
+	days          int // bit 0 = Sunday; the day the window starts on
+	loc           *time.Location
+	dndUntil      int64 // unix ms
+	allowPriority bool
+}
+
+type quietHoursJSON struct {
+	Start         string `json:"start,omitempty"` // "22:00"
+	End           string `json:"end,omitempty"`   // "07:00"
+	Days          []int  `json:"days,omitempty"`  // 0 = Sunday; empty = every day
+	Timezone      string `json:"timezone"`
+	DNDUntil      int64  `json:"dndUntil,omitempty"`
+	AllowPriority bool   `json:"allowPriority"`
+}
+
+const allDays = 1<<7 - 1
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a HH:MM time", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (j quietHoursJSON) parse() (*quietHours, error) {
+	q := &quietHours{days: allDays, dndUntil: j.DNDUntil, allowPriority: j.AllowPriority}
+	tz := j.Timezone
+	if tz == "" {
+		tz = "UTC"
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", j.Timezone)
+	}
+	q.loc = loc
+	if (j.Start == "") != (j.End == "") {
+		return nil, errors.New("start and end must be set together")
+	}
+	if j.Start != "" {
+		if q.startMin, err = parseClock(j.Start); err != nil {
+			return nil, err
+		}
+		if q.endMin, err = parseClock(j.End); err != nil {
+			return nil, err
+		}
+	}
+	if len(j.Days) > 0 {
+		q.days = 0
+		for _, d := range j.Days {
+			if d < 0 || d > 6 {
+				return nil, errors.New("days must be 0 (Sunday) to 6")
+			}
+			q.days |= 1 << d
+		}
+	}
+	if q.startMin == q.endMin && q.dndUntil == 0 {
+		return nil, errors.New("set a start and end time or dndUntil")
+	}
+	return q, nil
+}
+
+func (q *quietHours) toJSON() quietHoursJSON {
+	j := quietHoursJSON{Timezone: q.loc.String(), DNDUntil: q.dndUntil, AllowPriority: q.allowPriority}
+	if q.startMin != q.endMin {
+		j.Start = fmt.Sprintf("%02d:%02d", q.startMin/60, q.startMin%60)
+		j.End = fmt.Sprintf("%02d:%02d", q.endMin/60, q.endMin%60)
+	}
+	if q.days != allDays {
+		for d := 0; d < 7; d++ {
+			if q.days&(1<<d) != 0 {
+				j.Days = append(j.Days, d)
+			}
+		}
+	}
+	return j
+}
+
+// active reports whether notifications are held back at now.
+func (q *quietHours) active(now time.Time) bool {
+	if q.dndUntil > now.UnixMilli() {
+		return true
+	}
+	if q.startMin == q.endMin {
+		return false
+	}
+	local := now.In(q.loc)
+	minute := local.Hour()*60 + local.Minute()
+	day := int(local.Weekday())
+	on := func(d int) bool { return q.days&(1<<((d+7)%7)) != 0 }
+	if q.startMin < q.endMin {
+		return on(day) && minute >= q.startMin && minute < q.endMin
+	}
+	// Spans midnight: the early hours belong to the previous day's window.
+	return (on(day) && minute >= q.startMin) || (on(day-1) && minute < q.endMin)
+}
+
+func quietOwnerEndpoint(endpoint string) string { return "endpoint:" + endpoint }
+func quietOwnerUser(userID string) string       { return "user:" + userID }
+
+func createQuietHoursTable(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS quiet_hours (
+		owner TEXT PRIMARY KEY,
+		start_minute INTEGER NOT NULL,
+		end_minute INTEGER NOT NULL,
+		days INTEGER NOT NULL,
+		timezone TEXT NOT NULL,
+		dnd_until INTEGER NOT NULL DEFAULT 0,
+		allow_priority INTEGER NOT NULL DEFAULT 0,
+		updated_at INTEGER NOT NULL
+	);`)
+	return err
+}
+
+func (s *PushService) SetQuietHours(owner string, q *quietHours) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO quiet_hours(owner, start_minute, end_minute, days, timezone, dnd_until, allow_priority, updated_at) VALUES(?, ?, ?, ?, ?, ?, ?, ?)",
+		owner, q.startMin, q.endMin, q.days, q.loc.String(), q.dndUntil, q.allowPriority, time.Now().UnixMilli())
+	return err
+}
+
+func (s *PushService) DeleteQuietHours(owner string) error {
+	_, err := s.db.Exec("DELETE FROM quiet_hours WHERE owner = ?", owner)
+	return err
+}
+
+// QuietHours returns the owner's schedule, or nil if there is none.
+func (s *PushService) QuietHours(owner string) (*quietHours, error) {
+	q := &quietHours{}
+	var tz string
+	err := s.db.QueryRow("SELECT start_minute, end_minute, days, timezone, dnd_until, allow_priority FROM quiet_hours WHERE owner = ?", owner).
+		Scan(&q.startMin, &q.endMin, &q.days, &tz, &q.dndUntil, &q.allowPriority)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if q.loc, err = time.LoadLocation(tz); err != nil {
+		q.loc = time.UTC
+	}
+	return q, nil
+}
+
+// quietHoursFor returns the schedule that applies to a subscription.
+func (s *PushService) quietHoursFor(endpoint, userID string) *quietHours {
+	owners := []string{quietOwnerEndpoint(endpoint)}
+	if userID != "" {
+		owners = append(owners, quietOwnerUser(userID))
+	}
+	for _, owner := range owners {
+		q, err := s.QuietHours(owner)
+		if err != nil {
+			slog.Error("failed to load quiet hours", "err", err)
+			return nil
+		}
+		if q != nil {
+			return q
+		}
+	}
+	return nil
+}
+
+// holdBack decides whether a call notification to target is dropped or
+// delivered silently. Room mutes drop everything; quiet hours drop rings and
+// call-ended notifications unless the caller is a priority contact.
+func (s *PushService) holdBack(target roomSubscriber, kind, callerID string, now time.Time) (drop, silent bool) {
+	if target.MutedUntil > now.UnixMilli() {
+		return true, false
+	}
+	q := s.quietHoursFor(target.Endpoint, target.UserID)
+	if q == nil || !q.active(now) {
+		return false, false
+	}
+	if q.allowPriority && callerID != "" && target.UserID != "" && s.auth != nil && s.auth.isPriorityContact(target.UserID, callerID) {
+		return false, false
+	}
+	if kind == notifyMissedCall {
+		return false, true
+	}
+	return true, false
+}
+
+// SetRoomMute mutes the endpoint's subscription to a room until the given
+// time (unix ms); 0 unmutes.
+func (s *PushService) SetRoomMute(endpoint, roomID string, until int64) (bool, error) {
+	res, err := s.db.Exec("UPDATE subscriptions SET muted_until = ? WHERE endpoint = ? AND room_id = ?", until, endpoint, roomID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// handlePushQuietHours reads (GET), sets (PUT) or clears (DELETE) quiet
+// hours. Requests naming an endpoint (with its auth secret, as for
+// /api/push/subscriptions) manage that device's schedule; otherwise the
+// signed-in user's.
+func handlePushQuietHours(pushService *PushService, authStore *AuthStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			return
+		}
+
+		var req struct {
+			quietHoursJSON
+			Endpoint string `json:"endpoint"`
+			Auth     string `json:"auth"`
+		}
+		switch r.Method {
+		case http.MethodGet:
+			req.Endpoint = r.URL.Query().Get("endpoint")
+			req.Auth = r.Header.Get("X-Push-Auth")
+		case http.MethodPut, http.MethodDelete:
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid body", http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var owner string
+		if req.Endpoint != "" {
+			owned, err := pushService.ownsEndpoint(req.Endpoint, req.Auth)
+			if err != nil {
+				http.Error(w, "Failed to load subscriptions", http.StatusInternalServerError)
+				return
+			}
+			if !owned {
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			owner = quietOwnerEndpoint(req.Endpoint)
+		} else {
+			user, err := authStore.getUserByToken(extractToken(r))
+			if err != nil {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			owner = quietOwnerUser(user.UserID)
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			q, err := pushService.QuietHours(owner)
+			if err != nil {
+				http.Error(w, "Failed to load quiet hours", http.StatusInternalServerError)
+				return
+			}
+			if q == nil {
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(q.toJSON())
+		case http.MethodPut:
+			q, err := req.quietHoursJSON.parse()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := pushService.SetQuietHours(owner, q); err != nil {
+				http.Error(w, "Failed to save quiet hours", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(q.toJSON())
+		case http.MethodDelete:
+			if err := pushService.DeleteQuietHours(owner); err != nil {
+				http.Error(w, "Failed to delete quiet hours", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// handlePushMute mutes (POST {endpoint, auth, roomId, mutedUntil}) a room
+// subscription; mutedUntil 0 unmutes.
+func handlePushMute(cfg *Config, pushService *PushService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Endpoint   string `json:"endpoint"`
+			Auth       string `json:"auth"`
+			RoomID     string `json:"roomId"`
+			MutedUntil int64  `json:"mutedUntil"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid body", http.StatusBadRequest)
+			return
+		}
+		if err := validateRoomID(cfg, req.RoomID); err != nil {
+			http.Error(w, "Invalid roomId", http.StatusBadRequest)
+			return
+		}
+		if req.MutedUntil < 0 {
+			http.Error(w, "Invalid mutedUntil", http.StatusBadRequest)
+			return
+		}
+		owned, err := pushService.ownsEndpoint(req.Endpoint, req.Auth)
+		if err != nil {
+			http.Error(w, "Failed to load subscriptions", http.StatusInternalServerError)
+			return
+		}
+		if !owned {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		found, err := pushService.SetRoomMute(req.Endpoint, req.RoomID, req.MutedUntil)
+		if err != nil {
+			http.Error(w, "Failed to mute", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Not subscribed to this room", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
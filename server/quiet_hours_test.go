@@ -0,0 +1,153 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuietHoursActive(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utc := func(s string) time.Time {
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	local := func(loc *time.Location, s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	night := quietHoursJSON{Start: "22:00", End: "07:00", Timezone: "UTC"}
+	fridayNight := quietHoursJSON{Start: "22:00", End: "07:00", Days: []int{5}, Timezone: "UTC"}
+	workday := quietHoursJSON{Start: "09:00", End: "17:00", Days: []int{1, 2, 3, 4, 5}, Timezone: "UTC"}
+	nyNight := quietHoursJSON{Start: "22:00", End: "07:00", Timezone: "America/New_York"}
+	// 02:00-03:00 does not exist on the night clocks spring forward.
+	nyGap := quietHoursJSON{Start: "01:30", End: "03:00", Timezone: "America/New_York"}
+	dnd := func(until time.Time) quietHoursJSON {
+		return quietHoursJSON{DNDUntil: until.UnixMilli(), Timezone: "UTC"}
+	}
+
+	tests := []struct {
+		name     string
+		schedule quietHoursJSON
+		now      time.Time
+		want     bool
+	}{
+		{"spanning midnight, evening", night, utc("2026-03-06T23:00:00Z"), true},
+		{"spanning midnight, start is inclusive", night, utc("2026-03-06T22:00:00Z"), true},
+		{"spanning midnight, early hours", night, utc("2026-03-07T06:59:00Z"), true},
+		{"spanning midnight, end is exclusive", night, utc("2026-03-07T07:00:00Z"), false},
+		{"spanning midnight, daytime", night, utc("2026-03-07T12:00:00Z"), false},
+
+		// 2026-03-06 is a Friday.
+		{"day mask, on the start day", fridayNight, utc("2026-03-06T23:00:00Z"), true},
+		{"day mask, early hours after the start day", fridayNight, utc("2026-03-07T03:00:00Z"), true},
+		{"day mask, evening of another day", fridayNight, utc("2026-03-07T23:00:00Z"), false},
+		{"day mask, early hours belong to the day before", fridayNight, utc("2026-03-06T03:00:00Z"), false},
+		{"day mask, same-day window", workday, utc("2026-03-09T10:00:00Z"), true},
+		{"day mask, same-day window on a weekend", workday, utc("2026-03-08T10:00:00Z"), false},
+		{"day mask, same-day window end", workday, utc("2026-03-09T17:00:00Z"), false},
+
+		// Clocks spring forward on 2026-03-08 and fall back on 2026-11-01.
+		{"dst, 06:30 EST", nyNight, utc("2026-03-07T11:30:00Z"), true},
+		{"dst, same UTC time is 07:30 EDT", nyNight, utc("2026-03-08T11:30:00Z"), false},
+		{"dst, 06:30 EDT", nyNight, local(newYork, "2026-03-08 06:30"), true},
+		{"dst, 07:30 EDT before fall back", nyNight, utc("2026-10-31T11:30:00Z"), false},
+		{"dst, same UTC time is 06:30 EST", nyNight, utc("2026-11-01T11:30:00Z"), true},
+		{"dst gap, before the jump", nyGap, local(newYork, "2026-03-08 01:45"), true},
+		{"dst gap, after the jump", nyGap, utc("2026-03-08T07:05:00Z"), false},
+
+		{"dnd pending", dnd(utc("2026-03-07T13:00:00Z")), utc("2026-03-07T12:00:00Z"), true},
+		{"dnd passed", dnd(utc("2026-03-07T11:00:00Z")), utc("2026-03-07T12:00:00Z"), false},
+		{"dnd outside the window", quietHoursJSON{Start: "22:00", End: "07:00", DNDUntil: utc("2026-03-07T13:00:00Z").UnixMilli(), Timezone: "UTC"}, utc("2026-03-07T12:00:00Z"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := tt.schedule.parse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := q.active(tt.now); got != tt.want {
+				t.Errorf("active(%s) = %v, want %v", tt.now.In(q.loc).Format("Mon 2006-01-02 15:04 MST"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHoldBack(t *testing.T) {
+	cfg := newTestConfig()
+	authStore := newAuthStore(cfg)
+	s := newTestPushService(t, cfg, authStore)
+	user, _ := newTestUser(t, authStore, "alice", "correct horse battery")
+	friend, _ := newTestUser(t, authStore, "bob", "correct horse battery")
+	stranger, _ := newTestUser(t, authStore, "carol", "correct horse battery")
+	authStore.addPriorityContact(user, friend)
+
+	now := time.Now()
+	quiet := &quietHours{loc: time.UTC, dndUntil: now.Add(time.Hour).UnixMilli()}
+	priority := &quietHours{loc: time.UTC, dndUntil: now.Add(time.Hour).UnixMilli(), allowPriority: true}
+	signedIn := roomSubscriber{Endpoint: "https://push.example/alice", UserID: user.UserID}
+	device := roomSubscriber{Endpoint: "https://push.example/device"}
+
+	tests := []struct {
+		name        string
+		target      roomSubscriber
+		userHours   *quietHours
+		deviceHours *quietHours
+		kind        string
+		callerID    string
+		drop        bool
+		silent      bool
+	}{
+		{name: "no quiet hours", target: signedIn, kind: notifyIncomingCall, callerID: stranger.UserID},
+		{name: "ring dropped", target: signedIn, userHours: quiet, kind: notifyIncomingCall, callerID: stranger.UserID, drop: true},
+		{name: "call ended dropped", target: signedIn, userHours: quiet, kind: notifyCallEnded, drop: true},
+		{name: "missed call delivered silently", target: signedIn, userHours: quiet, kind: notifyMissedCall, silent: true},
+		{name: "priority caller without allowPriority", target: signedIn, userHours: quiet, kind: notifyIncomingCall, callerID: friend.UserID, drop: true},
+		{name: "priority caller rings through", target: signedIn, userHours: priority, kind: notifyIncomingCall, callerID: friend.UserID},
+		{name: "other caller held back", target: signedIn, userHours: priority, kind: notifyIncomingCall, callerID: stranger.UserID, drop: true},
+		{name: "anonymous caller held back", target: signedIn, userHours: priority, kind: notifyIncomingCall, drop: true},
+		{name: "anonymous device has no priority contacts", target: device, deviceHours: priority, kind: notifyIncomingCall, callerID: friend.UserID, drop: true},
+		{name: "device schedule wins", target: signedIn, userHours: quiet, deviceHours: &quietHours{loc: time.UTC}, kind: notifyIncomingCall},
+		{name: "room mute wins over priority", target: roomSubscriber{Endpoint: signedIn.Endpoint, UserID: user.UserID, MutedUntil: now.Add(time.Hour).UnixMilli()}, userHours: priority, kind: notifyIncomingCall, callerID: friend.UserID, drop: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.DeleteQuietHours(quietOwnerUser(user.UserID))
+			s.DeleteQuietHours(quietOwnerEndpoint(tt.target.Endpoint))
+			if tt.userHours != nil {
+				if err := s.SetQuietHours(quietOwnerUser(user.UserID), tt.userHours); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.deviceHours != nil {
+				if err := s.SetQuietHours(quietOwnerEndpoint(tt.target.Endpoint), tt.deviceHours); err != nil {
+					t.Fatal(err)
+				}
+			}
+			drop, silent := s.holdBack(tt.target, tt.kind, tt.callerID, now)
+			if drop != tt.drop || silent != tt.silent {
+				t.Errorf("holdBack = drop %v, silent %v; want drop %v, silent %v", drop, silent, tt.drop, tt.silent)
+			}
+		})
+	}
+
+	// A blocked priority contact no longer rings through.
+	if err := s.SetQuietHours(quietOwnerUser(user.UserID), priority); err != nil {
+		t.Fatal(err)
+	}
+	s.DeleteQuietHours(quietOwnerEndpoint(signedIn.Endpoint))
+	authStore.mu.Lock()
+	friend.Blocked = map[string]bool{user.UserID: true}
+	authStore.mu.Unlock()
+	if drop, _ := s.holdBack(signedIn, notifyIncomingCall, friend.UserID, now); !drop {
+		t.Error("ring from a priority contact who blocked the user was delivered")
+	}
+}
@@ -1,15 +1,36 @@
 package main
 
 import (
-	"log"
+	"container/list"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+// LimitResult describes the outcome of a rate limit check.
+type LimitResult struct {
+	Allowed    bool
+	Limit      int           // maximum burst
+	Remaining  int           // requests left before limiting
+	RetryAfter time.Duration // wait before the next request is allowed (when denied)
+	ResetAfter time.Duration // time until the limiter is back at full capacity
+}
+
+// Limiter rate-limits requests by key (usually a client IP).
+type Limiter interface {
+	Allow(key string) LimitResult
+}
+
+// limitState is the per-key state of a rate limiting algorithm.
+type limitState interface {
+	allowAt(now time.Time) LimitResult
+}
+
 // SimpleTokenBucket implements a token bucket rate limiter.
 type SimpleTokenBucket struct {
 	tokens         float64
@@ -30,10 +51,13 @@ func NewSimpleTokenBucket(capacity float64, refillRate float64) *SimpleTokenBuck
 }
 
 func (tb *SimpleTokenBucket) Allow() bool {
+	return tb.allowAt(time.Now()).Allowed
+}
+
+func (tb *SimpleTokenBucket) allowAt(now time.Time) LimitResult {
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
 
-	now := time.Now()
 	// Refill tokens based on time elapsed
 	elapsed := now.Sub(tb.lastRefillTime).Seconds()
 	tb.tokens = tb.tokens + elapsed*tb.refillRate
@@ -42,77 +66,376 @@ func (tb *SimpleTokenBucket) Allow() bool {
 	}
 	tb.lastRefillTime = now
 
+	res := LimitResult{Limit: int(tb.capacity)}
 	if tb.tokens >= 1.0 {
 		tb.tokens -= 1.0
-		return true
+		res.Allowed = true
+	} else {
+		res.RetryAfter = tb.secondsUntil(1.0 - tb.tokens)
 	}
-	return false
+	res.Remaining = int(math.Floor(tb.tokens))
+	res.ResetAfter = tb.secondsUntil(tb.capacity - tb.tokens)
+	return res
+}
+
+func (tb *SimpleTokenBucket) secondsUntil(tokens float64) time.Duration {
+	if tokens <= 0 || tb.refillRate <= 0 {
+		return 0
+	}
+	return time.Duration(tokens / tb.refillRate * float64(time.Second))
+}
+
+// slidingWindow approximates a sliding window counter by weighting the
+// previous fixed window's count by how much of it still overlaps.
+type slidingWindow struct {
+	limit  int
+	window time.Duration
+	start  time.Time // start of the current fixed window
+	prev   int
+	curr   int
+	mu     sync.Mutex
+}
+
+func (sw *slidingWindow) allowAt(now time.Time) LimitResult {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if elapsed := now.Sub(sw.start); elapsed >= sw.window {
+		if elapsed >= 2*sw.window {
+			sw.prev = 0
+		} else {
+			sw.prev = sw.curr
+		}
+		sw.curr = 0
+		sw.start = now.Truncate(sw.window)
+	}
+
+	overlap := 1 - float64(now.Sub(sw.start))/float64(sw.window)
+	estimate := float64(sw.prev)*overlap + float64(sw.curr)
+
+	res := LimitResult{Limit: sw.limit, ResetAfter: sw.start.Add(2 * sw.window).Sub(now)}
+	if estimate+1 <= float64(sw.limit) {
+		sw.curr++
+		res.Allowed = true
+		estimate++
+	} else if sw.prev > 0 {
+		// Wait until enough of the previous window has slid out.
+		excess := estimate + 1 - float64(sw.limit)
+		res.RetryAfter = time.Duration(excess / float64(sw.prev) * float64(sw.window))
+	} else {
+		res.RetryAfter = sw.start.Add(sw.window).Sub(now)
+	}
+	res.Remaining = int(math.Max(0, math.Floor(float64(sw.limit)-estimate)))
+	return res
+}
+
+// Per-IP limiter algorithms, selected by RATE_LIMIT_ALGORITHM.
+const (
+	rateLimitTokenBucket   = "token_bucket"
+	rateLimitSlidingWindow = "sliding_window"
+)
+
+const (
+	defaultLimiterMaxEntries    = 100000
+	defaultLimiterSweepInterval = time.Minute
+)
+
+// Per-IP limit shared by the push endpoints. Joining a call makes a handful
+// of requests (key, subscription, recipients, snapshot).
+const (
+	pushRateLimit = 1.0 // requests per second
+	pushRateBurst = 20
+)
+
+type limiterEntry struct {
+	key      string
+	state    limitState
+	lastSeen time.Time
 }
 
-// Global Rate Limiter Manager
+// IPLimiter keeps one limitState per client IP. Entries are kept in LRU order
+// and dropped once idle long enough to have fully recovered, or when the
+// table exceeds maxEntries. IPv6 addresses are aggregated per /64, since a
+// single client typically controls the whole prefix.
 type IPLimiter struct {
-	ips   map[string]*SimpleTokenBucket
-	mu    sync.Mutex
-	rate  float64
-	burst float64
+	mu            sync.Mutex
+	entries       map[string]*list.Element
+	lru           *list.List // front = most recently used
+	newState      func(now time.Time) limitState
+	limit         int
+	idleTTL       time.Duration
+	maxEntries    int
+	lastSweep     time.Time
+	sweepInterval time.Duration
+	allowlist     []*net.IPNet
 }
 
-func NewIPLimiter(r float64, b float64) *IPLimiter {
+func newIPLimiter(limit int, idleTTL time.Duration, newState func(now time.Time) limitState) *IPLimiter {
 	return &IPLimiter{
-		ips:   make(map[string]*SimpleTokenBucket),
-		rate:  r,
-		burst: b,
+		entries:       make(map[string]*list.Element),
+		lru:           list.New(),
+		newState:      newState,
+		limit:         limit,
+		idleTTL:       idleTTL,
+		maxEntries:    defaultLimiterMaxEntries,
+		lastSweep:     time.Now(),
+		sweepInterval: defaultLimiterSweepInterval,
+	}
+}
+
+// NewIPLimiter returns a token bucket limiter allowing r requests per second
+// with bursts of b.
+func NewIPLimiter(r float64, b float64) *IPLimiter {
+	idleTTL := time.Minute
+	if r > 0 {
+		if full := time.Duration(b / r * float64(time.Second)); full > idleTTL {
+			idleTTL = full
+		}
+	}
+	return newIPLimiter(int(b), idleTTL, func(now time.Time) limitState {
+		tb := NewSimpleTokenBucket(b, r)
+		tb.lastRefillTime = now
+		return tb
+	})
+}
+
+// NewSlidingWindowIPLimiter returns a sliding window limiter allowing limit
+// requests per window.
+func NewSlidingWindowIPLimiter(limit int, window time.Duration) *IPLimiter {
+	return newIPLimiter(limit, 2*window, func(now time.Time) limitState {
+		return &slidingWindow{limit: limit, window: window, start: now.Truncate(window)}
+	})
+}
+
+// SetAllowlist exempts the given networks from limiting.
+func (i *IPLimiter) SetAllowlist(nets []*net.IPNet) {
+	i.mu.Lock()
+	i.allowlist = nets
+	i.mu.Unlock()
+}
+
+// SetMaxEntries bounds the number of tracked keys.
+func (i *IPLimiter) SetMaxEntries(n int) {
+	i.mu.Lock()
+	i.maxEntries = n
+	i.mu.Unlock()
+}
+
+func (i *IPLimiter) Allow(ip string) LimitResult {
+	now := time.Now()
+	parsed := net.ParseIP(ip)
+
+	i.mu.Lock()
+	if parsed != nil && ipInNets(parsed, i.allowlist) {
+		i.mu.Unlock()
+		return LimitResult{Allowed: true, Limit: i.limit, Remaining: i.limit}
 	}
+
+	key := limiterKey(ip, parsed)
+	var entry *limiterEntry
+	if el, ok := i.entries[key]; ok {
+		entry = el.Value.(*limiterEntry)
+		i.lru.MoveToFront(el)
+	} else {
+		entry = &limiterEntry{key: key, state: i.newState(now)}
+		i.entries[key] = i.lru.PushFront(entry)
+		for i.lru.Len() > i.maxEntries {
+			i.removeElement(i.lru.Back())
+		}
+	}
+	entry.lastSeen = now
+
+	if now.Sub(i.lastSweep) >= i.sweepInterval {
+		i.sweep(now)
+	}
+	i.mu.Unlock()
+
+	return entry.state.allowAt(now)
+}
+
+// sweep drops entries idle for longer than idleTTL. Caller must hold i.mu.
+func (i *IPLimiter) sweep(now time.Time) {
+	i.lastSweep = now
+	for el := i.lru.Back(); el != nil; el = i.lru.Back() {
+		if now.Sub(el.Value.(*limiterEntry).lastSeen) < i.idleTTL {
+			return
+		}
+		i.removeElement(el)
+	}
+}
+
+func (i *IPLimiter) removeElement(el *list.Element) {
+	i.lru.Remove(el)
+	delete(i.entries, el.Value.(*limiterEntry).key)
 }
 
-func (i *IPLimiter) GetLimiter(ip string) *SimpleTokenBucket {
+// Len returns the number of tracked keys.
+func (i *IPLimiter) Len() int {
 	i.mu.Lock()
 	defer i.mu.Unlock()
+	return i.lru.Len()
+}
 
-	limiter, exists := i.ips[ip]
-	if !exists {
-		limiter = NewSimpleTokenBucket(i.burst, i.rate)
-		i.ips[ip] = limiter
+// limiterKey normalises an IP for rate limiting, collapsing IPv6 to its /64.
+func limiterKey(ip string, parsed net.IP) string {
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.String()
 	}
+	return parsed.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
 
-	return limiter
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses a list of CIDRs or bare IPs.
+func parseCIDRs(items []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(items))
+	for _, item := range items {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: item}
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// setRateLimitHeaders reports the limiter state using the conventional
+// X-RateLimit-* headers, plus Retry-After when the request was denied.
+func setRateLimitHeaders(w http.ResponseWriter, res LimitResult) {
+	h := w.Header()
+	h.Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(res.ResetAfter)))
+	if !res.Allowed {
+		retry := ceilSeconds(res.RetryAfter)
+		if retry < 1 {
+			retry = 1
+		}
+		h.Set("Retry-After", strconv.Itoa(retry))
+	}
 }
 
-// Cleanup routine to remove old IPs could be added here to prevent memory leaks
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
 
 // Middleware
-func rateLimitMiddleware(limiter *IPLimiter, next http.HandlerFunc) http.HandlerFunc {
+func rateLimitMiddleware(cfg *Config, limiter Limiter, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ip := getClientIP(r)
-		if !limiter.GetLimiter(ip).Allow() {
+		ip := getClientIP(cfg, r)
+		res := limiter.Allow(ip)
+		setRateLimitHeaders(w, res)
+		if !res.Allowed {
 			http.Error(w, "429 Too Many Requests", http.StatusTooManyRequests)
-			log.Printf("Rate limit exceeded for IP: %s", ip)
+			slog.Warn("rate limit exceeded", "ip", redactIP(ip), "path", r.URL.Path)
 			return
 		}
 		next(w, r)
 	}
 }
 
-func getClientIP(r *http.Request) string {
-	trustProxy := strings.EqualFold(os.Getenv("TRUST_PROXY"), "1")
-	if trustProxy {
-		realIP := strings.TrimSpace(r.Header.Get("X-Real-IP"))
-		if realIP != "" {
-			return realIP
-		}
-		// Check X-Forwarded-For first (since we are behind Nginx)
-		forwarded := r.Header.Get("X-Forwarded-For")
-		if forwarded != "" {
-			// X-Forwarded-For can be a comma-separated list
-			ips := strings.Split(forwarded, ",")
-			return strings.TrimSpace(ips[0])
-		}
+// signalingLimit is a token bucket configuration for one signaling message type.
+type signalingLimit struct {
+	rate  float64 // tokens per second
+	burst float64
+}
+
+// signalingLimits are applied per session. The per-IP limit for each type is
+// signalingIPLimitFactor times larger so that a few tabs behind one NAT work.
+var signalingLimits = map[string]signalingLimit{
+	"ping":        {rate: 1, burst: 10},
+	"join":        {rate: 0.5, burst: 5},
+	"leave":       {rate: 0.5, burst: 5},
+	"end_room":    {rate: 0.2, burst: 3},
+	"watch_rooms": {rate: 0.2, burst: 5},
+	"room_token":  {rate: 0.1, burst: 3},
+	"offer":       {rate: 1, burst: 10},
+	"answer":      {rate: 1, burst: 10},
+	"ice":         {rate: 20, burst: 100},
+	"default":     {rate: 1, burst: 5},
+}
+
+const signalingIPLimitFactor = 4
+
+func signalingLimitKey(msgType string) string {
+	if _, ok := signalingLimits[msgType]; ok {
+		return msgType
+	}
+	return "default"
+}
+
+// sessionLimiter holds a session's per-message-type token buckets.
+type sessionLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*SimpleTokenBucket
+}
+
+func (l *sessionLimiter) allow(key string) bool {
+	l.mu.Lock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*SimpleTokenBucket)
 	}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		limit := signalingLimits[key]
+		bucket = NewSimpleTokenBucket(limit.burst, limit.rate)
+		l.buckets[key] = bucket
+	}
+	l.mu.Unlock()
+	return bucket.Allow()
+}
+
+func newSignalingIPLimiters(cfg *Config) map[string]*IPLimiter {
+	limiters := make(map[string]*IPLimiter, len(signalingLimits))
+	for key, limit := range signalingLimits {
+		limiters[key] = newConfiguredIPLimiter(cfg, limit.rate*signalingIPLimitFactor, limit.burst*signalingIPLimitFactor)
+	}
+	return limiters
+}
+
+// newConfiguredIPLimiter returns an IPLimiter allowing r requests per second
+// with bursts of b, using the configured algorithm, allowlist and table size.
+// The sliding window admits b requests per b/r seconds.
+func newConfiguredIPLimiter(cfg *Config, r, b float64) *IPLimiter {
+	var limiter *IPLimiter
+	if cfg.RateLimitAlgorithm == rateLimitSlidingWindow && r > 0 {
+		limiter = NewSlidingWindowIPLimiter(int(b), time.Duration(b/r*float64(time.Second)))
+	} else {
+		limiter = NewIPLimiter(r, b)
+	}
+	limiter.SetAllowlist(cfg.rateLimitAllowlist)
+	limiter.SetMaxEntries(cfg.RateLimitMaxEntries)
+	return limiter
+}
 
-	// Fallback to RemoteAddr
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
+// allowMessage applies the per-session and per-IP limits for a message type.
+func (h *Hub) allowMessage(c *Client, msgType string) bool {
+	key := signalingLimitKey(msgType)
+	if !c.limiter.allow(key) {
+		return false
 	}
-	return ip
+	return h.ipLimiters[key].Allow(c.ip).Allowed
 }
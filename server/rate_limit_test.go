@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIPLimiterMaxEntries(t *testing.T) {
+	limiter := NewIPLimiter(1, 1)
+	limiter.SetMaxEntries(3)
+
+	limiter.Allow("192.0.2.1")
+	for i := 2; i <= 4; i++ {
+		limiter.Allow(fmt.Sprintf("192.0.2.%d", i))
+	}
+	if n := limiter.Len(); n != 3 {
+		t.Fatalf("Len() = %d, want 3", n)
+	}
+	// The least recently used IP was evicted and starts with a full bucket.
+	if !limiter.Allow("192.0.2.1").Allowed {
+		t.Error("evicted IP is still limited")
+	}
+	// 192.0.2.4 was used recently and its single token is spent.
+	if limiter.Allow("192.0.2.4").Allowed {
+		t.Error("recently used IP was evicted")
+	}
+}
+
+func TestIPLimiterSweepsIdleEntries(t *testing.T) {
+	limiter := NewIPLimiter(1, 1)
+	limiter.Allow("192.0.2.1")
+	limiter.Allow("192.0.2.2")
+
+	limiter.mu.Lock()
+	limiter.sweep(time.Now().Add(limiter.idleTTL))
+	limiter.mu.Unlock()
+	if n := limiter.Len(); n != 0 {
+		t.Errorf("Len() after sweep = %d, want 0", n)
+	}
+}
+
+func TestLimiterKey(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{"2001:db8:1:2:ffff::1", "2001:db8:1:2::/64"},
+		{"2001:db8:1:3::1", "2001:db8:1:3::/64"},
+		{"not-an-ip", "not-an-ip"},
+	}
+	for _, tt := range tests {
+		if got := limiterKey(tt.ip, net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("limiterKey(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestIPLimiterFoldsIPv6Prefix(t *testing.T) {
+	limiter := NewIPLimiter(1, 2)
+	limiter.Allow("2001:db8:1:2::1")
+	limiter.Allow("2001:db8:1:2::2")
+	if limiter.Allow("2001:db8:1:2:abcd::3").Allowed {
+		t.Error("addresses in one /64 have separate buckets")
+	}
+	if !limiter.Allow("2001:db8:1:3::1").Allowed {
+		t.Error("neighbouring /64 shares the bucket")
+	}
+	if n := limiter.Len(); n != 2 {
+		t.Errorf("Len() = %d, want 2", n)
+	}
+}
+
+func TestIPLimiterAllowlist(t *testing.T) {
+	nets, err := parseCIDRs([]string{"10.0.0.0/8", "192.0.2.7", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := NewIPLimiter(1, 1)
+	limiter.SetAllowlist(nets)
+
+	tests := []struct {
+		ip      string
+		limited bool
+	}{
+		{"10.1.2.3", false},
+		{"192.0.2.7", false},
+		{"2001:db8::1", false},
+		{"192.0.2.8", true},
+		{"2001:db9::1", true},
+	}
+	for _, tt := range tests {
+		limiter.Allow(tt.ip)
+		if got := !limiter.Allow(tt.ip).Allowed; got != tt.limited {
+			t.Errorf("%s: limited = %v, want %v", tt.ip, got, tt.limited)
+		}
+	}
+	if n := limiter.Len(); n != 2 {
+		t.Errorf("Len() = %d, want 2 (allowlisted IPs are not tracked)", n)
+	}
+}
+
+func TestParseCIDRsRejectsGarbage(t *testing.T) {
+	for _, item := range []string{"10.0.0.0/33", "example.com", ""} {
+		if _, err := parseCIDRs([]string{item}); err == nil {
+			t.Errorf("parseCIDRs(%q) succeeded", item)
+		}
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	sw := &slidingWindow{limit: 4, window: 10 * time.Second, start: start}
+
+	for i := 0; i < 4; i++ {
+		if !sw.allowAt(start.Add(time.Second)).Allowed {
+			t.Fatalf("request %d denied", i+1)
+		}
+	}
+	res := sw.allowAt(start.Add(time.Second))
+	if res.Allowed || res.RetryAfter != 9*time.Second {
+		t.Fatalf("over limit: allowed %v, retry after %v, want denied for 9s", res.Allowed, res.RetryAfter)
+	}
+	// Halfway through the next window half of the previous count remains.
+	if res := sw.allowAt(start.Add(15 * time.Second)); !res.Allowed || res.Remaining != 1 {
+		t.Errorf("next window: allowed %v, remaining %d, want allowed with 1 left", res.Allowed, res.Remaining)
+	}
+	// Two windows later the history is gone.
+	if res := sw.allowAt(start.Add(30 * time.Second)); !res.Allowed || res.Remaining != 3 {
+		t.Errorf("after two windows: allowed %v, remaining %d, want allowed with 3 left", res.Allowed, res.Remaining)
+	}
+}
+
+func TestConfiguredLimiterAlgorithm(t *testing.T) {
+	for _, algorithm := range []string{rateLimitTokenBucket, rateLimitSlidingWindow} {
+		cfg := newTestConfig()
+		cfg.RateLimitAlgorithm = algorithm
+		limiter := newConfiguredIPLimiter(cfg, 1, 3)
+		for i := 0; i < 3; i++ {
+			if !limiter.Allow("192.0.2.1").Allowed {
+				t.Fatalf("%s: request %d denied", algorithm, i+1)
+			}
+		}
+		if limiter.Allow("192.0.2.1").Allowed {
+			t.Errorf("%s: burst exceeded", algorithm)
+		}
+	}
+
+	cfg := newTestConfig()
+	cfg.RateLimitAlgorithm = "leaky_bucket"
+	if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "RATE_LIMIT_ALGORITHM") {
+		t.Errorf("unknown algorithm: validate() = %v", err)
+	}
+}
+
+func TestRateLimitMiddlewareHeaders(t *testing.T) {
+	cfg := newTestConfig()
+	h := rateLimitMiddleware(cfg, NewIPLimiter(1, 1), func(w http.ResponseWriter, r *http.Request) {})
+
+	call := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/push/vapid-public-key", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+	if rec := call(); rec.Code != http.StatusOK || rec.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Fatalf("first request: %d, remaining %q", rec.Code, rec.Header().Get("X-RateLimit-Remaining"))
+	}
+	rec := call()
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("second request: %d, Retry-After %q, want 429 after 1s", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
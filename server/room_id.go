@@ -7,7 +7,6 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"os"
 )
 
 const (
@@ -23,27 +22,18 @@ var (
 	ErrRoomIDSecretMissing = errors.New("room id secret not configured")
 )
 
-func roomIDContext() string {
-	env := os.Getenv("ROOM_ID_ENV")
+func roomIDContext(env string) string {
 	if env == "" {
 		env = "dev"
 	}
 	return fmt.Sprintf("id:%s|%s|%s", roomIDVersion, env, roomIDEntity)
 }
 
-func roomIDSecret() (string, error) {
-	secret := os.Getenv("ROOM_ID_SECRET")
+func generateRoomID(cfg *Config) (string, error) {
+	secret := cfg.RoomIDSecret
 	if secret == "" {
 		return "", ErrRoomIDSecretMissing
 	}
-	return secret, nil
-}
-
-func generateRoomID() (string, error) {
-	secret, err := roomIDSecret()
-	if err != nil {
-		return "", err
-	}
 
 	random := make([]byte, roomIDRandomBytes)
 	if _, err := rand.Read(random); err != nil {
@@ -52,7 +42,7 @@ func generateRoomID() (string, error) {
 
 	mac := hmac.New(sha256.New, []byte(secret))
 	mac.Write(random)
-	mac.Write([]byte(roomIDContext()))
+	mac.Write([]byte(roomIDContext(cfg.RoomIDEnv)))
 	tag := mac.Sum(nil)[:roomIDTagBytes]
 
 	token := make([]byte, 0, roomIDTotalBytes)
@@ -62,7 +52,7 @@ func generateRoomID() (string, error) {
 	return base64.RawURLEncoding.EncodeToString(token), nil
 }
 
-func validateRoomID(roomID string) error {
+func validateRoomID(cfg *Config, roomID string) error {
 	if roomID == "" {
 		return errors.New("missing room id")
 	}
@@ -70,9 +60,9 @@ func validateRoomID(roomID string) error {
 		return errors.New("room id must be a 27-character token")
 	}
 
-	secret, err := roomIDSecret()
-	if err != nil {
-		return err
+	secret := cfg.RoomIDSecret
+	if secret == "" {
+		return ErrRoomIDSecretMissing
 	}
 
 	raw, err := base64.RawURLEncoding.DecodeString(roomID)
@@ -91,7 +81,7 @@ func validateRoomID(roomID string) error {
 
 	mac := hmac.New(sha256.New, []byte(secret))
 	mac.Write(random)
-	mac.Write([]byte(roomIDContext()))
+	mac.Write([]byte(roomIDContext(cfg.RoomIDEnv)))
 	expected := mac.Sum(nil)[:roomIDTagBytes]
 
 	if !hmac.Equal(tag, expected) {
@@ -2,20 +2,20 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 )
 
-func handleRoomID() http.HandlerFunc {
+func handleRoomID(cfg *Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost && r.Method != http.MethodGet {
 			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		roomID, err := generateRoomID()
+		roomID, err := generateRoomID(cfg)
 		if err != nil {
-			log.Printf("room id generation failed: %v", err)
+			slog.Error("room id generation failed", "err", err)
 			http.Error(w, "Room ID service unavailable", http.StatusServiceUnavailable)
 			return
 		}
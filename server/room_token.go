@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Room tokens prove membership of a room to the push endpoints. They are
+// issued in `joined` (and on request via `room_token`) and sent back in the
+// X-Room-Token header.
+
+const (
+	roomTokenVersion = 1
+	roomTokenTTL     = 10 * time.Minute
+	// Separates room token MACs from room ID tags, which share the secret.
+	roomTokenDomain = "serenada-room-token:"
+)
+
+type roomTokenClaims struct {
+	V   int    `json:"v"`
+	RID string `json:"rid"`
+	Exp int64  `json:"exp"`
+}
+
+func roomTokenMAC(cfg *Config, payload string) ([]byte, error) {
+	if cfg.RoomIDSecret == "" {
+		return nil, ErrRoomIDSecretMissing
+	}
+	mac := hmac.New(sha256.New, []byte(cfg.RoomIDSecret))
+	mac.Write([]byte(roomTokenDomain + payload))
+	return mac.Sum(nil), nil
+}
+
+func issueRoomToken(cfg *Config, rid string) (string, time.Time, error) {
+	expiresAt := time.Now().Add(roomTokenTTL)
+	payloadBytes, err := json.Marshal(roomTokenClaims{V: roomTokenVersion, RID: rid, Exp: expiresAt.Unix()})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(payloadBytes)
+	sig, err := roomTokenMAC(cfg, payload)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sig), expiresAt, nil
+}
+
+func validateRoomToken(cfg *Config, token, rid string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return errors.New("malformed room token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return errors.New("malformed room token")
+	}
+	expected, err := roomTokenMAC(cfg, parts[0])
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(sig, expected) {
+		return errors.New("invalid room token signature")
+	}
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errors.New("malformed room token")
+	}
+	var claims roomTokenClaims
+	if err := json.Unmarshal(payloadBytes, &claims); err != nil {
+		return errors.New("malformed room token")
+	}
+	if claims.V != roomTokenVersion || claims.RID != rid {
+		return errors.New("room token is for another room")
+	}
+	if time.Now().Unix() > claims.Exp {
+		return errors.New("room token expired")
+	}
+	return nil
+}
+
+// requireRoomToken validates roomID and the request's room token for it,
+// writing the error response and returning false when either is invalid.
+func requireRoomToken(cfg *Config, w http.ResponseWriter, r *http.Request, roomID string) bool {
+	if err := validateRoomID(cfg, roomID); err != nil {
+		if errors.Is(err, ErrRoomIDSecretMissing) {
+			http.Error(w, "Room ID service is not configured", http.StatusServiceUnavailable)
+			return false
+		}
+		http.Error(w, "Invalid roomId", http.StatusBadRequest)
+		return false
+	}
+	token := r.Header.Get("X-Room-Token")
+	if token == "" {
+		http.Error(w, "Missing room token", http.StatusUnauthorized)
+		return false
+	}
+	if err := validateRoomToken(cfg, token, roomID); err != nil {
+		slog.Warn("push request denied", "ip", redactIP(getClientIP(cfg, r)), "path", r.URL.Path, "rid", redactRoomID(roomID), "err", err)
+		http.Error(w, "Invalid room token", http.StatusForbidden)
+		return false
+	}
+	return true
+}
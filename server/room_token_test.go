@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signRoomTokenClaims signs arbitrary claims the way issueRoomToken does.
+func signRoomTokenClaims(t *testing.T, cfg *Config, claims roomTokenClaims) string {
+	t.Helper()
+	payloadBytes, _ := json.Marshal(claims)
+	payload := base64.RawURLEncoding.EncodeToString(payloadBytes)
+	sig, err := roomTokenMAC(cfg, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestValidateRoomToken(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.RoomIDSecret = "test-room-id-secret"
+	rid, _ := generateRoomID(cfg)
+	other, _ := generateRoomID(cfg)
+	token, expiresAt, err := issueRoomToken(cfg, rid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(expiresAt); d <= roomTokenTTL-time.Minute || d > roomTokenTTL {
+		t.Errorf("token expires in %v, want %v", d, roomTokenTTL)
+	}
+	payload, sig, _ := strings.Cut(token, ".")
+	sigBytes, _ := base64.RawURLEncoding.DecodeString(sig)
+	sigBytes[0] ^= 1
+	flipped := base64.RawURLEncoding.EncodeToString(sigBytes)
+
+	otherSecret := newTestConfig()
+	otherSecret.RoomIDSecret = "another-secret"
+	foreign, _, _ := issueRoomToken(otherSecret, rid)
+	callerToken, _, _ := issueCallerToken(cfg, "U-alice", rid)
+
+	tests := []struct {
+		name  string
+		token string
+		rid   string
+		ok    bool
+	}{
+		{"valid", token, rid, true},
+		{"other room", token, other, false},
+		{"expired", signRoomTokenClaims(t, cfg, roomTokenClaims{V: roomTokenVersion, RID: rid, Exp: time.Now().Add(-time.Second).Unix()}), rid, false},
+		{"future version", signRoomTokenClaims(t, cfg, roomTokenClaims{V: roomTokenVersion + 1, RID: rid, Exp: expiresAt.Unix()}), rid, false},
+		{"tampered payload", payload + "x." + sig, rid, false},
+		{"tampered signature", payload + "." + flipped, rid, false},
+		{"other secret", foreign, rid, false},
+		{"caller token", callerToken, rid, false},
+		{"no signature", payload, rid, false},
+		{"empty", "", rid, false},
+	}
+	for _, tt := range tests {
+		if err := validateRoomToken(cfg, tt.token, tt.rid); (err == nil) != tt.ok {
+			t.Errorf("%s: validateRoomToken = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestPushEndpointsRequireRoomToken(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.RoomIDSecret = "test-room-id-secret"
+	authStore := newAuthStore(cfg)
+	s := newTestPushService(t, cfg, authStore)
+	rid, _ := generateRoomID(cfg)
+	other, _ := generateRoomID(cfg)
+	token, _, _ := issueRoomToken(cfg, rid)
+	otherToken, _, _ := issueRoomToken(cfg, other)
+
+	endpoints := []struct {
+		name   string
+		method string
+		h      http.HandlerFunc
+		body   string
+	}{
+		{"subscribe", http.MethodPost, handlePushSubscribe(cfg, s, authStore), `{"endpoint":"https://push.example/a","keys":{"auth":"a","p256dh":"k"}}`},
+		{"unsubscribe", http.MethodDelete, handlePushSubscribe(cfg, s, authStore), `{"endpoint":"https://push.example/a"}`},
+		{"recipients", http.MethodGet, handlePushRecipients(cfg, s), ""},
+		{"snapshot upload", http.MethodPost, handlePushSnapshot(cfg, s), `{}`},
+	}
+	tests := []struct {
+		name  string
+		rid   string
+		token string
+		want  int
+	}{
+		{"missing token", rid, "", http.StatusUnauthorized},
+		{"token for another room", rid, otherToken, http.StatusForbidden},
+		{"garbage token", rid, "not.a-token", http.StatusForbidden},
+		{"invalid room ID", "not-a-room", token, http.StatusBadRequest},
+	}
+	for _, ep := range endpoints {
+		for _, tt := range tests {
+			req := httptest.NewRequest(ep.method, "/api/push/x?roomId="+tt.rid, strings.NewReader(ep.body))
+			if tt.token != "" {
+				req.Header.Set("X-Room-Token", tt.token)
+			}
+			rec := httptest.NewRecorder()
+			ep.h(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("%s, %s: %d, want %d", ep.name, tt.name, rec.Code, tt.want)
+			}
+		}
+
+		req := httptest.NewRequest(ep.method, "/api/push/x?roomId="+rid, strings.NewReader(ep.body))
+		req.Header.Set("X-Room-Token", token)
+		rec := httptest.NewRecorder()
+		ep.h(rec, req)
+		if rec.Code == http.StatusUnauthorized || rec.Code == http.StatusForbidden {
+			t.Errorf("%s with a valid token: %d %s", ep.name, rec.Code, rec.Body)
+		}
+	}
+
+	// Without a secret the room token service is unavailable, not open.
+	cfg.RoomIDSecret = ""
+	req := httptest.NewRequest(http.MethodGet, "/api/push/recipients?roomId="+rid, nil)
+	req.Header.Set("X-Room-Token", token)
+	rec := httptest.NewRecorder()
+	handlePushRecipients(cfg, s)(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("no secret: %d, want 503", rec.Code)
+	}
+}
+
+func TestPushEndpointsRateLimitedPerIP(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.RoomIDSecret = "test-room-id-secret"
+	nets, err := parseCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.rateLimitAllowlist = nets
+	s := newTestPushService(t, cfg, newAuthStore(cfg))
+	limiter := newConfiguredIPLimiter(cfg, pushRateLimit, pushRateBurst)
+	h := rateLimitMiddleware(cfg, limiter, handlePushVapidKey(s))
+
+	call := func(ip string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/push/vapid-public-key", nil)
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec.Code
+	}
+	for i := 0; i < pushRateBurst; i++ {
+		if code := call("192.0.2.1"); code != http.StatusOK {
+			t.Fatalf("request %d: %d", i+1, code)
+		}
+	}
+	if code := call("192.0.2.1"); code != http.StatusTooManyRequests {
+		t.Errorf("request over the burst: %d, want 429", code)
+	}
+	if code := call("198.51.100.1"); code != http.StatusOK {
+		t.Errorf("another IP: %d, want 200", code)
+	}
+	for i := 0; i <= pushRateBurst; i++ {
+		if code := call(fmt.Sprintf("10.0.0.%d", i%2+1)); code != http.StatusOK {
+			t.Fatalf("allowlisted request %d: %d", i+1, code)
+		}
+	}
+}
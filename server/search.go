@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	searchDefaultLimit = 20
+	searchMaxLimit     = 50
+)
+
+var searchFolder = cases.Fold()
+
+// normalizeSearchKey makes matching case- and accent-insensitive and treats
+// compatibility forms alike (e.g. "Ｊöße" matches "josse").
+func normalizeSearchKey(s string) string {
+	t := transform.Chain(norm.NFKD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	stripped, _, err := transform.String(t, strings.TrimSpace(s))
+	if err != nil {
+		stripped = s
+	}
+	return searchFolder.String(stripped)
+}
+
+type searchEntry struct {
+	key  string
+	user *User
+}
+
+// userIndex is a sorted list of normalised search keys: the username, the
+// full display name and each of its words. Prefix queries are a binary
+// search followed by a scan. Guarded by AuthStore.mu.
+type userIndex struct {
+	entries []searchEntry
+	keys    map[string][]string // userID -> keys currently indexed
+}
+
+func newUserIndex() *userIndex {
+	return &userIndex{keys: make(map[string][]string)}
+}
+
+func searchKeys(user *User) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	add := func(s string) {
+		if k := normalizeSearchKey(s); k != "" && !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	add(user.Username)
+	add(user.DisplayName)
+	for _, word := range strings.Fields(user.DisplayName) {
+		add(word)
+	}
+	return keys
+}
+
+func (idx *userIndex) less(a, b searchEntry) bool {
+	if a.key != b.key {
+		return a.key < b.key
+	}
+	return a.user.Username < b.user.Username
+}
+
+func (idx *userIndex) add(user *User) {
+	keys := searchKeys(user)
+	idx.keys[user.UserID] = keys
+	for _, key := range keys {
+		entry := searchEntry{key: key, user: user}
+		i := sort.Search(len(idx.entries), func(i int) bool { return !idx.less(idx.entries[i], entry) })
+		idx.entries = append(idx.entries, searchEntry{})
+		copy(idx.entries[i+1:], idx.entries[i:])
+		idx.entries[i] = entry
+	}
+}
+
+func (idx *userIndex) remove(user *User) {
+	for _, key := range idx.keys[user.UserID] {
+		entry := searchEntry{key: key, user: user}
+		i := sort.Search(len(idx.entries), func(i int) bool { return !idx.less(idx.entries[i], entry) })
+		if i < len(idx.entries) && idx.entries[i].user == user {
+			idx.entries = append(idx.entries[:i], idx.entries[i+1:]...)
+		}
+	}
+	delete(idx.keys, user.UserID)
+}
+
+// reindex refreshes the user's keys after a display name change.
+func (idx *userIndex) reindex(user *User) {
+	idx.remove(user)
+	idx.add(user)
+}
+
+// search calls visit for each distinct user with a key starting with query,
+// in key order, until visit returns false. Exact matches sort before longer
+// keys, so they come first.
+func (idx *userIndex) search(query string, visit func(*User) bool) {
+	prefix := normalizeSearchKey(query)
+	if prefix == "" {
+		return
+	}
+	seen := make(map[*User]bool)
+	start := sort.Search(len(idx.entries), func(i int) bool { return idx.entries[i].key >= prefix })
+	for _, entry := range idx.entries[start:] {
+		if !strings.HasPrefix(entry.key, prefix) {
+			return
+		}
+		if seen[entry.user] {
+			continue
+		}
+		seen[entry.user] = true
+		if !visit(entry.user) {
+			return
+		}
+	}
+}
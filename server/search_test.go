@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func setDisplayName(authStore *AuthStore, user *User, name string) {
+	authStore.mu.Lock()
+	user.DisplayName = name
+	authStore.searchIndex.reindex(user)
+	authStore.mu.Unlock()
+}
+
+func searchUsernames(authStore *AuthStore, requester *User, query string, limit, offset int) ([]string, bool) {
+	users, hasMore := authStore.searchUsers(requester, query, limit, offset)
+	names := make([]string, len(users))
+	for i, user := range users {
+		names[i] = user.Username
+	}
+	return names, hasMore
+}
+
+func TestNormalizeSearchKey(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Alice", "alice"},
+		{"  Alice  ", "alice"},
+		{"José", "jose"},
+		{"ＪÖSSE", "josse"},
+		{"Straße", "strasse"},
+		{"Ёлка", "елка"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeSearchKey(tt.in); got != tt.want {
+			t.Errorf("normalizeSearchKey(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSearchUsersPrefixAndRanking(t *testing.T) {
+	authStore := newAuthStore(newTestConfig())
+	requester, _ := newTestUser(t, authStore, "requester", "correct horse battery")
+	for _, name := range []string{"annette", "ann", "bob", "anna"} {
+		newTestUser(t, authStore, name, "correct horse battery")
+	}
+	mary, _ := newTestUser(t, authStore, "mary", "correct horse battery")
+	setDisplayName(authStore, mary, "Mary Ann Smith")
+	zoe, _ := newTestUser(t, authStore, "zoe", "correct horse battery")
+	setDisplayName(authStore, zoe, "Ánnika")
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		// Exact keys first, ties broken by username, then longer keys.
+		{"ann", []string{"ann", "mary", "anna", "annette", "zoe"}},
+		{"ANNA", []string{"anna"}},
+		{"smi", []string{"mary"}},
+		{"mary ann", []string{"mary"}},
+		{"ánni", []string{"zoe"}},
+		{"nn", nil},
+		{"", nil},
+		{"   ", nil},
+	}
+	for _, tt := range tests {
+		got, _ := searchUsernames(authStore, requester, tt.query, searchMaxLimit, 0)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("search %q = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	// Renaming drops the old keys.
+	setDisplayName(authStore, mary, "Marie")
+	if got, _ := searchUsernames(authStore, requester, "smi", searchMaxLimit, 0); len(got) != 0 {
+		t.Errorf("search after rename = %v, want none", got)
+	}
+	if got, _ := searchUsernames(authStore, requester, "marie", searchMaxLimit, 0); fmt.Sprint(got) != "[mary]" {
+		t.Errorf("search new name = %v, want [mary]", got)
+	}
+}
+
+func TestSearchUsersSkipsInvisible(t *testing.T) {
+	authStore := newAuthStore(newTestConfig())
+	requester, _ := newTestUser(t, authStore, "sam", "correct horse battery")
+	for _, name := range []string{"sara", "sean", "seth", "sid"} {
+		newTestUser(t, authStore, name, "correct horse battery")
+	}
+	hidden, _ := newTestUser(t, authStore, "sally", "correct horse battery")
+	hidden.Privacy.Searchable = audienceNobody
+	contactsOnly, _ := newTestUser(t, authStore, "scott", "correct horse battery")
+	contactsOnly.Privacy.Searchable = audienceContacts
+
+	got, hasMore := searchUsernames(authStore, requester, "s", 3, 1)
+	if fmt.Sprint(got) != "[sean seth sid]" || hasMore {
+		t.Errorf("page = %v, hasMore %v, want [sean seth sid] without more", got, hasMore)
+	}
+
+	authStore.mu.Lock()
+	contactsOnly.Contacts = map[string]time.Time{requester.UserID: time.Now()}
+	authStore.mu.Unlock()
+	if got, _ := searchUsernames(authStore, requester, "sc", 10, 0); fmt.Sprint(got) != "[scott]" {
+		t.Errorf("contacts-only user found by contact = %v", got)
+	}
+}
+
+func TestHandleSearchUsersPagination(t *testing.T) {
+	authStore := newAuthStore(newTestConfig())
+	_, token := newTestUser(t, authStore, "requester", "correct horse battery")
+	for i := 0; i < 5; i++ {
+		newTestUser(t, authStore, fmt.Sprintf("tester%d", i), "correct horse battery")
+	}
+	h := handleSearchUsers(authStore)
+
+	var got []string
+	url := "/api/users/search?q=test&limit=2"
+	for pages := 0; url != ""; pages++ {
+		if pages == 5 {
+			t.Fatal("pagination does not terminate")
+		}
+		rec := callUserHandler(h, http.MethodGet, url, token, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", url, rec.Code, rec.Body)
+		}
+		var resp struct {
+			Users      []Profile `json:"users"`
+			NextOffset *int      `json:"nextOffset"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range resp.Users {
+			got = append(got, p.Username)
+		}
+		url = ""
+		if resp.NextOffset != nil {
+			url = fmt.Sprintf("/api/users/search?q=test&limit=2&offset=%d", *resp.NextOffset)
+		}
+	}
+	if fmt.Sprint(got) != "[tester0 tester1 tester2 tester3 tester4]" {
+		t.Errorf("paged results = %v", got)
+	}
+
+	for _, tt := range []struct {
+		query string
+		want  int
+	}{
+		{"q=test&limit=0", http.StatusBadRequest},
+		{"q=test&limit=x", http.StatusBadRequest},
+		{"q=test&offset=-1", http.StatusBadRequest},
+		{"q=test&limit=1000", http.StatusOK},
+	} {
+		if rec := callUserHandler(h, http.MethodGet, "/api/users/search?"+tt.query, token, ""); rec.Code != tt.want {
+			t.Errorf("%s: %d, want %d", tt.query, rec.Code, tt.want)
+		}
+	}
+	if rec := callUserHandler(h, http.MethodGet, "/api/users/search?q=test", "", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous search: %d, want 401", rec.Code)
+	}
+}
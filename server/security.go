@@ -2,32 +2,16 @@ package main
 
 import (
 	"net/http"
-	"os"
 	"strings"
 )
 
-var (
-	allowedOrigins = parseAllowedOrigins(os.Getenv("ALLOWED_ORIGINS"))
-)
-
-func parseAllowedOrigins(raw string) map[string]bool {
-	origins := make(map[string]bool)
-	for _, origin := range strings.Split(raw, ",") {
-		trimmed := strings.TrimSpace(origin)
-		if trimmed != "" {
-			origins[trimmed] = true
-		}
-	}
-	return origins
-}
-
-func isOriginAllowed(r *http.Request) bool {
+func isOriginAllowed(cfg *Config, r *http.Request) bool {
 	origin := strings.TrimSpace(r.Header.Get("Origin"))
 	if origin == "" {
 		return true
 	}
 
-	if allowedOrigins[origin] {
+	if cfg.allowedOrigins()[origin] {
 		return true
 	}
 
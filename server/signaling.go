@@ -5,9 +5,11 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"log"
+	"log/slog"
 	"sync"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 const maxMessageSize = 65536 // 64KB
@@ -36,48 +38,149 @@ type Participant struct {
 }
 
 type Hub struct {
+	cfg          *Config
+	push         *PushService
+	upgrader     *websocket.Upgrader
 	rooms        map[string]*Room
 	watchers     map[string]map[*Client]bool // roomID -> set of clients
 	mu           sync.RWMutex
 	clients      map[*Client]bool
 	clientsBySID map[string]*Client
+	sessionsByIP map[string]int        // ip -> number of registered clients
+	ipLimiters   map[string]*IPLimiter // message type -> per-IP limiter
+	lastTick     int64                 // unix nanos of the last run loop tick, for liveness
+	probes       chan chan struct{}    // readiness probes answered by the run loop
 }
 
 type Room struct {
 	RID          string
 	Participants map[*Client]string // client -> cid
 	HostCID      string
-	mu           sync.Mutex
+	CreatedAt    time.Time
+	// answered is set once two participants have been in the room, which
+	// decides between a missed-call and a call-ended notification.
+	answered bool
+	// pushEndpoints are the participants' own push endpoints, which are
+	// never notified about this call.
+	pushEndpoints map[string]bool
+	// pendingRing fires the ring when the joiner announced a snapshot that
+	// has not arrived yet (see push_snapshot).
+	pendingRing *time.Timer
+	// callerID is the signed-in user who rang the room, if any.
+	callerID string
+	mu       sync.Mutex
+}
+
+// pushSnapshotWait is how long a ring waits for the caller's snapshot.
+const pushSnapshotWait = 3 * time.Second
+
+// cancelRingLocked stops a pending ring and reports whether it had not fired
+// yet. Caller must hold room.mu.
+func (room *Room) cancelRingLocked() bool {
+	if room.pendingRing == nil {
+		return false
+	}
+	stopped := room.pendingRing.Stop()
+	room.pendingRing = nil
+	return stopped
+}
+
+// excludedEndpointsLocked returns the endpoints not to notify. Caller must
+// hold room.mu.
+func (room *Room) excludedEndpointsLocked() []string {
+	endpoints := make([]string, 0, len(room.pushEndpoints))
+	for endpoint := range room.pushEndpoints {
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints
 }
 
 type Client struct {
-	hub       *Hub
-	send      chan []byte
-	sid       string
-	cid       string // assigned on join
-	rid       string // current room
-	ip        string
-	replaced  bool
-	lastSeen  int64
-	transport TransportKind
-}
-
-func newHub() *Hub {
+	hub         *Hub
+	send        chan []byte
+	closed      chan struct{} // closed to force the transport to shut down
+	closeOnce   sync.Once
+	sid         string
+	cid         string // assigned on join
+	rid         string // current room
+	ip          string
+	replaced    bool
+	lastSeen    int64
+	transport   TransportKind
+	connectedAt time.Time
+	joinedAt    time.Time
+	limiter     sessionLimiter
+	watchCount  int // rooms in hub.watchers, guarded by hub.mu
+	locale      string
+}
+
+func newClient(hub *Hub, sid, ip, locale string, transport TransportKind) *Client {
+	return &Client{
+		hub:         hub,
+		send:        make(chan []byte, 256),
+		closed:      make(chan struct{}),
+		sid:         sid,
+		ip:          ip,
+		transport:   transport,
+		locale:      locale,
+		connectedAt: time.Now(),
+	}
+}
+
+// close asks the client's transport to terminate the connection.
+func (c *Client) close() {
+	c.closeOnce.Do(func() { close(c.closed) })
+}
+
+func newHub(cfg *Config, push *PushService) *Hub {
 	return &Hub{
+		cfg:          cfg,
+		push:         push,
+		upgrader:     newWSUpgrader(cfg),
 		rooms:        make(map[string]*Room),
 		watchers:     make(map[string]map[*Client]bool),
 		clients:      make(map[*Client]bool),
 		clientsBySID: make(map[string]*Client),
+		sessionsByIP: make(map[string]int),
+		ipLimiters:   newSignalingIPLimiters(cfg),
+		probes:       make(chan chan struct{}),
 	}
 }
 
 func (h *Hub) registerClient(c *Client) {
 	h.mu.Lock()
-	h.clients[c] = true
+	h.addClientLocked(c)
 	h.clientsBySID[c.sid] = c
 	h.mu.Unlock()
 }
 
+// addClientLocked and removeClientLocked keep clients and sessionsByIP in
+// sync. Callers must hold h.mu.
+func (h *Hub) addClientLocked(c *Client) {
+	if h.clients[c] {
+		return
+	}
+	h.clients[c] = true
+	h.sessionsByIP[c.ip]++
+}
+
+func (h *Hub) removeClientLocked(c *Client) {
+	if !h.clients[c] {
+		return
+	}
+	delete(h.clients, c)
+	if h.sessionsByIP[c.ip]--; h.sessionsByIP[c.ip] <= 0 {
+		delete(h.sessionsByIP, c.ip)
+	}
+}
+
+// allowNewSession reports whether ip is below the concurrent session limit.
+func (h *Hub) allowNewSession(ip string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.sessionsByIP[ip] < h.cfg.MaxSessionsPerIP
+}
+
 func (h *Hub) getClientBySID(sid string) *Client {
 	h.mu.RLock()
 	client := h.clientsBySID[sid]
@@ -87,8 +190,8 @@ func (h *Hub) getClientBySID(sid string) *Client {
 
 func (h *Hub) replaceClient(oldClient, newClient *Client) {
 	h.mu.Lock()
-	delete(h.clients, oldClient)
-	h.clients[newClient] = true
+	h.removeClientLocked(oldClient)
+	h.addClientLocked(newClient)
 	h.clientsBySID[newClient.sid] = newClient
 	for _, clientSet := range h.watchers {
 		if clientSet[oldClient] {
@@ -96,6 +199,8 @@ func (h *Hub) replaceClient(oldClient, newClient *Client) {
 			clientSet[newClient] = true
 		}
 	}
+	newClient.watchCount = oldClient.watchCount
+	oldClient.watchCount = 0
 	h.mu.Unlock()
 
 	if oldClient.rid != "" {
@@ -120,7 +225,7 @@ func (h *Hub) replaceClient(oldClient, newClient *Client) {
 func (c *Client) sendMessage(msg interface{}) {
 	b, err := json.Marshal(msg)
 	if err != nil {
-		log.Printf("json error: %v", err)
+		c.logger().Error("failed to marshal message", "err", err)
 		return
 	}
 	select {
@@ -135,12 +240,18 @@ func (c *Client) sendMessage(msg interface{}) {
 func (h *Hub) handleMessage(c *Client, msgBytes []byte) {
 	var msg SignalingMessage
 	if err := json.Unmarshal(msgBytes, &msg); err != nil {
-		c.sendError(msg.RID, "BAD_REQUEST", "Invalid JSON")
+		c.sendError(msg.RID, "BAD_REQUEST", "signaling.invalid_json")
 		return
 	}
 
 	if msg.V != 1 {
-		c.sendError(msg.RID, "UNSUPPORTED_VERSION", "Only version 1 is supported")
+		c.sendError(msg.RID, "UNSUPPORTED_VERSION", "signaling.unsupported_version")
+		return
+	}
+
+	if !h.allowMessage(c, msg.Type) {
+		c.logger().Debug("signaling message rate limited", "type", msg.Type)
+		c.sendError(msg.RID, "RATE_LIMITED", "signaling.rate_limited")
 		return
 	}
 
@@ -148,50 +259,55 @@ func (h *Hub) handleMessage(c *Client, msgBytes []byte) {
 	case "ping":
 		return
 	case "join":
-		log.Printf("[JOIN] Client %s joining room %s", c.sid, msg.RID)
+		c.logger().Info("join requested", "target_rid", redactRoomID(msg.RID))
 		if c.rid != "" {
 			h.removeClientFromRoom(c)
 		}
 		h.handleJoin(c, msg)
 	case "leave":
-		log.Printf("[LEAVE] Client %s leaving", c.cid)
+		c.logger().Info("leave requested")
 		h.handleLeave(c, msg)
 	case "end_room":
-		log.Printf("[END_ROOM] Client %s ending room %s", c.cid, c.rid)
+		c.logger().Info("end_room requested")
 		h.handleEndRoom(c, msg)
 	case "watch_rooms":
 		h.handleWatchRooms(c, msg)
+	case "room_token":
+		h.handleRoomToken(c, msg)
+	case "push_snapshot":
+		h.handlePushSnapshot(c, msg)
 	case "offer", "answer", "ice":
-		// log.Printf("[%s] Relay from %s to room %s", msg.Type, c.cid, c.rid) // verbose
 		h.handleRelay(c, msg)
 	default:
-		log.Printf("[UNKNOWN] Unknown message type: %s", msg.Type)
+		c.logger().Warn("unknown message type", "type", msg.Type)
 	}
 }
 
 func (h *Hub) handleJoin(c *Client, msg SignalingMessage) {
 	rid := msg.RID
 	if rid == "" {
-		c.sendError("", "BAD_REQUEST", "Missing roomId")
+		c.sendError("", "BAD_REQUEST", "signaling.missing_room_id")
 		return
 	}
 
-	if err := validateRoomID(rid); err != nil {
+	if err := validateRoomID(h.cfg, rid); err != nil {
 		if errors.Is(err, ErrRoomIDSecretMissing) {
-			c.sendError(rid, "SERVER_NOT_CONFIGURED", "Room ID service is not configured")
+			c.sendError(rid, "SERVER_NOT_CONFIGURED", "signaling.server_not_configured")
 			return
 		}
-		c.sendError(rid, "INVALID_ROOM_ID", "Room ID must be a valid room token")
+		c.sendError(rid, "INVALID_ROOM_ID", "signaling.invalid_room_id")
 		return
 	}
 
 	h.mu.Lock()
 	room, exists := h.rooms[rid]
 	if !exists {
-		log.Printf("[JOIN] Creating new room %s", rid)
+		slog.Info("room created", "rid", redactRoomID(rid))
 		room = &Room{
-			RID:          rid,
-			Participants: make(map[*Client]string),
+			RID:           rid,
+			Participants:  make(map[*Client]string),
+			CreatedAt:     time.Now(),
+			pushEndpoints: make(map[string]bool),
 		}
 		h.rooms[rid] = room
 	}
@@ -202,10 +318,16 @@ func (h *Hub) handleJoin(c *Client, msg SignalingMessage) {
 		ReconnectCID string `json:"reconnectCid"`
 		PushEndpoint string `json:"pushEndpoint"`
 		SnapshotID   string `json:"snapshotId"`
+		// SnapshotPending holds the ring until push_snapshot arrives, as the
+		// snapshot can only be uploaded with the room token from joined.
+		SnapshotPending bool `json:"snapshotPending"`
+		// CallerToken identifies a signed-in caller, so that priority
+		// contacts are rung through quiet hours.
+		CallerToken string `json:"callerToken"`
 	}
 	if len(msg.Payload) > 0 {
 		if err := json.Unmarshal(msg.Payload, &joinPayload); err != nil {
-			log.Printf("[JOIN] Failed to parse payload: %v", err)
+			c.logger().Warn("invalid join payload", "err", err)
 		}
 	}
 
@@ -248,7 +370,7 @@ func (h *Hub) handleJoin(c *Client, msg SignalingMessage) {
 			}
 
 			if ghostClient != nil {
-				log.Printf("[JOIN] Reconnection detected for CID %s. Evicting ghost client %s", reconnectCID, ghostClient.sid)
+				c.logger().Info("reconnection detected, evicting ghost client", "reconnect_cid", reconnectCID, "ghost_sid", ghostClient.sid)
 				// Evict ghost. MUST unlock room before calling removeClientFromRoom because it locks hub then room.
 				// Wait, removeClientFromRoom locks hub then room. We currently hold room lock.
 				// We CANNOT call removeClientFromRoom here directly without deadlock or complex unlocking.
@@ -281,8 +403,8 @@ func (h *Hub) handleJoin(c *Client, msg SignalingMessage) {
 
 		if !evicted && len(room.Participants) >= 2 {
 			room.mu.Unlock()
-			log.Printf("[JOIN] Room %s is full", rid)
-			c.sendError(rid, "ROOM_FULL", "Room is full")
+			c.logger().Info("room full", "target_rid", redactRoomID(rid))
+			c.sendError(rid, "ROOM_FULL", "signaling.room_full")
 			return
 		}
 	}
@@ -293,13 +415,43 @@ func (h *Hub) handleJoin(c *Client, msg SignalingMessage) {
 	}
 	c.cid = cid
 	c.rid = rid
+	c.joinedAt = time.Now()
 	room.Participants[c] = cid
 
 	if room.HostCID == "" {
 		room.HostCID = cid
 	}
+	if excludeEndpoint != "" {
+		room.pushEndpoints[excludeEndpoint] = true
+	}
+	// Joining an empty room rings the subscribers; joining an occupied one
+	// answers the call.
+	ring := len(room.Participants) == 1 && !reusedCID
+	if len(room.Participants) >= 2 {
+		room.answered = true
+		room.cancelRingLocked()
+	}
+	if ring {
+		room.callerID = ""
+		if joinPayload.CallerToken != "" {
+			if userID, err := validateCallerToken(h.cfg, joinPayload.CallerToken, rid); err != nil {
+				c.logger().Warn("invalid caller token", "err", err)
+			} else {
+				room.callerID = userID
+			}
+		}
+	}
+	callerID := room.callerID
+	exclude := room.excludedEndpointsLocked()
+	if ring && h.push != nil && snapshotID == "" && joinPayload.SnapshotPending {
+		room.cancelRingLocked()
+		room.pendingRing = time.AfterFunc(pushSnapshotWait, func() {
+			h.push.SendNotificationToRoom(rid, notifyIncomingCall, exclude, "", callerID)
+		})
+		ring = false
+	}
 
-	log.Printf("[JOIN] Client %s assigned CID %s in room %s. Host: %s", c.sid, cid, rid, room.HostCID)
+	c.logger().Info("joined room", "host_cid", room.HostCID)
 
 	// Send 'joined'
 	participants := []Participant{}
@@ -309,9 +461,9 @@ func (h *Hub) handleJoin(c *Client, msg SignalingMessage) {
 
 	room.mu.Unlock() // <--- CRITICAL FIX: Unlock before broadcast/send to avoid deadlock/blocking
 
-	// Trigger Push Notification when anyone joins (subscribed users waiting offline should get notified)
-	if pushService != nil {
-		go pushService.SendNotificationToRoom(rid, excludeEndpoint, snapshotID)
+	// Ring subscribers waiting offline
+	if h.push != nil && ring {
+		go h.push.SendNotificationToRoom(rid, notifyIncomingCall, exclude, snapshotID, callerID)
 	}
 
 	payload := map[string]interface{}{
@@ -320,13 +472,19 @@ func (h *Hub) handleJoin(c *Client, msg SignalingMessage) {
 	}
 
 	// Include TURN token in joined response (gated by valid room ID)
-	token, expiresAt, err := issueTurnToken(5*time.Minute, turnTokenKindCall)
+	token, expiresAt, err := issueTurnToken(h.cfg, 5*time.Minute, turnTokenKindCall)
 	if err != nil {
-		log.Printf("[TURN] Failed to issue token: %v", err)
+		c.logger().Error("failed to issue TURN token", "err", err)
 	} else {
 		payload["turnToken"] = token
 		payload["turnTokenExpiresAt"] = expiresAt.Unix()
 	}
+	if token, expiresAt, err := issueRoomToken(h.cfg, rid); err != nil {
+		c.logger().Error("failed to issue room token", "err", err)
+	} else {
+		payload["roomToken"] = token
+		payload["roomTokenExpiresAt"] = expiresAt.Unix()
+	}
 
 	payloadBytes, _ := json.Marshal(payload)
 
@@ -364,33 +522,52 @@ func (h *Hub) handleEndRoom(c *Client, msg SignalingMessage) {
 	h.mu.RUnlock()
 
 	if !exists {
-		log.Printf("[END_ROOM] Client %s tried to end non-existent room %s", c.sid, rid)
+		c.logger().Warn("end_room for non-existent room")
 		return
 	}
 
 	room.mu.Lock()
 
 	if room.HostCID != c.cid {
+		hostCID := room.HostCID
 		room.mu.Unlock()
-		c.sendError(rid, "NOT_HOST", "Only host can end room")
-		log.Printf("[END_ROOM] Client %s (CID: %s) tried to end room %s but is not host (Host: %s)", c.sid, c.cid, rid, room.HostCID)
+		c.sendError(rid, "NOT_HOST", "signaling.not_host")
+		c.logger().Warn("end_room rejected: not host", "host_cid", hostCID)
 		return
 	}
+	// Still holding the lock, so the host cannot change before the end.
+	notified := h.endRoomLocked(room, c.cid, "host_ended")
+	c.logger().Info("host ended room", "notified", notified)
+}
 
+// endRoom notifies all participants with room_ended and removes the room.
+// It returns the number of participants notified.
+func (h *Hub) endRoom(room *Room, by, reason string) int {
+	room.mu.Lock()
+	return h.endRoomLocked(room, by, reason)
+}
+
+// endRoomLocked is endRoom for callers that already hold room.mu; it
+// releases the lock before notifying anyone.
+func (h *Hub) endRoomLocked(room *Room, by, reason string) int {
+	rid := room.RID
 	// Collect clients to notify
 	clients := make([]*Client, 0, len(room.Participants))
 	for client := range room.Participants {
 		clients = append(clients, client)
 	}
-
+	answered := room.answered
+	exclude := room.excludedEndpointsLocked()
+	callerID := room.callerID
+	room.cancelRingLocked()
+	room.Participants = make(map[*Client]string)
+	room.HostCID = ""
 	room.mu.Unlock() // Unlock before sending
 
-	log.Printf("[END_ROOM] Host %s ending room %s. Notifying %d clients", c.cid, rid, len(clients))
-
 	// Broadcast room_ended
 	endPayload, _ := json.Marshal(map[string]string{
-		"by":     c.cid,
-		"reason": "host_ended",
+		"by":     by,
+		"reason": reason,
 	})
 	endMsg := SignalingMessage{
 		V:       1,
@@ -410,28 +587,97 @@ func (h *Hub) handleEndRoom(c *Client, msg SignalingMessage) {
 		// Let's just leave them stale, it's fine.
 	}
 
-	// Clear room
-	// Re-acquire lock to clear participants? Or just delete room.
-	// If we delete room from hub, existing clients can't find it.
-
 	// Remove room from hub
 	h.mu.Lock()
-	delete(h.rooms, rid)
+	if h.rooms[rid] == room {
+		delete(h.rooms, rid)
+	}
 	h.mu.Unlock()
 
-	// Also clear participants in room to help GC?
-	room.mu.Lock()
-	room.Participants = make(map[*Client]string)
-	room.HostCID = ""
-	room.mu.Unlock()
+	h.notifyCallOver(rid, answered, exclude, callerID)
 
 	// Notify watchers
 	h.broadcastRoomStatusUpdate(rid)
+	return len(clients)
+}
+
+// handleRoomToken issues a fresh room token to a participant whose token is
+// about to expire.
+func (h *Hub) handleRoomToken(c *Client, msg SignalingMessage) {
+	rid := c.rid
+	if rid == "" {
+		c.sendError(msg.RID, "NOT_IN_ROOM", "signaling.not_in_room")
+		return
+	}
+	token, expiresAt, err := issueRoomToken(h.cfg, rid)
+	if err != nil {
+		c.logger().Error("failed to issue room token", "err", err)
+		c.sendError(rid, "INTERNAL_ERROR", "signaling.room_token_failed")
+		return
+	}
+	payload, _ := json.Marshal(map[string]interface{}{
+		"roomToken":          token,
+		"roomTokenExpiresAt": expiresAt.Unix(),
+	})
+	c.sendMessage(SignalingMessage{
+		V:       1,
+		Type:    "room_token",
+		RID:     rid,
+		Payload: payload,
+	})
+}
+
+// handlePushSnapshot rings the room's subscribers with the snapshot the
+// caller uploaded after joining. An empty snapshotId rings without one.
+func (h *Hub) handlePushSnapshot(c *Client, msg SignalingMessage) {
+	rid := c.rid
+	if rid == "" || h.push == nil {
+		return
+	}
+	var payload struct {
+		SnapshotID string `json:"snapshotId"`
+	}
+	if len(msg.Payload) > 0 {
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			c.sendError(rid, "BAD_REQUEST", "signaling.invalid_snapshot")
+			return
+		}
+	}
+
+	h.mu.RLock()
+	room, exists := h.rooms[rid]
+	h.mu.RUnlock()
+	if !exists {
+		return
+	}
+	room.mu.Lock()
+	ring := room.cancelRingLocked()
+	exclude := room.excludedEndpointsLocked()
+	callerID := room.callerID
+	room.mu.Unlock()
+	if !ring {
+		// Already rung without the snapshot, or answered.
+		return
+	}
+	go h.push.SendNotificationToRoom(rid, notifyIncomingCall, exclude, payload.SnapshotID, callerID)
+}
+
+// notifyCallOver replaces the ring on subscribers' devices once the call is
+// over: with a missed call if nobody answered, otherwise with call ended.
+func (h *Hub) notifyCallOver(rid string, answered bool, exclude []string, callerID string) {
+	if h.push == nil {
+		return
+	}
+	kind := notifyMissedCall
+	if answered {
+		kind = notifyCallEnded
+	}
+	go h.push.SendNotificationToRoom(rid, kind, exclude, "", callerID)
 }
 
 func (h *Hub) handleRelay(c *Client, msg SignalingMessage) {
 	if c.rid == "" {
-		log.Printf("[RELAY] Client %s (CID: %s) tried to relay but not in a room", c.sid, c.cid)
+		c.logger().Debug("relay ignored: not in a room", "type", msg.Type)
 		return
 	}
 
@@ -440,7 +686,7 @@ func (h *Hub) handleRelay(c *Client, msg SignalingMessage) {
 	h.mu.RUnlock()
 
 	if !exists {
-		log.Printf("[RELAY] Client %s (CID: %s) tried to relay in non-existent room %s", c.sid, c.cid, c.rid)
+		c.logger().Debug("relay ignored: room does not exist", "type", msg.Type)
 		return
 	}
 
@@ -449,7 +695,7 @@ func (h *Hub) handleRelay(c *Client, msg SignalingMessage) {
 
 	// Check if sender is in room
 	if _, ok := room.Participants[c]; !ok {
-		log.Printf("[RELAY] Client %s (CID: %s) tried to relay in room %s but is not a participant", c.sid, c.cid, c.rid)
+		c.logger().Warn("relay ignored: not a participant", "type", msg.Type)
 		return
 	}
 
@@ -465,7 +711,7 @@ func (h *Hub) handleRelay(c *Client, msg SignalingMessage) {
 	var rawPayload map[string]interface{}
 	if err := json.Unmarshal(msg.Payload, &rawPayload); err != nil {
 		rawPayload = make(map[string]interface{})
-		log.Printf("[RELAY] Client %s (CID: %s) sent invalid payload for type %s: %v", c.sid, c.cid, msg.Type, err)
+		c.logger().Warn("invalid relay payload", "type", msg.Type, "err", err)
 	}
 	rawPayload["from"] = c.cid
 
@@ -490,14 +736,15 @@ func (h *Hub) handleRelay(c *Client, msg SignalingMessage) {
 			relayedCount++
 		}
 	}
-	log.Printf("[RELAY] Client %s (CID: %s) relayed %s message to %d participants in room %s", c.sid, c.cid, msg.Type, relayedCount, c.rid)
+	c.logger().Debug("relayed message", "type", msg.Type, "count", relayedCount)
 }
 
 func (h *Hub) disconnectClient(c *Client) {
-	log.Printf("[DISCONNECT] Client %s disconnected", c.sid)
+	c.logger().Info("client disconnected")
 	h.mu.Lock()
-	delete(h.clients, c)
+	h.removeClientLocked(c)
 	delete(h.clientsBySID, c.sid)
+	c.watchCount = 0
 	// Remove from all watchers
 	for rid, clientSet := range h.watchers {
 		delete(clientSet, c)
@@ -513,20 +760,20 @@ func (h *Hub) disconnectClient(c *Client) {
 }
 
 func (h *Hub) removeClientFromRoom(c *Client) {
-	log.Printf("[REMOVE_FROM_ROOM] Client %s (CID: %s) being removed from room %s", c.sid, c.cid, c.rid)
+	c.logger().Debug("removing client from room")
 	h.mu.Lock()
 	room, exists := h.rooms[c.rid]
 	h.mu.Unlock()
 
 	if !exists {
-		log.Printf("[REMOVE_FROM_ROOM] Room %s not found for client %s", c.rid, c.sid)
+		c.logger().Debug("room not found while removing client")
 		return
 	}
 
 	rid := c.rid // Store RID for broadcast
 	room.mu.Lock()
 	delete(room.Participants, c)
-	log.Printf("[REMOVE_FROM_ROOM] Client %s (CID: %s) removed from room %s. Remaining participants: %d", c.sid, c.cid, c.rid, len(room.Participants))
+	c.logger().Info("client removed from room", "remaining", len(room.Participants))
 
 	// Manage Host
 	if room.HostCID == c.cid {
@@ -538,23 +785,30 @@ func (h *Hub) removeClientFromRoom(c *Client) {
 		}
 		room.HostCID = newHost
 		if newHost != "" {
-			log.Printf("[REMOVE_FROM_ROOM] Host %s left room %s. New host: %s", c.cid, c.rid, newHost)
+			c.logger().Info("host left room, transferring host", "new_host_cid", newHost)
 		} else {
 			// No participants left, host is empty
 		}
 	}
 
 	isEmpty := len(room.Participants) == 0
+	answered := room.answered
+	exclude := room.excludedEndpointsLocked()
+	callerID := room.callerID
+	if isEmpty {
+		room.cancelRingLocked()
+	}
 	room.mu.Unlock()
 
 	c.rid = ""
 	c.cid = ""
 
 	if isEmpty {
-		log.Printf("[REMOVE_FROM_ROOM] Room %s is now empty. Deleting room.", rid)
+		slog.Info("room empty, deleting", "rid", redactRoomID(rid))
 		h.mu.Lock()
 		delete(h.rooms, rid)
 		h.mu.Unlock()
+		h.notifyCallOver(rid, answered, exclude, callerID)
 	} else {
 		h.broadcastRoomState(room)
 	}
@@ -586,7 +840,7 @@ func (h *Hub) broadcastRoomState(room *Room) {
 	}
 	payloadBytes, _ := json.Marshal(payload)
 
-	log.Printf("[BROADCAST] Room State for %s: %d participants", rid, len(participants))
+	slog.Debug("broadcasting room state", "rid", redactRoomID(rid), "participants", len(participants))
 
 	msg := SignalingMessage{
 		V:       1,
@@ -600,10 +854,12 @@ func (h *Hub) broadcastRoomState(room *Room) {
 	}
 }
 
-func (c *Client) sendError(rid, code, message string) {
+// sendError reports an error to the client. The message is looked up in the
+// catalogue under key for the locale the client connected with.
+func (c *Client) sendError(rid, code, key string, args ...interface{}) {
 	payload, _ := json.Marshal(map[string]interface{}{
 		"code":    code,
-		"message": message,
+		"message": localize(c.locale, key, args...),
 	})
 	c.sendMessage(SignalingMessage{
 		V:       1,
@@ -624,21 +880,33 @@ func (h *Hub) handleWatchRooms(c *Client, msg SignalingMessage) {
 		RIDs []string `json:"rids"`
 	}
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		c.sendError(msg.RID, "BAD_REQUEST", "Invalid payload")
+		c.sendError(msg.RID, "BAD_REQUEST", "signaling.invalid_payload")
+		return
+	}
+	if len(payload.RIDs) > h.cfg.MaxWatchRoomsPerMsg {
+		c.sendError(msg.RID, "BAD_REQUEST", "signaling.too_many_watch_rooms", h.cfg.MaxWatchRoomsPerMsg)
 		return
 	}
 
 	h.mu.Lock()
 	status := make(map[string]int)
+	limitReached := false
 	for _, rid := range payload.RIDs {
-		if err := validateRoomID(rid); err != nil {
+		if err := validateRoomID(h.cfg, rid); err != nil {
 			continue
 		}
 		// Add to watchers
-		if h.watchers[rid] == nil {
-			h.watchers[rid] = make(map[*Client]bool)
+		if !h.watchers[rid][c] {
+			if c.watchCount >= h.cfg.MaxWatchedRoomsPerSID {
+				limitReached = true
+				continue
+			}
+			if h.watchers[rid] == nil {
+				h.watchers[rid] = make(map[*Client]bool)
+			}
+			h.watchers[rid][c] = true
+			c.watchCount++
 		}
-		h.watchers[rid][c] = true
 
 		// Get current count
 		if room, ok := h.rooms[rid]; ok {
@@ -651,6 +919,10 @@ func (h *Hub) handleWatchRooms(c *Client, msg SignalingMessage) {
 	}
 	h.mu.Unlock()
 
+	if limitReached {
+		c.sendError(msg.RID, "BAD_REQUEST", "signaling.too_many_watched_rooms", h.cfg.MaxWatchedRoomsPerSID)
+	}
+
 	statusBytes, _ := json.Marshal(status)
 	c.sendMessage(SignalingMessage{
 		V:       1,
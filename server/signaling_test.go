@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func newTestHub(t *testing.T) *Hub {
+	t.Helper()
+	cfg := newTestConfig()
+	cfg.RoomIDSecret = "test-room-id-secret"
+	return newHub(cfg, nil)
+}
+
+// drainErrors returns the codes of the error messages queued for the client.
+func drainErrors(t *testing.T, c *Client) []string {
+	t.Helper()
+	var codes []string
+	for {
+		select {
+		case b := <-c.send:
+			var msg SignalingMessage
+			if err := json.Unmarshal(b, &msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type != "error" {
+				continue
+			}
+			var payload struct {
+				Code string `json:"code"`
+			}
+			json.Unmarshal(msg.Payload, &payload)
+			codes = append(codes, payload.Code)
+		default:
+			return codes
+		}
+	}
+}
+
+func sendPings(h *Hub, c *Client, n int) {
+	for i := 0; i < n; i++ {
+		h.handleMessage(c, []byte(`{"v":1,"type":"ping"}`))
+	}
+}
+
+func TestSignalingSessionRateLimit(t *testing.T) {
+	h := newTestHub(t)
+	burst := int(signalingLimits["ping"].burst)
+	c := newClient(h, "S-1", "192.0.2.1", "en", TransportWS)
+
+	sendPings(h, c, burst)
+	if codes := drainErrors(t, c); len(codes) != 0 {
+		t.Fatalf("within burst: errors %v", codes)
+	}
+	sendPings(h, c, 1)
+	if codes := drainErrors(t, c); len(codes) != 1 || codes[0] != "RATE_LIMITED" {
+		t.Fatalf("over burst: errors %v, want RATE_LIMITED", codes)
+	}
+
+	// Message types have separate buckets.
+	h.handleMessage(c, []byte(`{"v":1,"type":"watch_rooms","payload":{"rids":[]}}`))
+	if codes := drainErrors(t, c); len(codes) != 0 {
+		t.Errorf("other type limited: errors %v", codes)
+	}
+	// A new session from another IP is unaffected.
+	other := newClient(h, "S-2", "198.51.100.1", "en", TransportWS)
+	sendPings(h, other, 1)
+	if codes := drainErrors(t, other); len(codes) != 0 {
+		t.Errorf("other session limited: errors %v", codes)
+	}
+}
+
+func TestSignalingIPRateLimit(t *testing.T) {
+	h := newTestHub(t)
+	burst := int(signalingLimits["ping"].burst)
+
+	// Each session stays within its own burst, together they use up the IP's.
+	for i := 0; i < signalingIPLimitFactor; i++ {
+		c := newClient(h, fmt.Sprintf("S-%d", i), "192.0.2.1", "en", TransportWS)
+		sendPings(h, c, burst)
+		if codes := drainErrors(t, c); len(codes) != 0 {
+			t.Fatalf("session %d: errors %v", i, codes)
+		}
+	}
+	fresh := newClient(h, "S-fresh", "192.0.2.1", "en", TransportWS)
+	sendPings(h, fresh, 1)
+	if codes := drainErrors(t, fresh); len(codes) != 1 || codes[0] != "RATE_LIMITED" {
+		t.Errorf("fresh session on a busy IP: errors %v, want RATE_LIMITED", codes)
+	}
+	elsewhere := newClient(h, "S-elsewhere", "198.51.100.1", "en", TransportWS)
+	sendPings(h, elsewhere, 1)
+	if codes := drainErrors(t, elsewhere); len(codes) != 0 {
+		t.Errorf("session on another IP: errors %v", codes)
+	}
+}
+
+func TestMaxSessionsPerIP(t *testing.T) {
+	h := newTestHub(t)
+	h.cfg.MaxSessionsPerIP = 2
+
+	first := newClient(h, "S-1", "192.0.2.1", "en", TransportWS)
+	h.registerClient(first)
+	h.registerClient(newClient(h, "S-2", "192.0.2.1", "en", TransportSSE))
+	if h.allowNewSession("192.0.2.1") {
+		t.Fatal("third session from one IP allowed")
+	}
+	if !h.allowNewSession("198.51.100.1") {
+		t.Error("session from another IP refused")
+	}
+
+	// Replacing a session (SSE reconnect) does not count twice.
+	h.replaceClient(first, newClient(h, "S-1", "192.0.2.1", "en", TransportWS))
+	if n := h.sessionsByIP["192.0.2.1"]; n != 2 {
+		t.Errorf("sessions after replace = %d, want 2", n)
+	}
+
+	h.mu.Lock()
+	h.removeClientLocked(h.clientsBySID["S-2"])
+	h.mu.Unlock()
+	if !h.allowNewSession("192.0.2.1") {
+		t.Error("session refused after one disconnected")
+	}
+}
+
+func TestWatchedRoomsCap(t *testing.T) {
+	h := newTestHub(t)
+	h.cfg.MaxWatchRoomsPerMsg = 4
+	h.cfg.MaxWatchedRoomsPerSID = 3
+	c := newClient(h, "S-1", "192.0.2.1", "en", TransportWS)
+
+	rids := make([]string, 5)
+	for i := range rids {
+		rid, err := generateRoomID(h.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rids[i] = rid
+	}
+	watch := func(rids ...string) []string {
+		payload, _ := json.Marshal(map[string][]string{"rids": rids})
+		h.handleWatchRooms(c, SignalingMessage{V: 1, Type: "watch_rooms", Payload: payload})
+		return drainErrors(t, c)
+	}
+
+	if codes := watch(rids...); len(codes) != 1 || codes[0] != "BAD_REQUEST" || c.watchCount != 0 {
+		t.Fatalf("too many rooms in one message: errors %v, watching %d", codes, c.watchCount)
+	}
+	if codes := watch(rids[0], rids[1], "not-a-room-id"); len(codes) != 0 || c.watchCount != 2 {
+		t.Fatalf("two rooms: errors %v, watching %d", codes, c.watchCount)
+	}
+	// Rooms already watched do not count again.
+	if codes := watch(rids[0], rids[1], rids[2]); len(codes) != 0 || c.watchCount != 3 {
+		t.Fatalf("one more room: errors %v, watching %d", codes, c.watchCount)
+	}
+	if codes := watch(rids[3], rids[4]); len(codes) != 1 || codes[0] != "BAD_REQUEST" || c.watchCount != 3 {
+		t.Fatalf("over the session cap: errors %v, watching %d", codes, c.watchCount)
+	}
+	if h.watchers[rids[3]][c] {
+		t.Error("room over the cap is watched")
+	}
+
+	h.disconnectClient(c)
+	if c.watchCount != 0 || len(h.watchers) != 0 {
+		t.Errorf("after disconnect: watching %d rooms, %d watched rooms left", c.watchCount, len(h.watchers))
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Encrypted call snapshots live in a snapshotBackend as an <id>.bin
+// ciphertext and an <id>.json SnapshotMeta. The store keeps an index of them
+// in memory, rebuilt from the backend on startup, and deletes a snapshot when
+// it expires, when every notified recipient has fetched it, or when it is
+// evicted to stay within quota.
+
+const (
+	snapshotJanitorInterval = time.Minute
+	snapshotMaxBytes        = 300 * 1024
+	snapshotBackendTimeout  = 10 * time.Second
+)
+
+var (
+	errSnapshotNotFound = errors.New("snapshot not found")
+	// errSnapshotGone is returned for snapshots that existed but have
+	// expired, been fetched by everyone or been evicted.
+	errSnapshotGone = errors.New("snapshot gone")
+)
+
+// snapshotBackend stores opaque objects by key. Get and Delete return
+// errSnapshotNotFound for missing keys.
+type snapshotBackend interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context) ([]string, error)
+	// Check reports whether the backend is writable (readiness probe).
+	Check(ctx context.Context) error
+}
+
+type snapshotEntry struct {
+	meta *SnapshotMeta
+	size int64
+	// pending holds the recipients that have not fetched the snapshot yet.
+	pending map[string]bool
+	// downloads counts the fetches of each recipient.
+	downloads map[string]int
+}
+
+type SnapshotStore struct {
+	backend     snapshotBackend
+	ttl         time.Duration
+	roomQuota   int
+	globalQuota int64
+
+	mu      sync.Mutex
+	entries map[string]*snapshotEntry
+	bytes   int64
+}
+
+func newSnapshotStore(cfg *Config) (*SnapshotStore, error) {
+	var backend snapshotBackend
+	switch cfg.SnapshotBackend {
+	case "s3":
+		backend = newS3Backend(cfg)
+	default:
+		fs, err := newFSBackend(filepath.Join(cfg.DataDir, "snapshots"))
+		if err != nil {
+			return nil, err
+		}
+		backend = fs
+	}
+	s := &SnapshotStore{
+		backend:     backend,
+		ttl:         time.Duration(cfg.SnapshotTTLMinutes) * time.Minute,
+		roomQuota:   cfg.SnapshotRoomQuota,
+		globalQuota: int64(cfg.SnapshotQuotaMB) * 1024 * 1024,
+		entries:     make(map[string]*snapshotEntry),
+	}
+	if err := s.loadIndex(); err != nil {
+		return nil, fmt.Errorf("failed to load snapshot index: %v", err)
+	}
+	return s, nil
+}
+
+func snapshotDataKey(id string) string { return id + ".bin" }
+func snapshotMetaKey(id string) string { return id + ".json" }
+
+// loadIndex rebuilds the index from the backend, dropping expired snapshots
+// and halves of interrupted writes. Fetch progress is not persisted, so
+// every recipient counts as pending again after a restart.
+func (s *SnapshotStore) loadIndex() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	keys, err := s.backend.List(ctx)
+	if err != nil {
+		return err
+	}
+	data := make(map[string]bool)
+	var metas []string
+	for _, key := range keys {
+		switch {
+		case strings.HasSuffix(key, ".bin"):
+			data[strings.TrimSuffix(key, ".bin")] = true
+		case strings.HasSuffix(key, ".json"):
+			metas = append(metas, strings.TrimSuffix(key, ".json"))
+		}
+	}
+
+	cutoff := time.Now().Add(-s.ttl).UnixMilli()
+	for _, id := range metas {
+		raw, err := s.backend.Get(ctx, snapshotMetaKey(id))
+		var meta SnapshotMeta
+		if err == nil {
+			err = json.Unmarshal(raw, &meta)
+		}
+		if err != nil || !data[id] || meta.CreatedAt < cutoff || !isSafeSnapshotID(id) {
+			s.deleteObjects(ctx, id)
+			delete(data, id)
+			continue
+		}
+		delete(data, id)
+		s.entries[id] = newSnapshotEntry(&meta)
+		s.bytes += meta.Size
+	}
+	// Ciphertexts whose metadata was never written.
+	for id := range data {
+		_ = s.backend.Delete(ctx, snapshotDataKey(id))
+	}
+	slog.Info("snapshot store loaded", "snapshots", len(s.entries), "bytes", s.bytes)
+	return nil
+}
+
+func newSnapshotEntry(meta *SnapshotMeta) *snapshotEntry {
+	pending := make(map[string]bool, len(meta.Recipients))
+	for id := range meta.Recipients {
+		pending[id] = true
+	}
+	return &snapshotEntry{meta: meta, size: meta.Size, pending: pending, downloads: make(map[string]int)}
+}
+
+// Save stores a snapshot, evicting the oldest snapshots of the room and then
+// of the whole store to stay within quota.
+func (s *SnapshotStore) Save(meta *SnapshotMeta, ciphertext []byte) (string, error) {
+	id := generateID("SNAP-")
+	meta.Size = int64(len(ciphertext))
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotBackendTimeout)
+	defer cancel()
+	// The metadata is written last; loadIndex discards ciphertexts without it.
+	if err := s.backend.Put(ctx, snapshotDataKey(id), ciphertext); err != nil {
+		return "", err
+	}
+	if err := s.backend.Put(ctx, snapshotMetaKey(id), metaBytes); err != nil {
+		_ = s.backend.Delete(ctx, snapshotDataKey(id))
+		return "", err
+	}
+
+	s.mu.Lock()
+	s.entries[id] = newSnapshotEntry(meta)
+	s.bytes += meta.Size
+	evicted := s.evictLocked(meta.RoomID, id)
+	s.mu.Unlock()
+
+	for _, old := range evicted {
+		s.deleteObjects(ctx, old)
+	}
+	if len(evicted) > 0 {
+		slog.Info("snapshots evicted for quota", "rid", redactRoomID(meta.RoomID), "evicted", len(evicted))
+	}
+	return id, nil
+}
+
+// evictLocked removes the oldest snapshots, never keep, from the index until
+// the room and global quotas are met and returns their IDs. Caller must hold
+// s.mu.
+func (s *SnapshotStore) evictLocked(roomID, keep string) []string {
+	ids := make([]string, 0, len(s.entries))
+	for id := range s.entries {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return s.entries[ids[i]].meta.CreatedAt < s.entries[ids[j]].meta.CreatedAt
+	})
+
+	var evicted []string
+	inRoom := 0
+	for _, id := range ids {
+		if s.entries[id].meta.RoomID == roomID {
+			inRoom++
+		}
+	}
+	for _, id := range ids {
+		if id == keep {
+			continue
+		}
+		entry := s.entries[id]
+		overRoom := s.roomQuota > 0 && entry.meta.RoomID == roomID && inRoom > s.roomQuota
+		overGlobal := s.globalQuota > 0 && s.bytes > s.globalQuota
+		if !overRoom && !overGlobal {
+			continue
+		}
+		if entry.meta.RoomID == roomID {
+			inRoom--
+		}
+		s.removeLocked(id)
+		evicted = append(evicted, id)
+	}
+	return evicted
+}
+
+func (s *SnapshotStore) removeLocked(id string) {
+	if entry, ok := s.entries[id]; ok {
+		s.bytes -= entry.size
+		delete(s.entries, id)
+	}
+}
+
+func (s *SnapshotStore) deleteObjects(ctx context.Context, id string) {
+	for _, key := range []string{snapshotDataKey(id), snapshotMetaKey(id)} {
+		if err := s.backend.Delete(ctx, key); err != nil && !errors.Is(err, errSnapshotNotFound) {
+			slog.Warn("failed to delete snapshot", "snapshot", redactSnapshotID(id), "object", strings.TrimPrefix(key, id), "err", err)
+		}
+	}
+}
+
+// Meta returns the metadata of a live snapshot.
+func (s *SnapshotStore) Meta(id string) (*SnapshotMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[id]
+	if !ok || s.expiredLocked(entry, time.Now()) {
+		return nil, errSnapshotNotFound
+	}
+	return entry.meta, nil
+}
+
+func (s *SnapshotStore) expiredLocked(entry *snapshotEntry, now time.Time) bool {
+	return now.After(s.expiresAt(entry.meta))
+}
+
+// expiresAt is when the janitor deletes the snapshot.
+func (s *SnapshotStore) expiresAt(meta *SnapshotMeta) time.Time {
+	return time.UnixMilli(meta.CreatedAt).Add(s.ttl)
+}
+
+// Open returns the ciphertext for recipient and counts the download. It
+// returns errSnapshotGone once the snapshot is no longer available or the
+// recipient has used up its downloads.
+func (s *SnapshotStore) Open(id, recipient string) ([]byte, error) {
+	s.mu.Lock()
+	entry, ok := s.entries[id]
+	if !ok || s.expiredLocked(entry, time.Now()) {
+		s.mu.Unlock()
+		return nil, errSnapshotGone
+	}
+	if _, ok := entry.meta.Recipients[recipient]; !ok || entry.downloads[recipient] >= snapshotMaxDownloads {
+		s.mu.Unlock()
+		return nil, errSnapshotGone
+	}
+	entry.downloads[recipient]++
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotBackendTimeout)
+	defer cancel()
+	data, err := s.backend.Get(ctx, snapshotDataKey(id))
+	if errors.Is(err, errSnapshotNotFound) {
+		// Deleted while we were reading it.
+		return nil, errSnapshotGone
+	}
+	return data, err
+}
+
+// Notified narrows the pending recipients to those a notification was
+// actually queued for; the others will never fetch the snapshot.
+func (s *SnapshotStore) Notified(id string, recipients []string) {
+	s.mu.Lock()
+	entry, ok := s.entries[id]
+	if ok {
+		notified := make(map[string]bool, len(recipients))
+		for _, r := range recipients {
+			if entry.pending[r] {
+				notified[r] = true
+			}
+		}
+		entry.pending = notified
+	}
+	done := ok && len(entry.pending) == 0
+	if done {
+		s.removeLocked(id)
+	}
+	s.mu.Unlock()
+
+	if done {
+		s.deleteAsync(id, "unused")
+	}
+}
+
+// MarkFetched records that recipient downloaded the snapshot and deletes it
+// once nobody else is waiting for it.
+func (s *SnapshotStore) MarkFetched(id, recipient string) {
+	s.mu.Lock()
+	entry, ok := s.entries[id]
+	done := false
+	downloads := 0
+	if ok && entry.pending[recipient] {
+		delete(entry.pending, recipient)
+		if len(entry.pending) == 0 {
+			s.removeLocked(id)
+			done = true
+			for _, n := range entry.downloads {
+				downloads += n
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if done {
+		slog.Debug("snapshot fetched by all recipients", "snapshot", redactSnapshotID(id), "downloads", downloads)
+		s.deleteAsync(id, "fetched")
+	}
+}
+
+func (s *SnapshotStore) deleteAsync(id, reason string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), snapshotBackendTimeout)
+		defer cancel()
+		s.deleteObjects(ctx, id)
+		slog.Debug("snapshot deleted", "snapshot", redactSnapshotID(id), "reason", reason)
+	}()
+}
+
+// RunJanitor deletes expired snapshots; it blocks forever.
+func (s *SnapshotStore) RunJanitor() {
+	ticker := time.NewTicker(snapshotJanitorInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.expire(time.Now())
+	}
+}
+
+func (s *SnapshotStore) expire(now time.Time) {
+	s.mu.Lock()
+	var expired []string
+	for id, entry := range s.entries {
+		if s.expiredLocked(entry, now) {
+			s.removeLocked(id)
+			expired = append(expired, id)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(expired) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, id := range expired {
+		s.deleteObjects(ctx, id)
+	}
+	slog.Info("expired snapshots", "removed", len(expired))
+}
+
+// fsBackend stores objects as files in a directory. Writes go to a temporary
+// file that is renamed into place, so readers never see partial objects.
+type fsBackend struct {
+	dir string
+}
+
+const fsBackendTempPrefix = ".tmp-"
+
+func newFSBackend(dir string) (*fsBackend, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot dir: %v", err)
+	}
+	// Leftovers of writes interrupted by a crash.
+	if tmps, err := filepath.Glob(filepath.Join(dir, fsBackendTempPrefix+"*")); err == nil {
+		for _, tmp := range tmps {
+			_ = os.Remove(tmp)
+		}
+	}
+	return &fsBackend{dir: dir}, nil
+}
+
+func (b *fsBackend) path(key string) string {
+	return filepath.Join(b.dir, filepath.Base(key))
+}
+
+func (b *fsBackend) Put(_ context.Context, key string, data []byte) error {
+	f, err := os.CreateTemp(b.dir, fsBackendTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, b.path(key))
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+func (b *fsBackend) Get(_ context.Context, key string) ([]byte, error) {
+	data, err := os.ReadFile(b.path(key))
+	if os.IsNotExist(err) {
+		return nil, errSnapshotNotFound
+	}
+	return data, err
+}
+
+func (b *fsBackend) Delete(_ context.Context, key string) error {
+	err := os.Remove(b.path(key))
+	if os.IsNotExist(err) {
+		return errSnapshotNotFound
+	}
+	return err
+}
+
+func (b *fsBackend) Check(_ context.Context) error {
+	f, err := os.CreateTemp(b.dir, fsBackendTempPrefix+"healthcheck-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+func (b *fsBackend) List(_ context.Context) ([]string, error) {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), fsBackendTempPrefix) {
+			continue
+		}
+		keys = append(keys, entry.Name())
+	}
+	return keys, nil
+}
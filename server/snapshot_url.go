@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Snapshot download URLs are issued per recipient and embedded in the push
+// payload: /api/push/snapshot/{id}?r={recipient}&exp={unix}&sig={mac}. They
+// expire with the snapshot.
+
+const (
+	// Separates snapshot URL MACs from the other users of the secret.
+	snapshotURLDomain = "serenada-snapshot-url:"
+	// Downloads allowed per recipient, to survive a retried fetch.
+	snapshotMaxDownloads = 3
+)
+
+var (
+	errSnapshotURLInvalid = errors.New("invalid snapshot URL signature")
+	errSnapshotURLExpired = errors.New("snapshot URL expired")
+)
+
+func snapshotURLMAC(cfg *Config, id, recipient string, exp int64) ([]byte, error) {
+	if cfg.RoomIDSecret == "" {
+		return nil, ErrRoomIDSecretMissing
+	}
+	mac := hmac.New(sha256.New, []byte(cfg.RoomIDSecret))
+	fmt.Fprintf(mac, "%s%s\n%s\n%d", snapshotURLDomain, id, recipient, exp)
+	return mac.Sum(nil), nil
+}
+
+func signSnapshotURL(cfg *Config, id, recipient string, expiresAt time.Time) (string, error) {
+	exp := expiresAt.Unix()
+	sig, err := snapshotURLMAC(cfg, id, recipient, exp)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"r":   {recipient},
+		"exp": {strconv.FormatInt(exp, 10)},
+		"sig": {base64.RawURLEncoding.EncodeToString(sig)},
+	}
+	return "/api/push/snapshot/" + id + "?" + query.Encode(), nil
+}
+
+// verifySnapshotURL checks the signature of a download request and returns
+// the recipient it was issued to.
+func verifySnapshotURL(cfg *Config, id string, query url.Values) (string, error) {
+	recipient := query.Get("r")
+	exp, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if err != nil || recipient == "" {
+		return "", errSnapshotURLInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(query.Get("sig"))
+	if err != nil {
+		return "", errSnapshotURLInvalid
+	}
+	expected, err := snapshotURLMAC(cfg, id, recipient, exp)
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal(sig, expected) {
+		return "", errSnapshotURLInvalid
+	}
+	if time.Now().Unix() > exp {
+		return recipient, errSnapshotURLExpired
+	}
+	return recipient, nil
+}
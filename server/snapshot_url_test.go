@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// snapshotQuery splits a signed snapshot URL into its ID and query.
+func snapshotQuery(t *testing.T, signed string) (string, url.Values) {
+	t.Helper()
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimPrefix(u.Path, "/api/push/snapshot/"), u.Query()
+}
+
+func TestVerifySnapshotURL(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.RoomIDSecret = "test-room-id-secret"
+	expiresAt := time.Now().Add(time.Minute)
+	signed, err := signSnapshotURL(cfg, "SNAP-a", "1", expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, valid := snapshotQuery(t, signed)
+	if id != "SNAP-a" {
+		t.Fatalf("signed URL %q has ID %q", signed, id)
+	}
+
+	with := func(key, value string) url.Values {
+		q := url.Values{}
+		for k, v := range valid {
+			q[k] = v
+		}
+		if value == "" {
+			q.Del(key)
+		} else {
+			q.Set(key, value)
+		}
+		return q
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(valid.Get("sig"))
+	sig[0] ^= 1
+	otherSecret := newTestConfig()
+	otherSecret.RoomIDSecret = "another-secret"
+	foreign, _ := signSnapshotURL(otherSecret, "SNAP-a", "1", expiresAt)
+	_, foreignQuery := snapshotQuery(t, foreign)
+	expired, _ := signSnapshotURL(cfg, "SNAP-a", "1", time.Now().Add(-2*time.Second))
+	_, expiredQuery := snapshotQuery(t, expired)
+
+	tests := []struct {
+		name    string
+		id      string
+		query   url.Values
+		wantErr error
+	}{
+		{"valid", "SNAP-a", valid, nil},
+		{"expired", "SNAP-a", expiredQuery, errSnapshotURLExpired},
+		{"other snapshot", "SNAP-b", valid, errSnapshotURLInvalid},
+		{"other recipient", "SNAP-a", with("r", "2"), errSnapshotURLInvalid},
+		{"extended expiry", "SNAP-a", with("exp", strconv.FormatInt(expiresAt.Add(time.Hour).Unix(), 10)), errSnapshotURLInvalid},
+		{"tampered signature", "SNAP-a", with("sig", base64.RawURLEncoding.EncodeToString(sig)), errSnapshotURLInvalid},
+		{"other secret", "SNAP-a", foreignQuery, errSnapshotURLInvalid},
+		{"no signature", "SNAP-a", with("sig", ""), errSnapshotURLInvalid},
+		{"no recipient", "SNAP-a", with("r", ""), errSnapshotURLInvalid},
+		{"no expiry", "SNAP-a", with("exp", ""), errSnapshotURLInvalid},
+	}
+	for _, tt := range tests {
+		recipient, err := verifySnapshotURL(cfg, tt.id, tt.query)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if tt.wantErr == nil && recipient != "1" {
+			t.Errorf("%s: recipient = %q, want 1", tt.name, recipient)
+		}
+	}
+}
+
+func TestSnapshotDownload(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.RoomIDSecret = "test-room-id-secret"
+	s := newTestPushService(t, cfg, newAuthStore(cfg))
+	h := http.StripPrefix("/api/push/snapshot", handlePushSnapshot(cfg, s))
+	id := saveTestSnapshot(t, s.snapshots, "room", 0, 16, "1", "2")
+	other := saveTestSnapshot(t, s.snapshots, "room", 0, 16, "1")
+	meta, err := s.snapshots.Meta(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := s.snapshots.expiresAt(meta)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+	sign := func(id, recipient string, expiresAt time.Time) string {
+		signed, err := signSnapshotURL(cfg, id, recipient, expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	forRecipient1 := sign(id, "1", expiresAt)
+
+	tests := []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{"recipient swapped", strings.Replace(forRecipient1, "r=1", "r=2", 1), http.StatusForbidden},
+		{"URL of another snapshot", strings.Replace(forRecipient1, id, other, 1), http.StatusForbidden},
+		{"unsigned", "/api/push/snapshot/" + id, http.StatusForbidden},
+		{"expired URL", sign(id, "1", time.Now().Add(-2*time.Second)), http.StatusGone},
+		{"not a recipient", sign(id, "3", expiresAt), http.StatusGone},
+		{"unknown snapshot", sign("SNAP-0000000000000000", "1", expiresAt), http.StatusGone},
+		{"unsafe ID", "/api/push/snapshot/..%2Fsecret", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if rec := get(tt.target); rec.Code != tt.want {
+			t.Errorf("%s: %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+
+	// Each recipient may retry a few times, then the URL stops working.
+	for i := 0; i < snapshotMaxDownloads; i++ {
+		rec := get(forRecipient1)
+		if rec.Code != http.StatusOK || rec.Body.Len() != 16 {
+			t.Fatalf("download %d: %d, %d bytes", i+1, rec.Code, rec.Body.Len())
+		}
+		if cc := rec.Header().Get("Cache-Control"); cc != "no-store" {
+			t.Errorf("Cache-Control = %q, want no-store", cc)
+		}
+	}
+	if rec := get(forRecipient1); rec.Code != http.StatusGone {
+		t.Errorf("download over the limit: %d, want 410", rec.Code)
+	}
+	// Other recipients are unaffected.
+	if rec := get(sign(id, "2", expiresAt)); rec.Code != http.StatusOK {
+		t.Errorf("second recipient: %d, want 200", rec.Code)
+	}
+	waitForSnapshotKeys(t, s.snapshots.backend, 2)
+}
+
+func TestCallNotificationCarriesRecipientSnapshotURL(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.RoomIDSecret = "test-room-id-secret"
+	s := newTestPushService(t, cfg, newAuthStore(cfg))
+	id := saveTestSnapshot(t, s.snapshots, "room", 0, 16, "1")
+	meta, err := s.snapshots.Meta(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []roomSubscriber{
+		{ID: 1, Platform: platformWeb, Endpoint: "https://push.example/1", Locale: "en"},
+		{ID: 2, Platform: platformWeb, Endpoint: "https://push.example/2", Locale: "en"},
+	} {
+		carries := s.enqueueOne("room", notifyIncomingCall, target, id, meta, false)
+		if carries != (target.ID == 1) {
+			t.Errorf("subscriber %d: carries snapshot = %v", target.ID, carries)
+		}
+	}
+
+	rows, err := s.db.Query("SELECT endpoint, payload FROM push_queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	payloads := make(map[string]map[string]string)
+	for rows.Next() {
+		var endpoint, payload string
+		if err := rows.Scan(&endpoint, &payload); err != nil {
+			t.Fatal(err)
+		}
+		data := make(map[string]string)
+		json.Unmarshal([]byte(payload), &data)
+		payloads[endpoint] = data
+	}
+
+	if url := payloads["https://push.example/2"]["snapshotUrl"]; url != "" {
+		t.Errorf("subscriber without a key got snapshot URL %q", url)
+	}
+	signed := payloads["https://push.example/1"]["snapshotUrl"]
+	gotID, query := snapshotQuery(t, signed)
+	if gotID != id {
+		t.Fatalf("snapshot URL %q is for %q, want %q", signed, gotID, id)
+	}
+	if recipient, err := verifySnapshotURL(cfg, id, query); err != nil || recipient != "1" {
+		t.Errorf("verifySnapshotURL = %q, %v, want recipient 1", recipient, err)
+	}
+	if exp := query.Get("exp"); exp != strconv.FormatInt(s.snapshots.expiresAt(meta).Unix(), 10) {
+		t.Errorf("URL expires at %s, want the snapshot's expiry", exp)
+	}
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"bytes"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 	"sync/atomic"
@@ -20,8 +20,18 @@ const (
 func (h *Hub) run() {
 	ticker := time.NewTicker(sseReaperInterval)
 	defer ticker.Stop()
-	for range ticker.C {
-		h.evictStaleSSE()
+	h.markAlive()
+	for {
+		select {
+		case <-ticker.C:
+			h.evictStaleSSE()
+			h.markAlive()
+		case reply := <-h.probes:
+			// Taking the lock shows message handling is not wedged.
+			h.mu.Lock()
+			h.mu.Unlock()
+			close(reply)
+		}
 	}
 }
 
@@ -55,16 +65,22 @@ func serveSSE(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		sid = generateID("S-")
 	}
 
-	ip := getClientIP(r)
-	client := &Client{hub: hub, send: make(chan []byte, 256), sid: sid, ip: ip, transport: TransportSSE}
-	if existing := hub.getClientBySID(sid); existing != nil {
+	ip := getClientIP(hub.cfg, r)
+	existing := hub.getClientBySID(sid)
+	if existing == nil && !hub.allowNewSession(ip) {
+		slog.Warn("too many sessions from ip", "ip", redactIP(ip), "transport", string(TransportSSE))
+		http.Error(w, "Too many sessions", http.StatusTooManyRequests)
+		return
+	}
+	client := newClient(hub, sid, ip, requestLocale(r), TransportSSE)
+	if existing != nil {
 		hub.replaceClient(existing, client)
 	} else {
 		hub.registerClient(client)
 	}
 	hub.markSSESeen(client)
 
-	log.Printf("[SSE] Client %s connected", client.sid)
+	client.logger().Info("client connected", "ip", redactIP(ip))
 
 	if _, err := w.Write([]byte(": ready\n\n")); err != nil {
 		hub.handleDisconnectSSE(client)
@@ -117,6 +133,8 @@ func (c *Client) writeSSE(w http.ResponseWriter, flusher http.Flusher, done <-ch
 		select {
 		case <-done:
 			return
+		case <-c.closed:
+			return
 		case msg, ok := <-c.send:
 			if !ok {
 				return
@@ -160,7 +178,7 @@ func (h *Hub) markSSESeen(c *Client) {
 func (h *Hub) handleDisconnectSSE(c *Client) {
 	if c.replaced {
 		h.mu.Lock()
-		delete(h.clients, c)
+		h.removeClientLocked(c)
 		h.mu.Unlock()
 		return
 	}
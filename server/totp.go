@@ -0,0 +1,438 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TOTP per RFC 6238: HMAC-SHA1, 6 digits, 30 second steps, which is what
+// common authenticator apps expect.
+const (
+	totpIssuer                = "Serenada"
+	totpDigits                = 6
+	totpPeriod                = 30
+	totpSkewSteps             = 1
+	totpSecretBytes           = 20
+	recoveryCodeNum           = 10
+	loginChallengeTTL         = 5 * time.Minute
+	loginChallengeMaxAttempts = 5
+)
+
+var (
+	errInvalidTOTPCode    = newLocalizedError("error.totp_invalid_code")
+	errTOTPNotEnrolled    = newLocalizedError("error.totp_not_enabled")
+	errTOTPAlreadyEnabled = newLocalizedError("error.totp_already_enabled")
+	errInvalidChallenge   = newLocalizedError("error.totp_invalid_challenge")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type loginChallenge struct {
+	userID    string
+	expiresAt time.Time
+	attempts  int
+}
+
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+func totpURI(secret, username string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", totpIssuer)
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(totpIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0F
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7FFFFFFF
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// matchTOTP returns the time step the code matches, allowing one step of
+// clock skew either way, and only steps after lastStep so codes cannot be
+// replayed.
+func matchTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkewSteps; step <= current+totpSkewSteps; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// generateRecoveryCodes returns the codes to show the user once, and their
+// hashes to store. Codes carry 100 bits of entropy, so a fast hash suffices.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeNum)
+	hashes := make([]string, recoveryCodeNum)
+	for i := range codes {
+		raw := make([]byte, 13)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		encoded := strings.ToLower(totpEncoding.EncodeToString(raw))[:20]
+		codes[i] = encoded[:10] + "-" + encoded[10:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// beginTOTPEnrollment stores a pending secret that becomes active once the
+// user proves they can generate codes from it.
+func (s *AuthStore) beginTOTPEnrollment(user *User) (string, error) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user.TOTPSecret != "" {
+		return "", errTOTPAlreadyEnabled
+	}
+	user.pendingTOTPSecret = secret
+	return secret, nil
+}
+
+func (s *AuthStore) confirmTOTPEnrollment(user *User, code string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user.TOTPSecret != "" {
+		return nil, errTOTPAlreadyEnabled
+	}
+	if user.pendingTOTPSecret == "" {
+		return nil, errTOTPNotEnrolled
+	}
+	step, ok := matchTOTP(user.pendingTOTPSecret, code, 0, time.Now())
+	if !ok {
+		return nil, errInvalidTOTPCode
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	user.TOTPSecret = user.pendingTOTPSecret
+	user.pendingTOTPSecret = ""
+	user.totpLastStep = step
+	user.RecoveryCodeHashes = hashes
+	return codes, nil
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused
+// recovery code, which is consumed.
+func (s *AuthStore) verifySecondFactor(user *User, code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user.TOTPSecret == "" {
+		return errTOTPNotEnrolled
+	}
+	if step, ok := matchTOTP(user.TOTPSecret, code, user.totpLastStep, time.Now()); ok {
+		user.totpLastStep = step
+		return nil
+	}
+
+	hash := hashRecoveryCode(code)
+	for i, stored := range user.RecoveryCodeHashes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			user.RecoveryCodeHashes = append(user.RecoveryCodeHashes[:i:i], user.RecoveryCodeHashes[i+1:]...)
+			return nil
+		}
+	}
+	return errInvalidTOTPCode
+}
+
+func (s *AuthStore) disableTOTP(user *User) {
+	s.mu.Lock()
+	user.TOTPSecret = ""
+	user.pendingTOTPSecret = ""
+	user.totpLastStep = 0
+	user.RecoveryCodeHashes = nil
+	s.mu.Unlock()
+}
+
+func (s *AuthStore) hasTOTP(user *User) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return user.TOTPSecret != ""
+}
+
+// createLoginChallenge issues the short-lived token that stands in for the
+// password between the two login steps.
+func (s *AuthStore) createLoginChallenge(userID string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+	now := time.Now()
+
+	s.mu.Lock()
+	for key, challenge := range s.challenges {
+		if now.After(challenge.expiresAt) {
+			delete(s.challenges, key)
+		}
+	}
+	s.challenges[token] = &loginChallenge{userID: userID, expiresAt: now.Add(loginChallengeTTL)}
+	s.mu.Unlock()
+	return token, nil
+}
+
+// redeemLoginChallenge counts an attempt against the challenge and returns
+// its user. The challenge is dropped once expired or out of attempts.
+func (s *AuthStore) redeemLoginChallenge(token string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	challenge, ok := s.challenges[token]
+	if !ok {
+		return nil, errInvalidChallenge
+	}
+	challenge.attempts++
+	if time.Now().After(challenge.expiresAt) || challenge.attempts > loginChallengeMaxAttempts {
+		delete(s.challenges, token)
+		return nil, errInvalidChallenge
+	}
+	user, ok := s.usersByID[challenge.userID]
+	if !ok {
+		delete(s.challenges, token)
+		return nil, errInvalidChallenge
+	}
+	return user, nil
+}
+
+func (s *AuthStore) deleteLoginChallenge(token string) {
+	s.mu.Lock()
+	delete(s.challenges, token)
+	s.mu.Unlock()
+}
+
+func writeJSONMessage(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+// handleTOTPSetup starts enrollment and returns the secret and otpauth URI
+// for the authenticator app.
+func handleTOTPSetup(authStore *AuthStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, err := authStore.getUserByToken(extractToken(r))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		secret, err := authStore.beginTOTPEnrollment(user)
+		if errors.Is(err, errTOTPAlreadyEnabled) {
+			writeJSONMessage(w, http.StatusConflict, localizeError(requestLocale(r), err))
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"secret":     secret,
+			"otpauthUri": totpURI(secret, user.Username),
+		})
+	}
+}
+
+// handleTOTPConfirm activates 2FA and returns the recovery codes, which are
+// shown only this once.
+func handleTOTPConfirm(cfg *Config, authStore *AuthStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, err := authStore.getUserByToken(extractToken(r))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		codes, err := authStore.confirmTOTPEnrollment(user, req.Code)
+		switch {
+		case errors.Is(err, errInvalidTOTPCode), errors.Is(err, errTOTPNotEnrolled):
+			writeJSONMessage(w, http.StatusBadRequest, localizeError(requestLocale(r), err))
+			return
+		case errors.Is(err, errTOTPAlreadyEnabled):
+			writeJSONMessage(w, http.StatusConflict, localizeError(requestLocale(r), err))
+			return
+		case err != nil:
+			http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+
+		audit("totp_enabled", "user_id", user.UserID, "ip", redactIP(getClientIP(cfg, r)))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"recoveryCodes": codes})
+	}
+}
+
+// handleTOTPDisable turns 2FA off. It requires the password and a second
+// factor, so a stolen session token alone cannot remove it.
+func handleTOTPDisable(cfg *Config, authStore *AuthStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, err := authStore.getUserByToken(extractToken(r))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			Password string `json:"password"`
+			Code     string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		ip := getClientIP(cfg, r)
+		if wait := authStore.guard.check(user.Username, ip); wait > 0 {
+			writeTooManyAttempts(w, r, wait)
+			return
+		}
+
+		authStore.mu.RLock()
+		hash := user.PasswordHash
+		authStore.mu.RUnlock()
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) != nil {
+			authStore.guard.recordFailure(user.Username, ip)
+			writeJSONMessage(w, http.StatusForbidden, localizeError(requestLocale(r), errWrongPassword))
+			return
+		}
+		if err := authStore.verifySecondFactor(user, req.Code); err != nil {
+			if errors.Is(err, errInvalidTOTPCode) {
+				authStore.guard.recordFailure(user.Username, ip)
+				writeJSONMessage(w, http.StatusForbidden, localizeError(requestLocale(r), err))
+				return
+			}
+			writeJSONMessage(w, http.StatusBadRequest, localizeError(requestLocale(r), err))
+			return
+		}
+
+		authStore.disableTOTP(user)
+		audit("totp_disabled", "user_id", user.UserID, "ip", redactIP(ip))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleLoginTOTP completes a login that returned a challenge.
+func handleLoginTOTP(cfg *Config, authStore *AuthStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Challenge string `json:"challenge"`
+			Code      string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		user, err := authStore.redeemLoginChallenge(req.Challenge)
+		if err != nil {
+			writeJSONMessage(w, http.StatusUnauthorized, localizeError(requestLocale(r), err))
+			return
+		}
+
+		ip := getClientIP(cfg, r)
+		if wait := authStore.guard.check(user.Username, ip); wait > 0 {
+			writeTooManyAttempts(w, r, wait)
+			return
+		}
+
+		if err := authStore.verifySecondFactor(user, req.Code); err != nil {
+			accountLocked, _ := authStore.guard.recordFailure(user.Username, ip)
+			if accountLocked {
+				audit("login_account_locked", "username", user.Username, "ip", redactIP(ip), "duration", loginLockoutDuration)
+			}
+			writeJSONMessage(w, http.StatusUnauthorized, localizeError(requestLocale(r), err))
+			return
+		}
+		authStore.deleteLoginChallenge(req.Challenge)
+		authStore.guard.recordSuccess(user.Username)
+
+		writeLoginSession(w, authStore, user)
+	}
+}
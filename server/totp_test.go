@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 seed of RFC 6238 Appendix B.
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// Appendix B lists 8-digit codes; 6-digit codes are their last 6 digits.
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		got, err := totpCode(rfc6238Secret, tt.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tt.code[len(tt.code)-totpDigits:]; got != want {
+			t.Errorf("T=%d: code %s, want %s", tt.unix, got, want)
+		}
+	}
+}
+
+func TestMatchTOTPSkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpPeriod
+	for offset := int64(-2); offset <= 2; offset++ {
+		code, _ := totpCode(rfc6238Secret, current+offset)
+		step, ok := matchTOTP(rfc6238Secret, code, 0, now)
+		want := offset >= -totpSkewSteps && offset <= totpSkewSteps
+		if ok != want {
+			t.Errorf("offset %d: matched = %v, want %v", offset, ok, want)
+		}
+		if ok && step != current+offset {
+			t.Errorf("offset %d: step %d, want %d", offset, step, current+offset)
+		}
+	}
+
+	code, _ := totpCode(rfc6238Secret, current)
+	if _, ok := matchTOTP(rfc6238Secret, " "+code+" ", 0, now); !ok {
+		t.Error("code with surrounding spaces rejected")
+	}
+	if _, ok := matchTOTP(rfc6238Secret, code[:totpDigits-1], 0, now); ok {
+		t.Error("truncated code accepted")
+	}
+}
+
+func TestMatchTOTPReplay(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpPeriod
+	code, _ := totpCode(rfc6238Secret, current)
+	if _, ok := matchTOTP(rfc6238Secret, code, current, now); ok {
+		t.Error("code of the last used step accepted again")
+	}
+	previous, _ := totpCode(rfc6238Secret, current-1)
+	if _, ok := matchTOTP(rfc6238Secret, previous, current, now); ok {
+		t.Error("code older than the last used step accepted")
+	}
+	next, _ := totpCode(rfc6238Secret, current+1)
+	if step, ok := matchTOTP(rfc6238Secret, next, current, now); !ok || step != current+1 {
+		t.Errorf("code of the next step: step %d, matched %v", step, ok)
+	}
+}
+
+func TestVerifySecondFactor(t *testing.T) {
+	cfg := newTestConfig()
+	authStore := newAuthStore(cfg)
+	user, _ := newTestUser(t, authStore, "alice", "correct horse battery")
+
+	if err := authStore.verifySecondFactor(user, "123456"); !errors.Is(err, errTOTPNotEnrolled) {
+		t.Fatalf("not enrolled: %v", err)
+	}
+	secret, err := authStore.beginTOTPEnrollment(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := time.Now().Unix() / totpPeriod
+	code, _ := totpCode(secret, step)
+	recovery, err := authStore.confirmTOTPEnrollment(user, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The enrolment code is spent.
+	if err := authStore.verifySecondFactor(user, code); !errors.Is(err, errInvalidTOTPCode) {
+		t.Fatalf("enrolment code replayed: %v", err)
+	}
+
+	next, _ := totpCode(secret, step+1)
+	if err := authStore.verifySecondFactor(user, next); err != nil {
+		t.Fatalf("next code: %v", err)
+	}
+	if err := authStore.verifySecondFactor(user, next); !errors.Is(err, errInvalidTOTPCode) {
+		t.Fatalf("replayed code: %v", err)
+	}
+
+	if err := authStore.verifySecondFactor(user, recovery[0]); err != nil {
+		t.Fatalf("recovery code: %v", err)
+	}
+	if err := authStore.verifySecondFactor(user, recovery[0]); !errors.Is(err, errInvalidTOTPCode) {
+		t.Fatalf("recovery code reused: %v", err)
+	}
+	if len(user.RecoveryCodeHashes) != recoveryCodeNum-1 {
+		t.Errorf("%d recovery codes left, want %d", len(user.RecoveryCodeHashes), recoveryCodeNum-1)
+	}
+}
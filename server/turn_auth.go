@@ -6,11 +6,9 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 )
@@ -35,19 +33,8 @@ type turnTokenClaims struct {
 	Exp  int64  `json:"exp"`
 }
 
-func getTurnTokenSecret() (string, error) {
-	secret := os.Getenv("TURN_TOKEN_SECRET")
-	if secret == "" {
-		secret = os.Getenv("TURN_SECRET")
-	}
-	if secret == "" {
-		return "", errors.New("TURN token secret not configured")
-	}
-	return secret, nil
-}
-
-func issueTurnToken(ttl time.Duration, kind string) (string, time.Time, error) {
-	secret, err := getTurnTokenSecret()
+func issueTurnToken(cfg *Config, ttl time.Duration, kind string) (string, time.Time, error) {
+	secret, err := cfg.turnTokenSecret()
 	if err != nil {
 		return "", time.Time{}, err
 	}
@@ -72,7 +59,7 @@ func issueTurnToken(ttl time.Duration, kind string) (string, time.Time, error) {
 	return payload + "." + sig, expiresAt, nil
 }
 
-func parseTurnToken(token string) (turnTokenClaims, bool) {
+func parseTurnToken(cfg *Config, token string) (turnTokenClaims, bool) {
 	parts := strings.Split(token, ".")
 	if len(parts) != 2 {
 		return turnTokenClaims{}, false
@@ -88,7 +75,7 @@ func parseTurnToken(token string) (turnTokenClaims, bool) {
 		return turnTokenClaims{}, false
 	}
 
-	secret, err := getTurnTokenSecret()
+	secret, err := cfg.turnTokenSecret()
 	if err != nil {
 		return turnTokenClaims{}, false
 	}
@@ -108,8 +95,8 @@ func parseTurnToken(token string) (turnTokenClaims, bool) {
 	return claims, true
 }
 
-func validateTurnToken(token, kind string) bool {
-	claims, ok := parseTurnToken(token)
+func validateTurnToken(cfg *Config, token, kind string) bool {
+	claims, ok := parseTurnToken(cfg, token)
 	if !ok {
 		return false
 	}
@@ -126,7 +113,7 @@ func validateTurnToken(token, kind string) bool {
 	return true
 }
 
-func handleTurnCredentials() http.HandlerFunc {
+func handleTurnCredentials(cfg *Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
@@ -134,10 +121,10 @@ func handleTurnCredentials() http.HandlerFunc {
 		}
 
 		token := r.URL.Query().Get("token")
-		clientIP := getClientIP(r)
+		clientIP := getClientIP(cfg, r)
 
 		if token == "" {
-			log.Printf("[AUTH_FAIL] TURN Credentials requested by %s: No token provided", clientIP)
+			slog.Warn("TURN credentials denied: no token", "ip", redactIP(clientIP))
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
@@ -145,25 +132,25 @@ func handleTurnCredentials() http.HandlerFunc {
 		credentialTTL := 15 * 60 // default: 15 minutes
 		isAuthorized := false
 
-		if validateTurnToken(token, turnTokenKindCall) {
+		if validateTurnToken(cfg, token, turnTokenKindCall) {
 			isAuthorized = true
-		} else if validateTurnToken(token, turnTokenKindDiagnostic) {
+		} else if validateTurnToken(cfg, token, turnTokenKindDiagnostic) {
 			isAuthorized = true
 			credentialTTL = 5
 		}
 
 		if !isAuthorized {
-			log.Printf("[AUTH_FAIL] TURN Credentials requested by %s: Invalid token", clientIP)
+			slog.Warn("TURN credentials denied: invalid token", "ip", redactIP(clientIP))
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		log.Printf("[AUTH_OK] TURN Credentials requested by %s", clientIP)
+		slog.Info("TURN credentials issued", "ip", redactIP(clientIP))
 
-		// 1. Get Secret and Host from Env
-		secret := os.Getenv("TURN_SECRET")
-		turn_host := os.Getenv("TURN_HOST")
-		stun_host := os.Getenv("STUN_HOST")
+		// 1. Get Secret and Host from config
+		secret := cfg.TurnSecret
+		turn_host := cfg.TurnHost
+		stun_host := cfg.StunHost
 		if secret == "" || stun_host == "" {
 			http.Error(w, "STUN not configured", http.StatusServiceUnavailable)
 			return
@@ -208,14 +195,14 @@ func handleTurnCredentials() http.HandlerFunc {
 }
 
 // TODO: Remove this
-func handleDiagnosticToken() http.HandlerFunc {
+func handleDiagnosticToken(cfg *Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost && r.Method != http.MethodGet {
 			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		token, expires, err := issueTurnToken(5*time.Second, turnTokenKindDiagnostic)
+		token, expires, err := issueTurnToken(cfg, 5*time.Second, turnTokenKindDiagnostic)
 		if err != nil {
 			http.Error(w, "TURN token unavailable", http.StatusServiceUnavailable)
 			return
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
 	"time"
 
@@ -15,12 +15,14 @@ const (
 	wsGracePeriod = 6 * time.Second
 )
 
-var wsUpgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return isOriginAllowed(r)
-	},
+func newWSUpgrader(cfg *Config) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin: func(r *http.Request) bool {
+			return isOriginAllowed(cfg, r)
+		},
+	}
 }
 
 type wsClient struct {
@@ -29,17 +31,24 @@ type wsClient struct {
 }
 
 func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	ip := getClientIP(hub.cfg, r)
+	if !hub.allowNewSession(ip) {
+		slog.Warn("too many sessions from ip", "ip", redactIP(ip), "transport", string(TransportWS))
+		http.Error(w, "Too many sessions", http.StatusTooManyRequests)
+		return
+	}
+
+	conn, err := hub.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println(err)
+		slog.Warn("websocket upgrade failed", "ip", redactIP(ip), "err", err)
 		return
 	}
 
-	ip := getClientIP(r)
 	sid := generateID("S-")
-	client := &Client{hub: hub, send: make(chan []byte, 256), sid: sid, ip: ip, transport: TransportWS}
+	client := newClient(hub, sid, ip, requestLocale(r), TransportWS)
 
 	hub.registerClient(client)
+	client.logger().Info("client connected", "ip", redactIP(ip))
 
 	ws := &wsClient{client: client, conn: conn}
 	go ws.writePump()
@@ -59,7 +68,7 @@ func (c *wsClient) readPump() {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
+				c.client.logger().Warn("websocket closed unexpectedly", "err", err)
 			}
 			break
 		}
@@ -90,6 +99,10 @@ func (c *wsClient) writePump() {
 	}()
 	for {
 		select {
+		case <-c.client.closed:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "disconnected"))
+			return
 		case message, ok := <-c.client.send:
 			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
 			if !ok {